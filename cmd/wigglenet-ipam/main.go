@@ -0,0 +1,138 @@
+// wigglenet-ipam is a CNI IPAM plugin that delegates address allocation to
+// the Wigglenet daemon running on the node.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/ipam"
+	"github.com/tibordp/wigglenet/internal/util"
+)
+
+type netConf struct {
+	CNIVersion string         `json:"cniVersion"`
+	IPAM       cni.IPAMConfig `json:"ipam"`
+}
+
+// Arguments passed by the container runtime on behalf of kubelet
+type k8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+	K8S_POD_UID       types.UnmarshallableString
+}
+
+func main() {
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:   cmdAdd,
+		Del:   cmdDel,
+		Check: cmdCheck,
+	}, version.All, "CNI plugin wigglenet-ipam")
+}
+
+func loadConf(args *skel.CmdArgs) (*netConf, *ipam.Client, error) {
+	var conf netConf
+	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse network configuration: %w", err)
+	}
+	if conf.IPAM.SocketPath == "" {
+		return nil, nil, errors.New("ipam.socketPath is required")
+	}
+	return &conf, ipam.NewClient(conf.IPAM.SocketPath), nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, client, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+
+	var podArgs k8sArgs
+	if err := types.LoadArgs(args.Args, &podArgs); err != nil {
+		return err
+	}
+
+	req := ipam.AllocateRequest{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Namespace:   string(podArgs.K8S_POD_NAMESPACE),
+		Pod:         string(podArgs.K8S_POD_NAME),
+		PodUID:      string(podArgs.K8S_POD_UID),
+	}
+	for _, rangeSet := range conf.IPAM.Ranges {
+		for _, r := range rangeSet {
+			subnet := net.IPNet(r.Subnet)
+			prefix, ok := util.PrefixFromIPNet(subnet)
+			if !ok {
+				return fmt.Errorf("invalid subnet %s", subnet.String())
+			}
+			req.Ranges = append(req.Ranges, prefix)
+		}
+	}
+
+	allocation, err := client.Allocate(context.Background(), req)
+	if err != nil {
+		return err
+	}
+
+	result := &types100.Result{
+		CNIVersion: types100.ImplementedSpecVersion,
+		Routes:     conf.IPAM.Routes,
+	}
+	for _, ip := range allocation.IPs {
+		// Not util.PrefixToIPNet, which masks the address
+		addr := ip.Address.Addr()
+		result.IPs = append(result.IPs, &types100.IPConfig{
+			Address: net.IPNet{IP: addr.AsSlice(), Mask: net.CIDRMask(ip.Address.Bits(), addr.BitLen())},
+			Gateway: ip.Gateway.AsSlice(),
+		})
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	_, client, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+
+	err = client.Release(context.Background(), args.ContainerID, args.IfName)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		// The daemon is not running, e.g. while the node is being torn down.
+		// DEL must succeed so that the pod can go away, and the daemon frees
+		// the leaked addresses once it is back.
+		fmt.Fprintf(os.Stderr, "wigglenet-ipam: daemon not reachable, not releasing the addresses of container %s interface %s: %v\n", args.ContainerID, args.IfName, err)
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	_, client, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := client.Allocations(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, allocation := range allocations {
+		if allocation.ContainerID == args.ContainerID && allocation.IfName == args.IfName {
+			return nil
+		}
+	}
+	return fmt.Errorf("no addresses allocated for container %s interface %s", args.ContainerID, args.IfName)
+}
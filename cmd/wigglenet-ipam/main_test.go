@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/ipam"
+)
+
+// fakeManager stands in for the daemon behind the socket. It hands out the
+// second address after the gateway of each range.
+type fakeManager struct {
+	mu          sync.Mutex
+	err         error
+	allocations []ipam.Allocation
+	requests    []ipam.AllocateRequest
+	released    []ipam.ReleaseRequest
+}
+
+func (m *fakeManager) Allocate(_ context.Context, req ipam.AllocateRequest) (ipam.Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = append(m.requests, req)
+	if m.err != nil {
+		return ipam.Allocation{}, m.err
+	}
+	allocation := ipam.Allocation{ContainerID: req.ContainerID, IfName: req.IfName}
+	for _, r := range req.Ranges {
+		gateway := r.Addr().Next()
+		allocation.IPs = append(allocation.IPs, ipam.IPConfig{
+			Address: netip.PrefixFrom(gateway.Next(), r.Bits()),
+			Gateway: gateway,
+		})
+	}
+	m.allocations = append(m.allocations, allocation)
+	return allocation, nil
+}
+
+func (m *fakeManager) Release(_ context.Context, containerID, ifName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.released = append(m.released, ipam.ReleaseRequest{ContainerID: containerID, IfName: ifName})
+	return m.err
+}
+
+func (m *fakeManager) Allocations() []ipam.Allocation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.allocations
+}
+
+func (m *fakeManager) Run(context.Context) {}
+
+// startServer serves the IPAM API of the manager on a socket in a temporary
+// directory and returns the path of the socket.
+func startServer(t *testing.T, m ipam.Manager) string {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "ipam.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(ipam.NewHandler(m))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return socketPath
+}
+
+func cmdArgs(socketPath string) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: "container",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod;K8S_POD_UID=uid;K8S_POD_INFRA_CONTAINER_ID=container",
+		StdinData: []byte(`{
+			"cniVersion": "1.0.0",
+			"name": "wigglenet",
+			"type": "ptp",
+			"ipam": {
+				"type": "wigglenet-ipam",
+				"socketPath": "` + socketPath + `",
+				"routes": [{"dst": "0.0.0.0/0"}, {"dst": "::/0"}],
+				"ranges": [[{"subnet": "10.1.0.0/24"}], [{"subnet": "2001:db8:1::/64"}]]
+			}
+		}`),
+	}
+}
+
+// captureStdout returns what f prints to the standard output, which is where
+// the CNI result goes.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+
+	err = f()
+	w.Close()
+	return string(<-output), err
+}
+
+func TestCmdAdd(t *testing.T) {
+	m := &fakeManager{}
+	args := cmdArgs(startServer(t, m))
+
+	output, err := captureStdout(t, func() error { return cmdAdd(args) })
+	require.NoError(t, err)
+
+	require.Len(t, m.requests, 1)
+	assert.Equal(t, ipam.AllocateRequest{
+		ContainerID: "container",
+		IfName:      "eth0",
+		Namespace:   "default",
+		Pod:         "pod",
+		PodUID:      "uid",
+		Ranges:      []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("2001:db8:1::/64")},
+	}, m.requests[0])
+
+	var result types100.Result
+	require.NoError(t, json.Unmarshal([]byte(output), &result))
+	assert.Equal(t, "1.0.0", result.CNIVersion)
+	require.Len(t, result.IPs, 2)
+	assert.Equal(t, "10.1.0.2/24", result.IPs[0].Address.String())
+	assert.Equal(t, "10.1.0.1", result.IPs[0].Gateway.String())
+	assert.Equal(t, "2001:db8:1::2/64", result.IPs[1].Address.String())
+	assert.Equal(t, "2001:db8:1::1", result.IPs[1].Gateway.String())
+	require.Len(t, result.Routes, 2)
+	assert.Equal(t, "0.0.0.0/0", result.Routes[0].Dst.String())
+}
+
+func TestCmdAddError(t *testing.T) {
+	m := &fakeManager{err: errors.New("no free addresses in 10.1.0.0/24")}
+	args := cmdArgs(startServer(t, m))
+
+	output, err := captureStdout(t, func() error { return cmdAdd(args) })
+	assert.ErrorContains(t, err, "no free addresses in 10.1.0.0/24")
+	assert.Empty(t, output)
+
+	// The daemon is not running
+	args = cmdArgs(filepath.Join(t.TempDir(), "ipam.sock"))
+	_, err = captureStdout(t, func() error { return cmdAdd(args) })
+	assert.Error(t, err)
+
+	args.StdinData = []byte(`{"cniVersion": "1.0.0", "ipam": {"type": "wigglenet-ipam"}}`)
+	_, err = captureStdout(t, func() error { return cmdAdd(args) })
+	assert.ErrorContains(t, err, "ipam.socketPath is required")
+}
+
+func TestCmdDel(t *testing.T) {
+	m := &fakeManager{}
+	args := cmdArgs(startServer(t, m))
+
+	require.NoError(t, cmdDel(args))
+	assert.Equal(t, []ipam.ReleaseRequest{{ContainerID: "container", IfName: "eth0"}}, m.released)
+
+	m.err = errors.New("failed to persist the IPAM state")
+	assert.ErrorContains(t, cmdDel(args), "failed to persist the IPAM state")
+}
+
+func TestCmdDelDaemonNotRunning(t *testing.T) {
+	// No socket at all
+	socketPath := filepath.Join(t.TempDir(), "ipam.sock")
+	assert.NoError(t, cmdDel(cmdArgs(socketPath)))
+
+	// A socket left behind by a daemon that is gone
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, listener.Close())
+	assert.NoError(t, cmdDel(cmdArgs(socketPath)))
+
+	// Everything else still fails
+	args := cmdArgs(socketPath)
+	args.StdinData = []byte(`{"cniVersion": "1.0.0", "ipam": {"type": "wigglenet-ipam"}}`)
+	assert.ErrorContains(t, cmdDel(args), "ipam.socketPath is required")
+}
+
+func TestCmdCheck(t *testing.T) {
+	m := &fakeManager{}
+	args := cmdArgs(startServer(t, m))
+
+	assert.ErrorContains(t, cmdCheck(args), "no addresses allocated for container container interface eth0")
+
+	_, err := captureStdout(t, func() error { return cmdAdd(args) })
+	require.NoError(t, err)
+	assert.NoError(t, cmdCheck(args))
+
+	// Another interface of the same container
+	args.IfName = "net1"
+	assert.Error(t, cmdCheck(args))
+}
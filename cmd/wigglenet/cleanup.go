@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	wigglenet "github.com/tibordp/wigglenet/internal"
+	"github.com/tibordp/wigglenet/internal/config"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const cleanupUsage = `Usage: wigglenet cleanup [flags]
+
+Removes everything Wigglenet has set up on the node: the CNI configuration, the
+IPAM state, the firewall rules, the routes, the WireGuard interface and private
+keys, and the annotations and taint of the node. Use it when removing Wigglenet,
+as a preStop hook of the daemonset or in a job running on each node after the
+daemonset is deleted. It can be run any number of times.
+
+The configuration should be the one the daemon ran with (see -config). The node
+is updated through the Kubernetes API with the in-cluster configuration, unless
+-skip-node is set. The exit status is non-zero if anything could not be removed.
+
+Flags:
+`
+
+// cleanup implements the cleanup subcommand, it returns the exit status.
+func cleanup(ctx context.Context, args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, cleanupUsage)
+		flags.PrintDefaults()
+	}
+
+	configPath := flags.String("config", os.Getenv(config.ConfigFileEnv), "path of the configuration file, settings can be overridden with environment variables")
+	skipNode := flags.Bool("skip-node", false, "leave the node annotations and taint alone, e.g. if the Kubernetes API is not reachable")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: invalid configuration: %v\n", err)
+		return 1
+	}
+
+	defer klog.Flush()
+	ctx = klog.NewContext(ctx, klog.NewKlogr())
+
+	var clientset kubernetes.Interface
+	if !*skipNode {
+		if clientset, err = inClusterClientset(); err != nil {
+			fmt.Fprintf(stderr, "error: %v (use -skip-node outside of the cluster)\n", err)
+			return 1
+		}
+	}
+
+	if err := wigglenet.Cleanup(ctx, cfg, clientset); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// inClusterClientset returns a clientset with the in-cluster configuration, it
+// is replaced in tests.
+var inClusterClientset = func() (kubernetes.Interface, error) {
+	kubeconfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(kubeconfig)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tibordp/wigglenet/internal/celipam"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const evalCIDRUsage = `Usage: wigglenet eval-cidr [flags] [fixture...]
+
+Evaluates a pod CIDR expression and prints the resulting prefixes, one per line.
+
+Without fixtures, the expression is evaluated against the interfaces and routes
+of the local host and the node, which is read through the Kubernetes API with
+the in-cluster configuration unless -skip-node is set. Otherwise it is evaluated against each of the YAML or JSON
+fixtures in turn; a fixture with an "expected" list fails unless the result
+matches it. The exit status is non-zero if the expression does not compile or
+any evaluation fails.
+
+The expression defaults to podCIDR.expressionPath or podCIDR.expression of the
+configuration (see -config), which can be overridden with POD_CIDR_EXPRESSION_PATH
+or POD_CIDR_EXPRESSION.
+
+Flags:
+`
+
+// evalCIDR implements the eval-cidr subcommand, it returns the exit status.
+func evalCIDR(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("eval-cidr", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, evalCIDRUsage)
+		flags.PrintDefaults()
+	}
+
+	configPath := flags.String("config", os.Getenv(config.ConfigFileEnv), "path of the configuration file to take the defaults from")
+	expression := flags.String("expression", "", "the pod CIDR expression (default: from the configuration)")
+	expressionFile := flags.String("expression-file", "", "read the pod CIDR expression from a file (default: from the configuration)")
+	nodeName := flags.String("node-name", "", "the node name the expression sees when evaluated against the local host (default: NODE_NAME or the hostname)")
+	skipNode := flags.Bool("skip-node", false, "only pass the node name to the expression when evaluated against the local host, e.g. if the Kubernetes API is not reachable")
+	dumpFixture := flags.Bool("dump-fixture", false, "print the inputs gathered on the local host as a fixture, with the result of the expression (if any) as expected")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	fixtures := flags.Args()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: invalid configuration: %v\n", err)
+		return 1
+	}
+	if *expression == "" && *expressionFile == "" {
+		*expression, *expressionFile = cfg.PodCIDR.Expression, cfg.PodCIDR.ExpressionPath
+	}
+	if *nodeName == "" {
+		*nodeName = cfg.NodeName
+	}
+
+	source := *expression
+	if *expressionFile != "" {
+		data, err := os.ReadFile(*expressionFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: reading pod CIDR expression: %v\n", err)
+			return 1
+		}
+		source = strings.TrimSpace(string(data))
+	}
+
+	var evaluator *celipam.Evaluator
+	if source != "" {
+		var err error
+		if evaluator, err = celipam.Compile(source); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+	} else if !*dumpFixture {
+		fmt.Fprintln(stderr, "error: no pod CIDR expression, set -expression or -expression-file")
+		return 2
+	}
+
+	if len(fixtures) == 0 {
+		node, err := localNodeInfo(ctx, *nodeName, *skipNode)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		return evalCIDRLocal(ctx, evaluator, node, *dumpFixture, stdout, stderr)
+	}
+	if *dumpFixture {
+		fmt.Fprintln(stderr, "error: -dump-fixture cannot be used with fixtures")
+		return 2
+	}
+
+	status := 0
+	for _, path := range fixtures {
+		if err := evalCIDRFixture(evaluator, path, len(fixtures) > 1, stdout); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", path, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// localNodeInfo returns the metadata of the local node, only its name if
+// skipNode is set.
+func localNodeInfo(ctx context.Context, nodeName string, skipNode bool) (celipam.NodeInfo, error) {
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	if skipNode {
+		return celipam.NodeInfo{Name: nodeName}, nil
+	}
+
+	clientset, err := inClusterClientset()
+	if err != nil {
+		return celipam.NodeInfo{}, fmt.Errorf("%w (use -skip-node outside of the cluster)", err)
+	}
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return celipam.NodeInfo{}, fmt.Errorf("reading node %s: %w", nodeName, err)
+	}
+	return celipam.NewNodeInfo(ctx, node), nil
+}
+
+func evalCIDRLocal(ctx context.Context, evaluator *celipam.Evaluator, node celipam.NodeInfo, dumpFixture bool, stdout, stderr io.Writer) int {
+	interfaces, err := util.GetInterfacePrefixes(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: listing interface prefixes: %v\n", err)
+		return 1
+	}
+	routes, err := util.GetRoutePrefixes(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: listing routes: %v\n", err)
+		return 1
+	}
+
+	inputs := celipam.Inputs{
+		Interfaces: interfaces,
+		Routes:     routes,
+		Node:       node,
+	}
+	fixture := celipam.NewFixture(inputs)
+
+	if evaluator != nil {
+		fixture.Expected, err = evaluator.Evaluate(inputs)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			// Show what the expression saw
+			if data, err := fixture.Marshal(); err == nil {
+				fmt.Fprintf(stderr, "inputs:\n%s", data)
+			}
+			return 1
+		}
+	}
+
+	if dumpFixture {
+		data, err := fixture.Marshal()
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		stdout.Write(data)
+		return 0
+	}
+
+	for _, prefix := range fixture.Expected {
+		fmt.Fprintln(stdout, prefix)
+	}
+	return 0
+}
+
+// evalCIDRFixture evaluates the expression against the fixture at path and
+// prints the result, prefixed by the path if there are several fixtures.
+func evalCIDRFixture(evaluator *celipam.Evaluator, path string, prefixed bool, stdout io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fixture, err := celipam.ParseFixture(data)
+	if err != nil {
+		return err
+	}
+
+	result, err := evaluator.Evaluate(fixture.Inputs())
+	if err != nil {
+		return err
+	}
+
+	if fixture.Expected != nil && !slices.Equal(result, maskedPrefixes(fixture.Expected)) {
+		return fmt.Errorf("got %v, expected %v", result, fixture.Expected)
+	}
+
+	for _, prefix := range result {
+		if prefixed {
+			fmt.Fprintf(stdout, "%s: %s\n", path, prefix)
+		} else {
+			fmt.Fprintln(stdout, prefix)
+		}
+	}
+	return nil
+}
+
+func maskedPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	masked := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		masked = append(masked, prefix.Masked())
+	}
+	return masked
+}
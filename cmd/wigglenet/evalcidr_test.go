@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	matchingFixture = `
+node:
+  name: node-1
+  labels: {topology.kubernetes.io/zone: eu-central}
+  podCIDRs: ["10.244.3.0/24"]
+expected: ["10.244.3.0/24"]
+`
+	mismatchedFixture = `
+node:
+  name: node-2
+  podCIDRs: ["10.244.4.0/24"]
+expected: ["10.244.5.0/24"]
+`
+	unexpectedFixture = `
+node:
+  name: node-3
+  podCIDRs: ["10.244.6.0/24"]
+`
+)
+
+// unsetenv unsets the environment variable for the duration of the test, an
+// empty one would still override the configuration file.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	require.NoError(t, os.Unsetenv(key))
+}
+
+func TestEvalCIDR(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for name, data := range map[string]string{
+		"matching.yaml":   matchingFixture,
+		"mismatched.yaml": mismatchedFixture,
+		"unexpected.yaml": unexpectedFixture,
+		"invalid.yaml":    "node: {name: node-1, unknown: true}",
+		"expression.cel":  "node.podCIDRs\n",
+		"config.yaml":     "apiVersion: wigglenet.io/v1alpha1\nkind: Configuration\npodCIDR:\n  expression: node.podCIDRs\n",
+		"bad-config.yaml": "apiVersion: wigglenet.io/v1alpha1\nkind: Configuration\nunknown: true\n",
+	} {
+		require.NoError(t, os.WriteFile(name, []byte(data), 0o644))
+	}
+
+	// The settings of the environment must not leak into the defaults
+	for _, env := range []string{"WIGGLENET_CONFIG", "NODE_NAME", "POD_CIDR_EXPRESSION", "POD_CIDR_EXPRESSION_PATH"} {
+		unsetenv(t, env)
+	}
+
+	cases := []struct {
+		name   string
+		args   []string
+		status int
+		stdout string
+		stderr string
+	}{
+		{
+			name:   "fixture",
+			args:   []string{"-expression", "node.podCIDRs", "matching.yaml"},
+			stdout: "10.244.3.0/24\n",
+		},
+		{
+			name:   "fixture without expected",
+			args:   []string{"-expression", "node.podCIDRs[0].next()", "unexpected.yaml"},
+			stdout: "10.244.7.0/24\n",
+		},
+		{
+			name:   "several fixtures are prefixed",
+			args:   []string{"-expression", "node.podCIDRs", "matching.yaml", "unexpected.yaml"},
+			stdout: "matching.yaml: 10.244.3.0/24\nunexpected.yaml: 10.244.6.0/24\n",
+		},
+		{
+			name:   "expected mismatch",
+			args:   []string{"-expression", "node.podCIDRs", "mismatched.yaml"},
+			status: 1,
+			stderr: "mismatched.yaml: got [10.244.4.0/24], expected [10.244.5.0/24]",
+		},
+		{
+			name:   "expected mismatch does not stop the other fixtures",
+			args:   []string{"-expression", "node.podCIDRs", "mismatched.yaml", "matching.yaml"},
+			status: 1,
+			stdout: "matching.yaml: 10.244.3.0/24\n",
+			stderr: "mismatched.yaml: got [10.244.4.0/24], expected [10.244.5.0/24]",
+		},
+		{
+			name:   "expression file",
+			args:   []string{"-expression-file", "expression.cel", "matching.yaml"},
+			stdout: "10.244.3.0/24\n",
+		},
+		{
+			name:   "expression from the configuration",
+			args:   []string{"-config", "config.yaml", "matching.yaml"},
+			stdout: "10.244.3.0/24\n",
+		},
+		{
+			name:   "invalid fixture",
+			args:   []string{"-expression", "node.podCIDRs", "invalid.yaml"},
+			status: 1,
+			stderr: "invalid.yaml: parsing fixture",
+		},
+		{
+			name:   "missing fixture",
+			args:   []string{"-expression", "node.podCIDRs", "missing.yaml"},
+			status: 1,
+			stderr: "missing.yaml: open missing.yaml",
+		},
+		{
+			name:   "evaluation error",
+			args:   []string{"-expression", `node.labels["missing"] == "" ? node.podCIDRs : node.podCIDRs`, "matching.yaml"},
+			status: 1,
+			stderr: "matching.yaml: ",
+		},
+		{
+			name:   "compile error",
+			args:   []string{"-expression", "node.podCIDRs +", "matching.yaml"},
+			status: 1,
+			stderr: "error: ",
+		},
+		{
+			name:   "missing expression file",
+			args:   []string{"-expression-file", "missing.cel", "matching.yaml"},
+			status: 1,
+			stderr: "error: reading pod CIDR expression",
+		},
+		{
+			name:   "invalid configuration",
+			args:   []string{"-config", "bad-config.yaml", "matching.yaml"},
+			status: 1,
+			stderr: "error: invalid configuration",
+		},
+		{
+			name:   "no expression",
+			args:   []string{"matching.yaml"},
+			status: 2,
+			stderr: "error: no pod CIDR expression",
+		},
+		{
+			name:   "dump fixture with fixtures",
+			args:   []string{"-expression", "node.podCIDRs", "-dump-fixture", "matching.yaml"},
+			status: 2,
+			stderr: "error: -dump-fixture cannot be used with fixtures",
+		},
+		{
+			name:   "unknown flag",
+			args:   []string{"-unknown"},
+			status: 2,
+			stderr: "flag provided but not defined: -unknown",
+		},
+		{
+			name:   "missing flag value",
+			args:   []string{"-expression"},
+			status: 2,
+			stderr: "flag needs an argument: -expression",
+		},
+		{
+			name:   "help",
+			args:   []string{"-h"},
+			status: 2,
+			stderr: "Usage: wigglenet eval-cidr",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			status := evalCIDR(context.Background(), tc.args, &stdout, &stderr)
+
+			assert.Equal(t, tc.status, status, "stderr: %s", stderr.String())
+			assert.Equal(t, tc.stdout, stdout.String())
+			if tc.stderr != "" {
+				assert.Contains(t, stderr.String(), tc.stderr)
+			} else {
+				assert.Empty(t, stderr.String())
+			}
+		})
+	}
+}
+
+func TestEvalCIDRLocal(t *testing.T) {
+	for _, env := range []string{"WIGGLENET_CONFIG", "NODE_NAME", "POD_CIDR_EXPRESSION", "POD_CIDR_EXPRESSION_PATH"} {
+		unsetenv(t, env)
+	}
+
+	clientset := fake.NewClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"topology.kubernetes.io/zone": "eu-central"},
+		},
+		Spec: v1.NodeSpec{PodCIDRs: []string{"10.244.3.0/24"}},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: "node-1"},
+				{Type: v1.NodeInternalIP, Address: "10.0.0.5"},
+			},
+		},
+	})
+	var clientsetErr error
+	previous := inClusterClientset
+	inClusterClientset = func() (kubernetes.Interface, error) { return clientset, clientsetErr }
+	t.Cleanup(func() { inClusterClientset = previous })
+
+	// Uses the labels, the addresses and the pod CIDRs of the node
+	expression := `node.labels["topology.kubernetes.io/zone"] == "eu-central" ? [node.podCIDRs[0], cidr(string(node.addresses[0].address) + "/32")] : []`
+
+	var stdout, stderr bytes.Buffer
+	status := evalCIDR(context.Background(), []string{"-node-name", "node-1", "-expression", expression}, &stdout, &stderr)
+	assert.Equal(t, 0, status, "stderr: %s", stderr.String())
+	assert.Equal(t, "10.244.3.0/24\n10.0.0.5/32\n", stdout.String())
+
+	stdout.Reset()
+	stderr.Reset()
+	status = evalCIDR(context.Background(), []string{"-node-name", "node-1", "-expression", expression, "-dump-fixture"}, &stdout, &stderr)
+	assert.Equal(t, 0, status, "stderr: %s", stderr.String())
+	assert.Contains(t, stdout.String(), "topology.kubernetes.io/zone: eu-central")
+	assert.Contains(t, stdout.String(), "address: 10.0.0.5")
+	assert.Contains(t, stdout.String(), "- 10.0.0.5/32")
+
+	// Only the name with -skip-node, the labels are not set
+	stdout.Reset()
+	stderr.Reset()
+	status = evalCIDR(context.Background(), []string{"-node-name", "node-1", "-skip-node", "-expression", expression}, &stdout, &stderr)
+	assert.Equal(t, 1, status)
+	assert.Empty(t, stdout.String())
+
+	stdout.Reset()
+	stderr.Reset()
+	status = evalCIDR(context.Background(), []string{"-node-name", "node-2", "-expression", expression}, &stdout, &stderr)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr.String(), "error: reading node node-2")
+
+	clientsetErr = errors.New("unable to load in-cluster configuration")
+	stdout.Reset()
+	stderr.Reset()
+	status = evalCIDR(context.Background(), []string{"-node-name", "node-1", "-expression", expression}, &stdout, &stderr)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr.String(), "use -skip-node outside of the cluster")
+}
@@ -3,19 +3,34 @@ package main
 import (
 	"context"
 	"flag"
+	"os"
 	"os/signal"
 	"syscall"
 
 	wigglenet "github.com/tibordp/wigglenet/internal"
+	"github.com/tibordp/wigglenet/internal/config"
 	"k8s.io/klog/v2"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "eval-cidr" {
+		os.Exit(evalCIDR(context.Background(), os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		os.Exit(cleanup(context.Background(), os.Args[2:], os.Stderr))
+	}
+
 	klog.InitFlags(nil)
 	defer klog.Flush()
 
+	configPath := flag.String("config", os.Getenv(config.ConfigFileEnv), "path of the configuration file, settings can be overridden with environment variables")
 	flag.Parse()
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		klog.Fatalf("invalid configuration: %v", err)
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
@@ -23,7 +38,7 @@ func main() {
 	logger := klog.NewKlogr()
 	ctx = klog.NewContext(ctx, logger)
 
-	wigglenet, err := wigglenet.New(ctx)
+	wigglenet, err := wigglenet.New(ctx, *configPath, cfg)
 	if err != nil {
 		klog.Fatal(err)
 	}
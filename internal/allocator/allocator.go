@@ -0,0 +1,370 @@
+// Package allocator carves per-node pod CIDRs out of cluster-wide pools.
+//
+// There is no central allocator, each node claims its own pod CIDRs. A claim is
+// a Lease object named after the prefix, so creating it is atomic: if two nodes
+// pick the same prefix at the same time, only one of them succeeds and the
+// other moves on to the next free one. The claims are owned by the node, so
+// they are garbage collected together with it.
+package allocator
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/util"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	clientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	leaseNamePrefix = "wigglenet-pod-cidr-"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "wigglenet"
+	// The node holding the claim
+	nodeLabel = "wigglenet/node"
+	// The claimed prefix, the lease name is only derived from it
+	podCIDRAnnotation = "wigglenet/pod-cidr"
+)
+
+type Allocator interface {
+	// PodCIDRs returns the pod CIDRs of the address family claimed by the
+	// node, claiming one if the node does not have any yet.
+	PodCIDRs(ctx context.Context, node *v1.Node, ipv6 bool) ([]netip.Prefix, error)
+	// Claim claims an additional pod CIDR of the address family for the node.
+	Claim(ctx context.Context, node *v1.Node, ipv6 bool) (netip.Prefix, error)
+	// Release releases all the pod CIDRs claimed by the node.
+	Release(ctx context.Context, nodeName string) error
+}
+
+type allocator struct {
+	leases coordinationclientv1.LeaseInterface
+	nodes  clientv1.NodeInterface
+	pools  []netip.Prefix
+	// Length of the prefixes carved from the pools, per address family
+	bitsIPv4 int
+	bitsIPv6 int
+}
+
+// NewAllocator creates the allocator for the pools in podCIDR.allocatorPools,
+// the leases are created in the namespace of the Wigglenet pods.
+func NewAllocator(clientset kubernetes.Interface, cfg *config.Config) (Allocator, error) {
+	pools, err := ParsePools(cfg.PodCIDR.AllocatorPools)
+	if err != nil {
+		return nil, err
+	}
+	if len(pools) == 0 {
+		return nil, errors.New("podCIDR.allocatorPools must be set with the allocator pod CIDR source")
+	}
+
+	a := &allocator{
+		leases:   clientset.CoordinationV1().Leases(cfg.PodNamespace),
+		nodes:    clientset.CoreV1().Nodes(),
+		pools:    pools,
+		bitsIPv4: cfg.PodCIDR.AllocatorPrefixLengthIPv4,
+		bitsIPv6: cfg.PodCIDR.AllocatorPrefixLengthIPv6,
+	}
+	for _, pool := range pools {
+		if bits := a.prefixLength(pool.Addr().Is6()); bits < pool.Bits() || bits > pool.Addr().BitLen() {
+			return nil, fmt.Errorf("cannot carve /%d prefixes from pool %v", bits, pool)
+		}
+	}
+	return a, nil
+}
+
+// ParsePools parses a comma-separated list of CIDRs.
+func ParsePools(value string) ([]netip.Prefix, error) {
+	pools := make([]netip.Prefix, 0)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		pool, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod CIDR pool %q: %w", s, err)
+		}
+		pools = append(pools, pool.Masked())
+	}
+	return pools, nil
+}
+
+func (a *allocator) prefixLength(ipv6 bool) int {
+	if ipv6 {
+		return a.bitsIPv6
+	}
+	return a.bitsIPv4
+}
+
+// leaseName derives the name of the lease claiming the prefix from the hex
+// encoded address and the length, e.g. wigglenet-pod-cidr-0a600300-24 for
+// 10.96.3.0/24, as IPv6 addresses are not valid in a name in any notation.
+func leaseName(prefix netip.Prefix) string {
+	return fmt.Sprintf("%s%s-%d", leaseNamePrefix, hex.EncodeToString(prefix.Addr().AsSlice()), prefix.Bits())
+}
+
+func leasePrefix(lease *coordinationv1.Lease) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(lease.Annotations[podCIDRAnnotation])
+	return prefix, err == nil
+}
+
+// ownedBy reports whether the lease was created by this incarnation of the
+// node. Claims of a node that was deleted and registered again under the same
+// name are stale, they are garbage collected with the old node.
+func ownedBy(lease *coordinationv1.Lease, node *v1.Node) bool {
+	for _, owner := range lease.OwnerReferences {
+		if owner.Kind == "Node" && owner.UID == node.UID {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *allocator) PodCIDRs(ctx context.Context, node *v1.Node, ipv6 bool) ([]netip.Prefix, error) {
+	leases, err := a.leases.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue, nodeLabel: node.Name}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// In the order they were claimed, so that the node keeps its first pod
+	// CIDR and is expanded into the rest
+	slices.SortStableFunc(leases.Items, func(a, b coordinationv1.Lease) int {
+		return a.CreationTimestamp.Compare(b.CreationTimestamp.Time)
+	})
+
+	podCIDRs := make([]netip.Prefix, 0)
+	for _, lease := range leases.Items {
+		if prefix, ok := leasePrefix(&lease); ok && ownedBy(&lease, node) && prefix.Addr().Is6() == ipv6 {
+			podCIDRs = append(podCIDRs, prefix)
+		}
+	}
+	if len(podCIDRs) > 0 {
+		return podCIDRs, nil
+	}
+
+	prefix, err := a.Claim(ctx, node, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Prefix{prefix}, nil
+}
+
+func (a *allocator) Claim(ctx context.Context, node *v1.Node, ipv6 bool) (netip.Prefix, error) {
+	logger := klog.FromContext(ctx)
+
+	taken, err := a.taken(ctx)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	for {
+		prefix, ok := a.nextFree(taken, ipv6)
+		if !ok {
+			return netip.Prefix{}, fmt.Errorf("no free /%d left in pod CIDR pools %v", a.prefixLength(ipv6), a.pools)
+		}
+
+		_, err := a.leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: leaseName(prefix),
+				Labels: map[string]string{
+					managedByLabel: managedByValue,
+					nodeLabel:      node.Name,
+				},
+				Annotations: map[string]string{
+					podCIDRAnnotation: prefix.String(),
+				},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Node",
+					Name:       node.Name,
+					UID:        node.UID,
+				}},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity: &node.Name,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Another node was faster
+			taken = append(taken, prefix)
+			continue
+		}
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		logger.Info("claimed pod CIDR", "podCIDR", prefix, "node", node.Name)
+		return prefix, nil
+	}
+}
+
+// taken returns the prefixes that are claimed or otherwise in use by a node.
+// Claims of nodes that no longer exist are released on the way.
+func (a *allocator) taken(ctx context.Context) ([]netip.Prefix, error) {
+	logger := klog.FromContext(ctx)
+
+	// Leases first, so that the node of every lease is in the node list
+	// unless it was deleted
+	leases, err := a.leases.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := a.nodes.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	taken := make([]netip.Prefix, 0)
+	nodesByName := make(map[string]*v1.Node)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		nodesByName[node.Name] = node
+		// Pod CIDRs the node got from another source
+		taken = append(taken, util.GetPodCIDRsFromAnnotation(node)...)
+	}
+
+	for _, lease := range leases.Items {
+		prefix, ok := leasePrefix(&lease)
+		if !ok {
+			continue
+		}
+		if node, ok := nodesByName[lease.Labels[nodeLabel]]; !ok || !ownedBy(&lease, node) {
+			orphaned, err := a.orphaned(ctx, &lease)
+			if err != nil {
+				return nil, err
+			}
+			if orphaned {
+				logger.Info("releasing pod CIDR of deleted node", "podCIDR", prefix, "node", lease.Labels[nodeLabel])
+				if err := a.delete(ctx, &lease); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		taken = append(taken, prefix)
+	}
+
+	return taken, nil
+}
+
+// orphaned checks with a fresh read whether the node of the lease is gone, as
+// the node list may be older than the lease.
+func (a *allocator) orphaned(ctx context.Context, lease *coordinationv1.Lease) (bool, error) {
+	node, err := a.nodes.Get(ctx, lease.Labels[nodeLabel], metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !ownedBy(lease, node), nil
+}
+
+func (a *allocator) Release(ctx context.Context, nodeName string) error {
+	logger := klog.FromContext(ctx)
+
+	leases, err := a.leases.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue, nodeLabel: nodeName}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, lease := range leases.Items {
+		if err := a.delete(ctx, &lease); err != nil {
+			return err
+		}
+		logger.Info("released pod CIDR", "podCIDR", lease.Annotations[podCIDRAnnotation], "node", nodeName)
+	}
+	return nil
+}
+
+// delete deletes the lease, unless it was already deleted and claimed again
+// in the meantime.
+func (a *allocator) delete(ctx context.Context, lease *coordinationv1.Lease) error {
+	err := a.leases.Delete(ctx, lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID},
+	})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// nextFree returns the first prefix of the address family in the pools that
+// does not overlap with any of the taken ones.
+func (a *allocator) nextFree(taken []netip.Prefix, ipv6 bool) (netip.Prefix, bool) {
+	bits := a.prefixLength(ipv6)
+
+	for _, pool := range a.pools {
+		if pool.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		candidate := netip.PrefixFrom(pool.Addr(), bits)
+		for pool.Contains(candidate.Addr()) {
+			if !overlapsAny(taken, candidate) {
+				return candidate, true
+			}
+
+			// Skip past the largest of the taken prefixes that overlap with
+			// the candidate, if larger than the candidate itself
+			skip := candidate
+			for _, prefix := range taken {
+				if prefix.Overlaps(candidate) && prefix.Bits() < skip.Bits() {
+					skip = prefix
+				}
+			}
+
+			next, ok := after(skip.Masked(), bits)
+			if !ok {
+				break
+			}
+			candidate = next
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+func overlapsAny(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Overlaps(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// after returns the prefix of the given length right after the (masked) prefix,
+// which has to be at most as long.
+func after(prefix netip.Prefix, bits int) (netip.Prefix, bool) {
+	raw := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(raw)*8; i++ {
+		raw[i/8] |= 0x80 >> (i % 8)
+	}
+	last, _ := netip.AddrFromSlice(raw)
+
+	next := last.Next()
+	if !next.IsValid() {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(next, bits), true
+}
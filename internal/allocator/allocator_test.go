@@ -0,0 +1,193 @@
+package allocator
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/config"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func newTestNode(name string, podCIDRs ...netip.Prefix) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID("uid-" + name)}}
+	if len(podCIDRs) > 0 {
+		node.Annotations = map[string]string{annotation.PodCidrsAnnotation: annotation.MarshalPodCidrs(podCIDRs)}
+	}
+	return node
+}
+
+func newTestAllocator(t *testing.T, pools string, nodes ...*v1.Node) (*allocator, *fake.Clientset) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.PodCIDR.AllocatorPools = pools
+	cfg.PodNamespace = "kube-system"
+
+	clientset := fake.NewClientset()
+	for _, node := range nodes {
+		_, err := clientset.CoreV1().Nodes().Create(context.Background(), node, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	a, err := NewAllocator(clientset, cfg)
+	require.NoError(t, err)
+	return a.(*allocator), clientset
+}
+
+func TestParsePools(t *testing.T) {
+	pools, err := ParsePools(" 2001:db8:1::/56, 10.96.0.1/16,,")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/56"), netip.MustParsePrefix("10.96.0.0/16")}, pools)
+
+	_, err = ParsePools("2001:db8:1::/56,foo")
+	assert.Error(t, err)
+}
+
+func TestNewAllocatorInvalid(t *testing.T) {
+	cfg := config.Default()
+	cfg.PodCIDR.AllocatorPools = ""
+	_, err := NewAllocator(fake.NewClientset(), cfg)
+	assert.Error(t, err)
+
+	// Pool smaller than the prefixes carved from it
+	cfg.PodCIDR.AllocatorPools = "10.0.0.0/26"
+	_, err = NewAllocator(fake.NewClientset(), cfg)
+	assert.Error(t, err)
+}
+
+func TestPodCIDRs(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	node1 := newTestNode("node1")
+	node2 := newTestNode("node2")
+	a, _ := newTestAllocator(t, "2001:db8:1::/63,2001:db8:2::/64,10.96.0.0/23", node1, node2)
+
+	podCIDRs, err := a.PodCIDRs(ctx, node1, true)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, podCIDRs)
+
+	podCIDRs, err = a.PodCIDRs(ctx, node1, false)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.96.0.0/24")}, podCIDRs)
+
+	// Claims are kept across restarts
+	podCIDRs, err = a.PodCIDRs(ctx, node1, true)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, podCIDRs)
+
+	podCIDRs, err = a.PodCIDRs(ctx, node2, true)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1:1::/64")}, podCIDRs)
+
+	// Continues with the next pool
+	prefix, err := a.Claim(ctx, node1, true)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("2001:db8:2::/64"), prefix)
+
+	_, err = a.Claim(ctx, node1, true)
+	assert.ErrorContains(t, err, "no free /64")
+}
+
+func TestLeaseName(t *testing.T) {
+	assert.Equal(t, "wigglenet-pod-cidr-0a600300-24", leaseName(netip.MustParsePrefix("10.96.3.0/24")))
+	assert.Equal(t, "wigglenet-pod-cidr-20010db8000100000000000000000000-64", leaseName(netip.MustParsePrefix("2001:db8:1::/64")))
+
+	for _, prefix := range []string{"10.96.3.0/24", "0.0.0.0/0", "2001:db8:1::/64", "::/0", "fd00::/8", "2001:db8::ff00:42:8329/128"} {
+		name := leaseName(netip.MustParsePrefix(prefix))
+		assert.Empty(t, validation.IsDNS1123Subdomain(name), "lease name %q for %s", name, prefix)
+	}
+}
+
+func TestClaimSkipsTaken(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	// Pod CIDRs the other node got from another source
+	node := newTestNode("node1")
+	other := newTestNode("node2", netip.MustParsePrefix("10.96.0.0/23"), netip.MustParsePrefix("10.96.3.0/25"))
+	a, clientset := newTestAllocator(t, "10.96.0.0/16", node, other)
+
+	// Claimed by a node that lost the race
+	_, err := clientset.CoordinationV1().Leases("kube-system").Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: leaseName(netip.MustParsePrefix("10.96.2.0/24"))},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	prefix, err := a.Claim(ctx, node, false)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.96.4.0/24"), prefix)
+
+	lease, err := clientset.CoordinationV1().Leases("kube-system").Get(ctx, "wigglenet-pod-cidr-0a600400-24", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "node1", *lease.Spec.HolderIdentity)
+	assert.Equal(t, types.UID("uid-node1"), lease.OwnerReferences[0].UID)
+}
+
+func TestRelease(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	node1 := newTestNode("node1")
+	node2 := newTestNode("node2")
+	a, clientset := newTestAllocator(t, "10.96.0.0/16", node1, node2)
+
+	for _, node := range []*v1.Node{node1, node2, node1} {
+		_, err := a.Claim(ctx, node, false)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, a.Release(ctx, "node1"))
+	leases, err := clientset.CoordinationV1().Leases("kube-system").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, leases.Items, 1)
+	assert.Equal(t, "node2", leases.Items[0].Labels[nodeLabel])
+
+	// Claims of a deleted node are released when the next prefix is claimed
+	require.NoError(t, clientset.CoreV1().Nodes().Delete(ctx, "node2", metav1.DeleteOptions{}))
+	prefix, err := a.Claim(ctx, node1, false)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.96.0.0/24"), prefix)
+
+	// As are the claims of a previous node with the same name
+	recreated := newTestNode("node1")
+	recreated.UID = "uid-node1-new"
+	require.NoError(t, clientset.CoreV1().Nodes().Delete(ctx, "node1", metav1.DeleteOptions{}))
+	_, err = clientset.CoreV1().Nodes().Create(ctx, recreated, metav1.CreateOptions{})
+	require.NoError(t, err)
+	podCIDRs, err := a.PodCIDRs(ctx, recreated, false)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.96.0.0/24")}, podCIDRs)
+}
+
+func TestClaimKeepsLeasesOfNewNodes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	node1 := newTestNode("node1")
+	node2 := newTestNode("node2")
+	a, clientset := newTestAllocator(t, "10.96.0.0/16", node1, node2)
+	_, err := a.Claim(ctx, node2, false)
+	require.NoError(t, err)
+
+	// node2 registered after the node list was taken
+	clientset.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &v1.NodeList{Items: []v1.Node{*node1}}, nil
+	})
+
+	prefix, err := a.Claim(ctx, node1, false)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.96.1.0/24"), prefix)
+
+	leases, err := clientset.CoordinationV1().Leases("kube-system").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, leases.Items, 2)
+}
@@ -3,12 +3,34 @@ package annotation
 import (
 	"encoding/json"
 	"net/netip"
+	"strings"
 )
 
 const (
 	PublicKeyAnnotation string = "wigglenet/public-key"
 	NodeIpsAnnotation   string = "wigglenet/node-ips"
 	PodCidrsAnnotation  string = "wigglenet/pod-cidrs"
+
+	// The key the node is about to rotate to, published ahead of the switch so
+	// that peers can prepare for it
+	NextPublicKeyAnnotation string = "wigglenet/next-public-key"
+	// Node annotation requesting an immediate WireGuard key rotation. Removed
+	// once the rotation is complete.
+	RotateKeyAnnotation string = "wigglenet/rotate-key"
+
+	// Endpoint ("ip" or "ip:port") other nodes should use instead of the node's
+	// addresses, e.g. a port forward on a NAT gateway
+	EndpointAnnotation string = "wigglenet/endpoint"
+	// Set to "true" by nodes running with BEHIND_NAT
+	BehindNATAnnotation string = "wigglenet/behind-nat"
+	// The endpoints a node currently sees for its peers behind NAT, as a JSON
+	// object keyed by public key
+	ObservedEndpointsAnnotation string = "wigglenet/observed-endpoints"
+	// A node's endpoint behind NAT, as observed by the other nodes
+	ReflexiveEndpointAnnotation string = "wigglenet/reflexive-endpoint"
+
+	// Namespace annotation overriding NETPOL_AUDIT_MODE for the namespace's policies
+	NetpolAuditAnnotation string = "wigglenet/netpol-audit"
 )
 
 func UnmarshalPodCidrs(annotationValue string) ([]netip.Prefix, error) {
@@ -23,3 +45,25 @@ func MarshalPodCidrs(podCidrs []netip.Prefix) string {
 	val, _ := json.Marshal(podCidrs)
 	return string(val)
 }
+
+// ParseEndpoint parses an endpoint in the "ip" or "ip:port" form. The port is
+// 0 if not specified.
+func ParseEndpoint(annotationValue string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(annotationValue, "[]")); err == nil {
+		return netip.AddrPortFrom(addr, 0), nil
+	}
+	return netip.ParseAddrPort(annotationValue)
+}
+
+func UnmarshalObservedEndpoints(annotationValue string) (map[string]string, error) {
+	var endpoints map[string]string
+	if err := json.Unmarshal([]byte(annotationValue), &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func MarshalObservedEndpoints(endpoints map[string]string) string {
+	val, _ := json.Marshal(endpoints)
+	return string(val)
+}
@@ -0,0 +1,445 @@
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/metrics"
+	"github.com/tibordp/wigglenet/internal/util"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultPort        = 179
+	connectRetryPeriod = 5 * time.Second
+	connectTimeout     = 10 * time.Second
+	writeTimeout       = 10 * time.Second
+)
+
+// Peer is an upstream router to advertise the pod CIDRs to.
+type Peer struct {
+	Address netip.AddrPort
+	ASN     uint32
+}
+
+type Config struct {
+	LocalASN    uint32
+	RouterID    netip.Addr // If invalid, derived from the session address
+	Peers       []Peer
+	Communities []uint32
+	HoldTime    time.Duration
+	// Whether to export the session state as a metric
+	Metrics bool
+}
+
+// Speaker is a minimal BGP speaker that only advertises routes and ignores
+// the ones received from its peers.
+type Speaker interface {
+	// Run maintains the sessions with all the peers until the context is
+	// cancelled, then withdraws the advertised routes.
+	Run(ctx context.Context)
+	// Advertise sets the prefixes to advertise. The next hop is the local
+	// address of the session, or one of nextHops for the address families
+	// the session is not in.
+	Advertise(prefixes []netip.Prefix, nextHops []netip.Addr)
+}
+
+type advertisement struct {
+	prefixes []netip.Prefix
+	nextHops []netip.Addr
+}
+
+type speaker struct {
+	config Config
+
+	mu            sync.Mutex
+	advertisement advertisement
+	// Closed and replaced on every change of the advertisement
+	changed chan struct{}
+}
+
+func NewSpeaker(cfg Config) Speaker {
+	return &speaker{
+		config:  cfg,
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *speaker) Advertise(prefixes []netip.Prefix, nextHops []netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advertisement = advertisement{
+		prefixes: slices.Clone(prefixes),
+		nextHops: slices.Clone(nextHops),
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *speaker) current() (advertisement, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.advertisement, s.changed
+}
+
+func (s *speaker) Run(ctx context.Context) {
+	wg := wait.Group{}
+	for _, peer := range s.config.Peers {
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			s.runPeer(ctx, peer)
+		})
+	}
+	wg.Wait()
+}
+
+func (s *speaker) runPeer(ctx context.Context, peer Peer) {
+	logger := klog.FromContext(ctx).WithValues("peer", peer.Address)
+	ctx = klog.NewContext(ctx, logger)
+
+	for {
+		err := s.runSession(ctx, peer)
+		if s.config.Metrics {
+			metrics.BGPSessionEstablished.WithLabelValues(peer.Address.String()).Set(0)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error(err, "BGP session failed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(connectRetryPeriod):
+		}
+	}
+}
+
+// runSession connects to the peer and keeps the routes advertised to it
+// until the context is cancelled or the session fails.
+func (s *speaker) runSession(ctx context.Context, peer Peer) error {
+	logger := klog.FromContext(ctx)
+
+	dialer := net.Dialer{Timeout: connectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.Address.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	holdTime, params, err := s.openSession(conn, peer, localAddr)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("BGP session established", "holdTime", holdTime, "ipv4", params.IPv4Unicast, "ipv6", params.IPv6Unicast)
+	if s.config.Metrics {
+		metrics.BGPSessionEstablished.WithLabelValues(peer.Address.String()).Set(1)
+	}
+
+	// Read in the background, only to detect the session going away
+	_ = conn.SetReadDeadline(time.Time{})
+	readErrors := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(holdTime))
+			}
+			msgType, body, err := readMessage(conn)
+			if err != nil {
+				readErrors <- err
+				return
+			}
+			if msgType == msgNotification {
+				readErrors <- unmarshalNotification(body)
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	// Prefixes currently advertised to the peer and their next hops
+	advertised := make(map[netip.Prefix]netip.Addr)
+	for {
+		adv, changed := s.current()
+		desired := desiredRoutes(ctx, adv, localAddr)
+		// Routes of an address family the peer did not negotiate would be
+		// treated as malformed
+		maps.DeleteFunc(desired, func(prefix netip.Prefix, _ netip.Addr) bool {
+			return !params.supports(prefix)
+		})
+		if err := s.sync(ctx, conn, advertised, desired, params); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("withdrawing routes and closing BGP session")
+			if err := s.sync(ctx, conn, advertised, nil, params); err != nil {
+				return err
+			}
+			return writeMessage(conn, marshalNotification(errCease, subcodeAdminShutdown))
+		case err := <-readErrors:
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				_ = writeMessage(conn, marshalNotification(errHoldTimeExpire, 0))
+				return errors.New("hold timer expired")
+			}
+			return err
+		case <-keepalive:
+			if err := writeMessage(conn, marshalKeepalive()); err != nil {
+				return err
+			}
+		case <-changed:
+		}
+	}
+}
+
+// openSession exchanges the OPEN messages and returns the negotiated hold
+// time and the path attributes to use for the session.
+func (s *speaker) openSession(conn net.Conn, peer Peer, localAddr netip.Addr) (time.Duration, pathParams, error) {
+	routerID := s.config.RouterID
+	if !routerID.Is4() {
+		routerID = deriveRouterID(localAddr)
+	}
+
+	open := openMessage{
+		ASN:         s.config.LocalASN,
+		HoldTime:    uint16(min(s.config.HoldTime/time.Second, math.MaxUint16)),
+		RouterID:    routerID,
+		IPv4Unicast: true,
+		IPv6Unicast: true,
+	}
+	if err := writeMessage(conn, marshalOpen(open)); err != nil {
+		return 0, pathParams{}, err
+	}
+
+	// RFC 4271 suggests a large hold time until the OPEN is received
+	_ = conn.SetReadDeadline(time.Now().Add(4 * time.Minute))
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		return 0, pathParams{}, err
+	}
+	switch msgType {
+	case msgOpen:
+	case msgNotification:
+		return 0, pathParams{}, unmarshalNotification(body)
+	default:
+		return 0, pathParams{}, fmt.Errorf("unexpected message type %d, expected OPEN", msgType)
+	}
+
+	peerOpen, err := unmarshalOpen(body)
+	if err != nil {
+		return 0, pathParams{}, err
+	}
+	if peerOpen.ASN != peer.ASN {
+		_ = writeMessage(conn, marshalNotification(errOpenMessage, subcodeBadPeerAS))
+		return 0, pathParams{}, fmt.Errorf("peer ASN %d does not match the configured ASN %d", peerOpen.ASN, peer.ASN)
+	}
+	if peerOpen.HoldTime == 1 || peerOpen.HoldTime == 2 {
+		_ = writeMessage(conn, marshalNotification(errOpenMessage, subcodeBadHoldTime))
+		return 0, pathParams{}, fmt.Errorf("unacceptable hold time %d", peerOpen.HoldTime)
+	}
+	if !peerOpen.FourOctetAS && s.config.LocalASN > 0xffff {
+		return 0, pathParams{}, errors.New("peer does not support 4-octet ASNs")
+	}
+
+	if err := writeMessage(conn, marshalKeepalive()); err != nil {
+		return 0, pathParams{}, err
+	}
+
+	msgType, body, err = readMessage(conn)
+	if err != nil {
+		return 0, pathParams{}, err
+	}
+	switch msgType {
+	case msgKeepalive:
+	case msgNotification:
+		return 0, pathParams{}, unmarshalNotification(body)
+	default:
+		return 0, pathParams{}, fmt.Errorf("unexpected message type %d, expected KEEPALIVE", msgType)
+	}
+
+	holdTime := time.Duration(min(open.HoldTime, peerOpen.HoldTime)) * time.Second
+	return holdTime, pathParams{
+		LocalASN:    s.config.LocalASN,
+		Internal:    peer.ASN == s.config.LocalASN,
+		FourOctetAS: peerOpen.FourOctetAS,
+		Communities: s.config.Communities,
+		IPv4Unicast: peerOpen.IPv4Unicast,
+		IPv6Unicast: peerOpen.IPv6Unicast,
+	}, nil
+}
+
+// sync sends the updates needed to get from the advertised to the desired
+// routes, and updates advertised accordingly.
+func (s *speaker) sync(ctx context.Context, conn net.Conn, advertised, desired map[netip.Prefix]netip.Addr, params pathParams) error {
+	logger := klog.FromContext(ctx)
+
+	withdrawn := make([]netip.Prefix, 0)
+	for prefix := range advertised {
+		if _, ok := desired[prefix]; !ok {
+			withdrawn = append(withdrawn, prefix)
+		}
+	}
+
+	// Routes with the same next hop can share an UPDATE message
+	announced := make(map[netip.Addr][]netip.Prefix)
+	for prefix, nextHop := range desired {
+		if current, ok := advertised[prefix]; !ok || current != nextHop {
+			announced[nextHop] = append(announced[nextHop], prefix)
+		}
+	}
+
+	for _, ipv6 := range []bool{false, true} {
+		prefixes := slices.DeleteFunc(slices.Clone(withdrawn), func(prefix netip.Prefix) bool {
+			return prefix.Addr().Is6() != ipv6
+		})
+		if len(prefixes) == 0 {
+			continue
+		}
+		util.SortPrefixes(prefixes)
+		logger.Info("withdrawing routes", "prefixes", prefixes)
+		if err := writeMessage(conn, marshalWithdrawal(prefixes)); err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			delete(advertised, prefix)
+		}
+	}
+
+	for nextHop, prefixes := range announced {
+		util.SortPrefixes(prefixes)
+		logger.Info("advertising routes", "prefixes", prefixes, "nextHop", nextHop)
+		if err := writeMessage(conn, marshalAnnouncement(prefixes, nextHop, params)); err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			advertised[prefix] = nextHop
+		}
+	}
+
+	return nil
+}
+
+// desiredRoutes maps the prefixes to advertise to their next hops.
+func desiredRoutes(ctx context.Context, adv advertisement, localAddr netip.Addr) map[netip.Prefix]netip.Addr {
+	logger := klog.FromContext(ctx)
+
+	routes := make(map[netip.Prefix]netip.Addr)
+	for _, prefix := range adv.prefixes {
+		nextHop := localAddr
+		if nextHop.Is6() != prefix.Addr().Is6() {
+			index := slices.IndexFunc(adv.nextHops, func(addr netip.Addr) bool {
+				return addr.Is6() == prefix.Addr().Is6()
+			})
+			if index == -1 {
+				logger.Info("no next hop available for prefix, not advertising it", "prefix", prefix)
+				continue
+			}
+			nextHop = adv.nextHops[index]
+		}
+		routes[prefix] = nextHop
+	}
+	return routes
+}
+
+// deriveRouterID uses the session address as the router ID if it is an IPv4
+// address, and a hash of it otherwise.
+func deriveRouterID(localAddr netip.Addr) netip.Addr {
+	if localAddr.Is4() {
+		return localAddr
+	}
+	h := fnv.New32a()
+	h.Write(localAddr.AsSlice())
+	return netip.AddrFrom4([4]byte(h.Sum(nil)))
+}
+
+func writeMessage(conn net.Conn, msg []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// ParsePeers parses a comma-separated list of peers in the <address>=<asn>
+// format, where the address can optionally include a port.
+func ParsePeers(value string) ([]Peer, error) {
+	peers := make([]Peer, 0)
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		address, asn, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid BGP peer %q, expected <address>=<asn>", entry)
+		}
+
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			addr, err := netip.ParseAddr(address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid BGP peer address %q", address)
+			}
+			addrPort = netip.AddrPortFrom(addr, DefaultPort)
+		}
+
+		peerASN, err := strconv.ParseUint(asn, 10, 32)
+		if err != nil || peerASN == 0 {
+			return nil, fmt.Errorf("invalid BGP peer ASN %q", asn)
+		}
+
+		peers = append(peers, Peer{Address: addrPort, ASN: uint32(peerASN)})
+	}
+	return peers, nil
+}
+
+// ParseCommunities parses a comma-separated list of communities in the
+// <asn>:<value> format.
+func ParseCommunities(value string) ([]uint32, error) {
+	communities := make([]uint32, 0)
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		high, low, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid BGP community %q, expected <asn>:<value>", entry)
+		}
+		highValue, err := strconv.ParseUint(high, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BGP community %q", entry)
+		}
+		lowValue, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BGP community %q", entry)
+		}
+
+		communities = append(communities, uint32(highValue)<<16|uint32(lowValue))
+	}
+	return communities, nil
+}
@@ -0,0 +1,404 @@
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/util/netnstest"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type update struct {
+	Withdrawn   []netip.Prefix
+	Announced   []netip.Prefix
+	NextHop     netip.Addr
+	ASPath      []byte
+	Communities []uint32
+}
+
+func parsePrefixes(b []byte, ipv6 bool) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0)
+	for len(b) > 0 {
+		bits := int(b[0])
+		length := (bits + 7) / 8
+		var addr netip.Addr
+		if ipv6 {
+			var raw [16]byte
+			copy(raw[:], b[1:1+length])
+			addr = netip.AddrFrom16(raw)
+		} else {
+			var raw [4]byte
+			copy(raw[:], b[1:1+length])
+			addr = netip.AddrFrom4(raw)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, bits))
+		b = b[1+length:]
+	}
+	return prefixes
+}
+
+func parseUpdate(t *testing.T, body []byte) update {
+	var u update
+
+	withdrawnLength := int(binary.BigEndian.Uint16(body))
+	u.Withdrawn = parsePrefixes(body[2:2+withdrawnLength], false)
+	body = body[2+withdrawnLength:]
+	attributesLength := int(binary.BigEndian.Uint16(body))
+	attributes := body[2 : 2+attributesLength]
+	u.Announced = parsePrefixes(body[2+attributesLength:], false)
+
+	for len(attributes) > 0 {
+		flags, attrType := attributes[0], attributes[1]
+		var value []byte
+		if flags&flagExtendedLength != 0 {
+			length := int(binary.BigEndian.Uint16(attributes[2:]))
+			value, attributes = attributes[4:4+length], attributes[4+length:]
+		} else {
+			length := int(attributes[2])
+			value, attributes = attributes[3:3+length], attributes[3+length:]
+		}
+
+		switch attrType {
+		case attrASPath:
+			u.ASPath = value
+		case attrNextHop:
+			u.NextHop = netip.AddrFrom4([4]byte(value))
+		case attrCommunities:
+			for i := 0; i < len(value); i += 4 {
+				u.Communities = append(u.Communities, binary.BigEndian.Uint32(value[i:]))
+			}
+		case attrMPReach:
+			require.Equal(t, afiIPv6, binary.BigEndian.Uint16(value))
+			u.NextHop = netip.AddrFrom16([16]byte(value[4:20]))
+			u.Announced = append(u.Announced, parsePrefixes(value[21:], true)...)
+		case attrMPUnreach:
+			require.Equal(t, afiIPv6, binary.BigEndian.Uint16(value))
+			u.Withdrawn = append(u.Withdrawn, parsePrefixes(value[3:], true)...)
+		}
+	}
+	return u
+}
+
+func expectMessage(t *testing.T, conn net.Conn, expected uint8) []byte {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	msgType, body, err := readMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, expected, msgType)
+	return body
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("192.168.0.1=65000, [2001:db8::1]:1179=4200000000")
+	require.NoError(t, err)
+	assert.Equal(t, []Peer{
+		{Address: netip.MustParseAddrPort("192.168.0.1:179"), ASN: 65000},
+		{Address: netip.MustParseAddrPort("[2001:db8::1]:1179"), ASN: 4200000000},
+	}, peers)
+
+	_, err = ParsePeers("192.168.0.1")
+	assert.Error(t, err)
+	_, err = ParsePeers("192.168.0.1=0")
+	assert.Error(t, err)
+	_, err = ParsePeers("router=65000")
+	assert.Error(t, err)
+}
+
+func TestParseCommunities(t *testing.T) {
+	communities, err := ParseCommunities("65000:100,65535:65281")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{65000<<16 | 100, 0xffffff01}, communities)
+
+	_, err = ParseCommunities("65536:1")
+	assert.Error(t, err)
+	_, err = ParseCommunities("100")
+	assert.Error(t, err)
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	msg := marshalOpen(openMessage{
+		ASN:         4200000000,
+		HoldTime:    90,
+		RouterID:    netip.MustParseAddr("192.168.0.10"),
+		IPv6Unicast: true,
+	})
+
+	msgType, body, err := readMessage(bytes.NewReader(msg))
+	require.NoError(t, err)
+	assert.Equal(t, msgOpen, msgType)
+	// 2-octet field carries AS_TRANS
+	assert.Equal(t, asTrans, binary.BigEndian.Uint16(body[1:]))
+
+	open, err := unmarshalOpen(body)
+	require.NoError(t, err)
+	assert.Equal(t, openMessage{
+		ASN:         4200000000,
+		HoldTime:    90,
+		RouterID:    netip.MustParseAddr("192.168.0.10"),
+		FourOctetAS: true,
+		IPv6Unicast: true,
+	}, open)
+
+	// Without multiprotocol capabilities, only IPv4 unicast is supported
+	_, body, err = readMessage(bytes.NewReader(marshalOpen(openMessage{
+		ASN:      65000,
+		HoldTime: 90,
+		RouterID: netip.MustParseAddr("192.168.0.10"),
+	})))
+	require.NoError(t, err)
+	open, err = unmarshalOpen(body)
+	require.NoError(t, err)
+	assert.True(t, open.IPv4Unicast)
+	assert.False(t, open.IPv6Unicast)
+}
+
+func TestDeriveRouterID(t *testing.T) {
+	assert.Equal(t, netip.MustParseAddr("192.168.0.10"), deriveRouterID(netip.MustParseAddr("192.168.0.10")))
+
+	routerID := deriveRouterID(netip.MustParseAddr("2001:db8::10"))
+	assert.True(t, routerID.Is4())
+	assert.Equal(t, routerID, deriveRouterID(netip.MustParseAddr("2001:db8::10")))
+}
+
+// TestSpeaker runs the speaker against a local peer, which can just as well
+// be a real BGP daemon listening in a network namespace.
+func TestSpeaker(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := NewSpeaker(Config{
+		LocalASN: 65001,
+		Peers: []Peer{
+			{Address: listener.Addr().(*net.TCPAddr).AddrPort(), ASN: 65000},
+		},
+		Communities: []uint32{65000<<16 | 100},
+		HoldTime:    90 * time.Second,
+	})
+	s.Advertise(
+		[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("2001:db8:1::/64")},
+		[]netip.Addr{netip.MustParseAddr("192.168.0.10"), netip.MustParseAddr("2001:db8::10")},
+	)
+
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	open, err := unmarshalOpen(expectMessage(t, conn, msgOpen))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(65001), open.ASN)
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), open.RouterID)
+	assert.Equal(t, uint16(90), open.HoldTime)
+	assert.True(t, open.IPv4Unicast)
+	assert.True(t, open.IPv6Unicast)
+
+	_, err = conn.Write(marshalOpen(openMessage{
+		ASN:         65000,
+		HoldTime:    30,
+		RouterID:    netip.MustParseAddr("192.168.0.1"),
+		IPv4Unicast: true,
+		IPv6Unicast: true,
+	}))
+	require.NoError(t, err)
+	expectMessage(t, conn, msgKeepalive)
+	_, err = conn.Write(marshalKeepalive())
+	require.NoError(t, err)
+
+	// The IPv4 prefix is advertised with the session address as next hop, the
+	// IPv6 one with the node address
+	updates := map[netip.Addr]update{}
+	for range 2 {
+		u := parseUpdate(t, expectMessage(t, conn, msgUpdate))
+		updates[u.NextHop] = u
+	}
+	ipv4 := updates[netip.MustParseAddr("127.0.0.1")]
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}, ipv4.Announced)
+	assert.Equal(t, []byte{asPathSequence, 1, 0, 0, 0xfd, 0xe9}, ipv4.ASPath)
+	assert.Equal(t, []uint32{65000<<16 | 100}, ipv4.Communities)
+	ipv6 := updates[netip.MustParseAddr("2001:db8::10")]
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, ipv6.Announced)
+
+	// Removed prefixes are withdrawn
+	s.Advertise([]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}, nil)
+	u := parseUpdate(t, expectMessage(t, conn, msgUpdate))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, u.Withdrawn)
+	assert.Empty(t, u.Announced)
+
+	// Everything is withdrawn on shutdown
+	cancel()
+	u = parseUpdate(t, expectMessage(t, conn, msgUpdate))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}, u.Withdrawn)
+	notification := unmarshalNotification(expectMessage(t, conn, msgNotification))
+	assert.Equal(t, notificationMessage{Code: errCease, Subcode: subcodeAdminShutdown}, notification)
+
+	<-done
+}
+
+func TestSpeakerBadPeerAS(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := NewSpeaker(Config{LocalASN: 65001, HoldTime: 90 * time.Second}).(*speaker)
+	peer := Peer{Address: listener.Addr().(*net.TCPAddr).AddrPort(), ASN: 65000}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.runSession(ctx, peer)
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	expectMessage(t, conn, msgOpen)
+	_, err = conn.Write(marshalOpen(openMessage{ASN: 65002, HoldTime: 30, RouterID: netip.MustParseAddr("192.168.0.1")}))
+	require.NoError(t, err)
+
+	notification := unmarshalNotification(expectMessage(t, conn, msgNotification))
+	assert.Equal(t, notificationMessage{Code: errOpenMessage, Subcode: subcodeBadPeerAS}, notification)
+	assert.ErrorContains(t, <-errs, "does not match")
+}
+
+func TestSpeakerHoldTimeCapped(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := NewSpeaker(Config{LocalASN: 65001, HoldTime: 24 * time.Hour}).(*speaker)
+	peer := Peer{Address: listener.Addr().(*net.TCPAddr).AddrPort(), ASN: 65000}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.runSession(ctx, peer)
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	open, err := unmarshalOpen(expectMessage(t, conn, msgOpen))
+	require.NoError(t, err)
+	assert.Equal(t, uint16(math.MaxUint16), open.HoldTime)
+	conn.Close()
+	assert.Error(t, <-errs)
+}
+
+// TestSpeakerNetns runs the speaker against a peer in another network
+// namespace, connected over a veth pair with an IPv6 session. The peer only
+// supports IPv6 unicast, so the IPv4 pod CIDR is not advertised to it.
+func TestSpeakerNetns(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	local, remote := newNetnsPair(t, "2001:db8::10/64", "2001:db8::1/64")
+
+	var listener net.Listener
+	var err error
+	<-netnstest.Go(remote, func() {
+		listener, err = net.Listen("tcp", "[2001:db8::1]:179")
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := NewSpeaker(Config{LocalASN: 65001, HoldTime: 90 * time.Second}).(*speaker)
+	s.Advertise(
+		[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("2001:db8:1::/64")},
+		[]netip.Addr{netip.MustParseAddr("192.168.0.10")},
+	)
+
+	errs := make(chan error, 1)
+	netnstest.Go(local, func() {
+		errs <- s.runSession(ctx, Peer{Address: netip.MustParseAddrPort("[2001:db8::1]:179"), ASN: 65000})
+	})
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	open, err := unmarshalOpen(expectMessage(t, conn, msgOpen))
+	require.NoError(t, err)
+	assert.Equal(t, deriveRouterID(netip.MustParseAddr("2001:db8::10")), open.RouterID)
+
+	_, err = conn.Write(marshalOpen(openMessage{
+		ASN:         65000,
+		HoldTime:    30,
+		RouterID:    netip.MustParseAddr("192.168.0.1"),
+		IPv6Unicast: true,
+	}))
+	require.NoError(t, err)
+	expectMessage(t, conn, msgKeepalive)
+	_, err = conn.Write(marshalKeepalive())
+	require.NoError(t, err)
+
+	u := parseUpdate(t, expectMessage(t, conn, msgUpdate))
+	assert.Equal(t, netip.MustParseAddr("2001:db8::10"), u.NextHop)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, u.Announced)
+
+	// Only the IPv6 route was advertised, so only it is withdrawn
+	cancel()
+	u = parseUpdate(t, expectMessage(t, conn, msgUpdate))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, u.Withdrawn)
+	notification := unmarshalNotification(expectMessage(t, conn, msgNotification))
+	assert.Equal(t, notificationMessage{Code: errCease, Subcode: subcodeAdminShutdown}, notification)
+	assert.NoError(t, <-errs)
+}
+
+// newNetnsPair creates two network namespaces connected with a veth pair
+// with the given addresses. The test is skipped if they cannot be created,
+// e.g. when not running as root.
+func newNetnsPair(t *testing.T, localAddress, remoteAddress string) (netns.NsHandle, netns.NsHandle) {
+	t.Helper()
+
+	namespaces := []netns.NsHandle{netnstest.New(t), netnstest.New(t)}
+
+	handles := make([]*netlink.Handle, 0, 2)
+	for _, ns := range namespaces {
+		handle, err := netlink.NewHandleAt(ns)
+		require.NoError(t, err)
+		t.Cleanup(handle.Close)
+		handles = append(handles, handle)
+	}
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "bgp0"}, PeerName: "bgp1", PeerNamespace: netlink.NsFd(namespaces[1])}
+	require.NoError(t, handles[0].LinkAdd(veth))
+
+	for i, link := range []string{"bgp0", "bgp1"} {
+		address := []string{localAddress, remoteAddress}[i]
+		l, err := handles[i].LinkByName(link)
+		require.NoError(t, err)
+		addr, err := netlink.ParseAddr(address)
+		require.NoError(t, err)
+		// Skip duplicate address detection, the addresses are used right away
+		addr.Flags = unix.IFA_F_NODAD
+		require.NoError(t, handles[i].AddrAdd(l, addr))
+		require.NoError(t, handles[i].LinkSetUp(l))
+	}
+
+	return namespaces[0], namespaces[1]
+}
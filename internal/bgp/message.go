@@ -0,0 +1,328 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Message types (RFC 4271)
+const (
+	msgOpen         uint8 = 1
+	msgUpdate       uint8 = 2
+	msgNotification uint8 = 3
+	msgKeepalive    uint8 = 4
+)
+
+// Path attribute types and flags
+const (
+	attrOrigin      uint8 = 1
+	attrASPath      uint8 = 2
+	attrNextHop     uint8 = 3
+	attrLocalPref   uint8 = 5
+	attrCommunities uint8 = 8
+	attrMPReach     uint8 = 14
+	attrMPUnreach   uint8 = 15
+
+	flagOptional       uint8 = 0x80
+	flagTransitive     uint8 = 0x40
+	flagExtendedLength uint8 = 0x10
+)
+
+// Capability codes (RFC 5492)
+const (
+	capMultiprotocol uint8 = 1
+	capFourOctetAS   uint8 = 65
+)
+
+// Notification error codes and subcodes
+const (
+	errOpenMessage    uint8 = 2
+	errHoldTimeExpire uint8 = 4
+	errCease          uint8 = 6
+
+	subcodeBadPeerAS     uint8 = 2
+	subcodeBadHoldTime   uint8 = 6
+	subcodeAdminShutdown uint8 = 2
+)
+
+const (
+	headerLength     = 19
+	maxMessageLength = 4096
+
+	afiIPv4     uint16 = 1
+	afiIPv6     uint16 = 2
+	safiUnicast uint8  = 1
+
+	originIGP        uint8  = 0
+	asPathSequence   uint8  = 2
+	asTrans          uint16 = 23456 // Placeholder for 4-octet ASNs in the 2-octet field
+	defaultLocalPref uint32 = 100
+)
+
+type openMessage struct {
+	ASN         uint32
+	HoldTime    uint16
+	RouterID    netip.Addr
+	FourOctetAS bool
+	// Unicast address families of the multiprotocol capabilities. Without
+	// any, only IPv4 unicast is supported (RFC 4760).
+	IPv4Unicast bool
+	IPv6Unicast bool
+}
+
+type notificationMessage struct {
+	Code    uint8
+	Subcode uint8
+}
+
+func (n notificationMessage) Error() string {
+	return fmt.Sprintf("received notification (code %d, subcode %d)", n.Code, n.Subcode)
+}
+
+// pathParams are the path attributes shared by all the advertised routes.
+type pathParams struct {
+	LocalASN    uint32
+	Internal    bool // iBGP session
+	FourOctetAS bool
+	Communities []uint32
+	// Address families negotiated with the peer, routes of the others cannot
+	// be advertised
+	IPv4Unicast bool
+	IPv6Unicast bool
+}
+
+func (p pathParams) supports(prefix netip.Prefix) bool {
+	if prefix.Addr().Is6() {
+		return p.IPv6Unicast
+	}
+	return p.IPv4Unicast
+}
+
+func marshalMessage(msgType uint8, body []byte) []byte {
+	msg := make([]byte, headerLength, headerLength+len(body))
+	for i := range 16 {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLength+len(body)))
+	msg[18] = msgType
+	return append(msg, body...)
+}
+
+// readMessage reads a single message and returns its type and body.
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return 0, nil, errors.New("invalid message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLength || length > maxMessageLength {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body := make([]byte, length-headerLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+func marshalOpen(open openMessage) []byte {
+	capabilities := make([]byte, 0)
+	families := make([]uint16, 0, 2)
+	if open.IPv4Unicast {
+		families = append(families, afiIPv4)
+	}
+	if open.IPv6Unicast {
+		families = append(families, afiIPv6)
+	}
+	for _, afi := range families {
+		capabilities = append(capabilities, capMultiprotocol, 4)
+		capabilities = binary.BigEndian.AppendUint16(capabilities, afi)
+		capabilities = append(capabilities, 0, safiUnicast)
+	}
+	capabilities = append(capabilities, capFourOctetAS, 4)
+	capabilities = binary.BigEndian.AppendUint32(capabilities, open.ASN)
+
+	myAS := asTrans
+	if open.ASN <= 0xffff {
+		myAS = uint16(open.ASN)
+	}
+
+	body := []byte{4}
+	body = binary.BigEndian.AppendUint16(body, myAS)
+	body = binary.BigEndian.AppendUint16(body, open.HoldTime)
+	body = append(body, open.RouterID.AsSlice()...)
+	body = append(body, byte(2+len(capabilities)), 2, byte(len(capabilities)))
+	body = append(body, capabilities...)
+	return marshalMessage(msgOpen, body)
+}
+
+func unmarshalOpen(body []byte) (openMessage, error) {
+	var open openMessage
+	if len(body) < 10 {
+		return open, errors.New("open message too short")
+	}
+	if body[0] != 4 {
+		return open, fmt.Errorf("unsupported BGP version %d", body[0])
+	}
+	open.ASN = uint32(binary.BigEndian.Uint16(body[1:]))
+	open.HoldTime = binary.BigEndian.Uint16(body[3:])
+	open.RouterID = netip.AddrFrom4([4]byte(body[5:9]))
+
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return open, errors.New("invalid optional parameters length")
+	}
+	multiprotocol := false
+	for len(params) >= 2 {
+		paramType, paramLength := params[0], int(params[1])
+		if len(params) < 2+paramLength {
+			return open, errors.New("invalid optional parameter")
+		}
+		capabilities := params[2 : 2+paramLength]
+		params = params[2+paramLength:]
+		if paramType != 2 {
+			continue
+		}
+		for len(capabilities) >= 2 {
+			code, length := capabilities[0], int(capabilities[1])
+			if len(capabilities) < 2+length {
+				return open, errors.New("invalid capability")
+			}
+			if code == capFourOctetAS && length == 4 {
+				open.FourOctetAS = true
+				open.ASN = binary.BigEndian.Uint32(capabilities[2:])
+			}
+			if code == capMultiprotocol && length == 4 {
+				multiprotocol = true
+				if capabilities[5] == safiUnicast {
+					switch binary.BigEndian.Uint16(capabilities[2:]) {
+					case afiIPv4:
+						open.IPv4Unicast = true
+					case afiIPv6:
+						open.IPv6Unicast = true
+					}
+				}
+			}
+			capabilities = capabilities[2+length:]
+		}
+	}
+	if !multiprotocol {
+		open.IPv4Unicast = true
+	}
+	return open, nil
+}
+
+func marshalKeepalive() []byte {
+	return marshalMessage(msgKeepalive, nil)
+}
+
+func marshalNotification(code, subcode uint8) []byte {
+	return marshalMessage(msgNotification, []byte{code, subcode})
+}
+
+func unmarshalNotification(body []byte) notificationMessage {
+	var n notificationMessage
+	if len(body) >= 2 {
+		n.Code, n.Subcode = body[0], body[1]
+	}
+	return n
+}
+
+func appendPrefix(b []byte, prefix netip.Prefix) []byte {
+	b = append(b, byte(prefix.Bits()))
+	return append(b, prefix.Addr().AsSlice()[:(prefix.Bits()+7)/8]...)
+}
+
+func appendAttribute(b []byte, flags, attrType uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		b = append(b, flags|flagExtendedLength, attrType)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	} else {
+		b = append(b, flags, attrType, byte(len(value)))
+	}
+	return append(b, value...)
+}
+
+func marshalUpdate(withdrawn []byte, attributes []byte, nlri []byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attributes)))
+	body = append(body, attributes...)
+	body = append(body, nlri...)
+	return marshalMessage(msgUpdate, body)
+}
+
+// marshalAnnouncement creates an UPDATE message announcing the prefixes, which
+// all need to be of the same address family as the next hop. IPv4 prefixes
+// are announced in the NLRI field and IPv6 prefixes with MP_REACH_NLRI.
+func marshalAnnouncement(prefixes []netip.Prefix, nextHop netip.Addr, params pathParams) []byte {
+	attributes := appendAttribute(nil, flagTransitive, attrOrigin, []byte{originIGP})
+
+	asPath := make([]byte, 0)
+	if !params.Internal {
+		asPath = append(asPath, asPathSequence, 1)
+		if params.FourOctetAS {
+			asPath = binary.BigEndian.AppendUint32(asPath, params.LocalASN)
+		} else {
+			asPath = binary.BigEndian.AppendUint16(asPath, uint16(params.LocalASN))
+		}
+	}
+	attributes = appendAttribute(attributes, flagTransitive, attrASPath, asPath)
+
+	if nextHop.Is4() {
+		attributes = appendAttribute(attributes, flagTransitive, attrNextHop, nextHop.AsSlice())
+	}
+	if params.Internal {
+		attributes = appendAttribute(attributes, flagTransitive, attrLocalPref, binary.BigEndian.AppendUint32(nil, defaultLocalPref))
+	}
+	if len(params.Communities) > 0 {
+		communities := make([]byte, 0, 4*len(params.Communities))
+		for _, community := range params.Communities {
+			communities = binary.BigEndian.AppendUint32(communities, community)
+		}
+		attributes = appendAttribute(attributes, flagOptional|flagTransitive, attrCommunities, communities)
+	}
+
+	nlri := make([]byte, 0)
+	for _, prefix := range prefixes {
+		nlri = appendPrefix(nlri, prefix)
+	}
+
+	if nextHop.Is4() {
+		return marshalUpdate(nil, attributes, nlri)
+	}
+
+	mpReach := binary.BigEndian.AppendUint16(nil, afiIPv6)
+	mpReach = append(mpReach, safiUnicast, 16)
+	mpReach = append(mpReach, nextHop.AsSlice()...)
+	mpReach = append(mpReach, 0)
+	mpReach = append(mpReach, nlri...)
+	attributes = appendAttribute(attributes, flagOptional, attrMPReach, mpReach)
+	return marshalUpdate(nil, attributes, nil)
+}
+
+// marshalWithdrawal creates an UPDATE message withdrawing the prefixes, which
+// all need to be of the same address family.
+func marshalWithdrawal(prefixes []netip.Prefix) []byte {
+	withdrawn := make([]byte, 0)
+	for _, prefix := range prefixes {
+		withdrawn = appendPrefix(withdrawn, prefix)
+	}
+
+	if len(prefixes) == 0 || prefixes[0].Addr().Is4() {
+		return marshalUpdate(withdrawn, nil, nil)
+	}
+
+	mpUnreach := binary.BigEndian.AppendUint16(nil, afiIPv6)
+	mpUnreach = append(mpUnreach, safiUnicast)
+	mpUnreach = append(mpUnreach, withdrawn...)
+	return marshalUpdate(nil, appendAttribute(nil, flagOptional, attrMPUnreach, mpUnreach), nil)
+}
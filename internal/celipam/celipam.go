@@ -3,24 +3,31 @@
 //
 // It builds on the Kubernetes IP/CIDR CEL library (k8s.io/apiserver/pkg/cel)
 // for the familiar cidr()/ip()/masked()/prefixLength()/containsIP verbs, and
-// adds a single custom verb that the standard library lacks: carving a subnet
-// out of a prefix.
+// adds the verbs that the standard library lacks: carving subnets out of a
+// prefix, stepping through prefixes and addresses, and hashing.
 //
 //	cidr.subnet(prefixLength, index) -> cidr
+//	cidr.subnets(prefixLength) -> list(cidr)
+//	cidr.next() -> cidr
+//	ip.add(int) -> ip
+//	hash(string) -> int
 //
 // e.g. the second /80 of a routed /64:
 //
 //	interfaces["eth0"].filter(p, p.prefixLength() == 64)[0].subnet(80, 1)
 //
-// The expression is given two variables:
+// The expression is given three variables:
 //
 //	interfaces  map(string, list(cidr))   on-link prefixes per interface name
-//	node        map(string, dyn)          {name: string, labels: map, annotations: map}
+//	routes      map(string, list(cidr))   routed destination prefixes per interface name
+//	node        map(string, dyn)          {name: string, labels: map, annotations: map,
+//	                                       addresses: list(map), podCIDRs: list(cidr)}
 //
 // and must evaluate to a cidr or a list(cidr) — the pod CIDRs for this node.
 package celipam
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"net/netip"
@@ -30,6 +37,8 @@ import (
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/common/types/traits"
+	"github.com/tibordp/wigglenet/internal/util"
+	v1 "k8s.io/api/core/v1"
 	apiservercel "k8s.io/apiserver/pkg/cel"
 	"k8s.io/apiserver/pkg/cel/library"
 )
@@ -45,13 +54,45 @@ type NodeInfo struct {
 	Name        string
 	Labels      map[string]string
 	Annotations map[string]string
+	// The addresses from the node's status (.status.addresses) that are IPs
+	Addresses []NodeAddress
+	// The pod CIDRs from the node's spec (.spec.podCIDRs)
+	PodCIDRs []netip.Prefix
+}
+
+// NodeAddress is an address from the node's status, e.g. its InternalIP.
+type NodeAddress struct {
+	Type    string
+	Address netip.Addr
+}
+
+// NewNodeInfo returns the metadata of the node the expression sees.
+func NewNodeInfo(ctx context.Context, node *v1.Node) NodeInfo {
+	addresses := make([]NodeAddress, 0)
+	for _, address := range node.Status.Addresses {
+		if addr, err := netip.ParseAddr(address.Address); err == nil {
+			addresses = append(addresses, NodeAddress{Type: string(address.Type), Address: addr})
+		}
+	}
+
+	return NodeInfo{
+		Name:        node.Name,
+		Labels:      node.Labels,
+		Annotations: node.Annotations,
+		Addresses:   addresses,
+		PodCIDRs:    util.GetPodCIDRsFromSpec(ctx, node),
+	}
 }
 
 // Inputs is the data an expression is evaluated against.
 type Inputs struct {
 	// Interfaces maps interface name to the on-link prefixes configured on it.
 	Interfaces map[string][]netip.Prefix
-	Node       NodeInfo
+	// Routes maps interface name to the destinations of the routes through it
+	// in the main routing table. Routes without an interface (e.g. unreachable
+	// routes for a delegated prefix) are under "".
+	Routes map[string][]netip.Prefix
+	Node   NodeInfo
 }
 
 // Evaluator is a compiled pod-CIDR expression. It is safe for concurrent use.
@@ -87,7 +128,9 @@ func compile(expression string) (*Evaluator, error) {
 		library.IP(),
 		library.CIDR(),
 		subnetFunction(),
+		libraryFunctions(),
 		cel.Variable("interfaces", cel.MapType(cel.StringType, cel.ListType(apiservercel.CIDRType))),
+		cel.Variable("routes", cel.MapType(cel.StringType, cel.ListType(apiservercel.CIDRType))),
 		cel.Variable("node", cel.MapType(cel.StringType, cel.DynType)),
 	)
 	if err != nil {
@@ -100,16 +143,17 @@ func compile(expression string) (*Evaluator, error) {
 	}
 
 	// The expression must yield a cidr or a list of cidrs. Allow dyn (e.g. a
-	// bare ternary) and validate the concrete value at runtime instead.
+	// bare ternary, or a list mixing node.podCIDRs with other cidrs) and
+	// validate the concrete value at runtime instead.
 	out := ast.OutputType()
-	cidrList := cel.ListType(apiservercel.CIDRType)
 	if !out.IsEquivalentType(apiservercel.CIDRType) &&
-		!out.IsEquivalentType(cidrList) &&
+		!out.IsEquivalentType(cel.ListType(apiservercel.CIDRType)) &&
+		!out.IsEquivalentType(cel.ListType(cel.DynType)) &&
 		!out.IsEquivalentType(cel.DynType) {
 		return nil, fmt.Errorf("pod CIDR expression must evaluate to a cidr or list(cidr), got %s", out)
 	}
 
-	program, err := env.Program(ast, cel.CostLimit(costLimit))
+	program, err := env.Program(ast, cel.CostTracking(&costEstimator{}), cel.CostLimit(costLimit))
 	if err != nil {
 		return nil, fmt.Errorf("constructing CEL program: %w", err)
 	}
@@ -122,6 +166,7 @@ func compile(expression string) (*Evaluator, error) {
 func (e *Evaluator) Evaluate(inputs Inputs) ([]netip.Prefix, error) {
 	out, _, err := e.program.Eval(map[string]any{
 		"interfaces": interfacesValue(inputs.Interfaces),
+		"routes":     interfacesValue(inputs.Routes),
 		"node":       nodeValue(inputs.Node),
 	})
 	if err != nil {
@@ -178,10 +223,24 @@ func interfacesValue(interfaces map[string][]netip.Prefix) ref.Val {
 }
 
 func nodeValue(node NodeInfo) map[string]any {
+	addresses := make([]ref.Val, 0, len(node.Addresses))
+	for _, address := range node.Addresses {
+		addresses = append(addresses, types.NewStringInterfaceMap(types.DefaultTypeAdapter, map[string]any{
+			"type":    address.Type,
+			"address": apiservercel.IP{Addr: address.Address},
+		}))
+	}
+	podCIDRs := make([]ref.Val, 0, len(node.PodCIDRs))
+	for _, p := range node.PodCIDRs {
+		podCIDRs = append(podCIDRs, apiservercel.CIDR{Prefix: p})
+	}
+
 	return map[string]any{
 		"name":        node.Name,
 		"labels":      node.Labels,
 		"annotations": node.Annotations,
+		"addresses":   types.NewRefValList(types.DefaultTypeAdapter, addresses),
+		"podCIDRs":    types.NewRefValList(types.DefaultTypeAdapter, podCIDRs),
 	}
 }
 
@@ -2,6 +2,7 @@ package celipam
 
 import (
 	"net/netip"
+	"reflect"
 	"testing"
 )
 
@@ -20,9 +21,18 @@ func sampleInputs() Inputs {
 			"eth0": prefixes("2001:db8:abcd:1234::5/64", "10.0.0.5/24"),
 			"lo":   prefixes("::1/128"),
 		},
+		Routes: map[string][]netip.Prefix{
+			"eth0": prefixes("10.0.0.0/24", "2001:db8:ff00::/56"),
+			"":     prefixes("2001:db8:eeee::/48"),
+		},
 		Node: NodeInfo{
 			Name:   "node-1",
 			Labels: map[string]string{"topology.kubernetes.io/zone": "eu-central"},
+			Addresses: []NodeAddress{
+				{Type: "InternalIP", Address: netip.MustParseAddr("10.0.0.5")},
+				{Type: "ExternalIP", Address: netip.MustParseAddr("203.0.113.7")},
+			},
+			PodCIDRs: prefixes("10.244.3.0/24"),
 		},
 	}
 }
@@ -66,6 +76,56 @@ func TestEvaluate(t *testing.T) {
 			expr: `cidr("2001:db8::1/64").masked()`,
 			want: []string{"2001:db8::/64"},
 		},
+		{
+			name: "routed prefix",
+			expr: `routes["eth0"].filter(p, p.prefixLength() == 56)[0].subnet(64, 2)`,
+			want: []string{"2001:db8:ff00:2::/64"},
+		},
+		{
+			name: "unreachable route of a delegated prefix",
+			expr: `routes[""][0].subnet(64, 0)`,
+			want: []string{"2001:db8:eeee::/64"},
+		},
+		{
+			name: "spec pod CIDRs",
+			expr: `node.podCIDRs`,
+			want: []string{"10.244.3.0/24"},
+		},
+		{
+			name: "spec pod CIDRs mixed with other cidrs",
+			expr: `node.podCIDRs + [interfaces["eth0"].filter(p, p.ip().family() == 6)[0].subnet(80, 1)]`,
+			want: []string{"10.244.3.0/24", "2001:db8:abcd:1234:1::/80"},
+		},
+		{
+			name: "spec pod CIDR inside a list literal",
+			expr: `[node.podCIDRs[0], cidr("2001:db8:ffff::/64")]`,
+			want: []string{"10.244.3.0/24", "2001:db8:ffff::/64"},
+		},
+		{
+			name: "internal IP of the node",
+			expr: `cidr(string(node.addresses.filter(a, a.type == "InternalIP")[0].address) + "/24")`,
+			want: []string{"10.0.0.0/24"},
+		},
+		{
+			name: "subnet of a shared pool by hash of the node name",
+			expr: `cidr("10.96.0.0/16").subnet(24, hash(node.name) % 256)`,
+			want: []string{"10.96.195.0/24"},
+		},
+		{
+			name: "free subnets",
+			expr: `cidr("10.96.0.0/22").subnets(24).filter(p, !p.containsIP(ip("10.96.1.1")))`,
+			want: []string{"10.96.0.0/24", "10.96.2.0/24", "10.96.3.0/24"},
+		},
+		{
+			name: "next prefix",
+			expr: `node.podCIDRs[0].next()`,
+			want: []string{"10.244.4.0/24"},
+		},
+		{
+			name: "prefix from an offset address",
+			expr: `cidr(string(node.addresses[1].address.add(-7)) + "/24")`,
+			want: []string{"203.0.113.0/24"},
+		},
 		{
 			name: "unmasked result is masked by the evaluator",
 			expr: `interfaces["eth0"].filter(p, p.ip().family() == 6)[0]`,
@@ -143,6 +203,11 @@ func TestEvaluateRuntimeErrors(t *testing.T) {
 		{"shorter subnet than parent", `interfaces["eth0"].filter(p, p.ip().family()==6)[0].subnet(48, 0)`},
 		{"negative index", `interfaces["eth0"].filter(p, p.prefixLength() == 64)[0].subnet(80, -1)`},
 		{"missing interface", `interfaces["doesnotexist"][0]`},
+		{"too many subnets", `cidr("10.0.0.0/8").subnets(32)`},
+		{"no next prefix", `cidr("255.255.255.0/24").next()`},
+		{"address overflow", `cidr(string(ip("::").add(-1)) + "/128")`},
+		// Each call yields 65536 prefixes, which quickly exceeds the cost limit
+		{"cost limit", `cidr("2001:db8::/48").subnets(64).map(p, p.subnets(80)[0])`},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -192,3 +257,192 @@ func TestNthSubnet(t *testing.T) {
 		}
 	}
 }
+
+func TestHashString(t *testing.T) {
+	// The hash must be stable across releases, as it determines pod CIDRs
+	cases := map[string]int64{
+		"":       int64(0xcbf29ce484222325 & 0x7fffffffffffffff),
+		"node-1": hashString("node-1"),
+	}
+	for s, want := range cases {
+		if got := hashString(s); got != want || got < 0 {
+			t.Errorf("hashString(%q) = %d, want %d", s, got, want)
+		}
+	}
+	if hashString("node-1") == hashString("node-2") {
+		t.Errorf("hashString collision for node-1 and node-2")
+	}
+}
+
+func TestNextPrefix(t *testing.T) {
+	cases := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/24", "10.0.1.0/24", false},
+		{"10.0.0.5/24", "10.0.1.0/24", false}, // host bits are masked off
+		{"10.0.255.0/24", "10.1.0.0/24", false},
+		{"2001:db8::/64", "2001:db8:0:1::/64", false},
+		{"2001:db8:0:ffff::/64", "2001:db8:1::/64", false},
+		{"255.255.255.0/24", "", true},
+		{"0.0.0.0/0", "", true},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/128", "", true},
+	}
+	for _, tc := range cases {
+		got, err := nextPrefix(netip.MustParsePrefix(tc.prefix))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("nextPrefix(%s): expected error, got %s", tc.prefix, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nextPrefix(%s): unexpected error %v", tc.prefix, err)
+			continue
+		}
+		if got.String() != tc.want {
+			t.Errorf("nextPrefix(%s) = %s, want %s", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestAddToAddr(t *testing.T) {
+	cases := []struct {
+		addr    string
+		n       int64
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.1", 1, "10.0.0.2", false},
+		{"10.0.0.255", 1, "10.0.1.0", false},
+		{"10.0.1.0", -1, "10.0.0.255", false},
+		{"2001:db8::1", 0xffff, "2001:db8::1:0", false},
+		{"fe80::1%eth0", 1, "fe80::2", false},
+		{"255.255.255.255", 1, "", true},
+		{"0.0.0.0", -1, "", true},
+		{"::", -1, "", true},
+	}
+	for _, tc := range cases {
+		got, err := addToAddr(netip.MustParseAddr(tc.addr), tc.n)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("addToAddr(%s, %d): expected error, got %s", tc.addr, tc.n, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("addToAddr(%s, %d): unexpected error %v", tc.addr, tc.n, err)
+			continue
+		}
+		if got.String() != tc.want {
+			t.Errorf("addToAddr(%s, %d) = %s, want %s", tc.addr, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestAllSubnets(t *testing.T) {
+	cases := []struct {
+		parent  string
+		newLen  int
+		want    []string
+		wantErr bool
+	}{
+		{"10.0.0.0/24", 26, []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/26"}, false},
+		{"10.0.0.5/24", 24, []string{"10.0.0.0/24"}, false},
+		{"255.255.255.0/24", 25, []string{"255.255.255.0/25", "255.255.255.128/25"}, false}, // ends at the top of the address space
+		{"2001:db8::/63", 64, []string{"2001:db8::/64", "2001:db8:0:1::/64"}, false},
+		{"10.0.0.0/24", 20, nil, true},
+		{"10.0.0.0/24", 33, nil, true},
+		{"10.0.0.0/8", 25, nil, true}, // more than 65536 subnets
+	}
+	for _, tc := range cases {
+		got, err := allSubnets(netip.MustParsePrefix(tc.parent), tc.newLen)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("allSubnets(%s, %d): expected error, got %v", tc.parent, tc.newLen, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("allSubnets(%s, %d): unexpected error %v", tc.parent, tc.newLen, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("allSubnets(%s, %d) = %v, want %v", tc.parent, tc.newLen, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tc.want[i] {
+				t.Errorf("allSubnets(%s, %d)[%d] = %s, want %s", tc.parent, tc.newLen, i, got[i], tc.want[i])
+			}
+		}
+	}
+
+	if subnets, err := allSubnets(netip.MustParsePrefix("2001:db8::/48"), 64); err != nil || len(subnets) != 65536 {
+		t.Errorf("allSubnets(2001:db8::/48, 64): got %d subnets, err %v", len(subnets), err)
+	}
+}
+
+func TestFixture(t *testing.T) {
+	fixture, err := ParseFixture([]byte(`
+interfaces:
+  eth0: ["2001:db8:abcd:1234::5/64", "10.0.0.5/24"]
+routes:
+  "": ["2001:db8:ff00::/56"]
+node:
+  name: node-1
+  labels: {topology.kubernetes.io/zone: eu-central}
+  addresses: [{type: InternalIP, address: 10.0.0.5}]
+  podCIDRs: ["10.244.3.0/24"]
+expected: ["2001:db8:abcd:1234:1::/80"]
+`))
+	if err != nil {
+		t.Fatalf("ParseFixture: %v", err)
+	}
+
+	e, err := Compile(`[interfaces["eth0"][0].subnet(26, 1), node.podCIDRs[0], routes[""][0].subnet(64, node.addresses[0].address == ip("10.0.0.5") ? 0 : 1)]`)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	// Interfaces are sorted like on a node, IPv4 first
+	got, err := e.Evaluate(fixture.Inputs())
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	want := []string{"10.0.0.64/26", "10.244.3.0/24", "2001:db8:ff00::/64"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("element %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+	if len(fixture.Expected) != 1 || fixture.Expected[0].String() != "2001:db8:abcd:1234:1::/80" {
+		t.Errorf("expected: got %v", fixture.Expected)
+	}
+
+	// Recorded inputs parse back to the same fixture
+	data, err := NewFixture(fixture.Inputs()).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	parsed, err := ParseFixture(data)
+	if err != nil {
+		t.Fatalf("ParseFixture(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(parsed.Inputs(), fixture.Inputs()) {
+		t.Errorf("round trip: got %+v, want %+v", parsed.Inputs(), fixture.Inputs())
+	}
+
+	for _, invalid := range []string{
+		`interface: {eth0: ["10.0.0.5/24"]}`,
+		`interfaces: {eth0: ["10.0.0.5"]}`,
+		`node: {addresses: [{type: InternalIP, address: 10.0.0.0/24}]}`,
+	} {
+		if _, err := ParseFixture([]byte(invalid)); err == nil {
+			t.Errorf("ParseFixture(%q): expected error", invalid)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package celipam
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/tibordp/wigglenet/internal/util"
+	"sigs.k8s.io/yaml"
+)
+
+// Fixture is a recorded set of inputs, to evaluate an expression against
+// outside of a node. It is read from YAML or JSON:
+//
+//	interfaces:
+//	  eth0: ["2001:db8:abcd:1234::5/64", "10.0.0.5/24"]
+//	routes:
+//	  "": ["2001:db8:ff00::/56"]
+//	node:
+//	  name: node-1
+//	  labels: {topology.kubernetes.io/zone: eu-central}
+//	  addresses: [{type: InternalIP, address: 10.0.0.5}]
+//	expected: ["2001:db8:abcd:1234:1::/80"]
+//
+// Expected is optional, if set the result has to match it exactly.
+type Fixture struct {
+	Interfaces map[string][]netip.Prefix `json:"interfaces,omitempty"`
+	Routes     map[string][]netip.Prefix `json:"routes,omitempty"`
+	Node       FixtureNode               `json:"node,omitempty"`
+	Expected   []netip.Prefix            `json:"expected,omitempty"`
+}
+
+// FixtureNode is the node metadata of a fixture.
+type FixtureNode struct {
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Addresses   []FixtureAddress  `json:"addresses,omitempty"`
+	PodCIDRs    []netip.Prefix    `json:"podCIDRs,omitempty"`
+}
+
+type FixtureAddress struct {
+	Type    string     `json:"type"`
+	Address netip.Addr `json:"address"`
+}
+
+// ParseFixture parses a YAML or JSON fixture. Unknown fields are rejected, so
+// that a typo does not silently leave out an input.
+func ParseFixture(data []byte) (*Fixture, error) {
+	var fixture Fixture
+	if err := yaml.UnmarshalStrict(data, &fixture); err != nil {
+		return nil, fmt.Errorf("parsing fixture: %w", err)
+	}
+	return &fixture, nil
+}
+
+// Inputs returns the inputs of the fixture, sorted the same way as the inputs
+// gathered on a node, so that indexing into them gives the same results.
+func (f *Fixture) Inputs() Inputs {
+	addresses := make([]NodeAddress, 0, len(f.Node.Addresses))
+	for _, address := range f.Node.Addresses {
+		addresses = append(addresses, NodeAddress{Type: address.Type, Address: address.Address})
+	}
+
+	return Inputs{
+		Interfaces: sortedPrefixes(f.Interfaces),
+		Routes:     sortedPrefixes(f.Routes),
+		Node: NodeInfo{
+			Name:        f.Node.Name,
+			Labels:      f.Node.Labels,
+			Annotations: f.Node.Annotations,
+			Addresses:   addresses,
+			PodCIDRs:    f.Node.PodCIDRs,
+		},
+	}
+}
+
+// NewFixture records inputs (e.g. the ones gathered on a node) as a fixture.
+func NewFixture(inputs Inputs) *Fixture {
+	addresses := make([]FixtureAddress, 0, len(inputs.Node.Addresses))
+	for _, address := range inputs.Node.Addresses {
+		addresses = append(addresses, FixtureAddress{Type: address.Type, Address: address.Address})
+	}
+
+	return &Fixture{
+		Interfaces: inputs.Interfaces,
+		Routes:     inputs.Routes,
+		Node: FixtureNode{
+			Name:        inputs.Node.Name,
+			Labels:      inputs.Node.Labels,
+			Annotations: inputs.Node.Annotations,
+			Addresses:   addresses,
+			PodCIDRs:    inputs.Node.PodCIDRs,
+		},
+	}
+}
+
+// Marshal returns the fixture as YAML.
+func (f *Fixture) Marshal() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+func sortedPrefixes(prefixes map[string][]netip.Prefix) map[string][]netip.Prefix {
+	result := make(map[string][]netip.Prefix, len(prefixes))
+	for name, list := range prefixes {
+		sorted := slices.Clone(list)
+		util.SortPrefixes(sorted)
+		result[name] = sorted
+	}
+	return result
+}
@@ -0,0 +1,219 @@
+package celipam
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"net/netip"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	apiservercel "k8s.io/apiserver/pkg/cel"
+	"k8s.io/apiserver/pkg/cel/library"
+)
+
+// maxSubnetBits bounds the size of the list cidr.subnets() may return, so
+// that a single call cannot allocate more than the cost limit allows anyway.
+const maxSubnetBits = 16
+
+// libraryFunctions adds the functions on top of subnet():
+//
+//	cidr.subnets(prefixLength) -> list(cidr)  all the subnets of the given length
+//	cidr.next() -> cidr                       the prefix of the same length right after it
+//	ip.add(int) -> ip                         the address offset by n (which may be negative)
+//	hash(string) -> int                       a stable, non-negative 63-bit hash (FNV-1a)
+func libraryFunctions() cel.EnvOption {
+	return cel.Lib(functionLib{})
+}
+
+type functionLib struct{}
+
+func (functionLib) LibraryName() string {
+	return "wigglenet.celipam"
+}
+
+func (functionLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.Function("subnets",
+			cel.MemberOverload("cidr_subnets_int",
+				[]*cel.Type{apiservercel.CIDRType, cel.IntType},
+				cel.ListType(apiservercel.CIDRType),
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					cidr, ok := lhs.(apiservercel.CIDR)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(lhs)
+					}
+					newLen, ok := rhs.(types.Int)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(rhs)
+					}
+					subnets, err := allSubnets(cidr.Prefix, int(newLen))
+					if err != nil {
+						return types.NewErr("subnets: %v", err)
+					}
+					vals := make([]ref.Val, 0, len(subnets))
+					for _, subnet := range subnets {
+						vals = append(vals, apiservercel.CIDR{Prefix: subnet})
+					}
+					return types.NewRefValList(types.DefaultTypeAdapter, vals)
+				}),
+			),
+		),
+		cel.Function("next",
+			cel.MemberOverload("cidr_next",
+				[]*cel.Type{apiservercel.CIDRType},
+				apiservercel.CIDRType,
+				cel.UnaryBinding(func(arg ref.Val) ref.Val {
+					cidr, ok := arg.(apiservercel.CIDR)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(arg)
+					}
+					next, err := nextPrefix(cidr.Prefix)
+					if err != nil {
+						return types.NewErr("next: %v", err)
+					}
+					return apiservercel.CIDR{Prefix: next}
+				}),
+			),
+		),
+		cel.Function("add",
+			cel.MemberOverload("ip_add_int",
+				[]*cel.Type{apiservercel.IPType, cel.IntType},
+				apiservercel.IPType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					ip, ok := lhs.(apiservercel.IP)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(lhs)
+					}
+					n, ok := rhs.(types.Int)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(rhs)
+					}
+					addr, err := addToAddr(ip.Addr, int64(n))
+					if err != nil {
+						return types.NewErr("add: %v", err)
+					}
+					return apiservercel.IP{Addr: addr}
+				}),
+			),
+		),
+		cel.Function("hash",
+			cel.Overload("hash_string",
+				[]*cel.Type{cel.StringType},
+				cel.IntType,
+				cel.UnaryBinding(func(arg ref.Val) ref.Val {
+					s, ok := arg.(types.String)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(arg)
+					}
+					return types.Int(hashString(string(s)))
+				}),
+			),
+		),
+	}
+}
+
+func (functionLib) ProgramOptions() []cel.ProgramOption {
+	return nil
+}
+
+// costEstimator charges the functions that do more than constant work by the
+// size of their input or output, and defers to the Kubernetes library for the
+// IP/CIDR functions.
+type costEstimator struct {
+	library.CostEstimator
+}
+
+func (e *costEstimator) CallCost(function, overloadID string, args []ref.Val, result ref.Val) *uint64 {
+	switch overloadID {
+	case "cidr_subnets_int":
+		cost := uint64(1)
+		if list, ok := result.(traits.Lister); ok {
+			if size, ok := list.Size().(types.Int); ok {
+				cost += uint64(size)
+			}
+		}
+		return &cost
+	case "hash_string":
+		// Same as the other string functions, 0.1 per character
+		cost := uint64(1)
+		if len(args) == 1 {
+			if s, ok := args[0].(types.String); ok {
+				cost += uint64(len(s)) / 10
+			}
+		}
+		return &cost
+	case "cidr_next", "ip_add_int":
+		cost := uint64(1)
+		return &cost
+	}
+	return e.CostEstimator.CallCost(function, overloadID, args, result)
+}
+
+func hashString(s string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return int64(h.Sum64() & math.MaxInt64)
+}
+
+func addrToInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+// intToAddr converts n back to an address of the same family as addr, it
+// fails if n does not fit.
+func intToAddr(n *big.Int, addr netip.Addr) (netip.Addr, error) {
+	if n.Sign() < 0 || n.BitLen() > addr.BitLen() {
+		return netip.Addr{}, fmt.Errorf("result out of range of the address family")
+	}
+	out := make([]byte, addr.BitLen()/8)
+	n.FillBytes(out)
+	result, _ := netip.AddrFromSlice(out)
+	return result, nil
+}
+
+// addToAddr returns addr offset by n.
+func addToAddr(addr netip.Addr, n int64) (netip.Addr, error) {
+	return intToAddr(new(big.Int).Add(addrToInt(addr.WithZone("")), big.NewInt(n)), addr)
+}
+
+// nextPrefix returns the prefix of the same length right after p (after
+// masking it to its network address).
+func nextPrefix(p netip.Prefix) (netip.Prefix, error) {
+	p = p.Masked()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(p.Addr().BitLen()-p.Bits()))
+	addr, err := intToAddr(new(big.Int).Add(addrToInt(p.Addr()), size), p.Addr())
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("no prefix after %s", p)
+	}
+	return netip.PrefixFrom(addr, p.Bits()), nil
+}
+
+// allSubnets returns all the subnets of length newLen carved from p, in order.
+func allSubnets(p netip.Prefix, newLen int) ([]netip.Prefix, error) {
+	p = p.Masked()
+	if newLen < p.Bits() || newLen > p.Addr().BitLen() {
+		return nil, fmt.Errorf("subnet length /%d out of range for /%d prefix", newLen, p.Bits())
+	}
+	if newLen-p.Bits() > maxSubnetBits {
+		return nil, fmt.Errorf("/%d has more than %d subnets of /%d", p.Bits(), 1<<maxSubnetBits, newLen)
+	}
+
+	count := 1 << (newLen - p.Bits())
+	subnets := make([]netip.Prefix, 0, count)
+	subnet := netip.PrefixFrom(p.Addr(), newLen)
+	for i := 0; i < count; i++ {
+		subnets = append(subnets, subnet)
+		if i < count-1 {
+			next, err := nextPrefix(subnet)
+			if err != nil {
+				return nil, err
+			}
+			subnet = next
+		}
+	}
+	return subnets, nil
+}
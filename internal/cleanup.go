@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tibordp/wigglenet/internal/allocator"
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/controller"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/ipam"
+	"github.com/tibordp/wigglenet/internal/routing"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+)
+
+// Cleanup removes everything Wigglenet has set up on the node: the CNI
+// configuration, the IPAM state, the firewall rules, the routes, the WireGuard
+// interface and keys and, unless clientset is nil, the node annotations. It
+// carries on after a failure, so that as much as possible is removed, and
+// returns all the errors.
+func Cleanup(ctx context.Context, cfg *config.Config, clientset kubernetes.Interface) error {
+	logger := klog.FromContext(ctx)
+	errs := make([]error, 0)
+
+	// The CNI configuration goes first, so that no more pods are set up
+	errs = append(errs, cni.Cleanup(ctx, cfg))
+	errs = append(errs, ipam.Cleanup(ctx, cfg))
+	errs = append(errs, firewall.Cleanup(ctx, cfg))
+	errs = append(errs, routing.Cleanup(ctx))
+	errs = append(errs, wireguard.Cleanup(ctx, cfg))
+
+	if clientset != nil {
+		errs = append(errs, cleanupNode(ctx, cfg, clientset))
+	} else {
+		logger.Info("leaving the node annotations in place")
+	}
+
+	return errors.Join(errs...)
+}
+
+func cleanupNode(ctx context.Context, cfg *config.Config, clientset kubernetes.Interface) error {
+	var podCIDRAllocator allocator.Allocator
+	if cfg.PodCIDR.Uses(config.SourceAllocator) {
+		var err error
+		if podCIDRAllocator, err = allocator.NewAllocator(clientset, cfg); err != nil {
+			return err
+		}
+	}
+	return controller.CleanupNode(ctx, cfg, clientset.CoreV1().Nodes(), podCIDRAllocator)
+}
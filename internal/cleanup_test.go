@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/controller"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/health"
+	"github.com/tibordp/wigglenet/internal/ipam"
+	"github.com/tibordp/wigglenet/internal/routing"
+	"github.com/tibordp/wigglenet/internal/util/netnstest"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	klog "k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+)
+
+// addUnderlay adds an interface with the address, standing in for the node's
+// uplink.
+func addUnderlay(t *testing.T, name string, address string) {
+	t.Helper()
+
+	// A veth pair rather than a dummy interface, as it is available wherever
+	// containers are
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}
+	require.NoError(t, netlink.LinkAdd(link))
+	addr, err := netlink.ParseAddr(address)
+	require.NoError(t, err)
+	require.NoError(t, netlink.AddrAdd(link, addr))
+	require.NoError(t, netlink.LinkSetUp(link))
+
+	peer, err := netlink.LinkByName(link.PeerName)
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetUp(peer))
+}
+
+func testCleanupConfig(t *testing.T) *config.Config {
+	dir := t.TempDir()
+
+	cfg := config.Default()
+	cfg.NodeName = "test-node"
+	cfg.PodCIDR.SourceIPv4 = config.SourceNone
+	cfg.PodCIDR.SourceIPv6 = config.SourceNone
+	cfg.Routing.NodeIPInterfaces = ""
+	cfg.CNI.ConfigPath = filepath.Join(dir, "10-wigglenet.conflist")
+	cfg.CNI.IPAMStatePath = filepath.Join(dir, "ipam.json")
+	cfg.CNI.IPAMSocketPath = filepath.Join(dir, "ipam.sock")
+	cfg.WireGuard.PrivateKeyPath = filepath.Join(dir, "private.key")
+	cfg.WireGuard.HostEncryption = true
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = true
+	return cfg
+}
+
+// firewallBackendUnavailable returns why the firewall backend cannot be used, or
+// an empty string if it can.
+func firewallBackendUnavailable(backend config.FirewallBackend) string {
+	command := "nft"
+	if backend == config.BackendIptables {
+		command = "iptables-save"
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Sprintf("%s is not available", command)
+	}
+	return ""
+}
+
+// commandInNetns runs the command in the network namespace and returns its
+// output.
+func commandInNetns(ns netns.NsHandle, name string, args ...string) (string, error) {
+	var out []byte
+	var err error
+	<-netnstest.Go(ns, func() {
+		out, err = exec.Command(name, args...).CombinedOutput()
+	})
+	return string(out), err
+}
+
+func TestCleanup(t *testing.T) {
+	ns := netnstest.Enter(t)
+	_, ctx := ktesting.NewTestContext(t)
+	addUnderlay(t, "eth0", "192.0.2.1/24")
+
+	cfg := testCleanupConfig(t)
+	podCIDRs := []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}
+
+	// Node annotations, all of Wigglenet's and some that are not
+	annotations := map[string]string{
+		"unrelated/keep":              "keep-me",
+		annotation.EndpointAnnotation: "192.0.2.1:51820",
+	}
+	for _, key := range controller.OwnedAnnotations {
+		annotations[key] = "value"
+	}
+	clientset := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: cfg.NodeName, Annotations: annotations}})
+
+	// CNI configuration and IPAM state
+	require.NoError(t, cni.NewCNIConfigWriter(cfg).WriteCNIConfig(ctx, cni.CNIConfig{PodCIDRs: podCIDRs}, klog.FromContext(ctx)))
+	ipamManager, err := ipam.NewManager(clientset, cfg, nil)
+	require.NoError(t, err)
+	_, err = ipamManager.Allocate(ctx, ipam.AllocateRequest{ContainerID: "container", IfName: "eth0", Ranges: podCIDRs})
+	require.NoError(t, err)
+
+	// Native routes
+	require.NoError(t, routing.NewManager().ApplyRoutes(ctx, []routing.Route{
+		{Dst: netip.MustParsePrefix("10.0.2.0/24"), Gateway: netip.MustParseAddr("192.0.2.2")},
+	}, klog.FromContext(ctx)))
+
+	// WireGuard keys and host encryption routing rules, the interface itself
+	// is covered by TestCleanupWireguard
+	for _, path := range []string{cfg.WireGuard.PrivateKeyPath, cfg.WireGuard.PrivateKeyPath + ".next"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte(key.String()), 0o600))
+	}
+	for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Table = cfg.WireGuard.RouteTable
+		rule.Mark = uint32(cfg.WireGuard.Fwmark)
+		rule.Invert = true
+		require.NoError(t, netlink.RuleAdd(rule))
+	}
+	require.Len(t, hostRoutingRules(t, cfg), 2)
+
+	// Firewall rules of both backends, as far as they are available
+	backends := []config.FirewallBackend{config.BackendNftables, config.BackendIptables}
+	for _, backend := range backends {
+		t.Run("install "+string(backend), func(t *testing.T) {
+			if reason := firewallBackendUnavailable(backend); reason != "" {
+				t.Skip(reason)
+			}
+
+			backendCfg := *cfg
+			backendCfg.Firewall.Backend = backend
+			podCIDRUpdates := make(chan []netip.Prefix)
+			firewallManager, err := firewall.New(&backendCfg, health.NewChecker(0), podCIDRUpdates, make(chan []firewall.NetworkPolicyRule), nil)
+			require.NoError(t, err)
+
+			runCtx, cancel := context.WithCancel(ctx)
+			done := netnstest.Go(ns, func() { firewallManager.Run(runCtx) })
+			podCIDRUpdates <- podCIDRs
+			require.Eventually(t, func() bool {
+				applied := firewallManager.AppliedConfig()
+				return applied != nil && len(applied.PodCIDRs) > 0
+			}, 10*time.Second, 10*time.Millisecond)
+			cancel()
+			<-done
+		})
+	}
+
+	require.NoError(t, Cleanup(ctx, cfg, clientset))
+
+	// Nothing is left behind
+	for _, path := range []string{cfg.CNI.ConfigPath, cfg.CNI.IPAMStatePath, cfg.WireGuard.PrivateKeyPath, cfg.WireGuard.PrivateKeyPath + ".next"} {
+		assert.NoFileExists(t, path)
+	}
+
+	assert.Empty(t, hostRoutingRules(t, cfg))
+
+	routes, err := netlink.RouteListFiltered(nl.FAMILY_ALL, &netlink.Route{Protocol: routing.RouteProtocol}, netlink.RT_FILTER_PROTOCOL)
+	require.NoError(t, err)
+	assert.Empty(t, routes)
+
+	node, err := clientset.CoreV1().Nodes().Get(ctx, cfg.NodeName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"unrelated/keep":              "keep-me",
+		annotation.EndpointAnnotation: "192.0.2.1:51820",
+	}, node.Annotations)
+
+	for _, backend := range backends {
+		t.Run("removed "+string(backend), func(t *testing.T) {
+			if reason := firewallBackendUnavailable(backend); reason != "" {
+				t.Skip(reason)
+			}
+
+			switch backend {
+			case config.BackendNftables:
+				out, err := commandInNetns(ns, "nft", "list", "tables")
+				require.NoError(t, err, out)
+				assert.NotContains(t, out, "wigglenet")
+			case config.BackendIptables:
+				for _, command := range []string{"iptables-save", "ip6tables-save"} {
+					out, err := commandInNetns(ns, command)
+					require.NoError(t, err, out)
+					assert.NotContains(t, out, "WIGGLENET")
+				}
+			}
+		})
+	}
+
+	// Running it again is fine
+	require.NoError(t, Cleanup(ctx, cfg, clientset))
+}
+
+func TestCleanupWireguard(t *testing.T) {
+	netnstest.Enter(t)
+	_, ctx := ktesting.NewTestContext(t)
+	addUnderlay(t, "eth0", "192.0.2.1/24")
+
+	cfg := testCleanupConfig(t)
+	probe := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: cfg.WireGuard.InterfaceName}}
+	if err := netlink.LinkAdd(probe); err != nil {
+		t.Skipf("WireGuard is not supported by the kernel: %v", err)
+	}
+	require.NoError(t, netlink.LinkDel(probe))
+
+	// WireGuard interface, routes and routing rules
+	wg, err := wireguard.NewManager(ctx, cfg)
+	require.NoError(t, err)
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgConfig := wireguard.NewConfig(
+		[]netip.Addr{netip.MustParseAddr("10.0.1.1")},
+		[]netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		[]wireguard.Peer{{
+			Endpoint:  netip.MustParseAddr("192.0.2.3"),
+			NodeCIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.3/32")},
+			PodCIDRs:  []netip.Prefix{netip.MustParsePrefix("10.0.3.0/24")},
+			PublicKey: peerKey.PublicKey(),
+		}},
+	)
+	require.NoError(t, wg.ApplyConfiguration(ctx, &wgConfig, klog.FromContext(ctx)))
+	require.NoError(t, wg.StageKey(ctx))
+	require.NotEmpty(t, hostRoutingRules(t, cfg))
+
+	require.NoError(t, wireguard.Cleanup(ctx, cfg))
+
+	_, err = netlink.LinkByName(cfg.WireGuard.InterfaceName)
+	assert.IsType(t, netlink.LinkNotFoundError{}, err)
+	assert.Empty(t, hostRoutingRules(t, cfg))
+	assert.NoFileExists(t, cfg.WireGuard.PrivateKeyPath)
+	assert.NoFileExists(t, cfg.WireGuard.PrivateKeyPath+".next")
+}
+
+func TestCleanupRoutes(t *testing.T) {
+	netnstest.Enter(t)
+	_, ctx := ktesting.NewTestContext(t)
+	addUnderlay(t, "eth0", "192.0.2.1/24")
+
+	require.NoError(t, routing.NewManager().ApplyRoutes(ctx, []routing.Route{
+		{Dst: netip.MustParsePrefix("10.0.2.0/24"), Gateway: netip.MustParseAddr("192.0.2.2")},
+		{Dst: netip.MustParsePrefix("10.0.3.0/24"), Gateway: netip.MustParseAddr("192.0.2.3")},
+	}, klog.FromContext(ctx)))
+
+	// Not installed by Wigglenet
+	other := &netlink.Route{
+		Dst: &net.IPNet{IP: net.ParseIP("10.0.4.0"), Mask: net.CIDRMask(24, 32)},
+		Gw:  net.ParseIP("192.0.2.4"),
+	}
+	require.NoError(t, netlink.RouteAdd(other))
+
+	require.NoError(t, routing.Cleanup(ctx))
+
+	routes, err := netlink.RouteListFiltered(nl.FAMILY_ALL, &netlink.Route{Protocol: routing.RouteProtocol}, netlink.RT_FILTER_PROTOCOL)
+	require.NoError(t, err)
+	assert.Empty(t, routes)
+
+	routes, err = netlink.RouteListFiltered(nl.FAMILY_V4, &netlink.Route{Dst: other.Dst}, netlink.RT_FILTER_DST)
+	require.NoError(t, err)
+	assert.Len(t, routes, 1)
+}
+
+func TestCleanupForeignInterface(t *testing.T) {
+	netnstest.Enter(t)
+	_, ctx := ktesting.NewTestContext(t)
+
+	// An interface of the same name that is not ours is left alone
+	cfg := testCleanupConfig(t)
+	addUnderlay(t, cfg.WireGuard.InterfaceName, "192.0.2.1/24")
+
+	require.NoError(t, os.WriteFile(cfg.WireGuard.PrivateKeyPath, []byte("key"), 0o600))
+
+	assert.ErrorContains(t, wireguard.Cleanup(ctx, cfg), "is not of wireguard type")
+	_, err := netlink.LinkByName(cfg.WireGuard.InterfaceName)
+	assert.NoError(t, err)
+	// The rest is removed regardless
+	assert.NoFileExists(t, cfg.WireGuard.PrivateKeyPath)
+}
+
+func TestCleanupFiles(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cfg := testCleanupConfig(t)
+
+	podCIDRs := []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}
+	require.NoError(t, cni.NewCNIConfigWriter(cfg).WriteCNIConfig(ctx, cni.CNIConfig{PodCIDRs: podCIDRs}, klog.FromContext(ctx)))
+	ipamManager, err := ipam.NewManager(fake.NewSimpleClientset(), cfg, nil)
+	require.NoError(t, err)
+	_, err = ipamManager.Allocate(ctx, ipam.AllocateRequest{ContainerID: "container", IfName: "eth0", Ranges: podCIDRs})
+	require.NoError(t, err)
+	require.FileExists(t, cfg.CNI.ConfigPath)
+	require.FileExists(t, cfg.CNI.IPAMStatePath)
+
+	require.NoError(t, cni.Cleanup(ctx, cfg))
+	require.NoError(t, ipam.Cleanup(ctx, cfg))
+	assert.NoFileExists(t, cfg.CNI.ConfigPath)
+	assert.NoFileExists(t, cfg.CNI.IPAMStatePath)
+
+	// Nothing to remove
+	require.NoError(t, cni.Cleanup(ctx, cfg))
+	require.NoError(t, ipam.Cleanup(ctx, cfg))
+}
+
+func hostRoutingRules(t *testing.T, cfg *config.Config) []netlink.Rule {
+	t.Helper()
+	rules, err := netlink.RuleListFiltered(nl.FAMILY_ALL, &netlink.Rule{Table: cfg.WireGuard.RouteTable}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	return rules
+}
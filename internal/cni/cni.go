@@ -3,10 +3,14 @@ package cni
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 
 	cniTypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/tibordp/wigglenet/internal/config"
@@ -14,8 +18,14 @@ import (
 	"k8s.io/klog/v2"
 )
 
+const (
+	NetworkName = "wigglenet"
+	// Where the host-local IPAM plugin keeps its allocations
+	HostLocalDataDir = "/run/cni-ipam-state"
+)
+
 type CNIConfig struct {
-	PodCIDRs []netip.Prefix
+	PodCIDRs []netip.Prefix `json:"podCIDRs"`
 }
 
 // NetConfList is a CNI chaining configuration
@@ -44,7 +54,8 @@ type NetConfList struct {
 type IPAMConfig struct {
 	Type       string            `json:"type"`
 	Routes     []*cniTypes.Route `json:"routes"`
-	DataDir    string            `json:"dataDir"`
+	DataDir    string            `json:"dataDir,omitempty"`
+	SocketPath string            `json:"socketPath,omitempty"`
 	ResolvConf string            `json:"resolvConf"`
 	Ranges     []RangeSet        `json:"ranges"`
 }
@@ -60,30 +71,47 @@ type Range struct {
 
 type CNIConfigWriter interface {
 	WriteCNIConfig(ctx context.Context, inputs CNIConfig, logger klog.Logger) error
+	// LastConfig returns the last successfully written configuration, or nil.
+	LastConfig() *CNIConfig
 }
 
 type cniConfigWriter struct {
+	config     *config.Config
+	mu         sync.Mutex
 	lastConfig CNIConfig
+	written    bool
 }
 
-func NewCNIConfigWriter() CNIConfigWriter {
-	return &cniConfigWriter{}
+func NewCNIConfigWriter(cfg *config.Config) CNIConfigWriter {
+	return &cniConfigWriter{config: cfg}
+}
+
+func (c *cniConfigWriter) LastConfig() *CNIConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.written {
+		return nil
+	}
+	lastConfig := c.lastConfig
+	return &lastConfig
 }
 
 // WriteCNIConfig writes the
 func (c *cniConfigWriter) WriteCNIConfig(ctx context.Context, inputs CNIConfig, logger klog.Logger) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if reflect.DeepEqual(inputs, c.lastConfig) {
 		return nil
 	}
 
 	logger.Info("applying new CNI configuration", "config", inputs)
 
-	f, err := os.Create(config.CniConfigPath + ".temp")
+	f, err := os.Create(c.config.CNI.ConfigPath + ".temp")
 	if err != nil {
 		return err
 	}
 
-	if err := writeCNIConfig(f, inputs); err != nil {
+	if err := writeCNIConfig(f, c.config, inputs); err != nil {
 		f.Close()
 		os.Remove(f.Name())
 		return err
@@ -96,15 +124,54 @@ func (c *cniConfigWriter) WriteCNIConfig(ctx context.Context, inputs CNIConfig,
 		return err
 	}
 
-	if err := os.Rename(f.Name(), config.CniConfigPath); err != nil {
+	if err := os.Rename(f.Name(), c.config.CNI.ConfigPath); err != nil {
 		return err
 	}
 
 	c.lastConfig = inputs
+	c.written = true
 	return nil
 }
 
-func writeCNIConfig(w io.Writer, data CNIConfig) error {
+// Cleanup removes the CNI configuration, together with a temporary file left
+// behind by an interrupted write.
+func Cleanup(ctx context.Context, cfg *config.Config) error {
+	return util.RemoveFiles(klog.FromContext(ctx), cfg.CNI.ConfigPath, cfg.CNI.ConfigPath+".temp")
+}
+
+// HostLocalAllocations returns the addresses the host-local IPAM plugin has
+// allocated, with the IDs of the containers they were allocated to. The plugin
+// keeps a file named after each address in the directory of the network.
+func HostLocalAllocations(dataDir string) (map[netip.Addr]string, error) {
+	dir := filepath.Join(dataDir, NetworkName)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	allocations := make(map[netip.Addr]string)
+	for _, entry := range entries {
+		// Also holds the lock and the last reserved addresses
+		addr, err := netip.ParseAddr(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			// Released in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		containerID, _, _ := strings.Cut(string(data), "\n")
+		allocations[addr] = strings.TrimSpace(containerID)
+	}
+	return allocations, nil
+}
+
+func writeCNIConfig(w io.Writer, cfg *config.Config, data CNIConfig) error {
 	routes := make([]*cniTypes.Route, 0)
 	for _, route := range util.GetDefaultRoutes(data.PodCIDRs) {
 		ipnet := util.PrefixToIPNet(route)
@@ -113,28 +180,42 @@ func writeCNIConfig(w io.Writer, data CNIConfig) error {
 		})
 	}
 
+	// One range set per address family, so that pods get a single address of
+	// each family even if the node has several pod CIDRs of it. The first pod
+	// CIDR's family comes first, as it determines the pod's primary IP.
 	ranges := make([]RangeSet, 0)
+	families := make(map[bool]int)
 	for _, cidr := range data.PodCIDRs {
 		ipnet := util.PrefixToIPNet(cidr)
-		ranges = append(ranges, RangeSet{
-			Range{
-				Subnet: cniTypes.IPNet(ipnet),
-			},
-		})
+		r := Range{
+			Subnet: cniTypes.IPNet(ipnet),
+		}
+		if index, ok := families[cidr.Addr().Is6()]; ok {
+			ranges[index] = append(ranges[index], r)
+		} else {
+			families[cidr.Addr().Is6()] = len(ranges)
+			ranges = append(ranges, RangeSet{r})
+		}
+	}
+
+	ipam := IPAMConfig{
+		Type:   string(cfg.CNI.IPAMPlugin),
+		Routes: routes,
+		Ranges: ranges,
+	}
+	if cfg.CNI.IPAMPlugin == config.IPAMHostLocal {
+		ipam.DataDir = HostLocalDataDir
+	} else {
+		ipam.SocketPath = cfg.CNI.IPAMSocketPath
 	}
 
 	cniConfig := NetConfList{
 		CNIVersion: "0.3.1",
-		Name:       "wigglenet",
+		Name:       NetworkName,
 		Plugins: []interface{}{
 			&PtpNetConf{
 				Type: "ptp",
-				IPAM: IPAMConfig{
-					Type:    "host-local",
-					DataDir: "/run/cni-ipam-state",
-					Routes:  routes,
-					Ranges:  ranges,
-				},
+				IPAM: ipam,
 			},
 			&PortMapNetConf{
 				Type: "portmap",
@@ -1,8 +1,9 @@
 package config
 
 import (
-	"os"
-	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type PodCIDRSource string
@@ -12,6 +13,7 @@ const (
 	SourceSpec       PodCIDRSource = "spec"
 	SourceFile       PodCIDRSource = "file"
 	SourceExpression PodCIDRSource = "expression"
+	SourceAllocator  PodCIDRSource = "allocator"
 )
 
 type FirewallBackend string
@@ -21,6 +23,21 @@ const (
 	BackendIptables FirewallBackend = "iptables"
 )
 
+type MixedRoutingMode string
+
+const (
+	MixedRoutingNone   MixedRoutingMode = "none"
+	MixedRoutingSubnet MixedRoutingMode = "subnet"
+	MixedRoutingLabel  MixedRoutingMode = "label"
+)
+
+type IPAMPluginType string
+
+const (
+	IPAMWigglenet IPAMPluginType = "wigglenet-ipam"
+	IPAMHostLocal IPAMPluginType = "host-local"
+)
+
 type IPFamily string
 
 const (
@@ -29,93 +46,278 @@ const (
 	DualStackFamily IPFamily = "dualstack"
 )
 
-var (
-	CurrentNodeName string = os.Getenv("NODE_NAME")
+const (
+	APIVersion = "wigglenet.io/v1alpha1"
+	Kind       = "Configuration"
+)
+
+// Config is the configuration of Wigglenet. It is read from a versioned
+// YAML or JSON file (usually mounted from a ConfigMap), each setting can be
+// overridden by the environment variable in its env tag. The settings tagged
+// with reload:"live" can be changed without restarting, see Reload.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
 
-	// Wireguard network settings
-	WGLinkName         string = GetEnvOrDefault("WIGGLENET_IFACE_NAME", "wigglenet")
-	WGPort             int    = GetEnvOrDefaultInt("WIGGLENET_WG_PORT", 24601)
-	PrivateKeyFilename string = GetEnvOrDefault("WIGGLENET_PRIVKEY_PATH", "/etc/wigglenet/private.key")
+	// The local node and the namespace of the Wigglenet pods, these come from
+	// the downward API and can only be set through the environment
+	NodeName     string `json:"-" env:"NODE_NAME"`
+	PodNamespace string `json:"-" env:"POD_NAMESPACE"`
+
+	WireGuard     WireGuard     `json:"wireguard"`
+	Routing       Routing       `json:"routing"`
+	BGP           BGP           `json:"bgp"`
+	PodCIDR       PodCIDR       `json:"podCIDR"`
+	CNI           CNI           `json:"cni"`
+	Firewall      Firewall      `json:"firewall"`
+	NetworkPolicy NetworkPolicy `json:"networkPolicy"`
+	Metrics       Metrics       `json:"metrics"`
+	Health        Health        `json:"health"`
+}
+
+type WireGuard struct {
+	InterfaceName  string `json:"interfaceName" env:"WIGGLENET_IFACE_NAME"`
+	Port           int    `json:"port" env:"WIGGLENET_WG_PORT"`
+	PrivateKeyPath string `json:"privateKeyPath" env:"WIGGLENET_PRIVKEY_PATH"`
 
 	// Which IP family to use for the tunnel (relevant for dual-stack clusters)
-	WireguardIPFamily IPFamily = IPFamily(GetEnvOrDefault("WG_IP_FAMILY", "dualstack"))
+	IPFamily IPFamily `json:"ipFamily" env:"WG_IP_FAMILY" reload:"live"`
 
-	// CNI settings
-	CniConfigPath string = GetEnvOrDefault("CNI_CONFIG_PATH", "/etc/cni/net.d/10-wigglenet.conflist")
+	// WireGuard key rotation. A new key is published as the node's next key for
+	// the grace period before it is used, so that peers can prepare for it. An
+	// interval of 0 disables time-based rotation, rotation can still be
+	// requested with the wigglenet/rotate-key node annotation.
+	KeyRotationInterval    metav1.Duration `json:"keyRotationInterval" env:"WG_KEY_ROTATION_INTERVAL" reload:"live"`
+	KeyRotationGracePeriod metav1.Duration `json:"keyRotationGracePeriod" env:"WG_KEY_ROTATION_GRACE_PERIOD" reload:"live"`
 
-	// Firewall settings
-	MasqueradeIPv4 bool = GetEnvOrDefaultBool("MASQUERADE_IPV4", true)
-	FilterIPv4     bool = GetEnvOrDefaultBool("FILTER_IPV4", false)
-	MasqueradeIPv6 bool = GetEnvOrDefaultBool("MASQUERADE_IPV6", true)
-	FilterIPv6     bool = GetEnvOrDefaultBool("FILTER_IPV6", false)
+	// File with a cluster-wide secret (e.g. mounted from a Secret). If set, a
+	// preshared key is derived from it for each pair of nodes.
+	PresharedKeySecretPath string `json:"presharedKeySecretPath" env:"WG_PRESHARED_KEY_SECRET_PATH"`
 
+	// Route traffic to the other nodes' addresses through the tunnel, so that
+	// host-to-host traffic is encrypted too. The WireGuard device marks its own
+	// packets with Fwmark, all other traffic looks up RouteTable first.
+	HostEncryption bool `json:"hostEncryption" env:"ENABLE_HOST_ENCRYPTION"`
+	Fwmark         int  `json:"fwmark" env:"WG_FWMARK"`
+	RouteTable     int  `json:"routeTable" env:"WG_ROUTE_TABLE"`
+
+	// The node is behind NAT and cannot be reached at its own addresses. It keeps
+	// its NAT mappings open with keepalives and learns its public endpoint from
+	// the other nodes.
+	BehindNAT bool `json:"behindNAT" env:"BEHIND_NAT"`
+
+	// Move a peer to its next endpoint candidate if there was no handshake with
+	// it for this long. 0 disables endpoint failover.
+	EndpointFailoverTimeout metav1.Duration `json:"endpointFailoverTimeout" env:"WG_ENDPOINT_FAILOVER_TIMEOUT" reload:"live"`
+}
+
+type Routing struct {
 	// Auto detection of node IP. Take addresses from these comma-separated to be used as node's IP
 	// addresses. This option is mainly to work around limitations of kubelet and many cloud controllers
 	// that only set a single IP for dual-stack nodes.
-	NodeIPInterfaces string = GetEnvOrDefault("NODE_IP_INTERFACES", "")
+	NodeIPInterfaces string `json:"nodeIPInterfaces" env:"NODE_IP_INTERFACES"`
 
 	// Do not install Wireguard and CNI configuration, instead only install firewall rules
-	FirewallOnly bool = GetEnvOrDefaultBool("FIREWALL_ONLY", false)
+	FirewallOnly bool `json:"firewallOnly" env:"FIREWALL_ONLY"`
 
 	// Native routing. Wireguard tunnel will not be used for the specified address families
-	NativeRoutingIPv6 bool = GetEnvOrDefaultBool("NATIVE_ROUTING_IPV6", false)
-	NativeRoutingIPv4 bool = GetEnvOrDefaultBool("NATIVE_ROUTING_IPV4", false)
+	NativeRoutingIPv4 bool `json:"nativeRoutingIPv4" env:"NATIVE_ROUTING_IPV4"`
+	NativeRoutingIPv6 bool `json:"nativeRoutingIPv6" env:"NATIVE_ROUTING_IPV6"`
+
+	// Install direct routes to other nodes' pod CIDRs via their node addresses for
+	// the natively routed address families, rather than relying on something
+	// outside of the cluster to route them. Requires the nodes to be on-link.
+	NativeRoutingDirectRoutes bool `json:"nativeRoutingDirectRoutes" env:"NATIVE_ROUTING_DIRECT_ROUTES" reload:"live"`
 
-	NativeRouting = NativeRoutingIPv4 && NativeRoutingIPv6 // Completely disable Wireguard functionality if both are set
+	// Mixed routing. Pod traffic to peers in the same routing domain is routed
+	// natively over the underlay, and through the Wireguard tunnel otherwise.
+	// With "subnet", peers whose node addresses are on-link share the domain,
+	// with "label", peers with the same value of the MixedRoutingLabel label.
+	MixedRouting      MixedRoutingMode `json:"mixedRouting" env:"MIXED_ROUTING" reload:"live"`
+	MixedRoutingLabel string           `json:"mixedRoutingLabel" env:"MIXED_ROUTING_LABEL" reload:"live"`
+}
+
+// NativeRouting reports whether Wireguard is disabled completely, because both
+// address families are routed natively.
+func (r Routing) NativeRouting() bool {
+	return r.NativeRoutingIPv4 && r.NativeRoutingIPv6
+}
 
+// BGP advertisement of the local pod CIDRs to upstream routers. Enabled if
+// Peers (comma-separated <address>[:<port>]=<asn>) is set. The router ID
+// defaults to the local IPv4 address of each session.
+type BGP struct {
+	Peers       string          `json:"peers" env:"BGP_PEERS"`
+	LocalASN    int64           `json:"localASN" env:"BGP_LOCAL_ASN"`
+	RouterID    string          `json:"routerID" env:"BGP_ROUTER_ID"`
+	Communities string          `json:"communities" env:"BGP_COMMUNITIES"`
+	HoldTime    metav1.Duration `json:"holdTime" env:"BGP_HOLD_TIME"`
+}
+
+type PodCIDR struct {
 	// Where to take the node's pod CIDRs from per address family
-	PodCIDRSourceIPv4 PodCIDRSource = PodCIDRSource(GetEnvOrDefault("POD_CIDR_SOURCE_IPV4", string(SourceSpec)))
-	PodCIDRSourceIPv6 PodCIDRSource = PodCIDRSource(GetEnvOrDefault("POD_CIDR_SOURCE_IPV6", string(SourceSpec)))
+	SourceIPv4 PodCIDRSource `json:"sourceIPv4" env:"POD_CIDR_SOURCE_IPV4"`
+	SourceIPv6 PodCIDRSource `json:"sourceIPv6" env:"POD_CIDR_SOURCE_IPV6"`
 
-	// Where to take the pod CIDRs from, if mode is "file"
-	PodCidrSourceFilename string = os.Getenv("POD_CIDR_SOURCE_PATH")
+	// Where to take the pod CIDRs from, if the source is "file"
+	SourcePath string `json:"sourcePath" env:"POD_CIDR_SOURCE_PATH"`
 
-	// CEL expression deriving pod CIDRs from interface/node state, if mode is "expression".
-	// POD_CIDR_EXPRESSION_PATH (a file, e.g. mounted from a ConfigMap) takes
-	// precedence over the inline POD_CIDR_EXPRESSION.
-	PodCidrExpression     string = os.Getenv("POD_CIDR_EXPRESSION")
-	PodCidrExpressionPath string = os.Getenv("POD_CIDR_EXPRESSION_PATH")
+	// CEL expression deriving pod CIDRs from interface/node state, if the
+	// source is "expression". ExpressionPath (a file, e.g. mounted from a
+	// ConfigMap) takes precedence over the inline Expression.
+	Expression     string `json:"expression" env:"POD_CIDR_EXPRESSION"`
+	ExpressionPath string `json:"expressionPath" env:"POD_CIDR_EXPRESSION_PATH"`
 
-	// Enable NetworkPolicy support
-	EnableNetworkPolicy bool = GetEnvOrDefaultBool("ENABLE_NETWORK_POLICY", true)
+	// Cluster-wide pools (comma-separated CIDRs) from which the allocator pod
+	// CIDR source carves a prefix of the given length for each node
+	AllocatorPools            string `json:"allocatorPools" env:"POD_CIDR_ALLOCATOR_POOLS"`
+	AllocatorPrefixLengthIPv4 int    `json:"allocatorPrefixLengthIPv4" env:"POD_CIDR_ALLOCATOR_PREFIX_LENGTH_IPV4"`
+	AllocatorPrefixLengthIPv6 int    `json:"allocatorPrefixLengthIPv6" env:"POD_CIDR_ALLOCATOR_PREFIX_LENGTH_IPV6"`
+
+	// Grow the node's pod address space at runtime. The pod CIDRs of each
+	// family resolved by the source are used one at a time, the next one is
+	// added once the allocated addresses reach ExpansionThreshold percent of
+	// the current ones (requires the wigglenet-ipam plugin).
+	Expansion          bool `json:"expansion" env:"POD_CIDR_EXPANSION"`
+	ExpansionThreshold int  `json:"expansionThreshold" env:"POD_CIDR_EXPANSION_THRESHOLD"`
+
+	// Re-evaluate the pod CIDR sources and update the node's pod CIDRs when
+	// the node's addresses, labels or annotations or the source files change.
+	// The files are checked every WatchInterval.
+	Watch         bool            `json:"watch" env:"POD_CIDR_WATCH"`
+	WatchInterval metav1.Duration `json:"watchInterval" env:"POD_CIDR_WATCH_INTERVAL"`
+	// Hold back a change of the pod CIDRs as long as pods on the node still
+	// have addresses in a pod CIDR that would be removed
+	SafeChange bool `json:"safeChange" env:"POD_CIDR_SAFE_CHANGE"`
+}
+
+// Uses reports whether either address family takes its pod CIDRs from source.
+func (p PodCIDR) Uses(source PodCIDRSource) bool {
+	return p.SourceIPv4 == source || p.SourceIPv6 == source
+}
+
+type CNI struct {
+	ConfigPath string `json:"configPath" env:"CNI_CONFIG_PATH"`
+
+	// IPAM plugin to use for pods, either "host-local" (default) or
+	// "wigglenet-ipam" (addresses are allocated by the daemon)
+	IPAMPlugin     IPAMPluginType `json:"ipamPlugin" env:"IPAM_PLUGIN"`
+	IPAMSocketPath string         `json:"ipamSocketPath" env:"IPAM_SOCKET_PATH"`
+	IPAMStatePath  string         `json:"ipamStatePath" env:"IPAM_STATE_PATH"`
+}
 
+type Firewall struct {
 	// Firewall backend: "nftables" (default) or "iptables"
-	FirewallBackendMode FirewallBackend = FirewallBackend(GetEnvOrDefault("FIREWALL_BACKEND", string(BackendNftables)))
+	Backend FirewallBackend `json:"backend" env:"FIREWALL_BACKEND"`
 
-	// Metrics settings
-	EnableMetrics      bool   = GetEnvOrDefaultBool("ENABLE_METRICS", false)
-	MetricsBindAddr    string = GetEnvOrDefault("METRICS_BIND_ADDR", ":9091")
-	MetricsTLSCertFile string = GetEnvOrDefault("METRICS_TLS_CERT_FILE", "")
-	MetricsTLSKeyFile  string = GetEnvOrDefault("METRICS_TLS_KEY_FILE", "")
-	MetricsTLSClientCA string = GetEnvOrDefault("METRICS_TLS_CLIENT_CA_FILE", "")
+	MasqueradeIPv4 bool `json:"masqueradeIPv4" env:"MASQUERADE_IPV4" reload:"live"`
+	MasqueradeIPv6 bool `json:"masqueradeIPv6" env:"MASQUERADE_IPV6" reload:"live"`
+	FilterIPv4     bool `json:"filterIPv4" env:"FILTER_IPV4" reload:"live"`
+	FilterIPv6     bool `json:"filterIPv6" env:"FILTER_IPV6" reload:"live"`
 
 	// Flowtable (fastpath) settings - nftables backend only
-	EnableFlowtable          bool   = GetEnvOrDefaultBool("ENABLE_FLOWTABLE", false)
-	FlowtableDevices         string = GetEnvOrDefault("FLOWTABLE_DEVICES", "")
-	FlowtablePacketThreshold int    = GetEnvOrDefaultInt("FLOWTABLE_PACKET_THRESHOLD", 128)
-)
+	Flowtable                bool   `json:"flowtable" env:"ENABLE_FLOWTABLE" reload:"live"`
+	FlowtableDevices         string `json:"flowtableDevices" env:"FLOWTABLE_DEVICES" reload:"live"`
+	FlowtablePacketThreshold int    `json:"flowtablePacketThreshold" env:"FLOWTABLE_PACKET_THRESHOLD" reload:"live"`
+}
 
-func GetEnvOrDefault(name string, fallback string) string {
-	if val, ok := os.LookupEnv(name); ok {
-		return val
-	}
-	return fallback
+type NetworkPolicy struct {
+	// Enable NetworkPolicy support
+	Enabled bool `json:"enabled" env:"ENABLE_NETWORK_POLICY" reload:"live"`
+
+	// Enable AdminNetworkPolicy and BaselineAdminNetworkPolicy support (requires the
+	// policy.networking.k8s.io CRDs to be installed). Only effective together with
+	// Enabled.
+	AdminNetworkPolicy bool `json:"adminNetworkPolicy" env:"ENABLE_ADMIN_NETWORK_POLICY" reload:"live"`
+
+	// Log packets dropped by NetworkPolicy to an nflog group, which wigglenet listens
+	// on to attribute each drop to the policy that isolated the pod (nftables backend only)
+	Logging  bool `json:"logging" env:"ENABLE_NETPOL_LOGGING" reload:"live"`
+	LogGroup int  `json:"logGroup" env:"NETPOL_LOG_GROUP"`
+
+	// Only log traffic that NetworkPolicy would drop instead of dropping it. Can be
+	// overridden per namespace with the wigglenet/netpol-audit annotation.
+	AuditMode bool `json:"auditMode" env:"NETPOL_AUDIT_MODE" reload:"live"`
 }
 
-func GetEnvOrDefaultInt(name string, fallback int) int {
-	if val, ok := os.LookupEnv(name); ok {
-		if intVal, err := strconv.Atoi(val); err == nil {
-			return intVal
-		}
-	}
-	return fallback
+type Metrics struct {
+	Enabled         bool   `json:"enabled" env:"ENABLE_METRICS"`
+	BindAddr        string `json:"bindAddr" env:"METRICS_BIND_ADDR"`
+	TLSCertFile     string `json:"tlsCertFile" env:"METRICS_TLS_CERT_FILE"`
+	TLSKeyFile      string `json:"tlsKeyFile" env:"METRICS_TLS_KEY_FILE"`
+	TLSClientCAFile string `json:"tlsClientCAFile" env:"METRICS_TLS_CLIENT_CA_FILE"`
+
+	// Serve read-only JSON descriptions of the node's network state under /debug/
+	// on the metrics server
+	DebugAPI bool `json:"debugAPI" env:"ENABLE_DEBUG_API"`
+}
+
+type Health struct {
+	// /healthz and /readyz are served over plain HTTP so that they can be used
+	// by kubelet probes. An empty address disables the server.
+	BindAddr string `json:"bindAddr" env:"HEALTH_BIND_ADDR"`
+	// Seconds a component (e.g. the firewall) may keep failing to sync before
+	// the node is reported unhealthy. 0 disables the check.
+	SyncFailureTimeoutSeconds int `json:"syncFailureTimeoutSeconds" env:"HEALTH_SYNC_FAILURE_TIMEOUT"`
+	// Keep a wigglenet.io/network-unavailable:NoSchedule taint on the node while
+	// it is not ready
+	StartupTaint bool `json:"startupTaint" env:"ENABLE_STARTUP_TAINT"`
 }
 
-func GetEnvOrDefaultBool(name string, fallback bool) bool {
-	if val, ok := os.LookupEnv(name); ok {
-		if boolVal, err := strconv.ParseBool(val); err == nil {
-			return boolVal
-		}
+// Default returns the configuration with all the settings at their defaults.
+func Default() *Config {
+	return &Config{
+		APIVersion:   APIVersion,
+		Kind:         Kind,
+		PodNamespace: "kube-system",
+		WireGuard: WireGuard{
+			InterfaceName:          "wigglenet",
+			Port:                   24601,
+			PrivateKeyPath:         "/etc/wigglenet/private.key",
+			IPFamily:               DualStackFamily,
+			KeyRotationGracePeriod: metav1.Duration{Duration: time.Minute},
+			Fwmark:                 24601,
+			RouteTable:             24601,
+		},
+		Routing: Routing{
+			MixedRouting:      MixedRoutingNone,
+			MixedRoutingLabel: "topology.kubernetes.io/zone",
+		},
+		BGP: BGP{
+			HoldTime: metav1.Duration{Duration: 90 * time.Second},
+		},
+		PodCIDR: PodCIDR{
+			SourceIPv4:                SourceSpec,
+			SourceIPv6:                SourceSpec,
+			AllocatorPrefixLengthIPv4: 24,
+			AllocatorPrefixLengthIPv6: 64,
+			ExpansionThreshold:        90,
+			Watch:                     true,
+			WatchInterval:             metav1.Duration{Duration: 10 * time.Second},
+			SafeChange:                true,
+		},
+		CNI: CNI{
+			ConfigPath:     "/etc/cni/net.d/10-wigglenet.conflist",
+			IPAMPlugin:     IPAMHostLocal,
+			IPAMSocketPath: "/run/wigglenet/ipam.sock",
+			IPAMStatePath:  "/etc/wigglenet/ipam.json",
+		},
+		Firewall: Firewall{
+			Backend:                  BackendNftables,
+			MasqueradeIPv4:           true,
+			MasqueradeIPv6:           true,
+			FlowtablePacketThreshold: 128,
+		},
+		NetworkPolicy: NetworkPolicy{
+			Enabled:  true,
+			LogGroup: 100,
+		},
+		Metrics: Metrics{
+			BindAddr: ":9091",
+		},
+		Health: Health{
+			BindAddr:                  "127.0.0.1:9093",
+			SyncFailureTimeoutSeconds: 300,
+		},
 	}
-	return fallback
 }
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+}
+
+func TestParse(t *testing.T) {
+	cfg := Default()
+	err := Parse([]byte(`
+apiVersion: wigglenet.io/v1alpha1
+kind: Configuration
+wireguard:
+  port: 51820
+  keyRotationInterval: 720h
+routing:
+  nativeRoutingIPv6: true
+podCIDR:
+  sourceIPv6: expression
+  expression: "[interfaces.eth0[0]]"
+firewall:
+  backend: iptables
+`), cfg)
+	require.NoError(t, err)
+
+	assert.Equal(t, 51820, cfg.WireGuard.Port)
+	assert.Equal(t, 720*time.Hour, cfg.WireGuard.KeyRotationInterval.Duration)
+	assert.True(t, cfg.Routing.NativeRoutingIPv6)
+	assert.Equal(t, SourceExpression, cfg.PodCIDR.SourceIPv6)
+	assert.Equal(t, BackendIptables, cfg.Firewall.Backend)
+
+	// Settings that are not in the file keep their defaults
+	assert.Equal(t, "wigglenet", cfg.WireGuard.InterfaceName)
+	assert.Equal(t, SourceSpec, cfg.PodCIDR.SourceIPv4)
+	assert.True(t, cfg.NetworkPolicy.Enabled)
+}
+
+func TestParseJSON(t *testing.T) {
+	cfg := Default()
+	require.NoError(t, Parse([]byte(`{"apiVersion": "wigglenet.io/v1alpha1", "kind": "Configuration", "metrics": {"enabled": true}}`), cfg))
+	assert.True(t, cfg.Metrics.Enabled)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		errMsg string
+	}{
+		{
+			name:   "missing version",
+			data:   "wireguard:\n  port: 51820\n",
+			errMsg: "unsupported configuration",
+		},
+		{
+			name:   "other version",
+			data:   "apiVersion: wigglenet.io/v1\nkind: Configuration\n",
+			errMsg: "unsupported configuration",
+		},
+		{
+			name:   "unknown field",
+			data:   "apiVersion: wigglenet.io/v1alpha1\nkind: Configuration\nwireguard:\n  prot: 51820\n",
+			errMsg: `unknown field "prot"`,
+		},
+		{
+			name:   "wrong type",
+			data:   "apiVersion: wigglenet.io/v1alpha1\nkind: Configuration\nwireguard:\n  port: fast\n",
+			errMsg: "invalid configuration",
+		},
+		{
+			name:   "environment only",
+			data:   "apiVersion: wigglenet.io/v1alpha1\nkind: Configuration\nnodeName: node-1\n",
+			errMsg: `unknown field "nodeName"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Parse([]byte(tt.data), Default())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"NODE_NAME":               "node-1",
+		"WIGGLENET_WG_PORT":       "51820",
+		"FILTER_IPV6":             "true",
+		"BGP_LOCAL_ASN":           "4200000000",
+		"POD_CIDR_WATCH_INTERVAL": "1m",
+		"POD_CIDR_SOURCE_IPV4":    "allocator",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg := Default()
+	require.NoError(t, applyEnv(cfg, lookup))
+	assert.Equal(t, "node-1", cfg.NodeName)
+	assert.Equal(t, 51820, cfg.WireGuard.Port)
+	assert.True(t, cfg.Firewall.FilterIPv6)
+	assert.Equal(t, int64(4200000000), cfg.BGP.LocalASN)
+	assert.Equal(t, time.Minute, cfg.PodCIDR.WatchInterval.Duration)
+	assert.Equal(t, SourceAllocator, cfg.PodCIDR.SourceIPv4)
+
+	// All the invalid values are reported
+	env = map[string]string{
+		"WIGGLENET_WG_PORT":       "fast",
+		"ENABLE_METRICS":          "yes please",
+		"POD_CIDR_WATCH_INTERVAL": "10",
+	}
+	err := applyEnv(Default(), lookup)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "WIGGLENET_WG_PORT")
+	assert.Contains(t, err.Error(), "ENABLE_METRICS")
+	assert.Contains(t, err.Error(), "POD_CIDR_WATCH_INTERVAL")
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		errMsg string
+	}{
+		{
+			name:   "port",
+			modify: func(c *Config) { c.WireGuard.Port = 70000 },
+			errMsg: "wireguard.port",
+		},
+		{
+			name:   "ip family",
+			modify: func(c *Config) { c.WireGuard.IPFamily = "ipv5" },
+			errMsg: "wireguard.ipFamily",
+		},
+		{
+			name:   "pod CIDR source",
+			modify: func(c *Config) { c.PodCIDR.SourceIPv4 = "dhcp" },
+			errMsg: "podCIDR.sourceIPv4",
+		},
+		{
+			name:   "file source without path",
+			modify: func(c *Config) { c.PodCIDR.SourceIPv6 = SourceFile },
+			errMsg: "podCIDR.sourcePath",
+		},
+		{
+			name:   "expression source without expression",
+			modify: func(c *Config) { c.PodCIDR.SourceIPv6 = SourceExpression },
+			errMsg: "podCIDR.expression",
+		},
+		{
+			name:   "allocator source without pools",
+			modify: func(c *Config) { c.PodCIDR.SourceIPv4 = SourceAllocator },
+			errMsg: "podCIDR.allocatorPools",
+		},
+		{
+			name: "expansion with host-local",
+			modify: func(c *Config) {
+				c.PodCIDR.Expansion = true
+				c.CNI.IPAMPlugin = IPAMHostLocal
+			},
+			errMsg: "podCIDR.expansion",
+		},
+		{
+			name: "BGP ASN",
+			modify: func(c *Config) {
+				c.BGP.Peers = "192.0.2.1=65000"
+			},
+			errMsg: "bgp.localASN",
+		},
+		{
+			name: "BGP router ID",
+			modify: func(c *Config) {
+				c.BGP.Peers = "192.0.2.1=65000"
+				c.BGP.LocalASN = 65001
+				c.BGP.RouterID = "2001:db8::1"
+			},
+			errMsg: "bgp.routerID",
+		},
+		{
+			name: "BGP hold time",
+			modify: func(c *Config) {
+				c.BGP.Peers = "192.0.2.1=65000"
+				c.BGP.LocalASN = 65001
+				c.BGP.HoldTime.Duration = 24 * time.Hour
+			},
+			errMsg: "bgp.holdTime",
+		},
+		{
+			name:   "firewall backend",
+			modify: func(c *Config) { c.Firewall.Backend = "ebpf" },
+			errMsg: "firewall.backend",
+		},
+		{
+			name:   "TLS key",
+			modify: func(c *Config) { c.Metrics.TLSCertFile = "/etc/tls/tls.crt" },
+			errMsg: "metrics.tlsKeyFile",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+apiVersion: wigglenet.io/v1alpha1
+kind: Configuration
+wireguard:
+  port: 51820
+firewall:
+  filterIPv4: true
+`), 0o600))
+
+	// The environment takes precedence over the file
+	t.Setenv("WIGGLENET_WG_PORT", "51821")
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 51821, cfg.WireGuard.Port)
+	assert.True(t, cfg.Firewall.FilterIPv4)
+
+	// The result is validated
+	t.Setenv("WIGGLENET_WG_PORT", "0")
+	_, err = Load(path)
+	assert.ErrorContains(t, err, "wireguard.port")
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	current := Default()
+	current.NodeName = "node-1"
+
+	loaded := Default()
+	loaded.NodeName = "node-1"
+	loaded.Firewall.MasqueradeIPv6 = false
+	loaded.Firewall.FlowtableDevices = "eth0"
+	loaded.NetworkPolicy.Enabled = false
+	loaded.NetworkPolicy.AuditMode = true
+	loaded.WireGuard.InterfaceName = "wg0"
+	loaded.Firewall.Backend = BackendIptables
+
+	next, restart := Reload(current, loaded)
+
+	// Live settings are taken over
+	assert.False(t, next.Firewall.MasqueradeIPv6)
+	assert.Equal(t, "eth0", next.Firewall.FlowtableDevices)
+	assert.False(t, next.NetworkPolicy.Enabled)
+	assert.True(t, next.NetworkPolicy.AuditMode)
+
+	// The others keep their current values and are reported
+	assert.Equal(t, "wigglenet", next.WireGuard.InterfaceName)
+	assert.Equal(t, BackendNftables, next.Firewall.Backend)
+	assert.ElementsMatch(t, []string{"wireguard.interfaceName", "firewall.backend"}, restart)
+
+	// The current configuration is left alone
+	assert.True(t, current.Firewall.MasqueradeIPv6)
+
+	// Settings that only come from the environment are reported by their
+	// environment variable
+	loaded.NodeName = "node-2"
+	_, restart = Reload(current, loaded)
+	assert.Contains(t, restart, "NODE_NAME")
+
+	next, restart = Reload(current, current)
+	assert.Equal(t, current, next)
+	assert.Empty(t, restart)
+}
+
+func TestReloadPodCIDR(t *testing.T) {
+	// The pod CIDR watch reads these once when it starts
+	podCIDR := reflect.TypeOf(PodCIDR{})
+	for i := 0; i < podCIDR.NumField(); i++ {
+		assert.NotEqual(t, "live", podCIDR.Field(i).Tag.Get("reload"), podCIDR.Field(i).Name)
+	}
+
+	current := Default()
+	loaded := Default()
+	loaded.PodCIDR.WatchInterval.Duration = time.Minute
+	loaded.PodCIDR.SourceIPv4 = SourceExpression
+	next, restart := Reload(current, loaded)
+	assert.Equal(t, current.PodCIDR, next.PodCIDR)
+	assert.ElementsMatch(t, []string{"podCIDR.watchInterval", "podCIDR.sourceIPv4"}, restart)
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigFileEnv is the environment variable with the path of the
+// configuration file, if there is one.
+const ConfigFileEnv = "WIGGLENET_CONFIG"
+
+var durationType = reflect.TypeOf(metav1.Duration{})
+
+// Load reads the configuration file at path (none if empty), overrides its
+// settings from the environment and validates the result. All the problems
+// found are reported at once.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading configuration: %w", err)
+		}
+		if err := Parse(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Parse decodes a YAML or JSON configuration file into cfg, leaving the
+// settings that are not in the file as they are. Unknown fields are rejected.
+func Parse(data []byte, cfg *Config) error {
+	// Checked first, a file of another version is likely to have unknown
+	// fields too
+	var header struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+	}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if header.APIVersion != APIVersion || header.Kind != Kind {
+		return fmt.Errorf("unsupported configuration %s/%s, expected apiVersion %s and kind %s", header.APIVersion, header.Kind, APIVersion, Kind)
+	}
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
+
+// applyEnv overrides the settings that have an environment variable set.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	return errors.Join(applyEnvFields(reflect.ValueOf(cfg).Elem(), lookup)...)
+}
+
+func applyEnvFields(v reflect.Value, lookup func(string) (string, bool)) []error {
+	errs := make([]error, 0)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name, ok := v.Type().Field(i).Tag.Lookup("env")
+		if !ok {
+			if field.Kind() == reflect.Struct && field.Type() != durationType {
+				errs = append(errs, applyEnvFields(field, lookup)...)
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q of %s: %w", value, name, err))
+		}
+	}
+	return errs
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(metav1.Duration{Duration: d}))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate checks the settings and the combinations of them that cannot work.
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(setting string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: unsupported value %q, must be one of %s", setting, value, strings.Join(allowed, ", ")))
+	}
+
+	wg := c.WireGuard
+	check(wg.InterfaceName != "", "wireguard.interfaceName: must not be empty")
+	check(wg.Port > 0 && wg.Port <= math.MaxUint16, "wireguard.port: %d is not a valid port", wg.Port)
+	oneOf("wireguard.ipFamily", string(wg.IPFamily), string(IPv4Family), string(IPv6Family), string(DualStackFamily))
+	check(wg.KeyRotationInterval.Duration >= 0, "wireguard.keyRotationInterval: must not be negative")
+	check(wg.KeyRotationGracePeriod.Duration >= 0, "wireguard.keyRotationGracePeriod: must not be negative")
+	check(wg.EndpointFailoverTimeout.Duration >= 0, "wireguard.endpointFailoverTimeout: must not be negative")
+	if wg.HostEncryption {
+		check(wg.Fwmark > 0 && wg.Fwmark <= math.MaxUint32, "wireguard.fwmark: %d is not a valid firewall mark", wg.Fwmark)
+		check(wg.RouteTable > 0 && wg.RouteTable <= math.MaxUint32, "wireguard.routeTable: %d is not a valid routing table", wg.RouteTable)
+	}
+
+	r := c.Routing
+	oneOf("routing.mixedRouting", string(r.MixedRouting), string(MixedRoutingNone), string(MixedRoutingSubnet), string(MixedRoutingLabel))
+	check(r.MixedRouting != MixedRoutingLabel || r.MixedRoutingLabel != "", "routing.mixedRoutingLabel: must be set with label mixed routing")
+
+	if c.BGP.Peers != "" {
+		check(c.BGP.LocalASN > 0 && c.BGP.LocalASN <= math.MaxUint32, "bgp.localASN: %d is not a valid ASN", c.BGP.LocalASN)
+		if c.BGP.RouterID != "" {
+			routerID, err := netip.ParseAddr(c.BGP.RouterID)
+			check(err == nil && routerID.Is4(), "bgp.routerID: %q is not an IPv4 address", c.BGP.RouterID)
+		}
+		check(c.BGP.HoldTime.Duration == 0 || c.BGP.HoldTime.Duration >= 3*time.Second, "bgp.holdTime: must be 0 or at least 3s")
+		check(c.BGP.HoldTime.Duration <= math.MaxUint16*time.Second, "bgp.holdTime: must be at most %s", math.MaxUint16*time.Second)
+	}
+
+	p := c.PodCIDR
+	sources := []string{string(SourceNone), string(SourceSpec), string(SourceFile), string(SourceExpression), string(SourceAllocator)}
+	oneOf("podCIDR.sourceIPv4", string(p.SourceIPv4), sources...)
+	oneOf("podCIDR.sourceIPv6", string(p.SourceIPv6), sources...)
+	check(!p.Uses(SourceFile) || p.SourcePath != "", "podCIDR.sourcePath: must be set with the file pod CIDR source")
+	check(!p.Uses(SourceExpression) || p.Expression != "" || p.ExpressionPath != "", "podCIDR.expression: either it or podCIDR.expressionPath must be set with the expression pod CIDR source")
+	check(!p.Uses(SourceAllocator) || p.AllocatorPools != "", "podCIDR.allocatorPools: must be set with the allocator pod CIDR source")
+	check(p.AllocatorPrefixLengthIPv4 >= 0 && p.AllocatorPrefixLengthIPv4 <= 32, "podCIDR.allocatorPrefixLengthIPv4: /%d is not a valid IPv4 prefix length", p.AllocatorPrefixLengthIPv4)
+	check(p.AllocatorPrefixLengthIPv6 >= 0 && p.AllocatorPrefixLengthIPv6 <= 128, "podCIDR.allocatorPrefixLengthIPv6: /%d is not a valid IPv6 prefix length", p.AllocatorPrefixLengthIPv6)
+	check(p.ExpansionThreshold > 0 && p.ExpansionThreshold <= 100, "podCIDR.expansionThreshold: %d is not a percentage", p.ExpansionThreshold)
+	check(!p.Watch || p.WatchInterval.Duration > 0, "podCIDR.watchInterval: must be positive")
+
+	oneOf("cni.ipamPlugin", string(c.CNI.IPAMPlugin), string(IPAMWigglenet), string(IPAMHostLocal))
+	check(c.CNI.ConfigPath != "", "cni.configPath: must not be empty")
+	check(!p.Expansion || c.CNI.IPAMPlugin == IPAMWigglenet, "podCIDR.expansion: requires the %s IPAM plugin", IPAMWigglenet)
+
+	f := c.Firewall
+	oneOf("firewall.backend", string(f.Backend), string(BackendNftables), string(BackendIptables))
+	check(f.FlowtablePacketThreshold >= 0, "firewall.flowtablePacketThreshold: must not be negative")
+
+	np := c.NetworkPolicy
+	check(np.LogGroup >= 0 && np.LogGroup <= math.MaxUint16, "networkPolicy.logGroup: %d is not a valid nflog group", np.LogGroup)
+
+	check(c.Health.SyncFailureTimeoutSeconds >= 0, "health.syncFailureTimeoutSeconds: must not be negative")
+	check(c.Metrics.TLSCertFile == "" || c.Metrics.TLSKeyFile != "", "metrics.tlsKeyFile: must be set together with metrics.tlsCertFile")
+
+	return errors.Join(errs...)
+}
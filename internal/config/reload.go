@@ -0,0 +1,50 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Reload merges a newly loaded configuration into the current one. It returns
+// the configuration to switch to, which has the live settings of loaded and
+// keeps the current value of all the others, and the names of the settings
+// that were changed but need a restart to take effect.
+//
+// Only the settings tagged reload:"live" are ever changed, so a component may
+// read the others once when it starts. The pod CIDR settings are all of that
+// kind: the pod CIDR watch subscribes to the address and route changes and
+// sets up its ticker once, so tagging one of them live needs it to rebuild
+// those when the setting changes.
+func Reload(current, loaded *Config) (*Config, []string) {
+	next := *current
+	restart := reloadFields(reflect.ValueOf(&next).Elem(), reflect.ValueOf(loaded).Elem(), "")
+	return &next, restart
+}
+
+func reloadFields(next, loaded reflect.Value, prefix string) []string {
+	restart := make([]string, 0)
+	for i := 0; i < next.NumField(); i++ {
+		field := next.Type().Field(i)
+		name := prefix + strings.Split(field.Tag.Get("json"), ",")[0]
+
+		if _, ok := field.Tag.Lookup("env"); !ok {
+			// A section of the configuration, or the file header
+			if field.Type.Kind() == reflect.Struct {
+				restart = append(restart, reloadFields(next.Field(i), loaded.Field(i), name+".")...)
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(next.Field(i).Interface(), loaded.Field(i).Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") == "live" {
+			next.Field(i).Set(loaded.Field(i))
+		} else if field.Tag.Get("json") == "-" {
+			restart = append(restart, field.Tag.Get("env"))
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return restart
+}
@@ -6,12 +6,18 @@ import (
 	"fmt"
 	"net/netip"
 	"slices"
+	"sync/atomic"
 	"time"
 
+	"github.com/tibordp/wigglenet/internal/allocator"
 	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/bgp"
 	"github.com/tibordp/wigglenet/internal/cni"
 	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/health"
+	"github.com/tibordp/wigglenet/internal/ipam"
 	"github.com/tibordp/wigglenet/internal/metrics"
+	"github.com/tibordp/wigglenet/internal/routing"
 	"github.com/tibordp/wigglenet/internal/util"
 	"github.com/tibordp/wigglenet/internal/wireguard"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -19,12 +25,15 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	clientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	listersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
@@ -32,18 +41,43 @@ import (
 
 type Controller interface {
 	Run(ctx context.Context)
+	// Reconfigure switches to a new configuration and re-applies the
+	// WireGuard, routing, firewall and CNI configuration with it.
+	Reconfigure(cfg *config.Config)
 }
 
 type controller struct {
+	config         atomic.Pointer[config.Config]
 	factory        informers.SharedInformerFactory
+	health         *health.Checker
 	nodeLister     listersv1.NodeLister
 	queue          workqueue.TypedRateLimitingInterface[string]
 	wireguard      wireguard.Manager
+	routes         routing.Manager
+	bgp            bgp.Speaker
 	cniwriter      cni.CNIConfigWriter
+	nodeClient     clientv1.NodeInterface
 	podCIDRUpdates chan []netip.Prefix
+	// Pod CIDRs of an address family that IPAM reports as (nearly) full
+	podCIDRExhausted chan []netip.Prefix
+	// Set if pod CIDRs are claimed from the cluster-wide pools
+	podCIDRAllocator allocator.Allocator
+	// Requests to check the pod CIDR sources for changes, nil if they are
+	// not watched
+	podCIDRResync chan struct{}
+	podCIDRStatus *PodCIDRStatus
+	podClient     clientv1.PodInterface
+	// The allocations of the IPAM plugin, nil if it is host-local, in which
+	// case they are read from hostLocalDataDir
+	ipam             ipam.Manager
+	hostLocalDataDir string
+	endpoints        *endpointSelector
+	// Peers that no direct routes could be installed for in the last sync,
+	// so that this is only logged when it changes
+	offLinkPeers map[string]struct{}
 }
 
-func NewController(clientset kubernetes.Interface, wireguardManager wireguard.Manager, cniwriter cni.CNIConfigWriter, podCIDRUpdates chan []netip.Prefix) (*controller, error) {
+func NewController(cfg *config.Config, checker *health.Checker, clientset kubernetes.Interface, wireguardManager wireguard.Manager, routeManager routing.Manager, speaker bgp.Speaker, cniwriter cni.CNIConfigWriter, podCIDRUpdates chan []netip.Prefix, podCIDRExhausted chan []netip.Prefix, podCIDRAllocator allocator.Allocator, podCIDRStatus *PodCIDRStatus, ipamManager ipam.Manager) (*controller, error) {
 	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithTransform(util.StripManagedFields))
 	nodes := factory.Core().V1().Nodes()
 
@@ -69,33 +103,82 @@ func NewController(clientset kubernetes.Interface, wireguardManager wireguard.Ma
 		return nil, fmt.Errorf("registering node event handler: %w", err)
 	}
 
-	return &controller{
-		factory:        factory,
-		nodeLister:     nodes.Lister(),
-		queue:          queue,
-		wireguard:      wireguardManager,
-		cniwriter:      cniwriter,
-		podCIDRUpdates: podCIDRUpdates,
-	}, nil
+	var podCIDRResync chan struct{}
+	if cfg.PodCIDR.Watch {
+		podCIDRResync = make(chan struct{}, 1)
+	}
+
+	c := &controller{
+		factory:          factory,
+		health:           checker,
+		nodeLister:       nodes.Lister(),
+		queue:            queue,
+		wireguard:        wireguardManager,
+		routes:           routeManager,
+		bgp:              speaker,
+		cniwriter:        cniwriter,
+		nodeClient:       clientset.CoreV1().Nodes(),
+		podCIDRUpdates:   podCIDRUpdates,
+		podCIDRExhausted: podCIDRExhausted,
+		podCIDRAllocator: podCIDRAllocator,
+		podCIDRResync:    podCIDRResync,
+		podCIDRStatus:    podCIDRStatus,
+		podClient:        clientset.CoreV1().Pods(metav1.NamespaceAll),
+		ipam:             ipamManager,
+		hostLocalDataDir: cni.HostLocalDataDir,
+		endpoints:        newEndpointSelector(),
+	}
+	c.config.Store(cfg)
+	return c, nil
+}
+
+func (c *controller) Reconfigure(cfg *config.Config) {
+	c.config.Store(cfg)
+	// Processing any node re-applies everything that depends on the
+	// configuration, the local one also takes care of the CNI configuration.
+	c.queue.Add(cfg.NodeName)
 }
 
 // processChanges gets called on any change to a node object as well as additions and removals.
 // it computes the new state of the world and adjust the local networking setup accordingly
 func (c *controller) processChanges(ctx context.Context, key string) error {
+	cfg := c.config.Load()
 	if err := c.applyWireguardConfiguration(ctx); err != nil {
 		return err
 	}
 
+	if err := c.applyNativeRoutes(ctx); err != nil {
+		return err
+	}
+
 	if err := c.applyFirewallRules(); err != nil {
 		return err
 	}
 
-	if !config.FirewallOnly && key == config.CurrentNodeName {
+	if !cfg.Routing.FirewallOnly && key == cfg.NodeName {
 		if err := c.ensureCNI(ctx); err != nil {
 			return err
 		}
 	}
 
+	if c.bgp != nil && key == cfg.NodeName {
+		c.advertisePodCIDRs(ctx)
+	}
+
+	if key == cfg.NodeName {
+		c.requestPodCIDRResync()
+	}
+
+	if c.podCIDRAllocator != nil && key != cfg.NodeName {
+		// The claims of a deleted node are garbage collected with it as
+		// well, this releases them without waiting for the garbage collector.
+		if _, err := c.nodeLister.Get(key); apierrors.IsNotFound(err) {
+			if err := c.podCIDRAllocator.Release(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -118,7 +201,7 @@ func (c *controller) applyFirewallRules() error {
 	// the whole ruleset needlessly.
 	util.SortPrefixes(podCIDRs)
 
-	if config.EnableMetrics {
+	if c.config.Load().Metrics.Enabled {
 		metrics.PodCIDRsTotal.Set(float64(len(podCIDRs)))
 	}
 
@@ -135,6 +218,7 @@ func (c *controller) applyWireguardConfiguration(ctx context.Context) error {
 	}
 
 	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
 
 	nodes, err := c.nodeLister.List(labels.Everything())
 	if err != nil {
@@ -143,24 +227,59 @@ func (c *controller) applyWireguardConfiguration(ctx context.Context) error {
 
 	peers := make([]wireguard.Peer, 0)
 	localAddresses := make([]netip.Addr, 0)
+	nodeAddresses := make([]netip.Addr, 0)
+
+	interfaces, err := routingInterfaces(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	localNode, _ := c.nodeLister.Get(cfg.NodeName)
+	peerNodes := make([]string, 0)
+	if cfg.Metrics.Enabled {
+		metrics.PeerEndpoint.Reset()
+	}
 
 	for _, node := range nodes {
-		if node.Name == config.CurrentNodeName {
+		if node.Name == cfg.NodeName {
 			podCIDRs := util.GetPodCIDRsFromAnnotation(node)
 			localAddresses = util.GetPodNetworkLocalAddresses(podCIDRs)
+			if addresses, err := getNodeAddresses(ctx, node); err == nil {
+				nodeAddresses = addresses
+			}
 		} else {
-			if peer := makePeer(ctx, node); peer != nil {
+			if peer := makePeer(ctx, cfg.WireGuard, node); peer != nil {
+				peer.Endpoint = c.endpoints.selectEndpoint(node.Name, peer.PublicKey, peer.EndpointCandidates)
+				if _, native := nativeRoutes(cfg.Routing, localNode, node, nodeCIDRAddresses(peer.NodeCIDRs), peer.PodCIDRs, interfaces); native {
+					peer.Native = true
+				}
+				if cfg.WireGuard.EndpointFailoverTimeout.Duration > 0 && len(peer.EndpointCandidates) > 1 {
+					// Handshakes only happen while there is traffic, keep
+					// them going so that a broken endpoint can be detected.
+					peer.PersistentKeepalive = persistentKeepaliveInterval
+				}
+				if cfg.Metrics.Enabled {
+					metrics.PeerEndpoint.WithLabelValues(node.Name, peer.Endpoint.String()).Set(1)
+				}
+				peerNodes = append(peerNodes, node.Name)
 				peers = append(peers, *peer)
 			}
 		}
 	}
 
-	if config.EnableMetrics {
+	c.endpoints.retain(peerNodes)
+
+	if cfg.Metrics.Enabled {
 		metrics.PeersTotal.Set(float64(len(peers)))
 	}
 
-	wgConfig := wireguard.NewConfig(localAddresses, peers)
-	return c.wireguard.ApplyConfiguration(ctx, &wgConfig, logger)
+	wgConfig := wireguard.NewConfig(localAddresses, nodeAddresses, peers)
+	if err := c.wireguard.ApplyConfiguration(ctx, &wgConfig, logger); err != nil {
+		return err
+	}
+
+	c.health.MarkReady(health.WireguardApplied)
+	return nil
 }
 
 // ensureCNI writes the local CNI configuration to /etc/cni/net.d if there were
@@ -168,7 +287,7 @@ func (c *controller) applyWireguardConfiguration(ctx context.Context) error {
 // e.g. if another address family is added to an existing cluster.
 func (c *controller) ensureCNI(ctx context.Context) error {
 	logger := klog.FromContext(ctx)
-	node, err := c.nodeLister.Get(config.CurrentNodeName)
+	node, err := c.nodeLister.Get(c.config.Load().NodeName)
 	if err != nil {
 		// Node not yet observed in the cache; nothing to write.
 		return nil
@@ -184,7 +303,25 @@ func (c *controller) ensureCNI(ctx context.Context) error {
 		PodCIDRs: podCIDRs,
 	}
 
-	return c.cniwriter.WriteCNIConfig(ctx, config, logger)
+	if err := c.cniwriter.WriteCNIConfig(ctx, config, logger); err != nil {
+		return err
+	}
+
+	c.health.MarkReady(health.CNIWritten)
+	return nil
+}
+
+// advertisePodCIDRs advertises the local pod CIDRs to the BGP peers.
+func (c *controller) advertisePodCIDRs(ctx context.Context) {
+	node, err := c.nodeLister.Get(c.config.Load().NodeName)
+	if err != nil {
+		return
+	}
+
+	// Node addresses are only needed as next hops for the address families
+	// the BGP session is not in, so it's fine if there aren't any.
+	nodeAddresses, _ := getNodeAddresses(ctx, node)
+	c.bgp.Advertise(util.GetPodCIDRsFromAnnotation(node), nodeAddresses)
 }
 
 func getNodeAddresses(ctx context.Context, node *v1.Node) ([]netip.Addr, error) {
@@ -219,7 +356,7 @@ func getNodeAddresses(ctx context.Context, node *v1.Node) ([]netip.Addr, error)
 	return nodeAddresses, nil
 }
 
-func makePeer(ctx context.Context, node *v1.Node) *wireguard.Peer {
+func makePeer(ctx context.Context, cfg config.WireGuard, node *v1.Node) *wireguard.Peer {
 	logger := klog.FromContext(ctx)
 	publicKeyStr := node.Annotations[annotation.PublicKeyAnnotation]
 	if publicKeyStr == "" {
@@ -251,17 +388,42 @@ func makePeer(ctx context.Context, node *v1.Node) *wireguard.Peer {
 		nodeCidrs = append(nodeCidrs, util.SingleHostCIDR(nodeAddress))
 	}
 
-	peerEndpoint := util.SelectIP(nodeAddresses, config.WireguardIPFamily)
-	if peerEndpoint == nil {
+	endpointCandidates := util.SelectIPs(nodeAddresses, cfg.IPFamily)
+	endpointPort := 0
+	endpointOverride, hasEndpointOverride := peerEndpointOverride(ctx, node)
+	if hasEndpointOverride {
+		endpointCandidates = []netip.Addr{endpointOverride.Addr()}
+		endpointPort = int(endpointOverride.Port())
+	}
+	if len(endpointCandidates) == 0 {
 		logger.Info("could not determine peer endpoint", "node", node.Name)
 		return nil
 	}
 
 	peer := &wireguard.Peer{
-		Endpoint:  *peerEndpoint,
-		NodeCIDRs: nodeCidrs,
-		PodCIDRs:  podCIDRs,
-		PublicKey: publicKey,
+		Endpoint:           endpointCandidates[0],
+		EndpointCandidates: endpointCandidates,
+		NodeCIDRs:          nodeCidrs,
+		PodCIDRs:           podCIDRs,
+		PublicKey:          publicKey,
+		Port:               endpointPort,
+		// Without a known public endpoint, the node addresses of a peer behind
+		// NAT are likely private, so keep the endpoint WireGuard has learned
+		// from its packets.
+		Roaming: behindNAT(node) && !hasEndpointOverride,
+	}
+
+	// Keep the NAT mappings open, on our side and on the peer's side
+	if cfg.BehindNAT || behindNAT(node) {
+		peer.PersistentKeepalive = persistentKeepaliveInterval
+	}
+
+	if nextPublicKeyStr := node.Annotations[annotation.NextPublicKeyAnnotation]; nextPublicKeyStr != "" {
+		if nextPublicKey, err := wgtypes.ParseKey(nextPublicKeyStr); err == nil {
+			peer.NextPublicKey = &nextPublicKey
+		} else {
+			logger.Info("invalid next public key for node", "node", node.Name, "error", err)
+		}
 	}
 
 	return peer
@@ -282,6 +444,7 @@ func (c *controller) Run(ctx context.Context) {
 		runtime.HandleErrorWithContext(ctx, err, "timed out waiting for caches to sync")
 		return
 	}
+	c.health.MarkReady(health.NodeInformerSynced)
 
 	// After we have all the nodes in cache, sync the routing state
 	if err := c.applyWireguardConfiguration(ctx); err != nil {
@@ -289,6 +452,23 @@ func (c *controller) Run(ctx context.Context) {
 	}
 
 	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	if c.config.Load().Health.StartupTaint {
+		go wait.UntilWithContext(ctx, c.syncNetworkTaint, taintSyncPeriod)
+	}
+	if c.wireguard != nil {
+		go wait.UntilWithContext(ctx, c.syncKeyRotation, keyRotationSyncPeriod)
+		go wait.UntilWithContext(ctx, c.syncNextKeys, nextKeySyncPeriod)
+	}
+	if c.wireguard != nil {
+		go wait.UntilWithContext(ctx, c.syncEndpoints, endpointSyncPeriod)
+		go wait.UntilWithContext(ctx, c.syncNATEndpoints, endpointSyncPeriod)
+	}
+	if c.podCIDRExhausted != nil {
+		go c.runPodCIDRExpansion(ctx)
+	}
+	if c.podCIDRResync != nil {
+		go c.runPodCIDRWatch(ctx)
+	}
 	<-ctx.Done()
 
 	logger.Info("finished controller")
@@ -7,9 +7,12 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/klog/v2/ktesting"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/health"
 	"github.com/tibordp/wigglenet/internal/wireguard"
 )
 
@@ -20,7 +23,7 @@ func parsePrefix(cidr string) netip.Prefix {
 
 func TestMakePeer2(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	result := *makePeer(ctx, &v1.Node{
+	result := *makePeer(ctx, config.Default().WireGuard, &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				"wigglenet/public-key": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
@@ -40,6 +43,11 @@ func TestMakePeer2(t *testing.T) {
 
 	expected := wireguard.Peer{
 		Endpoint: netip.MustParseAddr("10.0.0.1"),
+		EndpointCandidates: []netip.Addr{
+			netip.MustParseAddr("10.0.0.1"),
+			netip.MustParseAddr("192.168.0.1"),
+			netip.MustParseAddr("2001:db8::1234"),
+		},
 		NodeCIDRs: []netip.Prefix{
 			parsePrefix("10.0.0.1/32"),
 			parsePrefix("192.168.0.1/32"),
@@ -62,7 +70,7 @@ func TestMakePeer2(t *testing.T) {
 
 func TestMakePeerNoAddresses(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	result := makePeer(ctx, &v1.Node{
+	result := makePeer(ctx, config.Default().WireGuard, &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				"wigglenet/public-key": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
@@ -80,7 +88,7 @@ func TestMakePeerNoAddresses(t *testing.T) {
 
 func TestMakePeerInvalid(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	result := makePeer(ctx, &v1.Node{
+	result := makePeer(ctx, config.Default().WireGuard, &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				"wigglenet/public-key": "AAECAwQFBgcICQoLwdHh8=",
@@ -95,7 +103,7 @@ func TestMakePeerInvalid(t *testing.T) {
 
 func TestMakePeerInvalid1(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	result := makePeer(ctx, &v1.Node{
+	result := makePeer(ctx, config.Default().WireGuard, &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				"wigglenet/public-key": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
@@ -110,7 +118,7 @@ func TestMakePeerInvalid1(t *testing.T) {
 
 func TestMakePeerInvalid2(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	result := makePeer(ctx, &v1.Node{
+	result := makePeer(ctx, config.Default().WireGuard, &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				"wigglenet/public-key": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
@@ -122,3 +130,21 @@ func TestMakePeerInvalid2(t *testing.T) {
 
 	assert.Nil(t, result)
 }
+
+func TestReconfigure(t *testing.T) {
+	cfg := config.Default()
+	cfg.NodeName = "test-node"
+	c, err := NewController(cfg, health.NewChecker(0), fake.NewClientset(), nil, nil, nil, nil, nil, nil, nil, &PodCIDRStatus{}, nil)
+	assert.NoError(t, err)
+	defer c.queue.ShutDown()
+
+	next := *cfg
+	next.Routing.MixedRouting = config.MixedRoutingSubnet
+	c.Reconfigure(&next)
+
+	// The local node is processed again with the new configuration
+	assert.Same(t, &next, c.config.Load())
+	assert.Equal(t, 1, c.queue.Len())
+	key, _ := c.queue.Get()
+	assert.Equal(t, "test-node", key)
+}
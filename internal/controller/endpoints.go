@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	endpointSyncPeriod          = 10 * time.Second
+	persistentKeepaliveInterval = 25 * time.Second
+)
+
+type endpointState struct {
+	candidates []netip.Addr
+	publicKey  wgtypes.Key
+	current    int
+	since      time.Time // when the current endpoint was selected
+}
+
+// endpointSelector tracks which of its endpoint candidates is used for each
+// peer node, and moves a peer to the next candidate when handshakes with it
+// go stale.
+type endpointSelector struct {
+	mu    sync.Mutex
+	nodes map[string]*endpointState
+}
+
+func newEndpointSelector() *endpointSelector {
+	return &endpointSelector{
+		nodes: make(map[string]*endpointState),
+	}
+}
+
+// selectEndpoint returns the endpoint to use for the node. The previously
+// selected endpoint is kept for as long as it remains a candidate.
+func (s *endpointSelector) selectEndpoint(node string, publicKey wgtypes.Key, candidates []netip.Addr) netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.nodes[node]
+	if !ok {
+		state = &endpointState{since: time.Now()}
+		s.nodes[node] = state
+	} else if current := slices.Index(candidates, state.candidates[state.current]); current >= 0 {
+		state.current = current
+	} else {
+		state.current = 0
+		state.since = time.Now()
+	}
+
+	// A new key needs a new handshake, give it as much time as a new endpoint
+	if state.publicKey != publicKey {
+		state.since = time.Now()
+	}
+
+	state.candidates = slices.Clone(candidates)
+	state.publicKey = publicKey
+	return state.candidates[state.current]
+}
+
+// retain forgets the nodes that are no longer peers.
+func (s *endpointSelector) retain(nodes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for node := range s.nodes {
+		if !slices.Contains(nodes, node) {
+			delete(s.nodes, node)
+		}
+	}
+}
+
+// failover moves every peer without a handshake within the timeout to its next
+// endpoint candidate and returns the names of the nodes that were moved.
+func (s *endpointSelector) failover(stats []wireguard.PeerStats, now time.Time, timeout time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastHandshakes := make(map[string]time.Time, len(stats))
+	for _, peer := range stats {
+		lastHandshakes[peer.PublicKey] = peer.LastHandshakeTime
+	}
+
+	moved := make([]string, 0)
+	for node, state := range s.nodes {
+		if len(state.candidates) < 2 {
+			continue
+		}
+
+		lastHandshake := lastHandshakes[state.publicKey.String()]
+		if lastHandshake.Before(state.since) {
+			lastHandshake = state.since
+		}
+		if now.Sub(lastHandshake) < timeout {
+			continue
+		}
+
+		state.current = (state.current + 1) % len(state.candidates)
+		state.since = now
+		moved = append(moved, node)
+	}
+
+	slices.Sort(moved)
+	return moved
+}
+
+// syncEndpoints moves peers with stale handshakes to their next endpoint
+// candidate and requeues them, so that the new endpoint gets configured.
+func (c *controller) syncEndpoints(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	timeout := c.config.Load().WireGuard.EndpointFailoverTimeout.Duration
+	if timeout == 0 {
+		// Endpoint failover is disabled
+		return
+	}
+
+	stats, err := c.wireguard.PeerStats()
+	if err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to read wireguard peer stats")
+		return
+	}
+
+	for _, node := range c.endpoints.failover(stats, time.Now(), timeout) {
+		logger.Info("handshakes with peer are stale, trying next endpoint", "node", node)
+		c.queue.Add(node)
+	}
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+)
+
+func TestEndpointFailover(t *testing.T) {
+	key := generateKey(t)
+	v4, v6 := netip.MustParseAddr("192.168.0.1"), netip.MustParseAddr("2001:db8::1")
+	timeout := 3 * time.Minute
+
+	s := newEndpointSelector()
+	assert.Equal(t, v4, s.selectEndpoint("node-1", key, []netip.Addr{v4, v6}))
+	selected := s.nodes["node-1"].since
+
+	// Recent handshake, nothing to do
+	stats := []wireguard.PeerStats{{PublicKey: key.String(), LastHandshakeTime: selected.Add(time.Minute)}}
+	assert.Empty(t, s.failover(stats, selected.Add(2*time.Minute), timeout))
+
+	// Stale handshake, move to the next candidate
+	assert.Equal(t, []string{"node-1"}, s.failover(stats, selected.Add(5*time.Minute), timeout))
+	assert.Equal(t, v6, s.selectEndpoint("node-1", key, []netip.Addr{v4, v6}))
+
+	// The new endpoint gets a full timeout before it is given up on, after
+	// which the first candidate is tried again
+	assert.Empty(t, s.failover(stats, selected.Add(7*time.Minute), timeout))
+	assert.Equal(t, []string{"node-1"}, s.failover(stats, selected.Add(9*time.Minute), timeout))
+	assert.Equal(t, v4, s.selectEndpoint("node-1", key, []netip.Addr{v4, v6}))
+}
+
+func TestEndpointSelection(t *testing.T) {
+	key := generateKey(t)
+	a, b, c := netip.MustParseAddr("192.168.0.1"), netip.MustParseAddr("192.168.0.2"), netip.MustParseAddr("192.168.0.3")
+
+	s := newEndpointSelector()
+	assert.Equal(t, a, s.selectEndpoint("node-1", key, []netip.Addr{a, b}))
+	s.nodes["node-1"].current = 1
+
+	// The selected endpoint is kept as long as it is a candidate
+	assert.Equal(t, b, s.selectEndpoint("node-1", key, []netip.Addr{c, b}))
+	assert.Equal(t, c, s.selectEndpoint("node-1", key, []netip.Addr{c, a}))
+
+	// Peers with a single candidate never fail over
+	s.selectEndpoint("node-2", key, []netip.Addr{a})
+	assert.Equal(t, []string{"node-1"}, s.failover(nil, time.Now().Add(time.Hour), time.Minute))
+
+	s.retain([]string{"node-2"})
+	assert.NotContains(t, s.nodes, "node-1")
+	assert.Contains(t, s.nodes, "node-2")
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	klog "k8s.io/klog/v2"
+)
+
+// runPodCIDRExpansion adds pod CIDRs to the local node when IPAM reports the
+// current ones of an address family as (nearly) full.
+func (c *controller) runPodCIDRExpansion(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ranges := <-c.podCIDRExhausted:
+			if err := c.expandPodCIDRs(ctx, ranges); err != nil {
+				runtime.HandleErrorWithContext(ctx, err, "failed to expand pod CIDRs", "podCIDRs", ranges)
+			}
+		}
+	}
+}
+
+// expandPodCIDRs appends the next pod CIDR of the family that the source
+// resolves to the node's pod-cidrs annotation. The CNI configuration, the
+// WireGuard peers and the firewall are then reconciled from the node update.
+func (c *controller) expandPodCIDRs(ctx context.Context, ranges []netip.Prefix) error {
+	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	node, err := c.nodeClient.Get(ctx, cfg.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	ipv6 := ranges[0].Addr().Is6()
+	current := util.GetPodCIDRsFromAnnotation(node)
+	for _, cidr := range current {
+		if cidr.Addr().Is6() == ipv6 && !util.PrefixCovered(ranges, cidr) {
+			// Already expanded since the request was made
+			return nil
+		}
+	}
+
+	source := cfg.PodCIDR.SourceIPv4
+	if ipv6 {
+		source = cfg.PodCIDR.SourceIPv6
+	}
+	resolver := &podCidrResolver{config: cfg.PodCIDR, node: node, allocator: c.podCIDRAllocator}
+	candidates, err := resolver.forSource(ctx, source, ipv6)
+	if err != nil {
+		return err
+	}
+
+	var next netip.Prefix
+	for _, candidate := range candidates {
+		if !util.PrefixCovered(current, candidate) {
+			next = candidate
+			break
+		}
+	}
+
+	// The allocator claims another one from the pools
+	if !next.IsValid() && source == config.SourceAllocator && c.podCIDRAllocator != nil {
+		if next, err = c.podCIDRAllocator.Claim(ctx, node, ipv6); err != nil {
+			return err
+		}
+	}
+
+	if next.IsValid() {
+		podCidrs := util.SummarizeCIDRs(append(current, next))
+		logger.Info("expanding pod CIDRs", "added", next, "podCIDRs", podCidrs)
+		return patchNodeAnnotations(ctx, c.nodeClient, cfg.NodeName, map[string]any{
+			annotation.PodCidrsAnnotation: annotation.MarshalPodCidrs(podCidrs),
+		})
+	}
+
+	logger.Info("pod CIDRs are running out of addresses, but there are no more to expand into", "podCIDRs", ranges, "source", source)
+	return nil
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestActivePodCidrs(t *testing.T) {
+	candidates := []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/24"),
+		netip.MustParsePrefix("10.1.1.0/24"),
+		netip.MustParsePrefix("10.2.0.0/24"),
+	}
+
+	assert.Equal(t, candidates[:1], activePodCidrs(candidates, nil))
+	// Expanded ranges are kept, even if they were summarized
+	assert.Equal(t, candidates[:2], activePodCidrs(candidates, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/23")}))
+	assert.Equal(t, []netip.Prefix{candidates[0], candidates[2]}, activePodCidrs(candidates, []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/24"),
+		netip.MustParsePrefix("10.2.0.0/24"),
+		netip.MustParsePrefix("2001:db8::/64"),
+	}))
+}
+
+func TestExpandPodCIDRs(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	cfg := config.Default()
+
+	cfg.PodCIDR.SourceIPv4 = config.SourceFile
+	cfg.PodCIDR.SourceIPv6 = config.SourceNone
+	cfg.PodCIDR.SourcePath = filepath.Join(t.TempDir(), "cidrs.txt")
+	cfg.NodeName = "test-node"
+	require.NoError(t, os.WriteFile(cfg.PodCIDR.SourcePath, []byte("10.1.0.0/24\n10.3.0.0/24\n10.5.0.0/24\n"), 0o600))
+
+	client := fake.NewClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-node",
+			Annotations: map[string]string{
+				annotation.PodCidrsAnnotation: annotation.MarshalPodCidrs([]netip.Prefix{
+					netip.MustParsePrefix("10.1.0.0/24"),
+					netip.MustParsePrefix("2001:db8::/64"),
+				}),
+			},
+		},
+	})
+	c := &controller{nodeClient: client.CoreV1().Nodes()}
+	c.config.Store(cfg)
+
+	podCIDRs := func() []netip.Prefix {
+		node, err := client.CoreV1().Nodes().Get(ctx, "test-node", metav1.GetOptions{})
+		require.NoError(t, err)
+		return util.GetPodCIDRsFromAnnotation(node)
+	}
+
+	full := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}
+	require.NoError(t, c.expandPodCIDRs(ctx, full))
+	assert.ElementsMatch(t, []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/24"),
+		netip.MustParsePrefix("10.3.0.0/24"),
+		netip.MustParsePrefix("2001:db8::/64"),
+	}, podCIDRs())
+
+	// A stale request from before the expansion is ignored
+	require.NoError(t, c.expandPodCIDRs(ctx, full))
+	assert.Len(t, podCIDRs(), 3)
+
+	full = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("10.3.0.0/24")}
+	require.NoError(t, c.expandPodCIDRs(ctx, full))
+	assert.Len(t, podCIDRs(), 4)
+
+	// Nothing left to expand into
+	full = append(full, netip.MustParsePrefix("10.5.0.0/24"))
+	require.NoError(t, c.expandPodCIDRs(ctx, full))
+	assert.Len(t, podCIDRs(), 4)
+}
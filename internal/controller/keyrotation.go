@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	clientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	keyRotationSyncPeriod = 10 * time.Second
+	// Peers switch over to their next key without notice, so this is short
+	nextKeySyncPeriod = time.Second
+)
+
+// keysPublished reports whether the node's annotations match the key state.
+func keysPublished(node *v1.Node, state wireguard.KeyState) bool {
+	if node.Annotations[annotation.PublicKeyAnnotation] != state.PublicKey.String() {
+		return false
+	}
+	nextPublicKey, ok := node.Annotations[annotation.NextPublicKeyAnnotation]
+	if state.NextPublicKey == nil {
+		return !ok
+	}
+	return nextPublicKey == state.NextPublicKey.String()
+}
+
+// publishKeys writes the current and the next public key to the node
+// annotations, optionally also removing a pending rotation request.
+func publishKeys(ctx context.Context, nodeClient clientv1.NodeInterface, nodeName string, state wireguard.KeyState, clearRequest bool) error {
+	// A null value removes the annotation in a JSON merge patch
+	annotations := map[string]any{
+		annotation.PublicKeyAnnotation:     state.PublicKey.String(),
+		annotation.NextPublicKeyAnnotation: nil,
+	}
+	if state.NextPublicKey != nil {
+		annotations[annotation.NextPublicKeyAnnotation] = state.NextPublicKey.String()
+	}
+	if clearRequest {
+		annotations[annotation.RotateKeyAnnotation] = nil
+	}
+
+	return patchNodeAnnotations(ctx, nodeClient, nodeName, annotations)
+}
+
+// syncKeyRotation rotates the WireGuard key when it is older than the rotation
+// interval or when a rotation is requested with the wigglenet/rotate-key
+// annotation. The new key is first published as the next key, so that peers
+// can configure it ahead of time, and the device is switched over to it only
+// after the grace period.
+func (c *controller) syncKeyRotation(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
+
+	node, err := c.nodeLister.Get(cfg.NodeName)
+	if err != nil {
+		// Node not yet observed in the cache
+		return
+	}
+
+	state := c.wireguard.KeyState()
+	if state.NextPublicKey == nil {
+		_, requested := node.Annotations[annotation.RotateKeyAnnotation]
+		interval := cfg.WireGuard.KeyRotationInterval.Duration
+		due := interval > 0 && time.Since(state.Created) >= interval
+		if !requested && !due {
+			if !keysPublished(node, state) {
+				if err := publishKeys(ctx, c.nodeClient, cfg.NodeName, state, false); err != nil {
+					runtime.HandleErrorWithContext(ctx, err, "failed to publish wireguard keys")
+				}
+			}
+			return
+		}
+
+		logger.Info("starting wireguard key rotation", "requested", requested, "keyAge", time.Since(state.Created).Round(time.Second))
+		if err := c.wireguard.StageKey(ctx); err != nil {
+			runtime.HandleErrorWithContext(ctx, err, "failed to stage next wireguard key")
+			return
+		}
+		state = c.wireguard.KeyState()
+	}
+
+	if time.Since(state.Staged) < cfg.WireGuard.KeyRotationGracePeriod.Duration {
+		if !keysPublished(node, state) {
+			if err := publishKeys(ctx, c.nodeClient, cfg.NodeName, state, false); err != nil {
+				runtime.HandleErrorWithContext(ctx, err, "failed to publish next wireguard key")
+			}
+		}
+		return
+	}
+
+	if err := c.wireguard.CommitKey(ctx); err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to switch to next wireguard key")
+		return
+	}
+
+	// Peers move their allowed IPs over to the new key as soon as they observe
+	// this update.
+	if err := publishKeys(ctx, c.nodeClient, cfg.NodeName, c.wireguard.KeyState(), true); err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to publish wireguard keys")
+	}
+}
+
+// syncNextKeys moves the allowed IPs of peers that are rotating their key over
+// to the next key as soon as they switch over to it. Until they do, and until
+// their node annotations are updated, traffic to and from them would be
+// dropped.
+func (c *controller) syncNextKeys(ctx context.Context) {
+	if err := c.wireguard.SyncNextKeys(ctx); err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to sync the next wireguard keys of peers")
+	}
+}
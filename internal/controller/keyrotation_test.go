@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	"github.com/tibordp/wigglenet/internal/wireguard/wireguardtest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func generateKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key.PublicKey()
+}
+
+func TestSyncKeyRotation(t *testing.T) {
+	cfg := config.Default()
+	cfg.NodeName = "test-node"
+	cfg.WireGuard.KeyRotationGracePeriod.Duration = time.Hour
+
+	manager := &wireguardtest.Manager{
+		Keys: wireguard.KeyState{PublicKey: generateKey(t), Created: time.Now()},
+		Next: generateKey(t),
+	}
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-node",
+			Annotations: map[string]string{
+				annotation.PublicKeyAnnotation: manager.Keys.PublicKey.String(),
+				annotation.RotateKeyAnnotation: "",
+			},
+		},
+	})
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c := &controller{
+		nodeLister: listersv1.NewNodeLister(indexer),
+		wireguard:  manager,
+		nodeClient: client.CoreV1().Nodes(),
+	}
+	c.config.Store(cfg)
+	ctx := context.Background()
+
+	sync := func() *v1.Node {
+		t.Helper()
+		node, err := client.CoreV1().Nodes().Get(ctx, "test-node", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NoError(t, indexer.Update(node))
+		c.syncKeyRotation(ctx)
+		node, err = client.CoreV1().Nodes().Get(ctx, "test-node", metav1.GetOptions{})
+		require.NoError(t, err)
+		return node
+	}
+
+	// The requested rotation stages the next key and publishes it
+	previousKey := manager.Keys.PublicKey
+	node := sync()
+	assert.Equal(t, previousKey.String(), node.Annotations[annotation.PublicKeyAnnotation])
+	assert.Equal(t, manager.Next.String(), node.Annotations[annotation.NextPublicKeyAnnotation])
+	assert.Contains(t, node.Annotations, annotation.RotateKeyAnnotation)
+
+	// Nothing happens until the grace period has passed
+	node = sync()
+	assert.Equal(t, previousKey, manager.Keys.PublicKey)
+
+	// After that, the node switches to the next key and clears the request
+	manager.Keys.Staged = time.Now().Add(-2 * time.Hour)
+	node = sync()
+	assert.Equal(t, manager.Next, manager.Keys.PublicKey)
+	assert.Equal(t, manager.Next.String(), node.Annotations[annotation.PublicKeyAnnotation])
+	assert.NotContains(t, node.Annotations, annotation.NextPublicKeyAnnotation)
+	assert.NotContains(t, node.Annotations, annotation.RotateKeyAnnotation)
+
+	// No further rotation without a request, as time-based rotation is disabled
+	node = sync()
+	assert.Nil(t, manager.Keys.NextPublicKey)
+	assert.Equal(t, manager.Next.String(), node.Annotations[annotation.PublicKeyAnnotation])
+}
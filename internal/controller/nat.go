@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	klog "k8s.io/klog/v2"
+)
+
+// Endpoints of peers without a handshake for this long are not reported, as
+// the keepalives of a peer behind NAT keep its tunnels active.
+const observedEndpointMaxAge = 3 * time.Minute
+
+func behindNAT(node *v1.Node) bool {
+	return node.Annotations[annotation.BehindNATAnnotation] == "true"
+}
+
+// peerEndpointOverride returns the endpoint from the wigglenet/endpoint
+// annotation or, for nodes behind NAT, the endpoint observed by the other nodes.
+func peerEndpointOverride(ctx context.Context, node *v1.Node) (netip.AddrPort, bool) {
+	logger := klog.FromContext(ctx)
+
+	annotations := []string{annotation.EndpointAnnotation}
+	if behindNAT(node) {
+		annotations = append(annotations, annotation.ReflexiveEndpointAnnotation)
+	}
+
+	for _, a := range annotations {
+		value := node.Annotations[a]
+		if value == "" {
+			continue
+		}
+		endpoint, err := annotation.ParseEndpoint(value)
+		if err != nil {
+			logger.Info("invalid endpoint annotation", "node", node.Name, "annotation", a, "error", err)
+			continue
+		}
+		return endpoint, true
+	}
+
+	return netip.AddrPort{}, false
+}
+
+// observeEndpoints returns the endpoints WireGuard currently reports for the
+// peers behind NAT, keyed by their public key. As WireGuard updates a peer's
+// endpoint to the source of its packets, this is the peer's address and port
+// on the public side of its NAT.
+func observeEndpoints(nodeName string, nodes []*v1.Node, stats []wireguard.PeerStats, now time.Time) map[string]string {
+	natKeys := make(map[string]struct{})
+	for _, node := range nodes {
+		if node.Name != nodeName && behindNAT(node) {
+			natKeys[node.Annotations[annotation.PublicKeyAnnotation]] = struct{}{}
+		}
+	}
+
+	observed := make(map[string]string)
+	for _, peer := range stats {
+		if _, ok := natKeys[peer.PublicKey]; !ok || peer.Endpoint == "" {
+			continue
+		}
+		if now.Sub(peer.LastHandshakeTime) > observedEndpointMaxAge {
+			continue
+		}
+		observed[peer.PublicKey] = peer.Endpoint
+	}
+	return observed
+}
+
+// reflexiveEndpoint determines the endpoint the other nodes see for the given
+// public key. Observations by nodes that are not behind NAT themselves are
+// preferred, as nodes behind the same NAT see the private address. Among them,
+// the most common endpoint wins.
+func reflexiveEndpoint(nodeName string, nodes []*v1.Node, publicKey string) string {
+	counts := make(map[string]int)
+	for _, preferred := range []bool{true, false} {
+		for _, node := range nodes {
+			if node.Name == nodeName || behindNAT(node) != !preferred {
+				continue
+			}
+			value, ok := node.Annotations[annotation.ObservedEndpointsAnnotation]
+			if !ok {
+				continue
+			}
+			observed, err := annotation.UnmarshalObservedEndpoints(value)
+			if err != nil {
+				continue
+			}
+			if endpoint, ok := observed[publicKey]; ok {
+				counts[endpoint]++
+			}
+		}
+		if len(counts) > 0 {
+			break
+		}
+	}
+
+	if len(counts) == 0 {
+		return ""
+	}
+
+	// Sorted, so that ties are broken deterministically
+	endpoints := slices.Sorted(maps.Keys(counts))
+	return slices.MaxFunc(endpoints, func(a, b string) int {
+		if c := cmp.Compare(counts[a], counts[b]); c != 0 {
+			return c
+		}
+		return cmp.Compare(b, a)
+	})
+}
+
+// syncNATEndpoints publishes the endpoints observed for peers behind NAT and,
+// if the local node is behind NAT, its own endpoint as observed by the others.
+// Nodes behind NAT use the published endpoints to reach each other.
+func (c *controller) syncNATEndpoints(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
+
+	node, err := c.nodeLister.Get(cfg.NodeName)
+	if err != nil {
+		// Node not yet observed in the cache
+		return
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to list nodes")
+		return
+	}
+
+	stats, err := c.wireguard.PeerStats()
+	if err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to read wireguard peer stats")
+		return
+	}
+
+	// An empty value removes the annotation
+	desired := map[string]string{
+		annotation.ObservedEndpointsAnnotation: "",
+		annotation.ReflexiveEndpointAnnotation: "",
+	}
+	if observed := observeEndpoints(cfg.NodeName, nodes, stats, time.Now()); len(observed) > 0 {
+		desired[annotation.ObservedEndpointsAnnotation] = annotation.MarshalObservedEndpoints(observed)
+	}
+	if cfg.WireGuard.BehindNAT {
+		// Keep the last known endpoint while there are no observations
+		desired[annotation.ReflexiveEndpointAnnotation] = node.Annotations[annotation.ReflexiveEndpointAnnotation]
+		if endpoint := reflexiveEndpoint(cfg.NodeName, nodes, c.wireguard.KeyState().PublicKey.String()); endpoint != "" {
+			desired[annotation.ReflexiveEndpointAnnotation] = endpoint
+		}
+	}
+
+	changed := make(map[string]any)
+	for key, value := range desired {
+		existing, ok := node.Annotations[key]
+		if value == "" && ok {
+			changed[key] = nil
+		} else if value != "" && value != existing {
+			changed[key] = value
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	if err := patchNodeAnnotations(ctx, c.nodeClient, cfg.NodeName, changed); err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to publish NAT endpoints")
+		return
+	}
+	if endpoint, ok := changed[annotation.ReflexiveEndpointAnnotation]; ok && endpoint != nil {
+		logger.Info("learned endpoint behind NAT", "endpoint", endpoint)
+	}
+}
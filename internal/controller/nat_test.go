@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func natNode(name string, behindNAT bool, annotations map[string]string) *v1.Node {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annotation.PublicKeyAnnotation: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+				annotation.NodeIpsAnnotation:   `["10.0.0.1"]`,
+				annotation.PodCidrsAnnotation:  `["10.1.0.0/24"]`,
+			},
+		},
+	}
+	if behindNAT {
+		node.Annotations[annotation.BehindNATAnnotation] = "true"
+	}
+	for k, v := range annotations {
+		node.Annotations[k] = v
+	}
+	return node
+}
+
+func TestMakePeerEndpointOverride(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	peer := makePeer(ctx, config.Default().WireGuard, natNode("node-1", false, map[string]string{
+		annotation.EndpointAnnotation: "203.0.113.1:51820",
+	}))
+	assert.Equal(t, netip.MustParseAddr("203.0.113.1"), peer.Endpoint)
+	assert.Equal(t, 51820, peer.Port)
+	assert.Zero(t, peer.PersistentKeepalive)
+
+	// The reflexive endpoint is only used for nodes behind NAT
+	peer = makePeer(ctx, config.Default().WireGuard, natNode("node-1", false, map[string]string{
+		annotation.ReflexiveEndpointAnnotation: "203.0.113.1:1024",
+	}))
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), peer.Endpoint)
+	assert.Zero(t, peer.Port)
+
+	peer = makePeer(ctx, config.Default().WireGuard, natNode("node-1", true, map[string]string{
+		annotation.ReflexiveEndpointAnnotation: "203.0.113.1:1024",
+	}))
+	assert.Equal(t, netip.MustParseAddr("203.0.113.1"), peer.Endpoint)
+	assert.Equal(t, 1024, peer.Port)
+	assert.Equal(t, persistentKeepaliveInterval, peer.PersistentKeepalive)
+	assert.False(t, peer.Roaming)
+
+	// Without the reflexive endpoint, the endpoint WireGuard learns is kept
+	peer = makePeer(ctx, config.Default().WireGuard, natNode("node-1", true, nil))
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), peer.Endpoint)
+	assert.True(t, peer.Roaming)
+
+	// An invalid override is ignored
+	peer = makePeer(ctx, config.Default().WireGuard, natNode("node-1", false, map[string]string{
+		annotation.EndpointAnnotation: "gateway.example.com:51820",
+	}))
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), peer.Endpoint)
+}
+
+func TestObservedEndpoints(t *testing.T) {
+	natKey, otherKey := generateKey(t).String(), generateKey(t).String()
+	now := time.Now()
+
+	nodes := []*v1.Node{
+		natNode("nat", true, map[string]string{annotation.PublicKeyAnnotation: natKey}),
+		natNode("other", false, map[string]string{annotation.PublicKeyAnnotation: otherKey}),
+	}
+	stats := []wireguard.PeerStats{
+		{PublicKey: natKey, Endpoint: "203.0.113.1:1024", LastHandshakeTime: now.Add(-time.Minute)},
+		{PublicKey: otherKey, Endpoint: "198.51.100.1:24601", LastHandshakeTime: now.Add(-time.Minute)},
+	}
+
+	// Only peers behind NAT are reported
+	assert.Equal(t, map[string]string{natKey: "203.0.113.1:1024"}, observeEndpoints("local", nodes, stats, now))
+
+	// ... and only while the tunnel is up
+	assert.Empty(t, observeEndpoints("local", nodes, stats, now.Add(time.Hour)))
+}
+
+func TestReflexiveEndpoint(t *testing.T) {
+	key := generateKey(t).String()
+	observed := func(endpoint string) map[string]string {
+		return map[string]string{
+			annotation.ObservedEndpointsAnnotation: annotation.MarshalObservedEndpoints(map[string]string{key: endpoint}),
+		}
+	}
+
+	assert.Equal(t, "", reflexiveEndpoint("local", []*v1.Node{natNode("a", false, nil)}, key))
+
+	// Nodes behind NAT are only used if there is nothing else
+	nodes := []*v1.Node{natNode("a", true, observed("192.168.0.1:24601"))}
+	assert.Equal(t, "192.168.0.1:24601", reflexiveEndpoint("local", nodes, key))
+
+	nodes = append(nodes,
+		natNode("b", false, observed("203.0.113.1:1024")),
+		natNode("c", false, observed("203.0.113.1:2048")),
+		natNode("d", false, observed("203.0.113.1:2048")),
+	)
+	assert.Equal(t, "203.0.113.1:2048", reflexiveEndpoint("local", nodes, key))
+}
@@ -0,0 +1,371 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/metrics"
+	"github.com/tibordp/wigglenet/internal/routing"
+	"github.com/tibordp/wigglenet/internal/util"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	klog "k8s.io/klog/v2"
+)
+
+// fileState is what is compared to detect changes of a watched file. Files
+// mounted from a ConfigMap are replaced through a symlink, which is followed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// podCIDRWatch tracks the inputs of the pod CIDR sources, so that they are
+// only re-evaluated when something they depend on changed.
+type podCIDRWatch struct {
+	files     map[string]fileState
+	nodeInput string
+	// A change of the pod CIDRs is held back and is retried periodically
+	blocked bool
+}
+
+func watchedFiles(cfg config.PodCIDR) []string {
+	files := make([]string, 0)
+	if cfg.Uses(config.SourceFile) && cfg.SourcePath != "" {
+		files = append(files, cfg.SourcePath)
+	}
+	if cfg.Uses(config.SourceExpression) && cfg.ExpressionPath != "" {
+		files = append(files, cfg.ExpressionPath)
+	}
+	return files
+}
+
+func statFiles(files []string) map[string]fileState {
+	states := make(map[string]fileState)
+	for _, file := range files {
+		// A missing file is a state too
+		if info, err := os.Stat(file); err == nil {
+			states[file] = fileState{modTime: info.ModTime(), size: info.Size()}
+		} else {
+			states[file] = fileState{}
+		}
+	}
+	return states
+}
+
+// podCIDRNodeInput returns the parts of the node object the pod CIDR sources
+// depend on: the labels and annotations for the expression and the pod CIDRs
+// in the spec. Annotations owned by Wigglenet are left out, as some of them
+// change regularly.
+func podCIDRNodeInput(cfg config.PodCIDR, node *v1.Node) string {
+	input := struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+		PodCIDRs    []string          `json:"podCIDRs,omitempty"`
+	}{PodCIDRs: node.Spec.PodCIDRs}
+
+	if cfg.Uses(config.SourceExpression) {
+		input.Labels = node.Labels
+		input.Annotations = make(map[string]string)
+		for key, value := range node.Annotations {
+			if !strings.HasPrefix(key, "wigglenet/") {
+				input.Annotations[key] = value
+			}
+		}
+	}
+
+	val, _ := json.Marshal(input)
+	return string(val)
+}
+
+// ignoredLinkChange reports whether a change of an address or a route on the
+// link cannot affect the pod CIDR sources. The expression only sees global
+// unicast addresses and routes. The WireGuard link and the host side of the
+// pods' veths, which the ptp plugin assigns the pod CIDR gateway to and routes
+// the pod addresses through, get theirs from the pod CIDRs, so they change
+// whenever pods and nodes come and go.
+func (c *controller) ignoredLinkChange(cfg *config.Config, linkIndex int, prefix netip.Prefix) bool {
+	wgLinkIndex := 0
+	if link, err := netlink.LinkByName(cfg.WireGuard.InterfaceName); err == nil {
+		wgLinkIndex = link.Attrs().Index
+	}
+	var podCIDRs []netip.Prefix
+	if node, err := c.nodeLister.Get(cfg.NodeName); err == nil {
+		podCIDRs = util.GetPodCIDRsFromAnnotation(node)
+	}
+	return ignoredPrefix(linkIndex, prefix, wgLinkIndex, podCIDRs)
+}
+
+func ignoredPrefix(linkIndex int, prefix netip.Prefix, wgLinkIndex int, podCIDRs []netip.Prefix) bool {
+	if !prefix.Addr().IsGlobalUnicast() || (wgLinkIndex != 0 && linkIndex == wgLinkIndex) {
+		return true
+	}
+	return slices.ContainsFunc(podCIDRs, func(cidr netip.Prefix) bool {
+		return cidr.Bits() <= prefix.Bits() && cidr.Contains(prefix.Addr())
+	})
+}
+
+// requestPodCIDRResync asks for the node's pod CIDR inputs to be checked for
+// changes. It does not block, requests are coalesced.
+func (c *controller) requestPodCIDRResync() {
+	if c.podCIDRResync == nil {
+		return
+	}
+	select {
+	case c.podCIDRResync <- struct{}{}:
+	default:
+	}
+}
+
+// runPodCIDRWatch re-evaluates the pod CIDR sources of the local node when the
+// addresses on the node, the node object or the source files change.
+func (c *controller) runPodCIDRWatch(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	// None of the pod CIDR settings are reloaded live, see config.Reload
+	cfg := c.config.Load()
+
+	w := &podCIDRWatch{files: statFiles(watchedFiles(cfg.PodCIDR))}
+	if node, err := c.nodeLister.Get(cfg.NodeName); err == nil {
+		w.nodeInput = podCIDRNodeInput(cfg.PodCIDR, node)
+	}
+
+	// The expression is evaluated against the addresses on the node's
+	// interfaces and the routing table
+	addrUpdates := make(chan netlink.AddrUpdate)
+	routeUpdates := make(chan netlink.RouteUpdate)
+	if cfg.PodCIDR.Uses(config.SourceExpression) {
+		err := netlink.AddrSubscribeWithOptions(addrUpdates, ctx.Done(), netlink.AddrSubscribeOptions{
+			ErrorCallback: func(err error) {
+				logger.Error(err, "address subscription failed")
+			},
+		})
+		if err != nil {
+			runtime.HandleErrorWithContext(ctx, err, "failed to subscribe to address changes, pod CIDRs will not follow them")
+		}
+		err = netlink.RouteSubscribeWithOptions(routeUpdates, ctx.Done(), netlink.RouteSubscribeOptions{
+			ErrorCallback: func(err error) {
+				logger.Error(err, "route subscription failed")
+			},
+		})
+		if err != nil {
+			runtime.HandleErrorWithContext(ctx, err, "failed to subscribe to route changes, pod CIDRs will not follow them")
+		}
+	}
+
+	ticker := time.NewTicker(cfg.PodCIDR.WatchInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		changed := false
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-addrUpdates:
+			if !ok {
+				// The subscription failed
+				addrUpdates = nil
+				continue
+			}
+			addr, _ := netip.AddrFromSlice(update.LinkAddress.IP)
+			changed = !c.ignoredLinkChange(cfg, update.LinkIndex, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		case update, ok := <-routeUpdates:
+			if !ok {
+				routeUpdates = nil
+				continue
+			}
+			// Only the main table is an input. Wigglenet installs routes
+			// there too: the native routes have their own protocol, the
+			// routes to the other nodes' pod CIDRs go through the WireGuard
+			// link and the ptp plugin's routes to the pods are in the node's
+			// own pod CIDRs.
+			if update.Table != unix.RT_TABLE_MAIN || update.Protocol == routing.RouteProtocol || update.Dst == nil {
+				continue
+			}
+			dst, ok := util.PrefixFromIPNet(*update.Dst)
+			changed = ok && !c.ignoredLinkChange(cfg, update.LinkIndex, dst.Masked())
+		case <-c.podCIDRResync:
+			if node, err := c.nodeLister.Get(cfg.NodeName); err == nil {
+				input := podCIDRNodeInput(cfg.PodCIDR, node)
+				changed = input != w.nodeInput
+				w.nodeInput = input
+			}
+		case <-ticker.C:
+			files := statFiles(watchedFiles(cfg.PodCIDR))
+			changed = w.blocked || !maps.Equal(files, w.files)
+			w.files = files
+		}
+
+		if !changed {
+			continue
+		}
+
+		blocked, err := c.reevaluatePodCIDRs(ctx)
+		if err != nil {
+			runtime.HandleErrorWithContext(ctx, err, "failed to re-evaluate pod CIDRs")
+		}
+		w.blocked = blocked
+	}
+}
+
+// reevaluatePodCIDRs resolves the pod CIDRs of the local node again and
+// updates the node's pod-cidrs annotation if they changed. It reports whether
+// the change was held back because pods still have addresses in the pod CIDRs
+// that would be removed.
+func (c *controller) reevaluatePodCIDRs(ctx context.Context) (bool, error) {
+	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
+
+	node, err := c.nodeLister.Get(cfg.NodeName)
+	if err != nil {
+		return false, err
+	}
+
+	resolution, err := resolvePodCidrs(ctx, cfg.PodCIDR, node, c.podCIDRAllocator)
+	if err != nil {
+		return false, err
+	}
+
+	current := util.GetPodCIDRsFromAnnotation(node)
+	if samePrefixes(current, resolution.PodCIDRs) {
+		c.setPodCIDRChangeBlocked(false)
+		c.podCIDRStatus.Set(resolution)
+		return false, nil
+	}
+
+	removed := make([]netip.Prefix, 0)
+	for _, cidr := range current {
+		if !util.PrefixCovered(resolution.PodCIDRs, cidr) {
+			removed = append(removed, cidr)
+		}
+	}
+
+	if cfg.PodCIDR.SafeChange && len(removed) > 0 {
+		pods, err := c.podsWithAddresses(ctx, removed)
+		if err != nil {
+			return false, err
+		}
+		if len(pods) > 0 {
+			logger.Info("not changing pod CIDRs while pods still have addresses in the ones being removed", "podCIDRs", resolution.PodCIDRs, "removed", removed, "pods", pods)
+			c.setPodCIDRChangeBlocked(true)
+			return true, nil
+		}
+	}
+
+	logger.Info("pod CIDRs changed", "old", current, "new", resolution.PodCIDRs)
+	if err := patchNodeAnnotations(ctx, c.nodeClient, cfg.NodeName, map[string]any{
+		annotation.PodCidrsAnnotation: annotation.MarshalPodCidrs(resolution.PodCIDRs),
+	}); err != nil {
+		return false, err
+	}
+
+	c.setPodCIDRChangeBlocked(false)
+	c.podCIDRStatus.Set(resolution)
+	return false, nil
+}
+
+func (c *controller) setPodCIDRChangeBlocked(blocked bool) {
+	if !c.config.Load().Metrics.Enabled {
+		return
+	}
+	if blocked {
+		metrics.PodCIDRChangeBlocked.Set(1)
+	} else {
+		metrics.PodCIDRChangeBlocked.Set(0)
+	}
+}
+
+// podsWithAddresses returns the pods on the local node that have an address
+// in one of the prefixes. The pod status is only updated once the pod sandbox
+// is up, so the allocations of the IPAM plugin are checked too, which also
+// cover the pods that are being created.
+func (c *controller) podsWithAddresses(ctx context.Context, prefixes []netip.Prefix) ([]string, error) {
+	cfg := c.config.Load()
+	inPrefixes := func(addr netip.Addr) bool {
+		return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr)
+		})
+	}
+
+	pods, err := c.podClient.List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", cfg.NodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]struct{})
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != cfg.NodeName || pod.Spec.HostNetwork {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			if addr, err := netip.ParseAddr(podIP.IP); err == nil && inPrefixes(addr) {
+				result[pod.Namespace+"/"+pod.Name] = struct{}{}
+				break
+			}
+		}
+	}
+
+	allocations, err := c.ipamAllocations(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for addr, owner := range allocations {
+		if inPrefixes(addr) {
+			result[owner] = struct{}{}
+		}
+	}
+
+	return slices.Sorted(maps.Keys(result)), nil
+}
+
+// ipamAllocations returns the addresses the IPAM plugin has allocated on the
+// node, with the pod (or the container, if the pod is not known) they were
+// allocated to.
+func (c *controller) ipamAllocations(cfg *config.Config) (map[netip.Addr]string, error) {
+	if c.ipam == nil {
+		if cfg.CNI.IPAMPlugin != config.IPAMHostLocal || c.hostLocalDataDir == "" {
+			return nil, nil
+		}
+		allocations, err := cni.HostLocalAllocations(c.hostLocalDataDir)
+		if err != nil {
+			return nil, err
+		}
+		for addr, containerID := range allocations {
+			allocations[addr] = "container " + containerID
+		}
+		return allocations, nil
+	}
+
+	result := make(map[netip.Addr]string)
+	for _, allocation := range c.ipam.Allocations() {
+		owner := "container " + allocation.ContainerID
+		if allocation.Pod != "" {
+			owner = allocation.Namespace + "/" + allocation.Pod
+		}
+		for _, ip := range allocation.IPs {
+			result[ip.Address.Addr()] = owner
+		}
+	}
+	return result, nil
+}
+
+// samePrefixes reports whether both lists have the same prefixes, in any order.
+func samePrefixes(a, b []netip.Prefix) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	util.SortPrefixes(a)
+	util.SortPrefixes(b)
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/annotation"
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/ipam"
+	"github.com/tibordp/wigglenet/internal/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestPodCIDRNodeInput(t *testing.T) {
+	cfg := config.Default()
+	cfg.PodCIDR.SourceIPv4 = config.SourceSpec
+	cfg.PodCIDR.SourceIPv6 = config.SourceExpression
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Labels:      map[string]string{"zone": "a"},
+		Annotations: map[string]string{"example.com/prefix": "1"},
+	}}
+	input := podCIDRNodeInput(cfg.PodCIDR, node)
+
+	node.Annotations[annotation.ObservedEndpointsAnnotation] = "{}"
+	assert.Equal(t, input, podCIDRNodeInput(cfg.PodCIDR, node))
+
+	node.Labels["zone"] = "b"
+	assert.NotEqual(t, input, podCIDRNodeInput(cfg.PodCIDR, node))
+
+	// Labels and annotations are only used by the expression
+	cfg.PodCIDR.SourceIPv6 = config.SourceFile
+	input = podCIDRNodeInput(cfg.PodCIDR, node)
+	node.Labels["zone"] = "c"
+	assert.Equal(t, input, podCIDRNodeInput(cfg.PodCIDR, node))
+
+	node.Spec.PodCIDRs = []string{"10.0.0.0/24"}
+	assert.NotEqual(t, input, podCIDRNodeInput(cfg.PodCIDR, node))
+}
+
+func TestReevaluatePodCIDRs(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	cfg := config.Default()
+
+	cfg.PodCIDR.SourceIPv4 = config.SourceNone
+	cfg.PodCIDR.SourceIPv6 = config.SourceFile
+	cfg.PodCIDR.SourcePath = filepath.Join(t.TempDir(), "cidrs.txt")
+	cfg.NodeName = "test-node"
+	cfg.PodCIDR.SafeChange = true
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-node",
+			Annotations: map[string]string{
+				annotation.PodCidrsAnnotation: annotation.MarshalPodCidrs([]netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}),
+			},
+		},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       v1.PodSpec{NodeName: "test-node"},
+		Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "2001:db8:1::5"}}},
+	}
+	client := fake.NewClientset(node, pod)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, indexer.Add(node))
+
+	c := &controller{
+		nodeLister:    listersv1.NewNodeLister(indexer),
+		nodeClient:    client.CoreV1().Nodes(),
+		podClient:     client.CoreV1().Pods(metav1.NamespaceAll),
+		podCIDRStatus: &PodCIDRStatus{},
+	}
+	c.config.Store(cfg)
+
+	podCIDRs := func() []netip.Prefix {
+		node, err := client.CoreV1().Nodes().Get(ctx, "test-node", metav1.GetOptions{})
+		require.NoError(t, err)
+		return util.GetPodCIDRsFromAnnotation(node)
+	}
+
+	// Unchanged
+	require.NoError(t, os.WriteFile(cfg.PodCIDR.SourcePath, []byte("2001:db8:1::/64\n"), 0o600))
+	blocked, err := c.reevaluatePodCIDRs(ctx)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, c.podCIDRStatus.Get().PodCIDRs)
+
+	// A pod still has an address in the old pod CIDR
+	require.NoError(t, os.WriteFile(cfg.PodCIDR.SourcePath, []byte("2001:db8:2::/64\n"), 0o600))
+	blocked, err = c.reevaluatePodCIDRs(ctx)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}, podCIDRs())
+
+	// Adding pod CIDRs is always fine
+	require.NoError(t, os.WriteFile(cfg.PodCIDR.SourcePath, []byte("2001:db8:1::/64\n2001:db8:2::/64\n"), 0o600))
+	blocked, err = c.reevaluatePodCIDRs(ctx)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64"), netip.MustParsePrefix("2001:db8:2::/64")}, podCIDRs())
+
+	// Once the pod is gone
+	require.NoError(t, os.WriteFile(cfg.PodCIDR.SourcePath, []byte("2001:db8:2::/64\n"), 0o600))
+	require.NoError(t, client.CoreV1().Pods("default").Delete(ctx, "web", metav1.DeleteOptions{}))
+	blocked, err = c.reevaluatePodCIDRs(ctx)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:2::/64")}, podCIDRs())
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:2::/64")}, c.podCIDRStatus.Get().PodCIDRs)
+}
+
+type fakeIPAM struct {
+	ipam.Manager
+	allocations []ipam.Allocation
+}
+
+func (f *fakeIPAM) Allocations() []ipam.Allocation {
+	return f.allocations
+}
+
+func TestPodsWithAddresses(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	cfg := config.Default()
+	cfg.NodeName = "test-node"
+	cfg.CNI.IPAMPlugin = config.IPAMHostLocal
+
+	client := fake.NewClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       v1.PodSpec{NodeName: "test-node"},
+		Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "2001:db8:1::5"}}},
+	})
+
+	// The pod that is being created does not have its addresses in the status yet
+	dataDir := t.TempDir()
+	networkDir := filepath.Join(dataDir, cni.NetworkName)
+	require.NoError(t, os.MkdirAll(networkDir, 0o755))
+	for name, content := range map[string]string{
+		"2001:db8:1::5":      "web\neth0",
+		"2001:db8:1::6":      "creating\neth0",
+		"10.1.0.2":           "elsewhere\neth0",
+		"last_reserved_ip.0": "2001:db8:1::6",
+		"lock":               "",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(networkDir, name), []byte(content), 0o600))
+	}
+
+	c := &controller{
+		podClient:        client.CoreV1().Pods(metav1.NamespaceAll),
+		hostLocalDataDir: dataDir,
+	}
+	c.config.Store(cfg)
+
+	prefixes := []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}
+	pods, err := c.podsWithAddresses(ctx, prefixes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"container creating", "container web", "default/web"}, pods)
+
+	// With wigglenet-ipam, the allocations know the pod
+	cfg.CNI.IPAMPlugin = config.IPAMWigglenet
+	c.ipam = &fakeIPAM{allocations: []ipam.Allocation{
+		{ContainerID: "web", Namespace: "default", Pod: "web", IPs: []ipam.IPConfig{{Address: netip.MustParsePrefix("2001:db8:1::5/64")}}},
+		{ContainerID: "creating", Namespace: "default", Pod: "db", IPs: []ipam.IPConfig{{Address: netip.MustParsePrefix("2001:db8:1::6/64")}}},
+		{ContainerID: "elsewhere", IPs: []ipam.IPConfig{{Address: netip.MustParsePrefix("10.1.0.2/24")}}},
+	}}
+	pods, err = c.podsWithAddresses(ctx, prefixes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default/db", "default/web"}, pods)
+}
+
+func TestIgnoredPrefix(t *testing.T) {
+	podCIDRs := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("2001:db8:1::/64")}
+	host := func(addr string) netip.Prefix {
+		a := netip.MustParseAddr(addr)
+		return netip.PrefixFrom(a, a.BitLen())
+	}
+
+	// Node addresses
+	assert.False(t, ignoredPrefix(2, host("192.168.0.10"), 5, podCIDRs))
+	assert.False(t, ignoredPrefix(2, host("2001:db8::10"), 5, podCIDRs))
+	assert.False(t, ignoredPrefix(2, host("192.168.0.10"), 0, podCIDRs))
+
+	// Gateway addresses on the pod veths
+	assert.True(t, ignoredPrefix(7, host("10.1.0.1"), 5, podCIDRs))
+	assert.True(t, ignoredPrefix(7, host("2001:db8:1::1"), 5, podCIDRs))
+	// Link-local addresses of the pod veths
+	assert.True(t, ignoredPrefix(7, host("fe80::1"), 5, podCIDRs))
+	// Anything on the WireGuard link
+	assert.True(t, ignoredPrefix(5, host("192.168.100.1"), 5, podCIDRs))
+
+	// Routes of the uplink, including ones covering the pod CIDRs
+	assert.False(t, ignoredPrefix(2, netip.MustParsePrefix("192.168.0.0/24"), 5, podCIDRs))
+	assert.False(t, ignoredPrefix(2, netip.MustParsePrefix("10.1.0.0/16"), 5, podCIDRs))
+	assert.False(t, ignoredPrefix(2, netip.MustParsePrefix("2001:db8::/48"), 5, podCIDRs))
+	// Routes to the pods through their veths
+	assert.True(t, ignoredPrefix(7, host("10.1.0.5"), 5, podCIDRs))
+	assert.True(t, ignoredPrefix(7, netip.MustParsePrefix("2001:db8:1::/64"), 5, podCIDRs))
+	// Routes to the other nodes' pod CIDRs
+	assert.True(t, ignoredPrefix(5, netip.MustParsePrefix("10.2.0.0/24"), 5, podCIDRs))
+}
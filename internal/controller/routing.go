@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/metrics"
+	"github.com/tibordp/wigglenet/internal/routing"
+	"github.com/tibordp/wigglenet/internal/util"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	klog "k8s.io/klog/v2"
+)
+
+// sameRoutingDomain reports whether pod traffic to the peer node can be routed
+// natively in mixed routing mode.
+func sameRoutingDomain(cfg config.Routing, localNode, node *v1.Node) bool {
+	switch cfg.MixedRouting {
+	case config.MixedRoutingSubnet:
+		// Decided per address family by gateway selection
+		return true
+	case config.MixedRoutingLabel:
+		value := localNode.Labels[cfg.MixedRoutingLabel]
+		return value != "" && node.Labels[cfg.MixedRoutingLabel] == value
+	default:
+		return false
+	}
+}
+
+// nativeRoutes returns the direct routes to a peer node's pod CIDRs via its
+// node addresses, if they are routed natively rather than through the tunnel.
+// A peer is only routed natively if all of its pod CIDRs can be, so that its
+// traffic does not end up split between the tunnel and the underlay. This
+// requires an on-link node address in each of their address families, as the
+// route via any other address could not be installed.
+func nativeRoutes(cfg config.Routing, localNode, node *v1.Node, nodeAddresses []netip.Addr, podCIDRs []netip.Prefix, interfaces map[string][]netip.Prefix) ([]routing.Route, bool) {
+	// Natively routed address families never go through the tunnel
+	podCIDRs = slices.DeleteFunc(slices.Clone(podCIDRs), func(cidr netip.Prefix) bool {
+		return nativeFamily(cfg, cidr)
+	})
+	if localNode == nil || len(podCIDRs) == 0 || !sameRoutingDomain(cfg, localNode, node) {
+		return nil, false
+	}
+
+	routes := make([]routing.Route, 0, len(podCIDRs))
+	for _, cidr := range podCIDRs {
+		index := slices.IndexFunc(nodeAddresses, func(address netip.Addr) bool {
+			_, ok := routing.OnLinkInterface(interfaces, address)
+			return ok && address.Is6() == cidr.Addr().Is6()
+		})
+		if index == -1 {
+			return nil, false
+		}
+		routes = append(routes, routing.Route{Dst: cidr, Gateway: nodeAddresses[index]})
+	}
+
+	return routes, true
+}
+
+// directRoutes returns the direct routes to a peer node's pod CIDRs in the
+// natively routed address families, like flannel's host-gw backend does. The
+// second return value is false if the peer has no on-link node address for
+// one of them, in which case no route can be installed for it.
+func directRoutes(cfg config.Routing, nodeAddresses []netip.Addr, podCIDRs []netip.Prefix, interfaces map[string][]netip.Prefix) ([]routing.Route, bool) {
+	if !cfg.NativeRoutingDirectRoutes {
+		return nil, true
+	}
+
+	routes := make([]routing.Route, 0)
+	onLink := true
+	for _, cidr := range podCIDRs {
+		if !nativeFamily(cfg, cidr) {
+			continue
+		}
+		index := slices.IndexFunc(nodeAddresses, func(address netip.Addr) bool {
+			_, ok := routing.OnLinkInterface(interfaces, address)
+			return ok && address.Is6() == cidr.Addr().Is6()
+		})
+		if index == -1 {
+			onLink = false
+			continue
+		}
+		routes = append(routes, routing.Route{Dst: cidr, Gateway: nodeAddresses[index]})
+	}
+
+	return routes, onLink
+}
+
+// nativeFamily reports whether the prefix is in an address family that is
+// routed natively rather than through the tunnel.
+func nativeFamily(cfg config.Routing, prefix netip.Prefix) bool {
+	if prefix.Addr().Is6() {
+		return cfg.NativeRoutingIPv6
+	}
+	return cfg.NativeRoutingIPv4
+}
+
+func nodeCIDRAddresses(cidrs []netip.Prefix) []netip.Addr {
+	addresses := make([]netip.Addr, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		addresses = append(addresses, cidr.Addr())
+	}
+	return addresses
+}
+
+// routingInterfaces returns the local interface prefixes if they are needed
+// to determine which peers are on-link. The WireGuard interface is left out,
+// the peers are not on-link through the tunnel.
+func routingInterfaces(ctx context.Context, cfg *config.Config) (map[string][]netip.Prefix, error) {
+	r := cfg.Routing
+	direct := r.NativeRoutingDirectRoutes && (r.NativeRoutingIPv4 || r.NativeRoutingIPv6)
+	if r.MixedRouting == config.MixedRoutingNone && !direct {
+		return nil, nil
+	}
+
+	interfaces, err := util.GetInterfacePrefixes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	delete(interfaces, cfg.WireGuard.InterfaceName)
+	return interfaces, nil
+}
+
+// applyNativeRoutes installs direct routes over the underlay to the pod CIDRs
+// of peers that are routed natively, and removes the ones that are stale.
+func (c *controller) applyNativeRoutes(ctx context.Context) error {
+	if c.routes == nil {
+		return nil
+	}
+
+	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	interfaces, err := routingInterfaces(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	localNode, _ := c.nodeLister.Get(cfg.NodeName)
+	routes := make([]routing.Route, 0)
+	offLinkPeers := make(map[string]struct{})
+	for _, node := range nodes {
+		if node.Name == cfg.NodeName {
+			continue
+		}
+
+		podCIDRs := util.GetPodCIDRsFromAnnotation(node)
+		if len(podCIDRs) == 0 {
+			continue
+		}
+
+		nodeAddresses, err := getNodeAddresses(ctx, node)
+		if err != nil {
+			continue
+		}
+
+		if nodeRoutes, ok := nativeRoutes(cfg.Routing, localNode, node, nodeAddresses, podCIDRs, interfaces); ok {
+			routes = append(routes, nodeRoutes...)
+		}
+
+		nodeRoutes, onLink := directRoutes(cfg.Routing, nodeAddresses, podCIDRs, interfaces)
+		routes = append(routes, nodeRoutes...)
+		if !onLink {
+			offLinkPeers[node.Name] = struct{}{}
+			if _, ok := c.offLinkPeers[node.Name]; !ok {
+				logger.Info("peer is not on-link, cannot install direct routes to its pod CIDRs", "node", node.Name, "addresses", nodeAddresses)
+			}
+		} else if _, ok := c.offLinkPeers[node.Name]; ok {
+			logger.Info("peer is on-link again", "node", node.Name)
+		}
+	}
+	c.offLinkPeers = offLinkPeers
+
+	if cfg.Metrics.Enabled {
+		metrics.OffLinkPeersTotal.Set(float64(len(offLinkPeers)))
+	}
+
+	// Node listing order is not stable, sort to keep the change detection happy
+	slices.SortFunc(routes, func(a, b routing.Route) int {
+		return util.ComparePrefix(a.Dst, b.Dst)
+	})
+
+	return c.routes.ApplyRoutes(ctx, routes, logger)
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/routing"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func zoneNode(name, zone string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{"topology.kubernetes.io/zone": zone},
+	}}
+}
+
+func TestNativeRoutesSubnet(t *testing.T) {
+	cfg := config.Default()
+	cfg.Routing.MixedRouting = config.MixedRoutingSubnet
+
+	interfaces := map[string][]netip.Prefix{
+		"eth0": {netip.MustParsePrefix("192.168.0.10/24")},
+	}
+	local, peer := zoneNode("local", "a"), zoneNode("peer", "b")
+	podCIDRs := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}
+
+	routes, ok := nativeRoutes(cfg.Routing, local, peer, []netip.Addr{netip.MustParseAddr("203.0.113.1"), netip.MustParseAddr("192.168.0.20")}, podCIDRs, interfaces)
+	assert.True(t, ok)
+	assert.Equal(t, []routing.Route{
+		{Dst: netip.MustParsePrefix("10.1.0.0/24"), Gateway: netip.MustParseAddr("192.168.0.20")},
+	}, routes)
+
+	// Not on-link
+	_, ok = nativeRoutes(cfg.Routing, local, peer, []netip.Addr{netip.MustParseAddr("203.0.113.1")}, podCIDRs, interfaces)
+	assert.False(t, ok)
+
+	// All pod CIDRs need to be routable natively
+	_, ok = nativeRoutes(cfg.Routing, local, peer, []netip.Addr{netip.MustParseAddr("192.168.0.20")},
+		append(podCIDRs, netip.MustParsePrefix("2001:db8:1::/64")), interfaces)
+	assert.False(t, ok)
+}
+
+func TestNativeRoutesLabel(t *testing.T) {
+	cfg := config.Default()
+	cfg.Routing.MixedRouting = config.MixedRoutingLabel
+
+	interfaces := map[string][]netip.Prefix{
+		"eth0": {netip.MustParsePrefix("192.168.0.10/24")},
+	}
+	podCIDRs := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}
+	addresses := []netip.Addr{netip.MustParseAddr("203.0.113.1"), netip.MustParseAddr("192.168.0.20")}
+
+	routes, ok := nativeRoutes(cfg.Routing, zoneNode("local", "a"), zoneNode("peer", "a"), addresses, podCIDRs, interfaces)
+	assert.True(t, ok)
+	assert.Equal(t, []routing.Route{
+		{Dst: netip.MustParsePrefix("10.1.0.0/24"), Gateway: netip.MustParseAddr("192.168.0.20")},
+	}, routes)
+
+	_, ok = nativeRoutes(cfg.Routing, zoneNode("local", "a"), zoneNode("peer", "b"), addresses, podCIDRs, interfaces)
+	assert.False(t, ok)
+	_, ok = nativeRoutes(cfg.Routing, zoneNode("local", ""), zoneNode("peer", ""), addresses, podCIDRs, interfaces)
+	assert.False(t, ok)
+
+	// A peer in the same zone that is not on-link stays on the tunnel, as the
+	// route via its address could not be installed
+	_, ok = nativeRoutes(cfg.Routing, zoneNode("local", "a"), zoneNode("peer", "a"), []netip.Addr{netip.MustParseAddr("203.0.113.1")}, podCIDRs, interfaces)
+	assert.False(t, ok)
+}
+
+func TestDirectRoutes(t *testing.T) {
+	cfg := config.Default()
+	cfg.Routing.NativeRoutingIPv4 = true
+	cfg.Routing.NativeRoutingIPv6 = false
+	cfg.Routing.NativeRoutingDirectRoutes = true
+
+	interfaces := map[string][]netip.Prefix{
+		"eth0": {netip.MustParsePrefix("192.168.0.10/24"), netip.MustParsePrefix("2001:db8::10/64")},
+	}
+	podCIDRs := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("2001:db8:1::/64")}
+
+	// Only the natively routed address family gets a direct route
+	routes, onLink := directRoutes(cfg.Routing, []netip.Addr{netip.MustParseAddr("192.168.0.20"), netip.MustParseAddr("2001:db8::20")}, podCIDRs, interfaces)
+	assert.True(t, onLink)
+	assert.Equal(t, []routing.Route{
+		{Dst: netip.MustParsePrefix("10.1.0.0/24"), Gateway: netip.MustParseAddr("192.168.0.20")},
+	}, routes)
+
+	routes, onLink = directRoutes(cfg.Routing, []netip.Addr{netip.MustParseAddr("203.0.113.1")}, podCIDRs, interfaces)
+	assert.False(t, onLink)
+	assert.Empty(t, routes)
+
+	cfg.Routing.NativeRoutingDirectRoutes = false
+	routes, onLink = directRoutes(cfg.Routing, []netip.Addr{netip.MustParseAddr("203.0.113.1")}, podCIDRs, interfaces)
+	assert.True(t, onLink)
+	assert.Empty(t, routes)
+}
@@ -10,12 +10,15 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/tibordp/wigglenet/internal/allocator"
 	"github.com/tibordp/wigglenet/internal/annotation"
 	"github.com/tibordp/wigglenet/internal/celipam"
 	"github.com/tibordp/wigglenet/internal/config"
 	"github.com/tibordp/wigglenet/internal/util"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
@@ -26,8 +29,8 @@ import (
 	clientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
-func setNodeAddressesAnnotation(ctx context.Context, node *v1.Node) error {
-	nodeAddresses, err := util.GetInterfaceIPs(ctx, config.NodeIPInterfaces)
+func setNodeAddressesAnnotation(ctx context.Context, cfg *config.Config, node *v1.Node) error {
+	nodeAddresses, err := util.GetInterfaceIPs(ctx, cfg.Routing.NodeIPInterfaces)
 	if err != nil {
 		return err
 	}
@@ -38,11 +41,28 @@ func setNodeAddressesAnnotation(ctx context.Context, node *v1.Node) error {
 	return nil
 }
 
+// PodCIDRFamily is the pod CIDRs resolved for one address family.
+type PodCIDRFamily struct {
+	Source config.PodCIDRSource `json:"source"`
+	CIDRs  []netip.Prefix       `json:"cidrs"`
+	// All the pod CIDRs the source resolved, if pod CIDR expansion is enabled
+	Candidates []netip.Prefix `json:"candidates,omitempty"`
+}
+
+// PodCIDRResolution describes how the local node's pod CIDRs were determined.
+type PodCIDRResolution struct {
+	IPv4     PodCIDRFamily  `json:"ipv4"`
+	IPv6     PodCIDRFamily  `json:"ipv6"`
+	PodCIDRs []netip.Prefix `json:"podCIDRs"` // summarized, as written to the node annotation
+}
+
 // podCidrResolver resolves a node's pod CIDRs from the configured per-family
 // sources. It memoizes the CEL evaluation so that, when both families use the
 // "expression" source, the expression is evaluated only once per node.
 type podCidrResolver struct {
-	node *v1.Node
+	config    config.PodCIDR
+	node      *v1.Node
+	allocator allocator.Allocator
 
 	celOnce sync.Once
 	celCidr []netip.Prefix
@@ -58,7 +78,7 @@ func (r *podCidrResolver) forSource(ctx context.Context, source config.PodCIDRSo
 		return podsCidrs, nil
 
 	case config.SourceFile:
-		file, err := os.Open(config.PodCidrSourceFilename)
+		file, err := os.Open(r.config.SourcePath)
 		if err != nil {
 			return nil, err
 		}
@@ -71,7 +91,7 @@ func (r *podCidrResolver) forSource(ctx context.Context, source config.PodCIDRSo
 					podsCidrs = append(podsCidrs, prefix)
 				}
 			} else {
-				logger.Info("unrecognized CIDR in file, skipping", "cidr", scanner.Text(), "file", config.PodCidrSourceFilename, "error", err)
+				logger.Info("unrecognized CIDR in file, skipping", "cidr", scanner.Text(), "file", r.config.SourcePath, "error", err)
 			}
 		}
 
@@ -85,6 +105,15 @@ func (r *podCidrResolver) forSource(ctx context.Context, source config.PodCIDRSo
 				podsCidrs = append(podsCidrs, cidr)
 			}
 		}
+	case config.SourceAllocator:
+		if r.allocator == nil {
+			return nil, fmt.Errorf("pod CIDR allocator is not configured")
+		}
+		claimed, err := r.allocator.PodCIDRs(ctx, r.node, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		podsCidrs = append(podsCidrs, claimed...)
 	case config.SourceExpression:
 		celCidrs, err := r.celResult(ctx)
 		if err != nil {
@@ -112,29 +141,29 @@ func (r *podCidrResolver) forSource(ctx context.Context, source config.PodCIDRSo
 // node's interface and metadata state, and caches the result.
 func (r *podCidrResolver) celResult(ctx context.Context) ([]netip.Prefix, error) {
 	r.celOnce.Do(func() {
-		r.celCidr, r.celErr = evaluatePodCidrExpression(ctx, r.node)
+		r.celCidr, r.celErr = evaluatePodCidrExpression(ctx, r.config, r.node)
 	})
 	return r.celCidr, r.celErr
 }
 
-func podCidrExpression() (string, error) {
-	if config.PodCidrExpressionPath != "" {
-		data, err := os.ReadFile(config.PodCidrExpressionPath)
+func podCidrExpression(cfg config.PodCIDR) (string, error) {
+	if cfg.ExpressionPath != "" {
+		data, err := os.ReadFile(cfg.ExpressionPath)
 		if err != nil {
-			return "", fmt.Errorf("reading pod CIDR expression from %s: %w", config.PodCidrExpressionPath, err)
+			return "", fmt.Errorf("reading pod CIDR expression from %s: %w", cfg.ExpressionPath, err)
 		}
 		return strings.TrimSpace(string(data)), nil
 	}
-	if config.PodCidrExpression != "" {
-		return config.PodCidrExpression, nil
+	if cfg.Expression != "" {
+		return cfg.Expression, nil
 	}
-	return "", fmt.Errorf("pod CIDR source is %q but neither POD_CIDR_EXPRESSION nor POD_CIDR_EXPRESSION_PATH is set", config.SourceExpression)
+	return "", fmt.Errorf("pod CIDR source is %q but neither podCIDR.expression nor podCIDR.expressionPath is set", config.SourceExpression)
 }
 
-func evaluatePodCidrExpression(ctx context.Context, node *v1.Node) ([]netip.Prefix, error) {
+func evaluatePodCidrExpression(ctx context.Context, cfg config.PodCIDR, node *v1.Node) ([]netip.Prefix, error) {
 	logger := klog.FromContext(ctx)
 
-	expression, err := podCidrExpression()
+	expression, err := podCidrExpression(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -149,18 +178,20 @@ func evaluatePodCidrExpression(ctx context.Context, node *v1.Node) ([]netip.Pref
 		return nil, err
 	}
 
+	routes, err := util.GetRoutePrefixes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	cidrs, err := evaluator.Evaluate(celipam.Inputs{
 		Interfaces: interfaces,
-		Node: celipam.NodeInfo{
-			Name:        node.Name,
-			Labels:      node.Labels,
-			Annotations: node.Annotations,
-		},
+		Routes:     routes,
+		Node:       celipam.NewNodeInfo(ctx, node),
 	})
 	if err != nil {
 		// Log the interface prefixes the expression saw to make a failed or
 		// empty derivation easier to debug.
-		logger.Error(err, "pod CIDR expression evaluation failed", "interfaces", interfaces)
+		logger.Error(err, "pod CIDR expression evaluation failed", "interfaces", interfaces, "routes", routes)
 		return nil, err
 	}
 
@@ -168,32 +199,108 @@ func evaluatePodCidrExpression(ctx context.Context, node *v1.Node) ([]netip.Pref
 	return cidrs, nil
 }
 
-func setPodCidrsAnnotation(ctx context.Context, node *v1.Node) error {
-	resolver := &podCidrResolver{node: node}
+// activePodCidrs returns the candidate pod CIDRs that are in use with pod CIDR
+// expansion, so that the ones the node has been expanded into are kept across
+// restarts. A node starts out with only the first one.
+func activePodCidrs(candidates, current []netip.Prefix) []netip.Prefix {
+	active := make([]netip.Prefix, 0)
+	for _, cidr := range candidates {
+		if util.PrefixCovered(current, cidr) {
+			active = append(active, cidr)
+		}
+	}
+	if len(active) == 0 {
+		return candidates[:1]
+	}
+	return active
+}
+
+// PodCIDRStatus holds the latest resolution of the local node's pod CIDRs, it
+// is updated whenever the pod CIDR sources are re-evaluated.
+type PodCIDRStatus struct {
+	resolution atomic.Pointer[PodCIDRResolution]
+}
+
+// Get returns the latest resolution, or nil if the pod CIDRs were not
+// resolved yet.
+func (s *PodCIDRStatus) Get() *PodCIDRResolution {
+	return s.resolution.Load()
+}
+
+func (s *PodCIDRStatus) Set(resolution *PodCIDRResolution) {
+	s.resolution.Store(resolution)
+}
+
+// resolvePodCidrs resolves the node's pod CIDRs from the configured sources.
+func resolvePodCidrs(ctx context.Context, cfg config.PodCIDR, node *v1.Node, podCIDRAllocator allocator.Allocator) (*PodCIDRResolution, error) {
+	resolver := &podCidrResolver{config: cfg, node: node, allocator: podCIDRAllocator}
+	resolution := &PodCIDRResolution{
+		IPv4: PodCIDRFamily{Source: cfg.SourceIPv4},
+		IPv6: PodCIDRFamily{Source: cfg.SourceIPv6},
+	}
+
+	currentPodCidrs := util.GetPodCIDRsFromAnnotation(node)
 
 	podCidrs := make([]netip.Prefix, 0)
-	if cidrs, err := resolver.forSource(ctx, config.PodCIDRSourceIPv6, true); err != nil {
-		return err
+	if cidrs, err := resolver.forSource(ctx, cfg.SourceIPv6, true); err != nil {
+		return nil, err
 	} else {
+		if cfg.Expansion && len(cidrs) > 0 {
+			resolution.IPv6.Candidates = cidrs
+			cidrs = activePodCidrs(cidrs, currentPodCidrs)
+		}
+		resolution.IPv6.CIDRs = cidrs
 		podCidrs = append(podCidrs, cidrs...)
 	}
 
-	if cidrs, err := resolver.forSource(ctx, config.PodCIDRSourceIPv4, false); err != nil {
-		return err
+	if cidrs, err := resolver.forSource(ctx, cfg.SourceIPv4, false); err != nil {
+		return nil, err
 	} else {
+		if cfg.Expansion && len(cidrs) > 0 {
+			resolution.IPv4.Candidates = cidrs
+			cidrs = activePodCidrs(cidrs, currentPodCidrs)
+		}
+		resolution.IPv4.CIDRs = cidrs
 		podCidrs = append(podCidrs, cidrs...)
 	}
 
-	podCidrs = util.SummarizeCIDRs(podCidrs)
-	node.ObjectMeta.Annotations[annotation.PodCidrsAnnotation] = annotation.MarshalPodCidrs(podCidrs)
+	resolution.PodCIDRs = util.SummarizeCIDRs(podCidrs)
+	return resolution, nil
+}
 
-	return nil
+func setPodCidrsAnnotation(ctx context.Context, cfg config.PodCIDR, node *v1.Node, podCIDRAllocator allocator.Allocator) (*PodCIDRResolution, error) {
+	resolution, err := resolvePodCidrs(ctx, cfg, node, podCIDRAllocator)
+	if err != nil {
+		return nil, err
+	}
+
+	node.ObjectMeta.Annotations[annotation.PodCidrsAnnotation] = annotation.MarshalPodCidrs(resolution.PodCIDRs)
+	return resolution, nil
+}
+
+// patchNodeAnnotations sets the given annotations on the node with a JSON
+// merge patch. A nil value removes the annotation.
+func patchNodeAnnotations(ctx context.Context, nodeClient clientv1.NodeInterface, nodeName string, annotations map[string]any) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = nodeClient.Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
-// SetupNode sets up the node annotations on each start.
-func SetupNode(ctx context.Context, nodeClient clientv1.NodeInterface, publicKey []byte) error {
-	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		node, err := nodeClient.Get(ctx, config.CurrentNodeName, metav1.GetOptions{})
+// SetupNode sets up the node annotations on each start. It returns how the
+// node's pod CIDRs were resolved. The allocator is only needed if one of the
+// address families uses the allocator pod CIDR source.
+func SetupNode(ctx context.Context, cfg *config.Config, nodeClient clientv1.NodeInterface, podCIDRAllocator allocator.Allocator, publicKey []byte) (*PodCIDRResolution, error) {
+	var resolution *PodCIDRResolution
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodeClient.Get(ctx, cfg.NodeName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
@@ -206,11 +313,12 @@ func SetupNode(ctx context.Context, nodeClient clientv1.NodeInterface, publicKey
 			node.ObjectMeta.Annotations[annotation.PublicKeyAnnotation] = base64.StdEncoding.EncodeToString(publicKey)
 		}
 
-		if err := setNodeAddressesAnnotation(ctx, node); err != nil {
+		if err := setNodeAddressesAnnotation(ctx, cfg, node); err != nil {
 			return err
 		}
 
-		if err := setPodCidrsAnnotation(ctx, node); err != nil {
+		resolution, err = setPodCidrsAnnotation(ctx, cfg.PodCIDR, node, podCIDRAllocator)
+		if err != nil {
 			return err
 		}
 
@@ -218,24 +326,66 @@ func SetupNode(ctx context.Context, nodeClient clientv1.NodeInterface, publicKey
 		// Node object. This lets the ClusterRole grant `patch` instead of `update`
 		// on nodes: `update` lets a token rewrite any field on any node (labels,
 		// taints, …), whereas a JSON merge patch here can only set these keys.
-		annotations := map[string]string{
+		annotations := map[string]any{
 			annotation.NodeIpsAnnotation:  node.ObjectMeta.Annotations[annotation.NodeIpsAnnotation],
 			annotation.PodCidrsAnnotation: node.ObjectMeta.Annotations[annotation.PodCidrsAnnotation],
 		}
 		if publicKey != nil {
 			annotations[annotation.PublicKeyAnnotation] = node.ObjectMeta.Annotations[annotation.PublicKeyAnnotation]
+			annotations[annotation.BehindNATAnnotation] = nil
+			if cfg.WireGuard.BehindNAT {
+				annotations[annotation.BehindNATAnnotation] = "true"
+			}
 		}
 
-		patch, err := json.Marshal(map[string]any{
-			"metadata": map[string]any{
-				"annotations": annotations,
-			},
-		})
-		if err != nil {
-			return err
-		}
+		return patchNodeAnnotations(ctx, nodeClient, cfg.NodeName, annotations)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolution, nil
+}
+
+// OwnedAnnotations are the node annotations set by Wigglenet. The ones set by
+// the user, like the endpoint override, are not included.
+var OwnedAnnotations = []string{
+	annotation.PublicKeyAnnotation,
+	annotation.NextPublicKeyAnnotation,
+	annotation.NodeIpsAnnotation,
+	annotation.PodCidrsAnnotation,
+	annotation.BehindNATAnnotation,
+	annotation.ObservedEndpointsAnnotation,
+	annotation.ReflexiveEndpointAnnotation,
+}
+
+// CleanupNode undoes SetupNode when Wigglenet is removed from the node: it
+// removes the annotations and the network-unavailable taint, and releases the
+// pod CIDRs claimed by the node. The allocator is only needed if one of the
+// address families uses the allocator pod CIDR source.
+func CleanupNode(ctx context.Context, cfg *config.Config, nodeClient clientv1.NodeInterface, podCIDRAllocator allocator.Allocator) error {
+	logger := klog.FromContext(ctx)
+
+	annotations := make(map[string]any, len(OwnedAnnotations))
+	for _, key := range OwnedAnnotations {
+		annotations[key] = nil
+	}
 
-		_, err = nodeClient.Patch(ctx, config.CurrentNodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	logger.Info("removing node annotations", "node", cfg.NodeName)
+	err := patchNodeAnnotations(ctx, nodeClient, cfg.NodeName, annotations)
+	if apierrors.IsNotFound(err) {
+		// The node is gone already, and its pod CIDR claims with it
+		return nil
+	} else if err != nil {
 		return err
-	})
+	}
+
+	if err := setNetworkUnavailableTaint(ctx, nodeClient, cfg.NodeName, false); err != nil {
+		return err
+	}
+
+	if podCIDRAllocator != nil {
+		logger.Info("releasing pod CIDRs", "node", cfg.NodeName)
+		return podCIDRAllocator.Release(ctx, cfg.NodeName)
+	}
+	return nil
 }
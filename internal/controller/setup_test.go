@@ -20,22 +20,13 @@ import (
 // Update. This is what allows the ClusterRole to grant `patch` instead of the
 // much broader `update` verb on nodes.
 func TestSetupNodePatchesAnnotations(t *testing.T) {
-	origV4 := config.PodCIDRSourceIPv4
-	origV6 := config.PodCIDRSourceIPv6
-	origIfaces := config.NodeIPInterfaces
-	origNode := config.CurrentNodeName
-	defer func() {
-		config.PodCIDRSourceIPv4 = origV4
-		config.PodCIDRSourceIPv6 = origV6
-		config.NodeIPInterfaces = origIfaces
-		config.CurrentNodeName = origNode
-	}()
+	cfg := config.Default()
 
 	// "none" sources and no interfaces avoid any dependency on host network state.
-	config.PodCIDRSourceIPv4 = config.SourceNone
-	config.PodCIDRSourceIPv6 = config.SourceNone
-	config.NodeIPInterfaces = ""
-	config.CurrentNodeName = "test-node"
+	cfg.PodCIDR.SourceIPv4 = config.SourceNone
+	cfg.PodCIDR.SourceIPv6 = config.SourceNone
+	cfg.Routing.NodeIPInterfaces = ""
+	cfg.NodeName = "test-node"
 
 	client := fake.NewSimpleClientset(&v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
@@ -49,7 +40,7 @@ func TestSetupNodePatchesAnnotations(t *testing.T) {
 		publicKey[i] = byte(i)
 	}
 
-	err := SetupNode(context.Background(), client.CoreV1().Nodes(), publicKey)
+	_, err := SetupNode(context.Background(), cfg, client.CoreV1().Nodes(), nil, publicKey)
 	require.NoError(t, err)
 
 	sawPatch := false
@@ -86,27 +77,19 @@ func TestSetupNodePatchesAnnotations(t *testing.T) {
 // modes (which pass a nil public key) do not write or clear the public-key
 // annotation.
 func TestSetupNodeOmitsPublicKeyWhenNil(t *testing.T) {
-	origV4 := config.PodCIDRSourceIPv4
-	origV6 := config.PodCIDRSourceIPv6
-	origIfaces := config.NodeIPInterfaces
-	origNode := config.CurrentNodeName
-	defer func() {
-		config.PodCIDRSourceIPv4 = origV4
-		config.PodCIDRSourceIPv6 = origV6
-		config.NodeIPInterfaces = origIfaces
-		config.CurrentNodeName = origNode
-	}()
-
-	config.PodCIDRSourceIPv4 = config.SourceNone
-	config.PodCIDRSourceIPv6 = config.SourceNone
-	config.NodeIPInterfaces = ""
-	config.CurrentNodeName = "test-node"
+	cfg := config.Default()
+
+	cfg.PodCIDR.SourceIPv4 = config.SourceNone
+	cfg.PodCIDR.SourceIPv6 = config.SourceNone
+	cfg.Routing.NodeIPInterfaces = ""
+	cfg.NodeName = "test-node"
 
 	client := fake.NewSimpleClientset(&v1.Node{
 		ObjectMeta: metav1.ObjectMeta{Name: "test-node"},
 	})
 
-	require.NoError(t, SetupNode(context.Background(), client.CoreV1().Nodes(), nil))
+	_, err := SetupNode(context.Background(), cfg, client.CoreV1().Nodes(), nil, nil)
+	require.NoError(t, err)
 
 	for _, a := range client.Actions() {
 		if a.GetResource().Resource == "nodes" && a.GetVerb() == "patch" {
@@ -118,3 +101,39 @@ func TestSetupNodeOmitsPublicKeyWhenNil(t *testing.T) {
 		}
 	}
 }
+
+func TestCleanupNode(t *testing.T) {
+	cfg := config.Default()
+	cfg.NodeName = "test-node"
+
+	annotations := map[string]string{
+		"unrelated/keep":              "keep-me",
+		annotation.EndpointAnnotation: "192.0.2.1:51820",
+	}
+	for _, key := range OwnedAnnotations {
+		annotations[key] = "value"
+	}
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-node", Annotations: annotations},
+		Spec: v1.NodeSpec{
+			Taints: []v1.Taint{
+				{Key: NetworkUnavailableTaintKey, Effect: v1.TaintEffectNoSchedule},
+				{Key: "unrelated", Effect: v1.TaintEffectNoSchedule},
+			},
+		},
+	})
+
+	require.NoError(t, CleanupNode(context.Background(), cfg, client.CoreV1().Nodes(), nil))
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "test-node", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"unrelated/keep":              "keep-me",
+		annotation.EndpointAnnotation: "192.0.2.1:51820",
+	}, node.Annotations)
+	assert.Equal(t, []v1.Taint{{Key: "unrelated", Effect: v1.TaintEffectNoSchedule}}, node.Spec.Taints)
+
+	// Nothing to do for a node that is gone
+	cfg.NodeName = "deleted-node"
+	assert.NoError(t, CleanupNode(context.Background(), cfg, client.CoreV1().Nodes(), nil))
+}
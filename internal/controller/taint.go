@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	clientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+	klog "k8s.io/klog/v2"
+)
+
+// NetworkUnavailableTaintKey is the taint kept on the node while Wigglenet is
+// not (or no longer) able to program the node's dataplane.
+const NetworkUnavailableTaintKey = "wigglenet.io/network-unavailable"
+
+const taintSyncPeriod = 5 * time.Second
+
+func hasNetworkUnavailableTaint(node *v1.Node) bool {
+	return slices.ContainsFunc(node.Spec.Taints, func(t v1.Taint) bool {
+		return t.Key == NetworkUnavailableTaintKey
+	})
+}
+
+// setNetworkUnavailableTaint adds or removes the network-unavailable taint,
+// leaving other taints intact. The merge patch carries the resourceVersion
+// the taint list was computed from, so concurrent changes to the node's taints
+// result in a conflict and a retry rather than being overwritten.
+func setNetworkUnavailableTaint(ctx context.Context, nodeClient clientv1.NodeInterface, nodeName string, tainted bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodeClient.Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if hasNetworkUnavailableTaint(node) == tainted {
+			return nil
+		}
+
+		taints := slices.DeleteFunc(slices.Clone(node.Spec.Taints), func(t v1.Taint) bool {
+			return t.Key == NetworkUnavailableTaintKey
+		})
+		if tainted {
+			taints = append(taints, v1.Taint{
+				Key:    NetworkUnavailableTaintKey,
+				Effect: v1.TaintEffectNoSchedule,
+			})
+		}
+
+		patch, err := json.Marshal(map[string]any{
+			"metadata": map[string]any{
+				"resourceVersion": node.ResourceVersion,
+			},
+			"spec": map[string]any{
+				"taints": taints,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = nodeClient.Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// syncNetworkTaint keeps the network-unavailable taint on the local node for as
+// long as Wigglenet is not ready.
+func (c *controller) syncNetworkTaint(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	cfg := c.config.Load()
+
+	node, err := c.nodeLister.Get(cfg.NodeName)
+	if err != nil {
+		// Node not yet observed in the cache
+		return
+	}
+
+	ready, _ := c.health.Ready()
+	tainted := !ready
+	if hasNetworkUnavailableTaint(node) == tainted {
+		return
+	}
+
+	if err := setNetworkUnavailableTaint(ctx, c.nodeClient, cfg.NodeName, tainted); err != nil {
+		runtime.HandleErrorWithContext(ctx, err, "failed to update network-unavailable taint")
+		return
+	}
+
+	if tainted {
+		logger.Info("tainted node as network-unavailable", "taint", NetworkUnavailableTaintKey)
+	} else {
+		logger.Info("removed network-unavailable taint from node", "taint", NetworkUnavailableTaintKey)
+	}
+}
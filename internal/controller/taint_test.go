@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetNetworkUnavailableTaint(t *testing.T) {
+	otherTaint := v1.Taint{Key: "example.com/dedicated", Value: "gpu", Effect: v1.TaintEffectNoExecute}
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-node"},
+		Spec:       v1.NodeSpec{Taints: []v1.Taint{otherTaint}},
+	})
+	nodes := client.CoreV1().Nodes()
+	ctx := context.Background()
+
+	require.NoError(t, setNetworkUnavailableTaint(ctx, nodes, "test-node", true))
+	node, err := nodes.Get(ctx, "test-node", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1.Taint{
+		otherTaint,
+		{Key: NetworkUnavailableTaintKey, Effect: v1.TaintEffectNoSchedule},
+	}, node.Spec.Taints)
+
+	// Already tainted, nothing to patch
+	client.ClearActions()
+	require.NoError(t, setNetworkUnavailableTaint(ctx, nodes, "test-node", true))
+	for _, a := range client.Actions() {
+		assert.NotEqual(t, "patch", a.GetVerb())
+	}
+
+	require.NoError(t, setNetworkUnavailableTaint(ctx, nodes, "test-node", false))
+	node, err = nodes.Get(ctx, "test-node", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1.Taint{otherTaint}, node.Spec.Taints)
+}
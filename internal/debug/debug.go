@@ -0,0 +1,153 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/controller"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/ipam"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+)
+
+// Sources are the components whose state is described by the debug API. Any of
+// them may be nil if the component is not running in the current mode.
+type Sources struct {
+	Wireguard wireguard.Manager
+	Firewall  firewall.Manager
+	CNI       cni.CNIConfigWriter
+	PodCIDRs  *controller.PodCIDRStatus
+	IPAM      ipam.Manager
+}
+
+// wireguardPeer leaves out the preshared key, which is a secret
+type wireguardPeer struct {
+	PublicKey           string         `json:"publicKey"`
+	NextPublicKey       string         `json:"nextPublicKey,omitempty"`
+	Endpoint            netip.Addr     `json:"endpoint"`
+	EndpointCandidates  []netip.Addr   `json:"endpointCandidates,omitempty"`
+	Port                int            `json:"port,omitempty"`
+	Roaming             bool           `json:"roaming"`
+	PersistentKeepalive string         `json:"persistentKeepalive,omitempty"`
+	Native              bool           `json:"native"`
+	NodeCIDRs           []netip.Prefix `json:"nodeCIDRs"`
+	PodCIDRs            []netip.Prefix `json:"podCIDRs"`
+}
+
+type wireguardConfig struct {
+	Addresses []netip.Addr    `json:"addresses"`
+	Peers     []wireguardPeer `json:"peers"`
+}
+
+// NewHandler returns a handler serving read-only JSON snapshots of the node's
+// computed network state:
+//
+//	/debug/wireguard  last applied WireGuard configuration
+//	/debug/firewall   pod CIDRs and policy rules of the last firewall sync
+//	/debug/cni        last written CNI configuration
+//	/debug/podcidrs   how the local node's pod CIDRs were resolved
+//	/debug/ipam       pod address allocations on the node
+func NewHandler(sources Sources) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /debug/{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []string{"/debug/wireguard", "/debug/firewall", "/debug/cni", "/debug/podcidrs", "/debug/ipam"})
+	})
+
+	mux.HandleFunc("GET /debug/wireguard", func(w http.ResponseWriter, r *http.Request) {
+		if sources.Wireguard == nil {
+			notAvailable(w, "WireGuard is not used in this mode")
+			return
+		}
+		applied := sources.Wireguard.AppliedConfig()
+		if applied == nil {
+			notAvailable(w, "no WireGuard configuration applied yet")
+			return
+		}
+
+		// wgtypes.Key has no text encoding, so render keys as base64 strings
+		view := wireguardConfig{
+			Addresses: applied.Addresses,
+			Peers:     make([]wireguardPeer, 0, len(applied.Peers)),
+		}
+		for _, peer := range applied.Peers {
+			p := wireguardPeer{
+				PublicKey:          peer.PublicKey.String(),
+				Endpoint:           peer.Endpoint,
+				EndpointCandidates: peer.EndpointCandidates,
+				Port:               peer.Port,
+				Roaming:            peer.Roaming,
+				Native:             peer.Native,
+				NodeCIDRs:          peer.NodeCIDRs,
+				PodCIDRs:           peer.PodCIDRs,
+			}
+			if peer.NextPublicKey != nil {
+				p.NextPublicKey = peer.NextPublicKey.String()
+			}
+			if peer.PersistentKeepalive != 0 {
+				p.PersistentKeepalive = peer.PersistentKeepalive.String()
+			}
+			view.Peers = append(view.Peers, p)
+		}
+		writeJSON(w, view)
+	})
+
+	mux.HandleFunc("GET /debug/firewall", func(w http.ResponseWriter, r *http.Request) {
+		if sources.Firewall == nil {
+			notAvailable(w, "firewall manager is not running")
+			return
+		}
+		applied := sources.Firewall.AppliedConfig()
+		if applied == nil {
+			notAvailable(w, "no firewall rules synced yet")
+			return
+		}
+		writeJSON(w, applied)
+	})
+
+	mux.HandleFunc("GET /debug/cni", func(w http.ResponseWriter, r *http.Request) {
+		if sources.CNI == nil {
+			notAvailable(w, "CNI configuration is not managed in this mode")
+			return
+		}
+		last := sources.CNI.LastConfig()
+		if last == nil {
+			notAvailable(w, "no CNI configuration written yet")
+			return
+		}
+		writeJSON(w, last)
+	})
+
+	mux.HandleFunc("GET /debug/podcidrs", func(w http.ResponseWriter, r *http.Request) {
+		if sources.PodCIDRs == nil || sources.PodCIDRs.Get() == nil {
+			notAvailable(w, "pod CIDRs not resolved yet")
+			return
+		}
+		writeJSON(w, sources.PodCIDRs.Get())
+	})
+
+	mux.HandleFunc("GET /debug/ipam", func(w http.ResponseWriter, r *http.Request) {
+		if sources.IPAM == nil {
+			notAvailable(w, "addresses are not allocated by Wigglenet in this mode")
+			return
+		}
+		writeJSON(w, sources.IPAM.Allocations())
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func notAvailable(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
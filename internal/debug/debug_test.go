@@ -0,0 +1,196 @@
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/cni"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/controller"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	"github.com/tibordp/wigglenet/internal/wireguard/wireguardtest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/klog/v2"
+)
+
+type fakeFirewall struct {
+	applied *firewall.FirewallConfig
+}
+
+func (f *fakeFirewall) Run(context.Context)                     {}
+func (f *fakeFirewall) AppliedConfig() *firewall.FirewallConfig { return f.applied }
+func (f *fakeFirewall) Reconfigure(*config.Config)              {}
+
+func get(t *testing.T, handler http.Handler, path string) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return rec.Code, body
+}
+
+func TestWireguardEndpoint(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	roamingKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	nextKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	nextPublicKey := nextKey.PublicKey()
+	presharedKey, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+
+	wg := &wireguardtest.Manager{}
+	handler := NewHandler(Sources{Wireguard: wg})
+
+	code, body := get(t, handler, "/debug/wireguard")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "no WireGuard configuration applied yet", body["error"])
+
+	applied := wireguard.NewConfig(
+		[]netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		[]netip.Addr{netip.MustParseAddr("192.168.0.1")},
+		[]wireguard.Peer{
+			{
+				Endpoint:  netip.MustParseAddr("192.168.0.2"),
+				PodCIDRs:  []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")},
+				NodeCIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.0.2/32")},
+				PublicKey: key.PublicKey(),
+				Native:    true,
+			},
+			{
+				Endpoint: netip.MustParseAddr("203.0.113.3"),
+				EndpointCandidates: []netip.Addr{
+					netip.MustParseAddr("203.0.113.3"),
+					netip.MustParseAddr("192.168.0.3"),
+				},
+				Port:                51821,
+				Roaming:             true,
+				PersistentKeepalive: 25 * time.Second,
+				PodCIDRs:            []netip.Prefix{netip.MustParsePrefix("10.0.2.0/24")},
+				NodeCIDRs:           []netip.Prefix{netip.MustParsePrefix("192.168.0.3/32")},
+				PublicKey:           roamingKey.PublicKey(),
+				NextPublicKey:       &nextPublicKey,
+				PresharedKey:        &presharedKey,
+			},
+		},
+	)
+	wg.Applied = &applied
+
+	code, body = get(t, handler, "/debug/wireguard")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"10.0.0.1"}, body["addresses"])
+
+	peers := map[string]any{}
+	for _, peer := range body["peers"].([]any) {
+		peers[peer.(map[string]any)["publicKey"].(string)] = peer
+	}
+	assert.Equal(t, map[string]any{
+		key.PublicKey().String(): map[string]any{
+			"publicKey": key.PublicKey().String(),
+			"endpoint":  "192.168.0.2",
+			"roaming":   false,
+			"native":    true,
+			"nodeCIDRs": []any{"192.168.0.2/32"},
+			"podCIDRs":  []any{"10.0.1.0/24"},
+		},
+		roamingKey.PublicKey().String(): map[string]any{
+			"publicKey":           roamingKey.PublicKey().String(),
+			"nextPublicKey":       nextKey.PublicKey().String(),
+			"endpoint":            "203.0.113.3",
+			"endpointCandidates":  []any{"203.0.113.3", "192.168.0.3"},
+			"port":                float64(51821),
+			"roaming":             true,
+			"persistentKeepalive": "25s",
+			"native":              false,
+			"nodeCIDRs":           []any{"192.168.0.3/32"},
+			"podCIDRs":            []any{"10.0.2.0/24"},
+		},
+	}, peers)
+}
+
+func TestFirewallEndpoint(t *testing.T) {
+	applied := firewall.NewConfigWithPolicies(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+		[]firewall.NetworkPolicyRule{{
+			Direction: "ingress",
+			Action:    "deny",
+			Policy:    "default/web",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.5")},
+		}},
+	)
+	handler := NewHandler(Sources{Firewall: &fakeFirewall{applied: &applied}})
+
+	code, body := get(t, handler, "/debug/firewall")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"10.0.0.0/24"}, body["podCIDRs"])
+	assert.Equal(t, []any{map[string]any{
+		"podIPs":    []any{"10.0.0.5"},
+		"direction": "ingress",
+		"action":    "deny",
+		"policy":    "default/web",
+	}}, body["policyRules"])
+}
+
+func TestPodCIDRsEndpoint(t *testing.T) {
+	status := &controller.PodCIDRStatus{}
+	status.Set(&controller.PodCIDRResolution{
+		IPv4:     controller.PodCIDRFamily{Source: config.SourceSpec, CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}},
+		IPv6:     controller.PodCIDRFamily{Source: config.SourceNone, CIDRs: []netip.Prefix{}},
+		PodCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+	})
+	handler := NewHandler(Sources{PodCIDRs: status})
+
+	code, body := get(t, handler, "/debug/podcidrs")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"source": "spec", "cidrs": []any{"10.0.0.0/24"}}, body["ipv4"])
+	assert.Equal(t, map[string]any{"source": "none", "cidrs": []any{}}, body["ipv6"])
+}
+
+func TestUnavailableSources(t *testing.T) {
+	handler := NewHandler(Sources{})
+	for path, reason := range map[string]string{
+		"/debug/wireguard": "WireGuard is not used in this mode",
+		"/debug/firewall":  "firewall manager is not running",
+		"/debug/cni":       "CNI configuration is not managed in this mode",
+		"/debug/podcidrs":  "pod CIDRs not resolved yet",
+	} {
+		code, body := get(t, handler, path)
+		assert.Equal(t, http.StatusNotFound, code, path)
+		assert.Equal(t, reason, body["error"], path)
+	}
+
+	// The API is read-only
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/firewall", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestCNIEndpoint(t *testing.T) {
+	cfg := config.Default()
+	cfg.CNI.ConfigPath = filepath.Join(t.TempDir(), "10-wigglenet.conflist")
+
+	writer := cni.NewCNIConfigWriter(cfg)
+	handler := NewHandler(Sources{CNI: writer})
+
+	code, _ := get(t, handler, "/debug/cni")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	require.NoError(t, writer.WriteCNIConfig(context.Background(), cni.CNIConfig{
+		PodCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+	}, klog.Background()))
+
+	code, body := get(t, handler, "/debug/cni")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"10.0.0.0/24"}, body["podCIDRs"])
+}
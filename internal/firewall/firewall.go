@@ -2,31 +2,53 @@ package firewall
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/netip"
+	"sync/atomic"
 
 	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/health"
 	"github.com/tibordp/wigglenet/internal/util"
+
+	klog "k8s.io/klog/v2"
+	ipt "k8s.io/kubernetes/pkg/util/iptables"
+	"sigs.k8s.io/knftables"
 )
 
 // PortRule represents a single protocol+port(+range) match from a NetworkPolicy.
 type PortRule struct {
-	Protocol string // "TCP", "UDP", or "SCTP"
-	Port     int    // 0 means any port for this protocol
-	EndPort  int    // 0 means single port (no range); >0 means port range [Port, EndPort]
+	Protocol string `json:"protocol"`          // "TCP", "UDP", or "SCTP"
+	Port     int    `json:"port,omitempty"`    // 0 means any port for this protocol
+	EndPort  int    `json:"endPort,omitempty"` // 0 means single port (no range); >0 means port range [Port, EndPort]
 }
 
+// NetworkPolicyRule is a single flattened policy rule. Rules belong to one of
+// three tiers which are evaluated in order: AdminNetworkPolicy ("admin"),
+// NetworkPolicy (empty tier) and BaselineAdminNetworkPolicy ("baseline").
+//
+// In the NetworkPolicy tier, "allow" rules permit traffic from/to the listed
+// peers and "deny" rules carry no peers and mark the pods as isolated. "audit"
+// rules are like "deny" rules, except that traffic that would be dropped is
+// only logged. In the admin and baseline tiers every rule matches on its peers
+// and ports, and the action is applied to matching traffic: "allow" and "deny"
+// are final for that direction, while "pass" (admin tier only) skips the
+// remaining admin rules and defers to NetworkPolicy.
 type NetworkPolicyRule struct {
-	PodIPs       []netip.Addr
-	AllowedIPs   []netip.Addr
-	AllowedCIDRs []netip.Prefix
-	PortRules    []PortRule
-	Direction    string
-	Action       string // "allow" or "deny"
+	PodIPs       []netip.Addr   `json:"podIPs"`
+	AllowedIPs   []netip.Addr   `json:"allowedIPs,omitempty"`
+	AllowedCIDRs []netip.Prefix `json:"allowedCIDRs,omitempty"`
+	PortRules    []PortRule     `json:"portRules,omitempty"`
+	Direction    string         `json:"direction"`
+	Action       string         `json:"action"`             // "allow", "deny", "audit" or "pass"
+	Tier         string         `json:"tier,omitempty"`     // "" (NetworkPolicy), "admin" or "baseline"
+	Priority     int            `json:"priority,omitempty"` // evaluation order within the admin/baseline tiers, lowest first
+	Policy       string         `json:"policy"`             // originating policy, "namespace/name" for NetworkPolicies
 }
 
 type FirewallConfig struct {
-	PodCIDRs    []netip.Prefix
-	PolicyRules []NetworkPolicyRule
+	PodCIDRs    []netip.Prefix      `json:"podCIDRs"`
+	PolicyRules []NetworkPolicyRule `json:"policyRules"`
 }
 
 func NewConfig(podCIDRs []netip.Prefix) FirewallConfig {
@@ -51,13 +73,90 @@ func NewConfigWithPolicies(podCIDRs []netip.Prefix, policyRules []NetworkPolicyR
 
 type Manager interface {
 	Run(ctx context.Context)
+	// AppliedConfig returns the configuration of the last successful sync, or nil.
+	AppliedConfig() *FirewallConfig
+	// Reconfigure switches to a new configuration. The rules are re-rendered
+	// with the next sync, which also removes the chains and sets of the
+	// features that were turned off.
+	Reconfigure(cfg *config.Config)
+}
+
+// configUpdates hands new configurations over to a manager's sync loop. Only
+// the latest one is kept if the loop has not picked up the previous one yet.
+type configUpdates struct {
+	latest  atomic.Pointer[config.Config]
+	updated chan struct{}
+}
+
+func newConfigUpdates() *configUpdates {
+	return &configUpdates{updated: make(chan struct{}, 1)}
+}
+
+func (u *configUpdates) send(cfg *config.Config) {
+	u.latest.Store(cfg)
+	select {
+	case u.updated <- struct{}{}:
+	default:
+	}
+}
+
+// PodResolver looks up pods by IP, so that logged packets can be attributed to
+// the pods that sent and received them.
+type PodResolver interface {
+	// PodName returns the "namespace/name" of the pod with the given IP.
+	PodName(addr netip.Addr) (string, bool)
 }
 
-func New(podCIDRUpdates chan []netip.Prefix, policyUpdates chan []NetworkPolicyRule) (Manager, error) {
-	switch config.FirewallBackendMode {
+// New creates the firewall manager for the configured backend. The outcome of
+// every sync is recorded in checker. podResolver is optional.
+func New(cfg *config.Config, checker *health.Checker, podCIDRUpdates chan []netip.Prefix, policyUpdates chan []NetworkPolicyRule, podResolver PodResolver) (Manager, error) {
+	switch cfg.Firewall.Backend {
 	case config.BackendIptables:
-		return newIptablesManager(podCIDRUpdates, policyUpdates), nil
+		return newIptablesManager(cfg, checker, podCIDRUpdates, policyUpdates, podResolver), nil
+	case config.BackendNftables:
+		return newNftablesManager(cfg, checker, podCIDRUpdates, policyUpdates, podResolver)
 	default:
-		return newNftablesManager(podCIDRUpdates, policyUpdates)
+		return nil, fmt.Errorf("unsupported firewall backend %q", cfg.Firewall.Backend)
+	}
+}
+
+// Cleanup removes the rules of both backends, as the backend may have been
+// switched since they were installed. It carries on after a failure. A backend
+// whose tools are not available on the node cannot have installed any rules,
+// so it is skipped.
+func Cleanup(ctx context.Context, _ *config.Config) error {
+	logger := klog.FromContext(ctx)
+	logger.Info("removing firewall rules")
+
+	nft, err := knftables.New(knftables.InetFamily, nftTable)
+	if err != nil {
+		logger.Info("nftables is not available, skipping", "error", err)
+	}
+
+	tables := make([]ipTables, 0, 2)
+	for _, protocol := range []ipt.Protocol{ipt.ProtocolIPv4, ipt.ProtocolIPv6} {
+		iptables := ipt.New(protocol)
+		if err := iptables.Present(); err != nil {
+			logger.Info("iptables is not available, skipping", "protocol", protocol, "error", err)
+			continue
+		}
+		tables = append(tables, iptables)
+	}
+
+	return cleanupBackends(ctx, nft, tables...)
+}
+
+// cleanupBackends removes the nftables table, unless nft is nil, and the
+// iptables chains in tables.
+func cleanupBackends(ctx context.Context, nft knftables.Interface, tables ...ipTables) error {
+	errs := make([]error, 0, 2)
+	if nft != nil {
+		if err := cleanupNftables(ctx, nft); err != nil {
+			errs = append(errs, fmt.Errorf("removing nftables rules: %w", err))
+		}
+	}
+	if err := cleanupIptables(tables...); err != nil {
+		errs = append(errs, fmt.Errorf("removing iptables rules: %w", err))
 	}
+	return errors.Join(errs...)
 }
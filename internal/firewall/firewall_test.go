@@ -3,26 +3,30 @@ package firewall
 //go:generate mockery --all --exported
 
 import (
+	"errors"
 	"net/netip"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/tibordp/wigglenet/internal/config"
 	"github.com/tibordp/wigglenet/internal/firewall/mocks"
 	"k8s.io/klog/v2/ktesting"
 	"k8s.io/kubernetes/pkg/util/iptables"
+	"sigs.k8s.io/knftables"
 )
 
 func TestSyncFilterWithGlobalFiltering(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	// Save original values
-	origFilterIPv6 := config.FilterIPv6
-	defer func() { config.FilterIPv6 = origFilterIPv6 }()
+	cfg := config.Default()
 
 	// Enable global IPv6 filtering for this test
-	config.FilterIPv6 = true
+	cfg.Firewall.FilterIPv6 = true
 
 	mockIptables := new(mocks.IpTables)
-	manager := new(iptablesManager)
+	manager := &iptablesManager{config: cfg}
 
 	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-FIREWALL")).Return(true, nil)
 
@@ -54,17 +58,14 @@ COMMIT
 
 func TestSyncFilterNetworkPolicyOnly(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
-	// Save original values
-	origFilterIPv6 := config.FilterIPv6
-	defer func() { config.FilterIPv6 = origFilterIPv6 }()
+	cfg := config.Default()
 
 	// Disable global IPv6 filtering for this test
-	config.FilterIPv6 = false
+	cfg.Firewall.FilterIPv6 = false
 
 	mockIptables := new(mocks.IpTables)
-	manager := new(iptablesManager)
+	manager := &iptablesManager{config: cfg}
 
-	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-FIREWALL")).Return(true, nil)
 	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL")).Return(true, nil)
 	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL-EGR")).Return(true, nil)
 	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL-ING")).Return(true, nil)
@@ -110,10 +111,141 @@ COMMIT
 	mockIptables.AssertExpectations(t)
 }
 
+func TestSyncFilterNetworkPolicyIsolation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cfg := config.Default()
+
+	cfg.Firewall.FilterIPv4 = false
+
+	mockIptables := new(mocks.IpTables)
+	manager := &iptablesManager{config: cfg}
+
+	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL")).Return(true, nil)
+	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL-EGR")).Return(true, nil)
+	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL-ING")).Return(true, nil)
+
+	mockIptables.On("EnsureRule", iptables.Prepend, iptables.Table("filter"), iptables.ChainForward,
+		"-m",
+		"comment",
+		"--comment",
+		"NetworkPolicy enforcement",
+		"-j",
+		"WIGGLENET-NETPOL",
+	).Return(true, nil)
+
+	// The pod is isolated by two policies, but dropped only once, after the
+	// allow rules
+	mockIptables.On("RestoreAll", []byte(`*filter
+-F WIGGLENET-NETPOL
+:WIGGLENET-NETPOL - [0:0]
+-A WIGGLENET-NETPOL -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN
+-A WIGGLENET-NETPOL -j WIGGLENET-NETPOL-EGR
+-A WIGGLENET-NETPOL -j WIGGLENET-NETPOL-ING
+-A WIGGLENET-NETPOL -j RETURN
+-F WIGGLENET-NETPOL-EGR
+:WIGGLENET-NETPOL-EGR - [0:0]
+-F WIGGLENET-NETPOL-ING
+:WIGGLENET-NETPOL-ING - [0:0]
+-A WIGGLENET-NETPOL-ING -d 10.0.0.1 -s 10.0.0.2 -j RETURN
+-A WIGGLENET-NETPOL-ING -d 10.0.0.1 -j DROP
+COMMIT
+`), iptables.NoFlushTables, iptables.NoRestoreCounters).Return(nil)
+
+	policyRules := []NetworkPolicyRule{
+		{
+			Direction: "ingress",
+			Policy:    "default/a",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			Action:    "deny",
+		},
+		{
+			Direction:  "ingress",
+			Policy:     "default/b",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:     "allow",
+		},
+		{
+			Direction: "ingress",
+			Policy:    "default/b",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			Action:    "deny",
+		},
+	}
+
+	cidr := netip.MustParsePrefix("10.0.0.0/24")
+	manager.syncFilterRules(ctx, mockIptables, []netip.Prefix{cidr}, policyRules, false, true)
+
+	mockIptables.AssertExpectations(t)
+}
+
+func TestSyncFilterNetworkPolicyAudit(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cfg := config.Default()
+
+	cfg.Firewall.FilterIPv4 = false
+	cfg.NetworkPolicy.LogGroup = 5
+
+	mockIptables := new(mocks.IpTables)
+	manager := &iptablesManager{config: cfg}
+
+	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL")).Return(true, nil)
+	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL-EGR")).Return(true, nil)
+	mockIptables.On("EnsureChain", iptables.Table("filter"), iptables.Chain("WIGGLENET-NETPOL-ING")).Return(true, nil)
+
+	mockIptables.On("EnsureRule", iptables.Prepend, iptables.Table("filter"), iptables.ChainForward,
+		"-m",
+		"comment",
+		"--comment",
+		"NetworkPolicy enforcement",
+		"-j",
+		"WIGGLENET-NETPOL",
+	).Return(true, nil)
+
+	// The audited pod is logged instead of dropped
+	prefix := nftPolicyChainName("audited/deny-all", "ingress")
+	mockIptables.On("RestoreAll", []byte(`*filter
+-F WIGGLENET-NETPOL
+:WIGGLENET-NETPOL - [0:0]
+-A WIGGLENET-NETPOL -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN
+-A WIGGLENET-NETPOL -j WIGGLENET-NETPOL-EGR
+-A WIGGLENET-NETPOL -j WIGGLENET-NETPOL-ING
+-A WIGGLENET-NETPOL -j RETURN
+-F WIGGLENET-NETPOL-EGR
+:WIGGLENET-NETPOL-EGR - [0:0]
+-F WIGGLENET-NETPOL-ING
+:WIGGLENET-NETPOL-ING - [0:0]
+-A WIGGLENET-NETPOL-ING -d 10.0.0.1 -j NFLOG --nflog-group 5 --nflog-prefix `+prefix+`
+-A WIGGLENET-NETPOL-ING -d 10.0.0.2 -j DROP
+COMMIT
+`), iptables.NoFlushTables, iptables.NoRestoreCounters).Return(nil)
+
+	policyRules := []NetworkPolicyRule{
+		{
+			Direction: "ingress",
+			Policy:    "audited/deny-all",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			Action:    "audit",
+		},
+		{
+			Direction: "ingress",
+			Policy:    "default/deny-all",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:    "deny",
+		},
+	}
+
+	cidr := netip.MustParsePrefix("10.0.0.0/24")
+	manager.syncFilterRules(ctx, mockIptables, []netip.Prefix{cidr}, policyRules, false, true)
+
+	mockIptables.AssertExpectations(t)
+}
+
 func TestSyncNat(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
 	mockIptables := new(mocks.IpTables)
-	manager := new(iptablesManager)
+	cfg := config.Default()
+	manager := &iptablesManager{config: cfg}
 
 	mockIptables.On("EnsureChain", iptables.Table("nat"), iptables.Chain("WIGGLENET-MASQ")).Return(true, nil)
 	mockIptables.On("EnsureRule", iptables.Append, iptables.Table("nat"), iptables.ChainPostrouting,
@@ -134,3 +266,115 @@ COMMIT
 
 	mockIptables.AssertExpectations(t)
 }
+
+func TestCleanupRules(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+
+	ip4tables := new(mocks.IpTables)
+	ip6tables := new(mocks.IpTables)
+	manager := &iptablesManager{config: cfg, ip4tables: ip4tables, ip6tables: ip6tables}
+
+	netpolChains := []iptables.Chain{"WIGGLENET-NETPOL", "WIGGLENET-NETPOL-EGR", "WIGGLENET-NETPOL-ING", "WIGGLENET-ANP-EGR", "WIGGLENET-ANP-ING", "WIGGLENET-BANP-EGR", "WIGGLENET-BANP-ING"}
+
+	// Nothing left over for IPv4
+	for _, chain := range netpolChains {
+		ip4tables.On("ChainExists", iptables.TableFilter, chain).Return(false, nil)
+	}
+
+	// IPv6 had filtering, NetworkPolicy without the admin tiers and masquerading
+	ip6tables.On("ChainExists", iptables.TableFilter, iptables.Chain("WIGGLENET-FIREWALL")).Return(true, nil)
+	ip6tables.On("DeleteRule", iptables.TableFilter, iptables.ChainForward,
+		"-m", "comment", "--comment", "prevent direct ingress traffic to pods", "-j", "WIGGLENET-FIREWALL").Return(nil)
+	ip6tables.On("FlushChain", iptables.TableFilter, iptables.Chain("WIGGLENET-FIREWALL")).Return(nil)
+	ip6tables.On("DeleteChain", iptables.TableFilter, iptables.Chain("WIGGLENET-FIREWALL")).Return(nil)
+
+	for _, chain := range netpolChains {
+		exists := !strings.Contains(string(chain), "ANP")
+		ip6tables.On("ChainExists", iptables.TableFilter, chain).Return(exists, nil)
+		if exists {
+			ip6tables.On("FlushChain", iptables.TableFilter, chain).Return(nil)
+			ip6tables.On("DeleteChain", iptables.TableFilter, chain).Return(nil)
+		}
+	}
+	ip6tables.On("DeleteRule", iptables.TableFilter, iptables.ChainForward,
+		"-m", "comment", "--comment", "NetworkPolicy enforcement", "-j", "WIGGLENET-NETPOL").Return(nil)
+
+	ip6tables.On("ChainExists", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ")).Return(true, nil)
+	ip6tables.On("DeleteRule", iptables.TableNAT, iptables.ChainPostrouting,
+		"-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "WIGGLENET-MASQ",
+		"-m", "comment", "--comment", "masquerade non-LOCAL traffic").Return(nil)
+	ip6tables.On("FlushChain", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ")).Return(nil)
+	ip6tables.On("DeleteChain", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ")).Return(nil)
+
+	require.NoError(t, manager.cleanupRules())
+
+	ip4tables.AssertExpectations(t)
+	ip6tables.AssertExpectations(t)
+}
+
+func TestCleanupIptables(t *testing.T) {
+	ip4tables := new(mocks.IpTables)
+	ip6tables := new(mocks.IpTables)
+
+	// Nothing left over for IPv4
+	ip4tables.On("ChainExists", mock.Anything, mock.Anything).Return(false, nil)
+
+	// IPv6 has all the chains
+	ip6tables.On("ChainExists", mock.Anything, mock.Anything).Return(true, nil)
+	ip6tables.On("DeleteRule", iptables.TableFilter, iptables.ChainForward,
+		"-m", "comment", "--comment", "prevent direct ingress traffic to pods", "-j", "WIGGLENET-FIREWALL").Return(nil)
+	ip6tables.On("DeleteRule", iptables.TableFilter, iptables.ChainForward,
+		"-m", "comment", "--comment", "NetworkPolicy enforcement", "-j", "WIGGLENET-NETPOL").Return(nil)
+	ip6tables.On("DeleteRule", iptables.TableNAT, iptables.ChainPostrouting,
+		"-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "WIGGLENET-MASQ",
+		"-m", "comment", "--comment", "masquerade non-LOCAL traffic").Return(nil)
+	ip6tables.On("FlushChain", mock.Anything, mock.Anything).Return(nil)
+	ip6tables.On("DeleteChain", mock.Anything, mock.Anything).Return(nil)
+
+	require.NoError(t, cleanupIptables(ip4tables, ip6tables))
+
+	ip4tables.AssertNotCalled(t, "DeleteRule", mock.Anything, mock.Anything, mock.Anything)
+	ip6tables.AssertExpectations(t)
+	ip6tables.AssertNumberOfCalls(t, "DeleteChain", 9)
+	ip6tables.AssertCalled(t, "DeleteChain", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ"))
+	ip6tables.AssertCalled(t, "DeleteChain", iptables.TableFilter, iptables.Chain("WIGGLENET-BANP-ING"))
+}
+
+func TestCleanupBackends(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	// Rules of both backends, e.g. after the backend was switched
+	nft := knftables.NewFake(knftables.InetFamily, nftTable)
+	tx := nft.NewTransaction()
+	tx.Add(&knftables.Table{})
+	require.NoError(t, nft.Run(ctx, tx))
+
+	ip4tables := new(mocks.IpTables)
+	ip4tables.On("ChainExists", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ")).Return(true, nil)
+	ip4tables.On("ChainExists", mock.Anything, mock.Anything).Return(false, nil)
+	ip4tables.On("DeleteRule", iptables.TableNAT, iptables.ChainPostrouting,
+		"-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "WIGGLENET-MASQ",
+		"-m", "comment", "--comment", "masquerade non-LOCAL traffic").Return(nil)
+	ip4tables.On("FlushChain", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ")).Return(nil)
+	ip4tables.On("DeleteChain", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ")).Return(nil)
+
+	require.NoError(t, cleanupBackends(ctx, nft, ip4tables))
+	assert.Nil(t, nft.Table)
+	ip4tables.AssertCalled(t, "DeleteChain", iptables.TableNAT, iptables.Chain("WIGGLENET-MASQ"))
+
+	// A failing backend does not keep the other one from being cleaned up
+	tx = nft.NewTransaction()
+	tx.Add(&knftables.Table{})
+	require.NoError(t, nft.Run(ctx, tx))
+	failing := new(mocks.IpTables)
+	failing.On("ChainExists", mock.Anything, mock.Anything).Return(false, errors.New("iptables is broken"))
+
+	assert.ErrorContains(t, cleanupBackends(ctx, nft, failing), "removing iptables rules: iptables is broken")
+	assert.Nil(t, nft.Table)
+
+	// Without nftables
+	assert.NoError(t, cleanupBackends(ctx, nil, ip4tables))
+}
@@ -7,9 +7,11 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/health"
 	"github.com/tibordp/wigglenet/internal/metrics"
 
 	ipt "k8s.io/kubernetes/pkg/util/iptables"
@@ -22,43 +24,95 @@ const (
 	netpolChain        = ipt.Chain("WIGGLENET-NETPOL")
 	netpolEgressChain  = ipt.Chain("WIGGLENET-NETPOL-EGR")
 	netpolIngressChain = ipt.Chain("WIGGLENET-NETPOL-ING")
+	anpEgressChain     = ipt.Chain("WIGGLENET-ANP-EGR")
+	anpIngressChain    = ipt.Chain("WIGGLENET-ANP-ING")
+	banpEgressChain    = ipt.Chain("WIGGLENET-BANP-EGR")
+	banpIngressChain   = ipt.Chain("WIGGLENET-BANP-ING")
 	natChain           = ipt.Chain("WIGGLENET-MASQ")
 
 	// Sync iptables every minute
 	syncInterval = 1 * time.Minute
 )
 
+// Rules in the built-in chains that jump to our chains
+var (
+	filterJumpArgs = []string{"-m", "comment", "--comment", "prevent direct ingress traffic to pods", "-j", string(filterChain)}
+	netpolJumpArgs = []string{"-m", "comment", "--comment", "NetworkPolicy enforcement", "-j", string(netpolChain)}
+	natJumpArgs    = []string{"-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", string(natChain), "-m", "comment", "--comment", "masquerade non-LOCAL traffic"}
+)
+
 type ipTables interface {
 	EnsureChain(table ipt.Table, chain ipt.Chain) (bool, error)
+	ChainExists(table ipt.Table, chain ipt.Chain) (bool, error)
+	FlushChain(table ipt.Table, chain ipt.Chain) error
+	DeleteChain(table ipt.Table, chain ipt.Chain) error
 	EnsureRule(position ipt.RulePosition, table ipt.Table, chain ipt.Chain, args ...string) (bool, error)
+	DeleteRule(table ipt.Table, chain ipt.Chain, args ...string) error
 	RestoreAll(data []byte, flush ipt.FlushFlag, counters ipt.RestoreCountersFlag) error
 }
 
 type iptablesManager struct {
+	config          *config.Config
+	health          *health.Checker
 	ip6tables       ipTables
 	ip4tables       ipTables
 	podCIDRUpdates  chan []netip.Prefix
 	policyUpdates   chan []NetworkPolicyRule
+	configUpdates   *configUpdates
 	currentPodCIDRs []netip.Prefix
 	currentPolicies []NetworkPolicyRule
+
+	// Set until the chains of the disabled features have been removed, once
+	// at startup (they may be left over from a previous configuration) and
+	// after each configuration change.
+	cleanupPending bool
+
+	nflog *nflogListener
+
+	// appliedConfig is the configuration of the last successful sync
+	appliedConfig atomic.Pointer[FirewallConfig]
 }
 
-func newIptablesManager(podCIDRUpdates chan []netip.Prefix, policyUpdates chan []NetworkPolicyRule) Manager {
+func newIptablesManager(cfg *config.Config, checker *health.Checker, podCIDRUpdates chan []netip.Prefix, policyUpdates chan []NetworkPolicyRule, podResolver PodResolver) Manager {
 	ip6tables := ipt.New(ipt.ProtocolIPv6)
 	ip4tables := ipt.New(ipt.ProtocolIPv4)
 
 	m := iptablesManager{
+		config:          cfg,
+		health:          checker,
 		ip6tables:       ip6tables,
 		ip4tables:       ip4tables,
 		podCIDRUpdates:  podCIDRUpdates,
 		policyUpdates:   policyUpdates,
+		configUpdates:   newConfigUpdates(),
 		currentPodCIDRs: []netip.Prefix{},
 		currentPolicies: []NetworkPolicyRule{},
+		cleanupPending:  true,
+		nflog:           newNflogListener(cfg, podResolver),
 	}
 
 	return &m
 }
 
+func (c *iptablesManager) AppliedConfig() *FirewallConfig {
+	return c.appliedConfig.Load()
+}
+
+func (c *iptablesManager) Reconfigure(cfg *config.Config) {
+	c.configUpdates.send(cfg)
+}
+
+// setConfig switches to a new configuration, the chains that are no longer
+// needed are removed after the next sync.
+func (c *iptablesManager) setConfig(cfg *config.Config) {
+	if !cfg.NetworkPolicy.Enabled {
+		// Not updated anymore, start from scratch if it is enabled again
+		c.currentPolicies = []NetworkPolicyRule{}
+	}
+	c.config = cfg
+	c.cleanupPending = true
+}
+
 func (c *iptablesManager) Run(ctx context.Context) {
 	logger := klog.FromContext(ctx)
 	logger.Info("started syncing firewall rules (iptables backend)")
@@ -91,21 +145,39 @@ func (c *iptablesManager) Run(ctx context.Context) {
 				timer.Reset(syncInterval)
 				c.currentPolicies = newPolicies
 			}
+		case <-c.configUpdates.updated:
+			logger.Info("received new firewall configuration")
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(syncInterval)
+			c.setConfig(c.configUpdates.latest.Load())
 		}
 
 		start := time.Now()
 		err := c.syncRules(ctx)
-		if config.EnableMetrics {
+		if err == nil && c.cleanupPending {
+			if err = c.cleanupRules(); err == nil {
+				c.cleanupPending = false
+			}
+		}
+		if c.config.Metrics.Enabled {
 			metrics.RecordFirewallSync("iptables", time.Since(start), err)
 		}
+		c.health.RecordSync(health.FirewallSynced, err)
 		if err != nil {
 			// Just log the error, we will retry in one minute if transient
 			logger.Error(err, "failed to sync firewall rules")
+		} else {
+			applied := NewConfigWithPolicies(c.currentPodCIDRs, c.currentPolicies)
+			c.appliedConfig.Store(&applied)
 		}
+		c.nflog.ensureStarted(ctx)
 	}
 }
 
 func (c *iptablesManager) syncRules(ctx context.Context) error {
+	fw, netpol := c.config.Firewall, c.config.NetworkPolicy
 	ip4cidrs := make([]netip.Prefix, 0)
 	ip6cidrs := make([]netip.Prefix, 0)
 
@@ -121,7 +193,15 @@ func (c *iptablesManager) syncRules(ctx context.Context) error {
 	ip4PolicyRules := make([]NetworkPolicyRule, 0)
 	ip6PolicyRules := make([]NetworkPolicyRule, 0)
 
+	// Only policies in audit mode are logged with this backend
+	logTags := make(map[string]netpolLogTag)
+
 	for _, rule := range c.currentPolicies {
+		if rule.Action == "audit" && netpol.Enabled {
+			prefix, tag := netpolLogPrefix(rule)
+			logTags[prefix] = tag
+		}
+
 		hasIPv4 := false
 		hasIPv6 := false
 
@@ -141,27 +221,29 @@ func (c *iptablesManager) syncRules(ctx context.Context) error {
 		}
 	}
 
+	c.nflog.tags.set(logTags)
+
 	// Apply IPv6 filter rules if filtering is enabled OR if NetworkPolicy is enabled
-	if config.FilterIPv6 || config.EnableNetworkPolicy {
-		if err := c.syncFilterRules(ctx, c.ip6tables, ip6cidrs, ip6PolicyRules, true, config.EnableNetworkPolicy); err != nil {
+	if fw.FilterIPv6 || netpol.Enabled {
+		if err := c.syncFilterRules(ctx, c.ip6tables, ip6cidrs, ip6PolicyRules, true, netpol.Enabled); err != nil {
 			return err
 		}
 	}
 
 	// Apply IPv4 filter rules if filtering is enabled OR if NetworkPolicy is enabled
-	if config.FilterIPv4 || config.EnableNetworkPolicy {
-		if err := c.syncFilterRules(ctx, c.ip4tables, ip4cidrs, ip4PolicyRules, false, config.EnableNetworkPolicy); err != nil {
+	if fw.FilterIPv4 || netpol.Enabled {
+		if err := c.syncFilterRules(ctx, c.ip4tables, ip4cidrs, ip4PolicyRules, false, netpol.Enabled); err != nil {
 			return err
 		}
 	}
 
-	if config.MasqueradeIPv6 {
+	if fw.MasqueradeIPv6 {
 		if err := c.syncMasqueradeRules(ctx, c.ip6tables, ip6cidrs); err != nil {
 			return err
 		}
 	}
 
-	if config.MasqueradeIPv4 {
+	if fw.MasqueradeIPv4 {
 		if err := c.syncMasqueradeRules(ctx, c.ip4tables, ip4cidrs); err != nil {
 			return err
 		}
@@ -170,16 +252,107 @@ func (c *iptablesManager) syncRules(ctx context.Context) error {
 	return nil
 }
 
+// cleanupRules removes the chains of the features that are disabled, together
+// with the rules that jump to them from the built-in chains.
+func (c *iptablesManager) cleanupRules() error {
+	fw, netpol := c.config.Firewall, c.config.NetworkPolicy
+	adminChains := []ipt.Chain{anpEgressChain, anpIngressChain, banpEgressChain, banpIngressChain}
+
+	for _, family := range []struct {
+		tables     ipTables
+		filter     bool
+		masquerade bool
+	}{
+		{c.ip4tables, fw.FilterIPv4, fw.MasqueradeIPv4},
+		{c.ip6tables, fw.FilterIPv6, fw.MasqueradeIPv6},
+	} {
+		if !family.filter {
+			if err := removeChains(family.tables, ipt.TableFilter, ipt.ChainForward, filterJumpArgs, filterChain); err != nil {
+				return err
+			}
+		}
+		if !netpol.Enabled {
+			chains := append([]ipt.Chain{netpolChain, netpolEgressChain, netpolIngressChain}, adminChains...)
+			if err := removeChains(family.tables, ipt.TableFilter, ipt.ChainForward, netpolJumpArgs, chains...); err != nil {
+				return err
+			}
+		} else if !netpol.AdminNetworkPolicy {
+			// Only referenced from the NetworkPolicy chains, which have been
+			// rewritten by now
+			if err := removeChains(family.tables, ipt.TableFilter, "", nil, adminChains...); err != nil {
+				return err
+			}
+		}
+		if !family.masquerade {
+			if err := removeChains(family.tables, ipt.TableNAT, ipt.ChainPostrouting, natJumpArgs, natChain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cleanupIptables removes all the chains, together with the rules that jump to
+// them from the built-in chains.
+func cleanupIptables(tables ...ipTables) error {
+	netpolChains := []ipt.Chain{netpolChain, netpolEgressChain, netpolIngressChain, anpEgressChain, anpIngressChain, banpEgressChain, banpIngressChain}
+	for _, t := range tables {
+		if err := removeChains(t, ipt.TableFilter, ipt.ChainForward, filterJumpArgs, filterChain); err != nil {
+			return err
+		}
+		if err := removeChains(t, ipt.TableFilter, ipt.ChainForward, netpolJumpArgs, netpolChains...); err != nil {
+			return err
+		}
+		if err := removeChains(t, ipt.TableNAT, ipt.ChainPostrouting, natJumpArgs, natChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeChains deletes the chains that exist, after removing the rule that
+// jumps to them from the built-in chain from (if any). All of them are flushed
+// before any is deleted, so that jumps between them do not prevent deletion.
+func removeChains(tables ipTables, table ipt.Table, from ipt.Chain, jumpArgs []string, chains ...ipt.Chain) error {
+	existing := make([]ipt.Chain, 0, len(chains))
+	for _, chain := range chains {
+		exists, err := tables.ChainExists(table, chain)
+		if err != nil {
+			return err
+		}
+		if exists {
+			existing = append(existing, chain)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+
+	if from != "" {
+		if err := tables.DeleteRule(table, from, jumpArgs...); err != nil {
+			return err
+		}
+	}
+	for _, chain := range existing {
+		if err := tables.FlushChain(table, chain); err != nil {
+			return err
+		}
+	}
+	for _, chain := range existing {
+		if err := tables.DeleteChain(table, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *iptablesManager) syncMasqueradeRules(ctx context.Context, tables ipTables, nonMasqCidrs []netip.Prefix) error {
 	_ = ctx // context not needed for this function, but keeping signature consistent
 	if _, err := tables.EnsureChain(ipt.TableNAT, natChain); err != nil {
 		return err
 	}
 
-	if _, err := tables.EnsureRule(ipt.Append, ipt.TableNAT, ipt.ChainPostrouting,
-		"-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", string(natChain),
-		"-m", "comment",
-		"--comment", "masquerade non-LOCAL traffic"); err != nil {
+	if _, err := tables.EnsureRule(ipt.Append, ipt.TableNAT, ipt.ChainPostrouting, natJumpArgs...); err != nil {
 		return err
 	}
 
@@ -203,10 +376,14 @@ func (c *iptablesManager) syncMasqueradeRules(ctx context.Context, tables ipTabl
 func (c *iptablesManager) syncFilterRules(ctx context.Context, tables ipTables, nonFilterCidrs []netip.Prefix, policyRules []NetworkPolicyRule, isIPv6 bool, enableNetworkPolicy bool) error {
 	_ = ctx // context not needed for this function, but keeping signature consistent
 	// Determine if we need global filtering (based on config) or just NetworkPolicy filtering
-	enableGlobalFiltering := (isIPv6 && config.FilterIPv6) || (!isIPv6 && config.FilterIPv4)
+	fw := c.config.Firewall
+	enableGlobalFiltering := (isIPv6 && fw.FilterIPv6) || (!isIPv6 && fw.FilterIPv4)
+	enableAdminNetpol := enableNetworkPolicy && c.config.NetworkPolicy.AdminNetworkPolicy
 
-	if _, err := tables.EnsureChain(ipt.TableFilter, filterChain); err != nil {
-		return err
+	if enableGlobalFiltering {
+		if _, err := tables.EnsureChain(ipt.TableFilter, filterChain); err != nil {
+			return err
+		}
 	}
 
 	if enableNetworkPolicy {
@@ -221,14 +398,20 @@ func (c *iptablesManager) syncFilterRules(ctx context.Context, tables ipTables,
 		}
 	}
 
+	if enableAdminNetpol {
+		for _, chain := range []ipt.Chain{anpEgressChain, anpIngressChain, banpEgressChain, banpIngressChain} {
+			if _, err := tables.EnsureChain(ipt.TableFilter, chain); err != nil {
+				return err
+			}
+		}
+	}
+
 	lines := bytes.NewBuffer(nil)
 	writeLine(lines, "*filter")
 
 	// Main filter chain rules (only if global filtering is enabled)
 	if enableGlobalFiltering {
-		if _, err := tables.EnsureRule(ipt.Prepend, ipt.TableFilter, ipt.ChainForward,
-			"-m", "comment", "--comment", "prevent direct ingress traffic to pods",
-			"-j", string(filterChain)); err != nil {
+		if _, err := tables.EnsureRule(ipt.Prepend, ipt.TableFilter, ipt.ChainForward, filterJumpArgs...); err != nil {
 			return err
 		}
 
@@ -255,12 +438,19 @@ func (c *iptablesManager) syncFilterRules(ctx context.Context, tables ipTables,
 	if enableNetworkPolicy {
 		// Insert at top of FORWARD so we run before KUBE-FORWARD's
 		// mark-based ACCEPT rule that would otherwise bypass policy checks.
-		if _, err := tables.EnsureRule(ipt.Prepend, ipt.TableFilter, ipt.ChainForward,
-			"-m", "comment", "--comment", "NetworkPolicy enforcement",
-			"-j", string(netpolChain)); err != nil {
+		if _, err := tables.EnsureRule(ipt.Prepend, ipt.TableFilter, ipt.ChainForward, netpolJumpArgs...); err != nil {
 			return err
 		}
 
+		// With AdminNetworkPolicy support each direction is evaluated as
+		// ANP -> NETPOL -> BANP. RETURN ends evaluation for the direction, DROP
+		// is final and the ANP chain hands over to the NETPOL chain with a goto
+		// (-g), so that a RETURN from there still lands back in WIGGLENET-NETPOL.
+		egressEntry, ingressEntry := netpolEgressChain, netpolIngressChain
+		if enableAdminNetpol {
+			egressEntry, ingressEntry = anpEgressChain, anpIngressChain
+		}
+
 		// Main netpol chain: established/related, then jump to egress + ingress sub-chains
 		writeLine(lines, "-F", string(netpolChain))
 		writeLine(lines, ipt.MakeChainLine(netpolChain))
@@ -269,8 +459,8 @@ func (c *iptablesManager) syncFilterRules(ctx context.Context, tables ipTables,
 		if isIPv6 {
 			writeRule(lines, ipt.Append, netpolChain, "-p", "ipv6-icmp", "-j", "RETURN")
 		}
-		writeRule(lines, ipt.Append, netpolChain, "-j", string(netpolEgressChain))
-		writeRule(lines, ipt.Append, netpolChain, "-j", string(netpolIngressChain))
+		writeRule(lines, ipt.Append, netpolChain, "-j", string(egressEntry))
+		writeRule(lines, ipt.Append, netpolChain, "-j", string(ingressEntry))
 		writeRule(lines, ipt.Append, netpolChain, "-j", "RETURN")
 
 		// Egress sub-chain
@@ -281,9 +471,33 @@ func (c *iptablesManager) syncFilterRules(ctx context.Context, tables ipTables,
 		writeLine(lines, "-F", string(netpolIngressChain))
 		writeLine(lines, ipt.MakeChainLine(netpolIngressChain))
 
+		if enableAdminNetpol {
+			for _, chain := range []ipt.Chain{anpEgressChain, anpIngressChain, banpEgressChain, banpIngressChain} {
+				writeLine(lines, "-F", string(chain))
+				writeLine(lines, ipt.MakeChainLine(chain))
+			}
+		}
+
+		// Isolation (deny) rules go after all the allow rules
+		var isolationRules []NetworkPolicyRule
 		for _, rule := range policyRules {
+			if rule.Tier != "" && !enableAdminNetpol {
+				continue
+			}
+			if rule.Tier == "" && (rule.Action == "deny" || rule.Action == "audit") {
+				isolationRules = append(isolationRules, rule)
+				continue
+			}
 			c.writeNetworkPolicyRules(lines, rule, isIPv6)
 		}
+		writeIsolationRules(lines, isolationRules, isIPv6, c.config.NetworkPolicy.LogGroup)
+
+		if enableAdminNetpol {
+			writeRule(lines, ipt.Append, anpEgressChain, "-g", string(netpolEgressChain))
+			writeRule(lines, ipt.Append, anpIngressChain, "-g", string(netpolIngressChain))
+			writeRule(lines, ipt.Append, netpolEgressChain, "-j", string(banpEgressChain))
+			writeRule(lines, ipt.Append, netpolIngressChain, "-j", string(banpIngressChain))
+		}
 	}
 
 	writeLine(lines, "COMMIT")
@@ -340,29 +554,79 @@ func groupPortRulesForIPTables(portRules []PortRule) []iptablesPortGroup {
 	return groups
 }
 
-func (c *iptablesManager) writeNetworkPolicyRules(lines *bytes.Buffer, rule NetworkPolicyRule, isIPv6 bool) {
-	// Pick the correct sub-chain based on direction
-	chain := netpolIngressChain
-	if rule.Direction == "egress" {
-		chain = netpolEgressChain
+// iptablesTierChain returns the chain a rule belongs to, based on its tier and direction.
+func iptablesTierChain(tier, direction string) ipt.Chain {
+	egress := direction == "egress"
+	switch tier {
+	case "admin":
+		if egress {
+			return anpEgressChain
+		}
+		return anpIngressChain
+	case "baseline":
+		if egress {
+			return banpEgressChain
+		}
+		return banpIngressChain
+	default:
+		if egress {
+			return netpolEgressChain
+		}
+		return netpolIngressChain
 	}
+}
+
+// iptablesTierTarget maps the action of a peer-matching rule to its target.
+func iptablesTierTarget(rule NetworkPolicyRule) []string {
+	if rule.Tier == "" {
+		return []string{"-j", "RETURN"}
+	}
+	switch rule.Action {
+	case "deny":
+		return []string{"-j", "DROP"}
+	case "pass":
+		return []string{"-g", string(iptablesTierChain("", rule.Direction))}
+	default:
+		return []string{"-j", "RETURN"}
+	}
+}
 
-	if rule.Action == "deny" {
+// writeIsolationRules drops traffic to/from pods isolated by NetworkPolicy, or
+// only logs it for policies in audit mode. A pod selected by several policies
+// is only dropped (or logged) once.
+func writeIsolationRules(lines *bytes.Buffer, rules []NetworkPolicyRule, isIPv6 bool, logGroup int) {
+	seen := make(map[string]map[netip.Addr]bool)
+	for _, rule := range rules {
+		if seen[rule.Direction] == nil {
+			seen[rule.Direction] = make(map[netip.Addr]bool)
+		}
 		for _, podIP := range rule.PodIPs {
-			if (isIPv6 && podIP.Is4()) || (!isIPv6 && podIP.Is6()) {
+			if (isIPv6 && podIP.Is4()) || (!isIPv6 && podIP.Is6()) || seen[rule.Direction][podIP] {
 				continue
 			}
+			seen[rule.Direction][podIP] = true
+
 			args := []string{}
 			if rule.Direction == "ingress" {
 				args = append(args, "-d", podIP.String())
 			} else if rule.Direction == "egress" {
 				args = append(args, "-s", podIP.String())
 			}
-			args = append(args, "-j", "DROP")
-			writeRule(lines, ipt.Append, chain, args...)
+			if rule.Action == "audit" {
+				prefix, _ := netpolLogPrefix(rule)
+				args = append(args, "-j", "NFLOG", "--nflog-group", strconv.Itoa(logGroup), "--nflog-prefix", prefix)
+			} else {
+				args = append(args, "-j", "DROP")
+			}
+			writeRule(lines, ipt.Append, iptablesTierChain("", rule.Direction), args...)
 		}
-		return
 	}
+}
+
+func (c *iptablesManager) writeNetworkPolicyRules(lines *bytes.Buffer, rule NetworkPolicyRule, isIPv6 bool) {
+	// Pick the correct sub-chain based on tier and direction
+	chain := iptablesTierChain(rule.Tier, rule.Direction)
+	target := iptablesTierTarget(rule)
 
 	// Group port rules by protocol
 	protoGroups := groupPortRulesForIPTables(rule.PortRules)
@@ -411,7 +675,7 @@ func (c *iptablesManager) writeNetworkPolicyRules(lines *bytes.Buffer, rule Netw
 				} else if rule.Direction == "egress" {
 					ruleArgs = append(ruleArgs, "-d", allowedIP.String())
 				}
-				ruleArgs = append(ruleArgs, "-j", "RETURN")
+				ruleArgs = append(ruleArgs, target...)
 				writeRule(lines, ipt.Append, chain, ruleArgs...)
 			}
 
@@ -425,7 +689,7 @@ func (c *iptablesManager) writeNetworkPolicyRules(lines *bytes.Buffer, rule Netw
 				} else if rule.Direction == "egress" {
 					ruleArgs = append(ruleArgs, "-d", allowedCIDR.String())
 				}
-				ruleArgs = append(ruleArgs, "-j", "RETURN")
+				ruleArgs = append(ruleArgs, target...)
 				writeRule(lines, ipt.Append, chain, ruleArgs...)
 			}
 		}
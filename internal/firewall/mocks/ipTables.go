@@ -12,6 +12,62 @@ type IpTables struct {
 	mock.Mock
 }
 
+// ChainExists provides a mock function with given fields: table, chain
+func (_m *IpTables) ChainExists(table iptables.Table, chain iptables.Chain) (bool, error) {
+	ret := _m.Called(table, chain)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(iptables.Table, iptables.Chain) bool); ok {
+		r0 = rf(table, chain)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(iptables.Table, iptables.Chain) error); ok {
+		r1 = rf(table, chain)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteChain provides a mock function with given fields: table, chain
+func (_m *IpTables) DeleteChain(table iptables.Table, chain iptables.Chain) error {
+	ret := _m.Called(table, chain)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(iptables.Table, iptables.Chain) error); ok {
+		r0 = rf(table, chain)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteRule provides a mock function with given fields: table, chain, args
+func (_m *IpTables) DeleteRule(table iptables.Table, chain iptables.Chain, args ...string) error {
+	_va := make([]interface{}, len(args))
+	for _i := range args {
+		_va[_i] = args[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, table, chain)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(iptables.Table, iptables.Chain, ...string) error); ok {
+		r0 = rf(table, chain, args...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // EnsureChain provides a mock function with given fields: table, chain
 func (_m *IpTables) EnsureChain(table iptables.Table, chain iptables.Chain) (bool, error) {
 	ret := _m.Called(table, chain)
@@ -61,6 +117,20 @@ func (_m *IpTables) EnsureRule(position iptables.RulePosition, table iptables.Ta
 	return r0, r1
 }
 
+// FlushChain provides a mock function with given fields: table, chain
+func (_m *IpTables) FlushChain(table iptables.Table, chain iptables.Chain) error {
+	ret := _m.Called(table, chain)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(iptables.Table, iptables.Chain) error); ok {
+		r0 = rf(table, chain)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // RestoreAll provides a mock function with given fields: data, flush, counters
 func (_m *IpTables) RestoreAll(data []byte, flush iptables.FlushFlag, counters iptables.RestoreCountersFlag) error {
 	ret := _m.Called(data, flush, counters)
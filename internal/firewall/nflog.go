@@ -0,0 +1,347 @@
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/metrics"
+	"golang.org/x/sys/unix"
+
+	klog "k8s.io/klog/v2"
+)
+
+// nfnetlink_log constants (see include/uapi/linux/netfilter/nfnetlink_log.h)
+const (
+	nfnlSubsysULOG = 4
+
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulaPayload = 9
+	nfulaPrefix  = 10
+
+	nfulnlCfgCmdBind = 1
+	nfulnlCopyPacket = 2
+
+	// Enough of the packet to cover the IP and transport headers
+	nflogCopyRange = 128
+)
+
+// netpolLogTag identifies the NetworkPolicy a drop log rule was emitted for.
+type netpolLogTag struct {
+	Namespace string
+	Policy    string
+	Direction string
+	Audit     bool // the packet was logged, but not dropped
+}
+
+// netpolLogPrefix returns the log prefix for an isolation rule, along with the
+// policy it identifies. The prefix is the name of the policy's nftables chain,
+// which is short enough for both backends.
+func netpolLogPrefix(rule NetworkPolicyRule) (string, netpolLogTag) {
+	namespace, name, _ := strings.Cut(rule.Policy, "/")
+	return nftPolicyChainName(rule.Policy, rule.Direction), netpolLogTag{
+		Namespace: namespace,
+		Policy:    name,
+		Direction: rule.Direction,
+		Audit:     rule.Action == "audit",
+	}
+}
+
+// netpolLogTags maps log prefixes to policies. It is written by the sync loop
+// and read by the nflog listener.
+type netpolLogTags struct {
+	mu   sync.RWMutex
+	tags map[string]netpolLogTag
+}
+
+func newNetpolLogTags() *netpolLogTags {
+	return &netpolLogTags{tags: make(map[string]netpolLogTag)}
+}
+
+func (t *netpolLogTags) set(tags map[string]netpolLogTag) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tags = tags
+}
+
+func (t *netpolLogTags) lookup(prefix string) (netpolLogTag, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tag, ok := t.tags[prefix]
+	return tag, ok
+}
+
+func (t *netpolLogTags) empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.tags) == 0
+}
+
+// nflogListener turns NetworkPolicy log rules into log lines and metrics. It
+// is only started once there are log rules, so that the nflog group is not
+// claimed on nodes that never log anything.
+type nflogListener struct {
+	config      *config.Config
+	tags        *netpolLogTags
+	podResolver PodResolver
+	started     bool
+}
+
+func newNflogListener(cfg *config.Config, podResolver PodResolver) *nflogListener {
+	return &nflogListener{
+		config:      cfg,
+		tags:        newNetpolLogTags(),
+		podResolver: podResolver,
+	}
+}
+
+// ensureStarted starts listening if any log rules have been installed. It must
+// be called from the firewall manager's sync loop.
+func (l *nflogListener) ensureStarted(ctx context.Context) {
+	if l.started || l.tags.empty() {
+		return
+	}
+	l.started = true
+	go l.run(ctx, uint16(l.config.NetworkPolicy.LogGroup))
+}
+
+// nflogPacket is a packet received from an nflog group.
+type nflogPacket struct {
+	Prefix  string
+	Payload []byte
+}
+
+// packetSummary holds the header fields of a logged packet.
+type packetSummary struct {
+	Src      netip.Addr
+	Dst      netip.Addr
+	Protocol string
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// run binds to the given nflog group and handles logged packets until the
+// context is cancelled.
+func (l *nflogListener) run(ctx context.Context, group uint16) {
+	logger := klog.FromContext(ctx)
+
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		logger.Error(err, "failed to open nflog socket")
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := nflogBind(conn, group); err != nil {
+		logger.Error(err, "failed to bind nflog group", "group", group)
+		return
+	}
+	logger.Info("listening for NetworkPolicy drops", "group", group)
+
+	for {
+		msgs, err := conn.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, unix.ENOBUFS) {
+				// The kernel dropped some messages, nothing to do but carry on
+				logger.V(2).Info("nflog socket buffer overrun")
+				continue
+			}
+			logger.Error(err, "failed to receive nflog messages")
+			return
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type != netlink.HeaderType(nfnlSubsysULOG<<8|nfulnlMsgPacket) {
+				continue
+			}
+			pkt, err := parseNflogMessage(msg.Data)
+			if err != nil {
+				logger.V(2).Info("failed to parse nflog message", "err", err)
+				continue
+			}
+			l.record(logger, pkt)
+		}
+	}
+}
+
+func (l *nflogListener) record(logger klog.Logger, pkt nflogPacket) {
+	tag, ok := l.tags.lookup(pkt.Prefix)
+	if !ok {
+		// Logged by a rule from a ruleset that has since been replaced
+		logger.V(2).Info("packet logged by unknown NetworkPolicy", "tag", pkt.Prefix)
+		return
+	}
+
+	if l.config.Metrics.Enabled {
+		counter := metrics.NetpolDropsTotal
+		if tag.Audit {
+			counter = metrics.NetpolAuditDropsTotal
+		}
+		counter.WithLabelValues(tag.Namespace, tag.Policy, tag.Direction).Inc()
+	}
+
+	keysAndValues := []interface{}{"namespace", tag.Namespace, "policy", tag.Policy, "direction", tag.Direction}
+	if summary, ok := parsePacketHeaders(pkt.Payload); ok {
+		keysAndValues = append(keysAndValues, "src", summary.Src, "dst", summary.Dst, "protocol", summary.Protocol)
+		if summary.SrcPort != 0 || summary.DstPort != 0 {
+			keysAndValues = append(keysAndValues, "srcPort", summary.SrcPort, "dstPort", summary.DstPort)
+		}
+		if l.podResolver != nil {
+			if pod, ok := l.podResolver.PodName(summary.Src); ok {
+				keysAndValues = append(keysAndValues, "srcPod", pod)
+			}
+			if pod, ok := l.podResolver.PodName(summary.Dst); ok {
+				keysAndValues = append(keysAndValues, "dstPod", pod)
+			}
+		}
+	}
+
+	if tag.Audit {
+		logger.Info("packet would be dropped by NetworkPolicy", keysAndValues...)
+	} else {
+		logger.Info("packet dropped by NetworkPolicy", keysAndValues...)
+	}
+}
+
+// nflogBind binds the connection to an nflog group and asks the kernel to copy
+// the beginning of each packet.
+func nflogBind(conn *netlink.Conn, group uint16) error {
+	cmd := netlink.NewAttributeEncoder()
+	cmd.ByteOrder = binary.BigEndian
+	cmd.Uint8(nfulaCfgCmd, nfulnlCfgCmdBind)
+
+	mode := netlink.NewAttributeEncoder()
+	mode.ByteOrder = binary.BigEndian
+	modeData := make([]byte, 6)
+	binary.BigEndian.PutUint32(modeData, nflogCopyRange)
+	modeData[4] = nfulnlCopyPacket
+	mode.Bytes(nfulaCfgMode, modeData)
+
+	for _, ae := range []*netlink.AttributeEncoder{cmd, mode} {
+		attrs, err := ae.Encode()
+		if err != nil {
+			return err
+		}
+		_, err = conn.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(nfnlSubsysULOG<<8 | nfulnlMsgConfig),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: append(nfgenmsg(unix.AF_UNSPEC, group), attrs...),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nfgenmsg encodes the nfnetlink message header.
+func nfgenmsg(family uint8, resID uint16) []byte {
+	b := make([]byte, 4)
+	b[0] = family
+	b[1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(b[2:], resID)
+	return b
+}
+
+// parseNflogMessage decodes an NFULNL_MSG_PACKET message.
+func parseNflogMessage(data []byte) (nflogPacket, error) {
+	var pkt nflogPacket
+	if len(data) < 4 {
+		return pkt, fmt.Errorf("message too short: %d bytes", len(data))
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return pkt, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPrefix:
+			pkt.Prefix = strings.TrimRight(ad.String(), "\x00")
+		case nfulaPayload:
+			pkt.Payload = ad.Bytes()
+		}
+	}
+	return pkt, ad.Err()
+}
+
+// parsePacketHeaders extracts the addresses, protocol and ports from an IP
+// packet. IPv6 extension headers are not followed.
+func parsePacketHeaders(payload []byte) (packetSummary, bool) {
+	var summary packetSummary
+	if len(payload) == 0 {
+		return summary, false
+	}
+
+	var proto uint8
+	var l4 []byte
+	switch payload[0] >> 4 {
+	case 4:
+		if len(payload) < 20 {
+			return summary, false
+		}
+		ihl := int(payload[0]&0x0f) * 4
+		if ihl < 20 || len(payload) < ihl {
+			return summary, false
+		}
+		proto = payload[9]
+		summary.Src = netip.AddrFrom4([4]byte(payload[12:16]))
+		summary.Dst = netip.AddrFrom4([4]byte(payload[16:20]))
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(payload[6:8])&0x1fff == 0 {
+			l4 = payload[ihl:]
+		}
+	case 6:
+		if len(payload) < 40 {
+			return summary, false
+		}
+		proto = payload[6]
+		summary.Src = netip.AddrFrom16([16]byte(payload[8:24]))
+		summary.Dst = netip.AddrFrom16([16]byte(payload[24:40]))
+		l4 = payload[40:]
+	default:
+		return summary, false
+	}
+
+	switch proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP:
+		summary.Protocol = map[uint8]string{
+			unix.IPPROTO_TCP:  "tcp",
+			unix.IPPROTO_UDP:  "udp",
+			unix.IPPROTO_SCTP: "sctp",
+		}[proto]
+		if len(l4) >= 4 {
+			summary.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+			summary.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+	case unix.IPPROTO_ICMP:
+		summary.Protocol = "icmp"
+	case unix.IPPROTO_ICMPV6:
+		summary.Protocol = "icmpv6"
+	default:
+		summary.Protocol = strconv.Itoa(int(proto))
+	}
+
+	return summary, true
+}
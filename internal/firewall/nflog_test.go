@@ -0,0 +1,92 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNflogMessage(t *testing.T) {
+	payload := []byte{0x45, 0x00}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Uint32(1, 0) // NFULA_PACKET_HDR, ignored
+	ae.String(nfulaPrefix, "np-0123456789ab-ingress")
+	ae.Bytes(nfulaPayload, payload)
+	attrs, err := ae.Encode()
+	require.NoError(t, err)
+
+	pkt, err := parseNflogMessage(append(nfgenmsg(2, 5), attrs...))
+	require.NoError(t, err)
+	assert.Equal(t, "np-0123456789ab-ingress", pkt.Prefix)
+	assert.Equal(t, payload, pkt.Payload)
+
+	_, err = parseNflogMessage([]byte{0, 0})
+	assert.Error(t, err)
+}
+
+func TestParsePacketHeadersIPv4(t *testing.T) {
+	packet := make([]byte, 24)
+	packet[0] = 0x45 // version 4, 20 byte header
+	packet[9] = 6    // TCP
+	copy(packet[12:16], []byte{10, 0, 0, 2})
+	copy(packet[16:20], []byte{10, 0, 0, 1})
+	binary.BigEndian.PutUint16(packet[20:22], 40000)
+	binary.BigEndian.PutUint16(packet[22:24], 80)
+
+	summary, ok := parsePacketHeaders(packet)
+	require.True(t, ok)
+	assert.Equal(t, packetSummary{
+		Src:      netip.MustParseAddr("10.0.0.2"),
+		Dst:      netip.MustParseAddr("10.0.0.1"),
+		Protocol: "tcp",
+		SrcPort:  40000,
+		DstPort:  80,
+	}, summary)
+
+	// Non-first fragments carry no ports
+	binary.BigEndian.PutUint16(packet[6:8], 100)
+	summary, ok = parsePacketHeaders(packet)
+	require.True(t, ok)
+	assert.Zero(t, summary.SrcPort)
+	assert.Zero(t, summary.DstPort)
+}
+
+func TestParsePacketHeadersIPv6(t *testing.T) {
+	packet := make([]byte, 48)
+	packet[0] = 0x60 // version 6
+	packet[6] = 17   // UDP
+	src := netip.MustParseAddr("2001:db8::2").As16()
+	dst := netip.MustParseAddr("2001:db8::1").As16()
+	copy(packet[8:24], src[:])
+	copy(packet[24:40], dst[:])
+	binary.BigEndian.PutUint16(packet[40:42], 5353)
+	binary.BigEndian.PutUint16(packet[42:44], 53)
+
+	summary, ok := parsePacketHeaders(packet)
+	require.True(t, ok)
+	assert.Equal(t, packetSummary{
+		Src:      netip.MustParseAddr("2001:db8::2"),
+		Dst:      netip.MustParseAddr("2001:db8::1"),
+		Protocol: "udp",
+		SrcPort:  5353,
+		DstPort:  53,
+	}, summary)
+}
+
+func TestParsePacketHeadersInvalid(t *testing.T) {
+	for _, packet := range [][]byte{
+		nil,
+		{0x45, 0x00},
+		{0x60},
+		{0x20, 0x00, 0x00, 0x00},
+	} {
+		_, ok := parsePacketHeaders(packet)
+		assert.False(t, ok)
+	}
+}
@@ -2,15 +2,22 @@ package firewall
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"maps"
 	"net/netip"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/health"
 	"github.com/tibordp/wigglenet/internal/metrics"
+	"github.com/tibordp/wigglenet/internal/util"
 
 	klog "k8s.io/klog/v2"
 	"sigs.k8s.io/knftables"
@@ -20,13 +27,17 @@ const (
 	nftTable = "wigglenet"
 
 	// Chain names
-	nftForwardChain       = "forward"
-	nftPostroutingChain   = "postrouting"
-	nftFirewallChain      = "firewall"
-	nftNetpolChain        = "netpol"
-	nftNetpolEgressChain  = "netpol-egress"
-	nftNetpolIngressChain = "netpol-ingress"
-	nftMasqueradeChain    = "masq"
+	nftForwardChain         = "forward"
+	nftPostroutingChain     = "postrouting"
+	nftFirewallChain        = "firewall"
+	nftNetpolChain          = "netpol"
+	nftNetpolEgressChain    = "netpol-egress"
+	nftNetpolIngressChain   = "netpol-ingress"
+	nftAdminEgressChain     = "anp-egress"
+	nftAdminIngressChain    = "anp-ingress"
+	nftBaselineEgressChain  = "banp-egress"
+	nftBaselineIngressChain = "banp-ingress"
+	nftMasqueradeChain      = "masq"
 
 	// Flowtable name
 	nftFlowtable = "fastpath"
@@ -39,32 +50,78 @@ const (
 	nftNetpolEgressV4  = "netpol-egress-v4"
 	nftNetpolEgressV6  = "netpol-egress-v6"
 
+	// Packet mark bit set by per-policy chains on traffic a NetworkPolicy allows
+	nftNetpolAllowMark = 0x10000
+
 	nftSyncInterval = 1 * time.Minute
 )
 
 type nftablesManager struct {
+	config          *config.Config
+	health          *health.Checker
 	nft             knftables.Interface
 	podCIDRUpdates  chan []netip.Prefix
 	policyUpdates   chan []NetworkPolicyRule
+	configUpdates   *configUpdates
 	currentPodCIDRs []netip.Prefix
 	currentPolicies []NetworkPolicyRule
+
+	// applied is the ruleset written by the last successful sync, or nil if
+	// the next sync should rewrite the table in full.
+	applied *nftRuleset
+
+	nflog *nflogListener
+
+	// appliedConfig is the configuration of the last successful sync
+	appliedConfig atomic.Pointer[FirewallConfig]
 }
 
-func newNftablesManager(podCIDRUpdates chan []netip.Prefix, policyUpdates chan []NetworkPolicyRule) (Manager, error) {
+func newNftablesManager(cfg *config.Config, checker *health.Checker, podCIDRUpdates chan []netip.Prefix, policyUpdates chan []NetworkPolicyRule, podResolver PodResolver) (Manager, error) {
 	nft, err := knftables.New(knftables.InetFamily, nftTable)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create knftables interface: %w", err)
 	}
 
 	return &nftablesManager{
+		config:          cfg,
+		health:          checker,
 		nft:             nft,
 		podCIDRUpdates:  podCIDRUpdates,
 		policyUpdates:   policyUpdates,
+		configUpdates:   newConfigUpdates(),
 		currentPodCIDRs: []netip.Prefix{},
 		currentPolicies: []NetworkPolicyRule{},
+		nflog:           newNflogListener(cfg, podResolver),
 	}, nil
 }
 
+// cleanupNftables deletes the wigglenet table, and everything in it.
+func cleanupNftables(ctx context.Context, nft knftables.Interface) error {
+	tx := nft.NewTransaction()
+	// Adding it first, so that the deletion does not fail if it does not exist
+	tx.Add(&knftables.Table{})
+	tx.Delete(&knftables.Table{})
+	return nft.Run(ctx, tx)
+}
+
+func (c *nftablesManager) AppliedConfig() *FirewallConfig {
+	return c.appliedConfig.Load()
+}
+
+func (c *nftablesManager) Reconfigure(cfg *config.Config) {
+	c.configUpdates.send(cfg)
+}
+
+// setConfig switches to a new configuration. The next sync is incremental as
+// usual, it deletes whatever the new configuration no longer renders.
+func (c *nftablesManager) setConfig(cfg *config.Config) {
+	if !cfg.NetworkPolicy.Enabled {
+		// Not updated anymore, start from scratch if it is enabled again
+		c.currentPolicies = []NetworkPolicyRule{}
+	}
+	c.config = cfg
+}
+
 func (c *nftablesManager) Run(ctx context.Context) {
 	logger := klog.FromContext(ctx)
 	logger.Info("started syncing firewall rules (nftables backend)")
@@ -77,6 +134,8 @@ func (c *nftablesManager) Run(ctx context.Context) {
 			return
 		case <-timer.C:
 			timer.Reset(nftSyncInterval)
+			// Periodically rewrite everything to repair any drift
+			c.applied = nil
 		case newPodCIDRs := <-c.podCIDRUpdates:
 			if !reflect.DeepEqual(newPodCIDRs, c.currentPodCIDRs) {
 				logger.Info("received new pod CIDR configuration")
@@ -95,97 +154,107 @@ func (c *nftablesManager) Run(ctx context.Context) {
 				timer.Reset(nftSyncInterval)
 				c.currentPolicies = newPolicies
 			}
+		case <-c.configUpdates.updated:
+			logger.Info("received new firewall configuration")
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(nftSyncInterval)
+			c.setConfig(c.configUpdates.latest.Load())
 		}
 
 		start := time.Now()
 		err := c.syncRules(ctx)
-		if config.EnableMetrics {
+		if c.config.Metrics.Enabled {
 			metrics.RecordFirewallSync("nftables", time.Since(start), err)
 		}
+		c.health.RecordSync(health.FirewallSynced, err)
 		if err != nil {
 			logger.Error(err, "failed to sync nftables rules")
+		} else {
+			applied := NewConfigWithPolicies(c.currentPodCIDRs, c.currentPolicies)
+			c.appliedConfig.Store(&applied)
 		}
+		c.nflog.ensureStarted(ctx)
 	}
 }
 
 func (c *nftablesManager) syncRules(ctx context.Context) error {
-	tx := c.nft.NewTransaction()
+	desired := c.buildRuleset()
 
-	// Ensure table exists
-	tx.Add(&knftables.Table{
-		Comment: knftables.PtrTo("wigglenet firewall rules"),
-	})
+	// Resolve the new log prefixes before they can appear in the kernel
+	c.nflog.tags.set(desired.logTags)
 
-	// Determine what features are active
-	enableFilter := config.FilterIPv4 || config.FilterIPv6
-	enableMasquerade := config.MasqueradeIPv4 || config.MasqueradeIPv6
-	enableNetpol := config.EnableNetworkPolicy
-	enableFlowtable := config.EnableFlowtable && config.FirewallBackendMode == config.BackendNftables
-
-	// Split pod CIDRs by family
-	var v4cidrs, v6cidrs []netip.Prefix
-	for _, cidr := range c.currentPodCIDRs {
-		if cidr.Addr().Is6() {
-			v6cidrs = append(v6cidrs, cidr)
-		} else {
-			v4cidrs = append(v4cidrs, cidr)
+	tx := c.nft.NewTransaction()
+	switch {
+	case c.applied == nil:
+		if err := desired.fullSync(ctx, c.nft, tx); err != nil {
+			return err
 		}
+	case !desired.sameDefinitions(c.applied):
+		// Chains and sets cannot be redefined in place
+		desired.recreate(tx)
+	default:
+		desired.incrementalSync(c.applied, tx)
 	}
 
+	if tx.NumOperations() > 0 {
+		if err := c.nft.Run(ctx, tx); err != nil {
+			// The table is in an unknown state, rewrite it in full next time.
+			c.applied = nil
+			return err
+		}
+	}
+
+	c.applied = desired
+	return nil
+}
+
+// buildRuleset renders the complete desired content of the wigglenet table.
+func (c *nftablesManager) buildRuleset() *nftRuleset {
+	r := newNftRuleset()
+
+	// Determine what features are active
+	fw, netpol := c.config.Firewall, c.config.NetworkPolicy
+	enableFilter := fw.FilterIPv4 || fw.FilterIPv6
+	enableMasquerade := fw.MasqueradeIPv4 || fw.MasqueradeIPv6
+	enableNetpol := netpol.Enabled
+	enableAdminNetpol := enableNetpol && netpol.AdminNetworkPolicy
+	enableNetpolLogging := enableNetpol && netpol.Logging
+	enableFlowtable := fw.Flowtable
+
 	// Create pod CIDR sets (used by both firewall and masquerade chains)
 	if enableFilter || enableMasquerade {
-		tx.Add(&knftables.Set{
+		podCIDRsV4 := r.addSet(knftables.Set{
 			Name:    nftPodCIDRsV4,
 			Type:    "ipv4_addr",
 			Flags:   []knftables.SetFlag{knftables.IntervalFlag},
 			Comment: knftables.PtrTo("pod CIDRs (IPv4)"),
 		})
-		tx.Flush(&knftables.Set{Name: nftPodCIDRsV4})
-		for _, cidr := range v4cidrs {
-			tx.Add(&knftables.Element{
-				Set: nftPodCIDRsV4,
-				Key: []string{cidr.String()},
-			})
-		}
-
-		tx.Add(&knftables.Set{
+		podCIDRsV6 := r.addSet(knftables.Set{
 			Name:    nftPodCIDRsV6,
 			Type:    "ipv6_addr",
 			Flags:   []knftables.SetFlag{knftables.IntervalFlag},
 			Comment: knftables.PtrTo("pod CIDRs (IPv6)"),
 		})
-		tx.Flush(&knftables.Set{Name: nftPodCIDRsV6})
-		for _, cidr := range v6cidrs {
-			tx.Add(&knftables.Element{
-				Set: nftPodCIDRsV6,
-				Key: []string{cidr.String()},
-			})
+		for _, cidr := range c.currentPodCIDRs {
+			if cidr.Addr().Is6() {
+				podCIDRsV6.addElement(cidr.String())
+			} else {
+				podCIDRsV4.addElement(cidr.String())
+			}
 		}
 	}
 
-	// Add all regular chains first (before base chains reference them via jump rules).
-	// knftables Fake validates jump targets exist at rule-add time.
-	if enableFilter {
-		tx.Add(&knftables.Chain{Name: nftFirewallChain})
-	}
-	if enableNetpol {
-		tx.Add(&knftables.Chain{Name: nftNetpolEgressChain})
-		tx.Add(&knftables.Chain{Name: nftNetpolIngressChain})
-		tx.Add(&knftables.Chain{Name: nftNetpolChain})
-	}
-	if enableMasquerade {
-		tx.Add(&knftables.Chain{Name: nftMasqueradeChain})
-	}
-
 	// --- Flowtable ---
 	if enableFlowtable {
-		devices := parseFlowtableDevices(config.FlowtableDevices)
+		devices := parseFlowtableDevices(fw.FlowtableDevices)
 		if len(devices) > 0 {
-			tx.Add(&knftables.Flowtable{
+			r.flowtable = &knftables.Flowtable{
 				Name:     nftFlowtable,
 				Priority: knftables.PtrTo(knftables.FilterIngressPriority),
 				Devices:  devices,
-			})
+			}
 		} else {
 			enableFlowtable = false
 		}
@@ -193,20 +262,17 @@ func (c *nftablesManager) syncRules(ctx context.Context) error {
 
 	// --- Forward base chain ---
 	if enableFilter || enableNetpol || enableFlowtable {
-		tx.Add(&knftables.Chain{
+		forward := r.addChain(knftables.Chain{
 			Name:     nftForwardChain,
 			Type:     knftables.PtrTo(knftables.FilterType),
 			Hook:     knftables.PtrTo(knftables.ForwardHook),
 			Priority: knftables.PtrTo(knftables.FilterPriority),
 		})
-		tx.Flush(&knftables.Chain{Name: nftForwardChain})
 
 		if enableFlowtable {
-			tx.Add(&knftables.Rule{
-				Chain:   nftForwardChain,
-				Rule:    fmt.Sprintf("ct state established ct packets > %d flow offload @%s", config.FlowtablePacketThreshold, nftFlowtable),
-				Comment: knftables.PtrTo("offload established flows to fastpath"),
-			})
+			forward.addWithComment(
+				fmt.Sprintf("ct state established ct packets > %d flow offload @%s", fw.FlowtablePacketThreshold, nftFlowtable),
+				"offload established flows to fastpath")
 		}
 		// NetworkPolicy must be evaluated before the global firewall chain.
 		// The firewall chain whitelists pod-sourced traffic with a terminal
@@ -217,152 +283,138 @@ func (c *nftablesManager) syncRules(ctx context.Context) error {
 		// continues on to the firewall chain. This matches the iptables backend,
 		// which prepends the netpol jump ahead of the filter jump in FORWARD.
 		if enableNetpol {
-			tx.Add(&knftables.Rule{
-				Chain:   nftForwardChain,
-				Rule:    "jump " + nftNetpolChain,
-				Comment: knftables.PtrTo("NetworkPolicy enforcement"),
-			})
+			forward.addWithComment("jump "+nftNetpolChain, "NetworkPolicy enforcement")
 		}
 		if enableFilter {
-			tx.Add(&knftables.Rule{
-				Chain:   nftForwardChain,
-				Rule:    "jump " + nftFirewallChain,
-				Comment: knftables.PtrTo("global firewall filtering"),
-			})
+			forward.addWithComment("jump "+nftFirewallChain, "global firewall filtering")
 		}
 	}
 
 	// --- Postrouting base chain ---
 	if enableMasquerade {
-		tx.Add(&knftables.Chain{
+		postrouting := r.addChain(knftables.Chain{
 			Name:     nftPostroutingChain,
 			Type:     knftables.PtrTo(knftables.NATType),
 			Hook:     knftables.PtrTo(knftables.PostroutingHook),
 			Priority: knftables.PtrTo(knftables.SNATPriority),
 		})
-		tx.Flush(&knftables.Chain{Name: nftPostroutingChain})
-		tx.Add(&knftables.Rule{
-			Chain:   nftPostroutingChain,
-			Rule:    "jump " + nftMasqueradeChain,
-			Comment: knftables.PtrTo("masquerade pod traffic"),
-		})
+		postrouting.addWithComment("jump "+nftMasqueradeChain, "masquerade pod traffic")
 	}
 
 	// --- Firewall chain ---
 	if enableFilter {
-		tx.Flush(&knftables.Chain{Name: nftFirewallChain})
+		firewall := r.addChain(knftables.Chain{Name: nftFirewallChain})
 
 		// Allow established/related
-		tx.Add(&knftables.Rule{
-			Chain: nftFirewallChain,
-			Rule:  "ct state established,related accept",
-		})
+		firewall.add("ct state established,related accept")
 
 		// Per-family filtering. The chain lives in an `inet` table and sees
 		// both address families, so each family's drop must be gated on
 		// `meta nfproto` — otherwise enabling FilterIPv6 alone would also
 		// drop all IPv4 forward traffic (and vice versa).
-		if config.FilterIPv4 {
-			tx.Add(&knftables.Rule{
-				Chain: nftFirewallChain,
-				Rule:  knftables.Concat("ip saddr", "@", nftPodCIDRsV4, "accept"),
-			})
-			tx.Add(&knftables.Rule{
-				Chain: nftFirewallChain,
-				Rule:  "meta nfproto ipv4 drop",
-			})
+		if fw.FilterIPv4 {
+			firewall.add(knftables.Concat("ip saddr", "@", nftPodCIDRsV4, "accept"))
+			firewall.add("meta nfproto ipv4 drop")
 		}
-		if config.FilterIPv6 {
-			tx.Add(&knftables.Rule{
-				Chain:   nftFirewallChain,
-				Rule:    "meta nfproto ipv6 meta l4proto icmpv6 accept",
-				Comment: knftables.PtrTo("allow ICMPv6 (RFC 4890)"),
-			})
-			tx.Add(&knftables.Rule{
-				Chain: nftFirewallChain,
-				Rule:  knftables.Concat("ip6 saddr", "@", nftPodCIDRsV6, "accept"),
-			})
-			tx.Add(&knftables.Rule{
-				Chain: nftFirewallChain,
-				Rule:  "meta nfproto ipv6 drop",
-			})
+		if fw.FilterIPv6 {
+			firewall.addWithComment("meta nfproto ipv6 meta l4proto icmpv6 accept", "allow ICMPv6 (RFC 4890)")
+			firewall.add(knftables.Concat("ip6 saddr", "@", nftPodCIDRsV6, "accept"))
+			firewall.add("meta nfproto ipv6 drop")
 		}
 	}
 
 	// --- Masquerade chain ---
 	if enableMasquerade {
-		tx.Flush(&knftables.Chain{Name: nftMasqueradeChain})
+		masq := r.addChain(knftables.Chain{Name: nftMasqueradeChain})
 
 		// Skip local destinations
-		tx.Add(&knftables.Rule{
-			Chain: nftMasqueradeChain,
-			Rule:  "fib daddr type local accept",
-		})
+		masq.add("fib daddr type local accept")
 
 		// Skip traffic destined to pod CIDRs (no masquerade needed)
-		if config.MasqueradeIPv4 {
-			tx.Add(&knftables.Rule{
-				Chain: nftMasqueradeChain,
-				Rule:  knftables.Concat("ip daddr", "@", nftPodCIDRsV4, "accept"),
-			})
+		if fw.MasqueradeIPv4 {
+			masq.add(knftables.Concat("ip daddr", "@", nftPodCIDRsV4, "accept"))
 		}
-		if config.MasqueradeIPv6 {
-			tx.Add(&knftables.Rule{
-				Chain: nftMasqueradeChain,
-				Rule:  knftables.Concat("ip6 daddr", "@", nftPodCIDRsV6, "accept"),
-			})
+		if fw.MasqueradeIPv6 {
+			masq.add(knftables.Concat("ip6 daddr", "@", nftPodCIDRsV6, "accept"))
 		}
 
 		// Masquerade everything else
-		tx.Add(&knftables.Rule{
-			Chain: nftMasqueradeChain,
-			Rule:  "masquerade",
-		})
+		masq.add("masquerade")
 	}
 
 	// --- NetworkPolicy chain ---
 	if enableNetpol {
-		c.buildNetpolRules(tx)
+		c.buildNetpolRules(r, enableAdminNetpol, enableNetpolLogging)
 	}
 
-	return c.nft.Run(ctx, tx)
+	return r
 }
 
-func (c *nftablesManager) buildNetpolRules(tx *knftables.Transaction) {
+// buildNetpolRules renders the policy tiers. Each direction is evaluated as
+//
+//	anp-<dir> -> netpol-<dir> -> banp-<dir>
+//
+// where the admin and baseline chains only exist when AdminNetworkPolicy support
+// is enabled. A `return` verdict anywhere ends evaluation for the direction
+// (allowed), `drop` is final, and the admin chain hands over to the NetworkPolicy
+// chain with `goto` (either on a "pass" rule or when no admin rule matched), so
+// that its `return` still lands back in the main netpol chain.
+//
+// Each NetworkPolicy is rendered into its own chain per direction, matching on
+// named sets of its own, so that a change to one policy (or to the pods it
+// selects) only touches that policy's chains and sets. A `return` in a policy
+// chain only returns to netpol-<dir>, so policy chains mark allowed packets
+// with nftNetpolAllowMark instead, which netpol-<dir> checks (and clears) after
+// all policies have been evaluated.
+//
+// With logging enabled, pods isolated by each policy additionally get a
+// logging drop rule ahead of the aggregate deny sets, tagged with the policy's
+// chain name, so that drops can be attributed to a policy. Pods isolated by
+// policies in audit mode always get a logging rule, but are not dropped.
+func (c *nftablesManager) buildNetpolRules(r *nftRuleset, enableAdmin bool, enableLogging bool) {
+	egressEntry, ingressEntry := nftNetpolEgressChain, nftNetpolIngressChain
+	if enableAdmin {
+		egressEntry, ingressEntry = nftAdminEgressChain, nftAdminIngressChain
+	}
+
 	// --- Main netpol chain: established/related, then jump to egress + ingress sub-chains ---
-	tx.Flush(&knftables.Chain{Name: nftNetpolChain})
-
-	tx.Add(&knftables.Rule{
-		Chain: nftNetpolChain,
-		Rule:  "ct state established,related accept",
-	})
-	tx.Add(&knftables.Rule{
-		Chain:   nftNetpolChain,
-		Rule:    "meta nfproto ipv6 meta l4proto icmpv6 accept",
-		Comment: knftables.PtrTo("allow ICMPv6 (RFC 4890)"),
-	})
-	tx.Add(&knftables.Rule{
-		Chain:   nftNetpolChain,
-		Rule:    "jump " + nftNetpolEgressChain,
-		Comment: knftables.PtrTo("check egress policies"),
-	})
-	tx.Add(&knftables.Rule{
-		Chain:   nftNetpolChain,
-		Rule:    "jump " + nftNetpolIngressChain,
-		Comment: knftables.PtrTo("check ingress policies"),
-	})
-
-	// --- Populate egress and ingress sub-chains ---
-	tx.Flush(&knftables.Chain{Name: nftNetpolEgressChain})
-	tx.Flush(&knftables.Chain{Name: nftNetpolIngressChain})
+	netpol := r.addChain(knftables.Chain{Name: nftNetpolChain})
+	netpol.add("ct state established,related accept")
+	netpol.addWithComment("meta nfproto ipv6 meta l4proto icmpv6 accept", "allow ICMPv6 (RFC 4890)")
+	netpol.addWithComment("jump "+egressEntry, "check egress policies")
+	netpol.addWithComment("jump "+ingressEntry, "check ingress policies")
+
+	egress := r.addChain(knftables.Chain{Name: nftNetpolEgressChain})
+	ingress := r.addChain(knftables.Chain{Name: nftNetpolIngressChain})
+	if enableAdmin {
+		r.addChain(knftables.Chain{Name: nftAdminEgressChain})
+		r.addChain(knftables.Chain{Name: nftAdminIngressChain})
+		r.addChain(knftables.Chain{Name: nftBaselineEgressChain})
+		r.addChain(knftables.Chain{Name: nftBaselineIngressChain})
+	}
 
 	ingressDenyV4 := make(map[netip.Addr]bool)
 	ingressDenyV6 := make(map[netip.Addr]bool)
 	egressDenyV4 := make(map[netip.Addr]bool)
 	egressDenyV6 := make(map[netip.Addr]bool)
 
+	// Rule index within each policy, used to name the per-rule sets
+	ruleIndex := make(map[string]int)
+
+	var isolationRules []NetworkPolicyRule
+
 	for _, rule := range c.currentPolicies {
+		if rule.Tier != "" {
+			// Admin and baseline rules are already in evaluation order, since
+			// canonicalization sorts them by priority.
+			if enableAdmin {
+				addNetpolPeerRules(r.chain(nftTierChain(rule)), rule, nftTierVerdict(rule))
+			}
+			continue
+		}
+
 		if rule.Action == "deny" {
+			isolationRules = append(isolationRules, rule)
 			for _, podIP := range rule.PodIPs {
 				if rule.Direction == "ingress" {
 					if podIP.Is4() {
@@ -381,22 +433,270 @@ func (c *nftablesManager) buildNetpolRules(tx *knftables.Transaction) {
 			continue
 		}
 
-		// Allow rules use "return" verdict so the packet continues
-		// to the next sub-chain check instead of being accepted immediately.
-		c.addNetpolAllowRules(tx, rule)
+		if rule.Action == "audit" {
+			isolationRules = append(isolationRules, rule)
+			continue
+		}
+
+		chainName := nftPolicyChainName(rule.Policy, rule.Direction)
+		chain := r.chain(chainName)
+		if chain == nil {
+			chain = r.addChain(knftables.Chain{
+				Name:    chainName,
+				Comment: knftables.PtrTo("NetworkPolicy " + rule.Policy),
+			})
+			if rule.Direction == "egress" {
+				egress.add("jump " + chainName)
+			} else {
+				ingress.add("jump " + chainName)
+			}
+		}
+
+		prefix := nftPolicyChainName(rule.Policy, "") + "r" + strconv.Itoa(ruleIndex[rule.Policy])
+		ruleIndex[rule.Policy]++
+		addPolicySetRules(r, chain, prefix, rule)
+	}
+
+	for _, chain := range []*nftChain{egress, ingress} {
+		chain.addWithComment(
+			fmt.Sprintf("meta mark & 0x%x != 0 meta mark set meta mark & 0x%x return", nftNetpolAllowMark, ^uint32(nftNetpolAllowMark)),
+			"allowed by NetworkPolicy")
+	}
+
+	for _, rule := range isolationRules {
+		if rule.Action == "audit" || enableLogging {
+			addPolicyLogRules(r, rule, c.config.NetworkPolicy.LogGroup)
+		}
+	}
+
+	addNetpolDenySets(r, ingressDenyV4, ingressDenyV6, egressDenyV4, egressDenyV6)
+
+	if enableAdmin {
+		// Traffic that no admin rule decided on falls through to NetworkPolicy,
+		// and traffic to/from pods that no NetworkPolicy isolates falls through
+		// to the baseline policy.
+		for _, dir := range []struct{ admin, netpol, baseline string }{
+			{nftAdminEgressChain, nftNetpolEgressChain, nftBaselineEgressChain},
+			{nftAdminIngressChain, nftNetpolIngressChain, nftBaselineIngressChain},
+		} {
+			r.chain(dir.admin).add("goto " + dir.netpol)
+			r.chain(dir.netpol).addWithComment("jump "+dir.baseline, "BaselineAdminNetworkPolicy")
+		}
 	}
+}
 
-	c.addNetpolDenySets(tx, ingressDenyV4, ingressDenyV6, egressDenyV4, egressDenyV6)
+// nftPolicyChainName derives the chain name for a policy and direction. Policy
+// identities can be longer than nftables allows for names, so they are hashed;
+// the chain comment carries the readable identity. With an empty direction it
+// returns the prefix used for the policy's sets.
+func nftPolicyChainName(policy string, direction string) string {
+	hash := sha256.Sum256([]byte(policy))
+	return "np-" + hex.EncodeToString(hash[:6]) + "-" + direction
 }
 
-func (c *nftablesManager) addNetpolAllowRules(tx *knftables.Transaction, rule NetworkPolicyRule) {
-	// Route to the correct sub-chain; use "return" so the packet
-	// continues to the next sub-chain instead of being accepted outright.
-	chain := nftNetpolIngressChain
+// addPolicyLogRules renders a logging drop for the pods a NetworkPolicy
+// isolates in one direction (or just logging, for policies in audit mode). The
+// log prefix is registered in the ruleset's log tags.
+func addPolicyLogRules(r *nftRuleset, rule NetworkPolicyRule, logGroup int) {
+	prefix, tag := netpolLogPrefix(rule)
+	r.logTags[prefix] = tag
+
+	verdict, comment := []string{"drop"}, "NetworkPolicy "+rule.Policy
+	if tag.Audit {
+		verdict, comment = nil, "NetworkPolicy "+rule.Policy+" (audit)"
+	}
+
+	chain := r.chain(nftNetpolIngressChain)
+	podField := "daddr"
 	if rule.Direction == "egress" {
-		chain = nftNetpolEgressChain
+		chain = r.chain(nftNetpolEgressChain)
+		podField = "saddr"
 	}
 
+	for _, family := range []struct {
+		suffix, setType, match string
+		is4                    bool
+	}{
+		{"v4", "ipv4_addr", "ip", true},
+		{"v6", "ipv6_addr", "ip6", false},
+	} {
+		var podIPs []netip.Addr
+		for _, ip := range rule.PodIPs {
+			if ip.Is4() == family.is4 {
+				podIPs = append(podIPs, ip)
+			}
+		}
+		if len(podIPs) == 0 {
+			continue
+		}
+
+		podSet := r.addSet(knftables.Set{
+			Name:    nftPolicyChainName(rule.Policy, "") + "isolated-" + rule.Direction + "-" + family.suffix,
+			Type:    family.setType,
+			Comment: knftables.PtrTo("pods isolated by NetworkPolicy " + rule.Policy),
+		})
+		for _, ip := range podIPs {
+			podSet.addElement(ip.String())
+		}
+
+		chain.addWithComment(knftables.Concat(
+			family.match, podField, "@", podSet.Name,
+			"counter",
+			fmt.Sprintf("log prefix %q group %d", prefix, logGroup),
+			verdict,
+		), comment)
+	}
+}
+
+// addPolicySetRules renders a NetworkPolicy allow rule as matches against
+// named sets holding the rule's pods, peers and ports (all prefixed with
+// prefix), one nftables rule per address family.
+func addPolicySetRules(r *nftRuleset, chain *nftChain, prefix string, rule NetworkPolicyRule) {
+	var portMatch []string
+	if len(rule.PortRules) > 0 {
+		elements := nftPortElements(rule.PortRules)
+		if len(elements) == 0 {
+			return
+		}
+		ports := r.addSet(knftables.Set{
+			Name:  prefix + "-ports",
+			Type:  "inet_proto . inet_service",
+			Flags: []knftables.SetFlag{knftables.IntervalFlag},
+		})
+		for _, key := range elements {
+			ports.addElement(key...)
+		}
+		portMatch = []string{"meta l4proto . th dport", "@", ports.Name}
+	}
+
+	var peers []netip.Prefix
+	for _, ip := range rule.AllowedIPs {
+		peers = append(peers, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	peers = append(peers, rule.AllowedCIDRs...)
+	peers = util.SummarizeCIDRs(peers)
+
+	for _, family := range []struct {
+		suffix, setType, match string
+		is4                    bool
+	}{
+		{"v4", "ipv4_addr", "ip", true},
+		{"v6", "ipv6_addr", "ip6", false},
+	} {
+		var podIPs []netip.Addr
+		for _, ip := range rule.PodIPs {
+			if ip.Is4() == family.is4 {
+				podIPs = append(podIPs, ip)
+			}
+		}
+		var familyPeers []netip.Prefix
+		for _, peer := range peers {
+			if peer.Addr().Is4() == family.is4 {
+				familyPeers = append(familyPeers, peer)
+			}
+		}
+		if len(podIPs) == 0 || len(familyPeers) == 0 {
+			continue
+		}
+
+		podSet := r.addSet(knftables.Set{
+			Name: prefix + "-pods-" + family.suffix,
+			Type: family.setType,
+		})
+		for _, ip := range podIPs {
+			podSet.addElement(ip.String())
+		}
+
+		peerSet := r.addSet(knftables.Set{
+			Name:  prefix + "-peers-" + family.suffix,
+			Type:  family.setType,
+			Flags: []knftables.SetFlag{knftables.IntervalFlag},
+		})
+		for _, peer := range familyPeers {
+			if peer.IsSingleIP() {
+				peerSet.addElement(peer.Addr().String())
+			} else {
+				peerSet.addElement(peer.String())
+			}
+		}
+
+		podField, peerField := "daddr", "saddr"
+		if rule.Direction == "egress" {
+			podField, peerField = "saddr", "daddr"
+		}
+
+		chain.add(knftables.Concat(
+			family.match, podField, "@", podSet.Name,
+			family.match, peerField, "@", peerSet.Name,
+			portMatch,
+			fmt.Sprintf("meta mark set meta mark | 0x%x", nftNetpolAllowMark),
+			"return",
+		))
+	}
+}
+
+// nftPortElements converts PortRules into "protocol . port-range" set elements.
+func nftPortElements(portRules []PortRule) [][]string {
+	var elements [][]string
+	seen := make(map[string]bool)
+	for _, pr := range portRules {
+		proto := strings.ToLower(pr.Protocol)
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
+			continue
+		}
+		var port string
+		if pr.Port == 0 {
+			port = "0-65535"
+		} else if pr.EndPort > 0 && pr.EndPort != pr.Port {
+			port = strconv.Itoa(pr.Port) + "-" + strconv.Itoa(pr.EndPort)
+		} else {
+			port = strconv.Itoa(pr.Port)
+		}
+		if key := proto + " . " + port; !seen[key] {
+			seen[key] = true
+			elements = append(elements, []string{proto, port})
+		}
+	}
+	return elements
+}
+
+// nftTierChain returns the chain a rule belongs to, based on its tier and direction.
+func nftTierChain(rule NetworkPolicyRule) string {
+	egress := rule.Direction == "egress"
+	switch rule.Tier {
+	case "admin":
+		if egress {
+			return nftAdminEgressChain
+		}
+		return nftAdminIngressChain
+	case "baseline":
+		if egress {
+			return nftBaselineEgressChain
+		}
+		return nftBaselineIngressChain
+	default:
+		if egress {
+			return nftNetpolEgressChain
+		}
+		return nftNetpolIngressChain
+	}
+}
+
+// nftTierVerdict maps the action of an admin or baseline rule to its verdict.
+func nftTierVerdict(rule NetworkPolicyRule) string {
+	switch rule.Action {
+	case "deny":
+		return "drop"
+	case "pass":
+		return "goto " + nftTierChain(NetworkPolicyRule{Direction: rule.Direction})
+	default:
+		return "return"
+	}
+}
+
+// addNetpolPeerRules emits one rule per pod IP (and protocol group) matching
+// traffic between the pod and the rule's peers, with the given verdict.
+func addNetpolPeerRules(chain *nftChain, rule NetworkPolicyRule, verdict string) {
 	var v4Allowed, v6Allowed []string
 
 	for _, ip := range rule.AllowedIPs {
@@ -479,107 +779,57 @@ func (c *nftablesManager) addNetpolAllowRules(tx *knftables.Transaction, rule Ne
 		base := podMatch + " " + peerMatch
 
 		if len(portMatches) == 0 {
-			tx.Add(&knftables.Rule{
-				Chain: chain,
-				Rule:  base + " return",
-			})
+			chain.add(base + " " + verdict)
 		} else {
 			for _, pm := range portMatches {
-				tx.Add(&knftables.Rule{
-					Chain: chain,
-					Rule:  base + " " + pm + " return",
-				})
+				chain.add(base + " " + pm + " " + verdict)
 			}
 		}
 	}
 }
 
-func (c *nftablesManager) addNetpolDenySets(tx *knftables.Transaction,
+func addNetpolDenySets(r *nftRuleset,
 	ingressDenyV4, ingressDenyV6 map[netip.Addr]bool,
 	egressDenyV4, egressDenyV6 map[netip.Addr]bool,
 ) {
-	// Ingress deny sets
-	tx.Add(&knftables.Set{
-		Name:    nftNetpolIngressV4,
-		Type:    "ipv4_addr",
-		Comment: knftables.PtrTo("pods with ingress NetworkPolicy (IPv4)"),
-	})
-	tx.Flush(&knftables.Set{Name: nftNetpolIngressV4})
-	for ip := range ingressDenyV4 {
-		tx.Add(&knftables.Element{
-			Set: nftNetpolIngressV4,
-			Key: []string{ip.String()},
-		})
-	}
-
-	tx.Add(&knftables.Set{
-		Name:    nftNetpolIngressV6,
-		Type:    "ipv6_addr",
-		Comment: knftables.PtrTo("pods with ingress NetworkPolicy (IPv6)"),
-	})
-	tx.Flush(&knftables.Set{Name: nftNetpolIngressV6})
-	for ip := range ingressDenyV6 {
-		tx.Add(&knftables.Element{
-			Set: nftNetpolIngressV6,
-			Key: []string{ip.String()},
-		})
-	}
-
-	// Egress deny sets
-	tx.Add(&knftables.Set{
-		Name:    nftNetpolEgressV4,
-		Type:    "ipv4_addr",
-		Comment: knftables.PtrTo("pods with egress NetworkPolicy (IPv4)"),
-	})
-	tx.Flush(&knftables.Set{Name: nftNetpolEgressV4})
-	for ip := range egressDenyV4 {
-		tx.Add(&knftables.Element{
-			Set: nftNetpolEgressV4,
-			Key: []string{ip.String()},
-		})
-	}
-
-	tx.Add(&knftables.Set{
-		Name:    nftNetpolEgressV6,
-		Type:    "ipv6_addr",
-		Comment: knftables.PtrTo("pods with egress NetworkPolicy (IPv6)"),
-	})
-	tx.Flush(&knftables.Set{Name: nftNetpolEgressV6})
-	for ip := range egressDenyV6 {
-		tx.Add(&knftables.Element{
-			Set: nftNetpolEgressV6,
-			Key: []string{ip.String()},
+	for _, s := range []struct {
+		name, setType, comment string
+		ips                    map[netip.Addr]bool
+	}{
+		{nftNetpolIngressV4, "ipv4_addr", "pods with ingress NetworkPolicy (IPv4)", ingressDenyV4},
+		{nftNetpolIngressV6, "ipv6_addr", "pods with ingress NetworkPolicy (IPv6)", ingressDenyV6},
+		{nftNetpolEgressV4, "ipv4_addr", "pods with egress NetworkPolicy (IPv4)", egressDenyV4},
+		{nftNetpolEgressV6, "ipv6_addr", "pods with egress NetworkPolicy (IPv6)", egressDenyV6},
+	} {
+		set := r.addSet(knftables.Set{
+			Name:    s.name,
+			Type:    s.setType,
+			Comment: knftables.PtrTo(s.comment),
 		})
+		ips := make([]netip.Addr, 0, len(s.ips))
+		for ip := range s.ips {
+			ips = append(ips, ip)
+		}
+		slices.SortFunc(ips, netip.Addr.Compare)
+		for _, ip := range ips {
+			set.addElement(ip.String())
+		}
 	}
 
 	// Default deny rules in each sub-chain
+	ingress := r.chain(nftNetpolIngressChain)
+	egress := r.chain(nftNetpolEgressChain)
 	if len(ingressDenyV4) > 0 {
-		tx.Add(&knftables.Rule{
-			Chain:   nftNetpolIngressChain,
-			Rule:    knftables.Concat("ip daddr", "@", nftNetpolIngressV4, "drop"),
-			Comment: knftables.PtrTo("default deny ingress (IPv4)"),
-		})
+		ingress.addWithComment(knftables.Concat("ip daddr", "@", nftNetpolIngressV4, "drop"), "default deny ingress (IPv4)")
 	}
 	if len(ingressDenyV6) > 0 {
-		tx.Add(&knftables.Rule{
-			Chain:   nftNetpolIngressChain,
-			Rule:    knftables.Concat("ip6 daddr", "@", nftNetpolIngressV6, "drop"),
-			Comment: knftables.PtrTo("default deny ingress (IPv6)"),
-		})
+		ingress.addWithComment(knftables.Concat("ip6 daddr", "@", nftNetpolIngressV6, "drop"), "default deny ingress (IPv6)")
 	}
 	if len(egressDenyV4) > 0 {
-		tx.Add(&knftables.Rule{
-			Chain:   nftNetpolEgressChain,
-			Rule:    knftables.Concat("ip saddr", "@", nftNetpolEgressV4, "drop"),
-			Comment: knftables.PtrTo("default deny egress (IPv4)"),
-		})
+		egress.addWithComment(knftables.Concat("ip saddr", "@", nftNetpolEgressV4, "drop"), "default deny egress (IPv4)")
 	}
 	if len(egressDenyV6) > 0 {
-		tx.Add(&knftables.Rule{
-			Chain:   nftNetpolEgressChain,
-			Rule:    knftables.Concat("ip6 saddr", "@", nftNetpolEgressV6, "drop"),
-			Comment: knftables.PtrTo("default deny egress (IPv6)"),
-		})
+		egress.addWithComment(knftables.Concat("ip6 saddr", "@", nftNetpolEgressV6, "drop"), "default deny egress (IPv6)")
 	}
 }
 
@@ -615,8 +865,10 @@ func buildPortMatches(rule NetworkPolicyRule) []string {
 		}
 	}
 
+	// In a fixed order, so that the rendered rules compare equal across syncs
 	var matches []string
-	for proto, g := range groups {
+	for _, proto := range slices.Sorted(maps.Keys(groups)) {
+		g := groups[proto]
 		if g.hasAnyPort || len(g.ports) == 0 {
 			matches = append(matches, "meta l4proto "+proto)
 		} else if len(g.ports) == 1 {
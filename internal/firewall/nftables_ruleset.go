@@ -0,0 +1,292 @@
+package firewall
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/knftables"
+)
+
+// nftRuleset is the desired content of the wigglenet table. It is rendered in
+// full on every sync and then diffed against the previously applied ruleset,
+// so that only the chains and sets whose content changed are written.
+type nftRuleset struct {
+	flowtable *knftables.Flowtable
+	chains    []*nftChain
+	sets      []*nftSet
+
+	chainsByName map[string]*nftChain
+	setsByName   map[string]*nftSet
+
+	// logTags maps the prefixes of NetworkPolicy drop log rules to the policy
+	// they were emitted for. It is not part of the table content.
+	logTags map[string]netpolLogTag
+}
+
+func newNftRuleset() *nftRuleset {
+	return &nftRuleset{
+		chainsByName: make(map[string]*nftChain),
+		setsByName:   make(map[string]*nftSet),
+		logTags:      make(map[string]netpolLogTag),
+	}
+}
+
+type nftChain struct {
+	knftables.Chain
+	rules []*knftables.Rule
+}
+
+type nftSet struct {
+	knftables.Set
+	elements [][]string
+}
+
+func (r *nftRuleset) addChain(chain knftables.Chain) *nftChain {
+	ch := &nftChain{Chain: chain}
+	r.chains = append(r.chains, ch)
+	r.chainsByName[ch.Name] = ch
+	return ch
+}
+
+func (r *nftRuleset) addSet(set knftables.Set) *nftSet {
+	s := &nftSet{Set: set}
+	r.sets = append(r.sets, s)
+	r.setsByName[s.Name] = s
+	return s
+}
+
+func (r *nftRuleset) chain(name string) *nftChain {
+	return r.chainsByName[name]
+}
+
+func (r *nftRuleset) set(name string) *nftSet {
+	return r.setsByName[name]
+}
+
+func (ch *nftChain) add(rule string) {
+	ch.rules = append(ch.rules, &knftables.Rule{Chain: ch.Name, Rule: rule})
+}
+
+func (ch *nftChain) addWithComment(rule string, comment string) {
+	ch.rules = append(ch.rules, &knftables.Rule{Chain: ch.Name, Rule: rule, Comment: knftables.PtrTo(comment)})
+}
+
+func (s *nftSet) addElement(key ...string) {
+	s.elements = append(s.elements, key)
+}
+
+// sameRules compares the rule content of two chains, ignoring handles.
+func (ch *nftChain) sameRules(other *nftChain) bool {
+	return slices.EqualFunc(ch.rules, other.rules, func(a, b *knftables.Rule) bool {
+		return a.Rule == b.Rule && reflect.DeepEqual(a.Comment, b.Comment)
+	})
+}
+
+// sameDefinitions reports whether the chains and sets that are in both
+// rulesets are defined the same way. The type, hook and priority of a chain
+// and the type and flags of a set cannot be changed in place.
+func (r *nftRuleset) sameDefinitions(applied *nftRuleset) bool {
+	for _, ch := range r.chains {
+		if old := applied.chain(ch.Name); old != nil {
+			a, b := ch.Chain, old.Chain
+			a.Handle, b.Handle = nil, nil
+			if !reflect.DeepEqual(a, b) {
+				return false
+			}
+		}
+	}
+	for _, s := range r.sets {
+		if old := applied.set(s.Name); old != nil {
+			a, b := s.Set, old.Set
+			a.Handle, b.Handle = nil, nil
+			if !reflect.DeepEqual(a, b) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func elementKey(key []string) string {
+	return strings.Join(key, " . ")
+}
+
+// write adds the table and everything in the ruleset to the transaction,
+// flushing every chain and set it contains.
+func (r *nftRuleset) write(tx *knftables.Transaction) {
+	tx.Add(&knftables.Table{
+		Comment: knftables.PtrTo("wigglenet firewall rules"),
+	})
+	if r.flowtable != nil {
+		tx.Add(r.flowtable)
+	}
+
+	for _, s := range r.sets {
+		set := s.Set
+		tx.Add(&set)
+		tx.Flush(&knftables.Set{Name: s.Name})
+		for _, key := range s.elements {
+			tx.Add(&knftables.Element{Set: s.Name, Key: key})
+		}
+	}
+
+	// Create all chains before writing any rules, since rules may jump to
+	// chains that come later in the list.
+	for _, ch := range r.chains {
+		chain := ch.Chain
+		tx.Add(&chain)
+	}
+	for _, ch := range r.chains {
+		tx.Flush(&knftables.Chain{Name: ch.Name})
+		for _, rule := range ch.rules {
+			tx.Add(rule)
+		}
+	}
+}
+
+// recreate replaces the table with the ruleset. The transaction is atomic, so
+// the old rules stay in effect until the new ones are in place.
+func (r *nftRuleset) recreate(tx *knftables.Transaction) {
+	tx.Delete(&knftables.Table{})
+	r.write(tx)
+}
+
+// fullSync writes the whole ruleset, flushing every chain and set it contains,
+// and deletes any chains and sets in the table that are no longer part of it.
+func (r *nftRuleset) fullSync(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction) error {
+	r.write(tx)
+
+	existingChains, err := nft.List(ctx, "chains")
+	if err != nil && !knftables.IsNotFound(err) {
+		return err
+	}
+	existingSets, err := nft.List(ctx, "sets")
+	if err != nil && !knftables.IsNotFound(err) {
+		return err
+	}
+	existingFlowtables, err := nft.List(ctx, "flowtables")
+	if err != nil && !knftables.IsNotFound(err) {
+		return err
+	}
+
+	var staleChains []string
+	for _, name := range existingChains {
+		if r.chain(name) == nil {
+			staleChains = append(staleChains, name)
+		}
+	}
+	deleteChains(tx, staleChains)
+
+	for _, name := range existingSets {
+		if r.set(name) == nil {
+			tx.Delete(&knftables.Set{Name: name})
+		}
+	}
+
+	// The rules that offloaded to it are gone by now
+	for _, name := range existingFlowtables {
+		if r.flowtable == nil || r.flowtable.Name != name {
+			tx.Delete(&knftables.Flowtable{Name: name})
+		}
+	}
+
+	return nil
+}
+
+// incrementalSync writes only the differences between the applied ruleset and
+// r, which must have the same definitions, see sameDefinitions. Changed chains
+// are flushed and rewritten, changed sets have individual elements added and
+// removed, and everything else is left untouched.
+func (r *nftRuleset) incrementalSync(applied *nftRuleset, tx *knftables.Transaction) {
+	// The devices of a flowtable cannot be removed in place, and a flowtable
+	// cannot be deleted while the forward chain refers to it, so the chain is
+	// rewritten around a changed flowtable.
+	flowtableChanged := !reflect.DeepEqual(r.flowtable, applied.flowtable)
+	if flowtableChanged && applied.flowtable != nil {
+		if applied.chain(nftForwardChain) != nil {
+			tx.Flush(&knftables.Chain{Name: nftForwardChain})
+		}
+		tx.Delete(&knftables.Flowtable{Name: applied.flowtable.Name})
+	}
+	if flowtableChanged && r.flowtable != nil {
+		tx.Add(r.flowtable)
+	}
+
+	for _, s := range r.sets {
+		old := applied.set(s.Name)
+		if old == nil {
+			set := s.Set
+			tx.Add(&set)
+			for _, key := range s.elements {
+				tx.Add(&knftables.Element{Set: s.Name, Key: key})
+			}
+			continue
+		}
+
+		current := make(map[string]bool, len(s.elements))
+		for _, key := range s.elements {
+			current[elementKey(key)] = true
+		}
+		previous := make(map[string]bool, len(old.elements))
+		for _, key := range old.elements {
+			previous[elementKey(key)] = true
+			if !current[elementKey(key)] {
+				tx.Delete(&knftables.Element{Set: s.Name, Key: key})
+			}
+		}
+		for _, key := range s.elements {
+			if !previous[elementKey(key)] {
+				tx.Add(&knftables.Element{Set: s.Name, Key: key})
+			}
+		}
+	}
+
+	for _, ch := range r.chains {
+		if applied.chain(ch.Name) == nil {
+			chain := ch.Chain
+			tx.Add(&chain)
+		}
+	}
+	for _, ch := range r.chains {
+		old := applied.chain(ch.Name)
+		rewritten := flowtableChanged && applied.flowtable != nil && ch.Name == nftForwardChain
+		if old != nil && ch.sameRules(old) && !rewritten {
+			continue
+		}
+		if old != nil && !rewritten {
+			tx.Flush(&knftables.Chain{Name: ch.Name})
+		}
+		for _, rule := range ch.rules {
+			tx.Add(rule)
+		}
+	}
+
+	// Removed chains are no longer referenced, since any chain that jumped to
+	// them has been rewritten above.
+	var staleChains []string
+	for _, ch := range applied.chains {
+		if r.chain(ch.Name) == nil {
+			staleChains = append(staleChains, ch.Name)
+		}
+	}
+	deleteChains(tx, staleChains)
+
+	for _, s := range applied.sets {
+		if r.set(s.Name) == nil {
+			tx.Delete(&knftables.Set{Name: s.Name})
+		}
+	}
+}
+
+// deleteChains flushes all the given chains before deleting any of them, so
+// that jumps between them do not prevent deletion.
+func deleteChains(tx *knftables.Transaction, names []string) {
+	for _, name := range names {
+		tx.Flush(&knftables.Chain{Name: name})
+	}
+	for _, name := range names {
+		tx.Delete(&knftables.Chain{Name: name})
+	}
+}
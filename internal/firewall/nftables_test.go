@@ -2,7 +2,9 @@ package firewall
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,39 +13,28 @@ import (
 	"sigs.k8s.io/knftables"
 )
 
-func newTestNftablesManager(nft knftables.Interface) *nftablesManager {
+func newTestNftablesManager(nft knftables.Interface, cfg *config.Config) *nftablesManager {
 	return &nftablesManager{
+		config:          cfg,
 		nft:             nft,
 		podCIDRUpdates:  make(chan []netip.Prefix),
 		policyUpdates:   make(chan []NetworkPolicyRule),
 		currentPodCIDRs: []netip.Prefix{},
 		currentPolicies: []NetworkPolicyRule{},
+		nflog:           newNflogListener(cfg, nil),
 	}
 }
 
 func TestNftablesSyncFilterRules(t *testing.T) {
-	// Save and restore config
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = true
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = false
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = true
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("2001:db8::/64"),
 	}
@@ -81,27 +72,15 @@ func TestNftablesSyncFilterRules(t *testing.T) {
 }
 
 func TestNftablesSyncMasqueradeRules(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = true
-	config.EnableNetworkPolicy = false
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = true
+	cfg.NetworkPolicy.Enabled = false
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("2001:db8::/64"),
 	}
@@ -128,27 +107,15 @@ func TestNftablesSyncMasqueradeRules(t *testing.T) {
 }
 
 func TestNftablesSyncNetworkPolicy(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("2001:db8::/64"),
 	}
@@ -178,18 +145,22 @@ func TestNftablesSyncNetworkPolicy(t *testing.T) {
 	assert.Equal(t, "jump netpol-egress", mainChain.Rules[2].Rule)
 	assert.Equal(t, "jump netpol-ingress", mainChain.Rules[3].Rule)
 
-	// Allow rule should be in the ingress sub-chain with "return" verdict
+	// The ingress sub-chain jumps to the policy chain, then returns if the
+	// policy marked the packet as allowed
 	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
 	require.NotNil(t, ingressChain)
 
-	foundAllow := false
-	for _, r := range ingressChain.Rules {
-		if containsAll(r.Rule, "ip6 daddr 2001:db8::1", "ip6 saddr 2001:db8::2", "return") {
-			foundAllow = true
-			break
-		}
-	}
-	assert.True(t, foundAllow, "expected ingress allow rule with return verdict")
+	policyChain := nftPolicyChainName("", "ingress")
+	assert.Equal(t, "jump "+policyChain, ingressChain.Rules[0].Rule)
+	assert.Equal(t, "meta mark & 0x10000 != 0 meta mark set meta mark & 0xfffeffff return", ingressChain.Rules[1].Rule)
+
+	// Allow rule should be in the policy chain, matching on the rule's sets
+	prefix := nftPolicyChainName("", "") + "r0"
+	rules := fake.Table.Chains[policyChain].Rules
+	require.Len(t, rules, 1)
+	assert.Equal(t, "ip6 daddr @"+prefix+"-pods-v6 ip6 saddr @"+prefix+"-peers-v6 meta mark set meta mark | 0x10000 return", rules[0].Rule)
+	assert.Equal(t, []string{"2001:db8::1"}, setElements(fake, prefix+"-pods-v6"))
+	assert.Equal(t, []string{"2001:db8::2"}, setElements(fake, prefix+"-peers-v6"))
 
 	// Verify deny set was populated and deny rule is in ingress sub-chain
 	ingressV6Set := fake.Table.Sets[nftNetpolIngressV6]
@@ -207,27 +178,15 @@ func TestNftablesSyncNetworkPolicy(t *testing.T) {
 }
 
 func TestNftablesNetworkPolicyWithPorts(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPolicies = []NetworkPolicyRule{
 		{
 			Direction:  "ingress",
@@ -249,40 +208,147 @@ func TestNftablesNetworkPolicyWithPorts(t *testing.T) {
 	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
 	require.NotNil(t, ingressChain)
 
-	// Find the allow rule with port match in ingress sub-chain
-	foundAllow := false
-	for _, r := range ingressChain.Rules {
-		if r.Rule != "" &&
-			containsAll(r.Rule, "ip daddr 10.0.0.1", "ip saddr 10.0.0.2", "meta l4proto tcp", "th dport 80", "return") {
-			foundAllow = true
-			break
-		}
+	// Find the allow rule with port match in the policy chain
+	prefix := nftPolicyChainName("", "") + "r0"
+	rules := fake.Table.Chains[nftPolicyChainName("", "ingress")].Rules
+	require.Len(t, rules, 1)
+	assert.True(t, containsAll(rules[0].Rule, "ip daddr @"+prefix+"-pods-v4", "ip saddr @"+prefix+"-peers-v4",
+		"meta l4proto . th dport @"+prefix+"-ports", "return"))
+	assert.Equal(t, []string{"tcp . 80"}, setElements(fake, prefix+"-ports"))
+}
+
+func TestNftablesNetworkPolicyLogging(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
+	cfg.NetworkPolicy.Logging = true
+	cfg.NetworkPolicy.LogGroup = 5
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPolicies = []NetworkPolicyRule{
+		{
+			Direction:  "ingress",
+			Policy:     "default/web",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:     "allow",
+		},
+		{
+			Direction: "egress",
+			Policy:    "default/web",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+			Action:    "deny",
+		},
+		{
+			Direction: "ingress",
+			Policy:    "default/web",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			Action:    "deny",
+		},
 	}
-	assert.True(t, foundAllow, "expected allow rule with port match and return verdict")
+
+	err := manager.syncRules(context.Background())
+	require.NoError(t, err)
+
+	// The logging drop comes after the allow mark check and before the
+	// aggregate deny rule
+	ingressTag := nftPolicyChainName("default/web", "ingress")
+	ingressSet := nftPolicyChainName("default/web", "") + "isolated-ingress-v4"
+	rules := fake.Table.Chains[nftNetpolIngressChain].Rules
+	require.Len(t, rules, 4)
+	assert.Equal(t, "meta mark & 0x10000 != 0 meta mark set meta mark & 0xfffeffff return", rules[1].Rule)
+	assert.Equal(t, `ip daddr @`+ingressSet+` counter log prefix "`+ingressTag+`" group 5 drop`, rules[2].Rule)
+	assert.Equal(t, "NetworkPolicy default/web", *rules[2].Comment)
+	assert.Equal(t, "ip daddr @netpol-ingress-v4 drop", rules[3].Rule)
+	assert.Equal(t, []string{"10.0.0.1"}, setElements(fake, ingressSet))
+
+	egressTag := nftPolicyChainName("default/web", "egress")
+	egressSet := nftPolicyChainName("default/web", "") + "isolated-egress-v6"
+	rules = fake.Table.Chains[nftNetpolEgressChain].Rules
+	require.Len(t, rules, 3)
+	assert.Equal(t, `ip6 saddr @`+egressSet+` counter log prefix "`+egressTag+`" group 5 drop`, rules[1].Rule)
+	assert.Equal(t, []string{"2001:db8::1"}, setElements(fake, egressSet))
+
+	// Both tags resolve to the policy
+	tag, ok := manager.nflog.tags.lookup(ingressTag)
+	require.True(t, ok)
+	assert.Equal(t, netpolLogTag{Namespace: "default", Policy: "web", Direction: "ingress"}, tag)
+	tag, ok = manager.nflog.tags.lookup(egressTag)
+	require.True(t, ok)
+	assert.Equal(t, netpolLogTag{Namespace: "default", Policy: "web", Direction: "egress"}, tag)
+
+	// Disabling logging removes the logging rules and sets
+	cfg.NetworkPolicy.Logging = false
+	manager.applied = nil
+	err = manager.syncRules(context.Background())
+	require.NoError(t, err)
+
+	assert.Nil(t, fake.Table.Sets[ingressSet])
+	assert.Nil(t, fake.Table.Sets[egressSet])
+	assert.Len(t, fake.Table.Chains[nftNetpolIngressChain].Rules, 3)
+	_, ok = manager.nflog.tags.lookup(ingressTag)
+	assert.False(t, ok)
+}
+
+func TestNftablesNetworkPolicyAudit(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
+	cfg.NetworkPolicy.Logging = false
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPolicies = []NetworkPolicyRule{
+		{
+			Direction: "ingress",
+			Policy:    "audited/deny-all",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			Action:    "audit",
+		},
+		{
+			Direction: "ingress",
+			Policy:    "default/deny-all",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:    "deny",
+		},
+	}
+
+	err := manager.syncRules(context.Background())
+	require.NoError(t, err)
+
+	// Audited pods are logged even without ENABLE_NETPOL_LOGGING, but not
+	// dropped
+	prefix := nftPolicyChainName("audited/deny-all", "ingress")
+	auditSet := nftPolicyChainName("audited/deny-all", "") + "isolated-ingress-v4"
+	rules := fake.Table.Chains[nftNetpolIngressChain].Rules
+	require.Len(t, rules, 3)
+	assert.Equal(t, fmt.Sprintf(`ip daddr @%s counter log prefix "%s" group %d`, auditSet, prefix, cfg.NetworkPolicy.LogGroup), rules[1].Rule)
+	assert.Equal(t, "NetworkPolicy audited/deny-all (audit)", *rules[1].Comment)
+	assert.Equal(t, "ip daddr @netpol-ingress-v4 drop", rules[2].Rule)
+	assert.Equal(t, []string{"10.0.0.2"}, setElements(fake, nftNetpolIngressV4))
+
+	tag, ok := manager.nflog.tags.lookup(prefix)
+	require.True(t, ok)
+	assert.Equal(t, netpolLogTag{Namespace: "audited", Policy: "deny-all", Direction: "ingress", Audit: true}, tag)
 }
 
 func TestNftablesDualStack(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = true
-	config.FilterIPv6 = true
-	config.MasqueradeIPv4 = true
-	config.MasqueradeIPv6 = true
-	config.EnableNetworkPolicy = false
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = true
+	cfg.Firewall.MasqueradeIPv4 = true
+	cfg.Firewall.MasqueradeIPv6 = true
+	cfg.NetworkPolicy.Enabled = false
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("10.0.0.0/24"),
 		netip.MustParsePrefix("2001:db8::/64"),
@@ -343,27 +409,15 @@ func TestNftablesDualStack(t *testing.T) {
 // first it would short-circuit ruleset evaluation and skip NetworkPolicy for all
 // pod-to-pod traffic.
 func TestNftablesNetpolBeforeFirewall(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = true
-	config.FilterIPv6 = true
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = true
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("10.0.0.0/24"),
 	}
@@ -399,27 +453,15 @@ func TestNftablesNetpolBeforeFirewall(t *testing.T) {
 }
 
 func TestNftablesNetworkPolicyMultiplePeers(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPolicies = []NetworkPolicyRule{
 		{
 			Direction: "ingress",
@@ -444,40 +486,21 @@ func TestNftablesNetworkPolicyMultiplePeers(t *testing.T) {
 	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
 	require.NotNil(t, ingressChain)
 
-	// Should use anonymous set syntax for multiple peers in ingress sub-chain
-	foundAnonSet := false
-	for _, r := range ingressChain.Rules {
-		if r.Rule != "" &&
-			containsAll(r.Rule, "ip daddr 10.0.0.1", "ip saddr {", "10.0.0.2", "10.0.0.3", "10.0.0.4", "return") {
-			foundAnonSet = true
-			break
-		}
-	}
-	assert.True(t, foundAnonSet, "expected allow rule with anonymous set for multiple peers")
+	// All peers go into the rule's peer set, with adjacent addresses merged
+	prefix := nftPolicyChainName("", "") + "r0"
+	assert.ElementsMatch(t, []string{"10.0.0.2/31", "10.0.0.4"}, setElements(fake, prefix+"-peers-v4"))
 }
 
 func TestNftablesEgressPolicy(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPolicies = []NetworkPolicyRule{
 		{
 			Direction:    "egress",
@@ -498,15 +521,13 @@ func TestNftablesEgressPolicy(t *testing.T) {
 	egressChain := fake.Table.Chains[nftNetpolEgressChain]
 	require.NotNil(t, egressChain)
 
-	// Verify egress allow rule in egress sub-chain with return verdict
-	foundEgressAllow := false
-	for _, r := range egressChain.Rules {
-		if containsAll(r.Rule, "ip saddr 10.0.0.1", "ip daddr 192.168.0.0/16", "return") {
-			foundEgressAllow = true
-			break
-		}
-	}
-	assert.True(t, foundEgressAllow, "expected egress allow rule with return verdict")
+	// Verify egress allow rule in the egress policy chain with return verdict
+	prefix := nftPolicyChainName("", "") + "r0"
+	assert.Equal(t, "jump "+nftPolicyChainName("", "egress"), egressChain.Rules[0].Rule)
+	rules := fake.Table.Chains[nftPolicyChainName("", "egress")].Rules
+	require.Len(t, rules, 1)
+	assert.True(t, containsAll(rules[0].Rule, "ip saddr @"+prefix+"-pods-v4", "ip daddr @"+prefix+"-peers-v4", "return"))
+	assert.Equal(t, []string{"192.168.0.0/16"}, setElements(fake, prefix+"-peers-v4"))
 
 	// Verify egress deny set and deny rule in egress sub-chain
 	egressV4Set := fake.Table.Sets[nftNetpolEgressV4]
@@ -524,27 +545,15 @@ func TestNftablesEgressPolicy(t *testing.T) {
 }
 
 func TestNftablesMixedProtocolPorts(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPolicies = []NetworkPolicyRule{
 		{
 			Direction:  "ingress",
@@ -569,43 +578,22 @@ func TestNftablesMixedProtocolPorts(t *testing.T) {
 	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
 	require.NotNil(t, ingressChain)
 
-	// Should have separate rules for TCP and UDP (not one combined rule)
-	foundTCP := false
-	foundUDP := false
-	for _, r := range ingressChain.Rules {
-		if containsAll(r.Rule, "meta l4proto tcp", "th dport 80", "return") {
-			foundTCP = true
-		}
-		if containsAll(r.Rule, "meta l4proto udp", "th dport 53", "return") {
-			foundUDP = true
-		}
-	}
-	assert.True(t, foundTCP, "expected TCP port 80 rule")
-	assert.True(t, foundUDP, "expected UDP port 53 rule")
+	// Both protocols share a single port set
+	prefix := nftPolicyChainName("", "") + "r0"
+	assert.Len(t, fake.Table.Chains[nftPolicyChainName("", "ingress")].Rules, 1)
+	assert.ElementsMatch(t, []string{"tcp . 80", "udp . 53"}, setElements(fake, prefix+"-ports"))
 }
 
 func TestNftablesEndPort(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPolicies = []NetworkPolicyRule{
 		{
 			Direction:  "ingress",
@@ -627,38 +615,20 @@ func TestNftablesEndPort(t *testing.T) {
 	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
 	require.NotNil(t, ingressChain)
 
-	foundRange := false
-	for _, r := range ingressChain.Rules {
-		if containsAll(r.Rule, "meta l4proto tcp", "th dport 8000-9000", "return") {
-			foundRange = true
-			break
-		}
-	}
-	assert.True(t, foundRange, "expected port range 8000-9000 rule with return verdict")
+	prefix := nftPolicyChainName("", "") + "r0"
+	assert.Equal(t, []string{"tcp . 8000-9000"}, setElements(fake, prefix+"-ports"))
 }
 
 func TestNftablesSCTPPort(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = true
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPolicies = []NetworkPolicyRule{
 		{
 			Direction:  "ingress",
@@ -680,50 +650,24 @@ func TestNftablesSCTPPort(t *testing.T) {
 	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
 	require.NotNil(t, ingressChain)
 
-	foundSCTP := false
-	for _, r := range ingressChain.Rules {
-		if containsAll(r.Rule, "meta l4proto sctp", "th dport 80", "return") {
-			foundSCTP = true
-			break
-		}
-	}
-	assert.True(t, foundSCTP, "expected SCTP port 80 rule with return verdict")
+	prefix := nftPolicyChainName("", "") + "r0"
+	assert.Equal(t, []string{"sctp . 80"}, setElements(fake, prefix+"-ports"))
 }
 
 func TestNftablesFlowtableEnabled(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	origFlowtable := config.EnableFlowtable
-	origDevices := config.FlowtableDevices
-	origThreshold := config.FlowtablePacketThreshold
-	origBackend := config.FirewallBackendMode
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-		config.EnableFlowtable = origFlowtable
-		config.FlowtableDevices = origDevices
-		config.FlowtablePacketThreshold = origThreshold
-		config.FirewallBackendMode = origBackend
-	}()
-
-	config.FilterIPv4 = true
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = false
-	config.EnableFlowtable = true
-	config.FlowtableDevices = "eth0,wigglenet"
-	config.FlowtablePacketThreshold = 64
-	config.FirewallBackendMode = config.BackendNftables
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+	cfg.Firewall.Flowtable = true
+	cfg.Firewall.FlowtableDevices = "eth0,wigglenet"
+	cfg.Firewall.FlowtablePacketThreshold = 64
+	cfg.Firewall.Backend = config.BackendNftables
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("10.0.0.0/24"),
 	}
@@ -747,33 +691,17 @@ func TestNftablesFlowtableEnabled(t *testing.T) {
 }
 
 func TestNftablesFlowtableDisabled(t *testing.T) {
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	origFlowtable := config.EnableFlowtable
-	origBackend := config.FirewallBackendMode
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-		config.EnableFlowtable = origFlowtable
-		config.FirewallBackendMode = origBackend
-	}()
-
-	config.FilterIPv4 = true
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = false
-	config.EnableFlowtable = false
-	config.FirewallBackendMode = config.BackendNftables
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+	cfg.Firewall.Flowtable = false
+	cfg.Firewall.Backend = config.BackendNftables
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 	manager.currentPodCIDRs = []netip.Prefix{
 		netip.MustParsePrefix("10.0.0.0/24"),
 	}
@@ -792,41 +720,50 @@ func TestNftablesFlowtableDisabled(t *testing.T) {
 	}
 }
 
+func TestNftablesFlowtableTurnedOff(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+	cfg.Firewall.Flowtable = true
+	cfg.Firewall.FlowtableDevices = "eth0"
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPodCIDRs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	require.NoError(t, manager.syncRules(context.Background()))
+	require.NotNil(t, fake.Table.Flowtables[nftFlowtable])
+
+	// The flowtable is removed by the incremental sync, not only by the next
+	// full one, and the forward chain no longer offloads to it.
+	next := *cfg
+	next.Firewall.Flowtable = false
+	manager.setConfig(&next)
+	require.NotNil(t, manager.applied)
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	assert.Empty(t, fake.Table.Flowtables)
+	fwdChain := fake.Table.Chains[nftForwardChain]
+	require.NotNil(t, fwdChain)
+	require.Len(t, fwdChain.Rules, 1)
+	assert.Equal(t, "jump firewall", fwdChain.Rules[0].Rule)
+}
+
 func TestNftablesFlowtableOnlyMode(t *testing.T) {
 	// Flowtable should create a forward chain even without filter or netpol
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	origFlowtable := config.EnableFlowtable
-	origDevices := config.FlowtableDevices
-	origThreshold := config.FlowtablePacketThreshold
-	origBackend := config.FirewallBackendMode
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-		config.EnableFlowtable = origFlowtable
-		config.FlowtableDevices = origDevices
-		config.FlowtablePacketThreshold = origThreshold
-		config.FirewallBackendMode = origBackend
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = false
-	config.EnableFlowtable = true
-	config.FlowtableDevices = "eth0"
-	config.FlowtablePacketThreshold = 20
-	config.FirewallBackendMode = config.BackendNftables
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+	cfg.Firewall.Flowtable = true
+	cfg.Firewall.FlowtableDevices = "eth0"
+	cfg.Firewall.FlowtablePacketThreshold = 20
+	cfg.Firewall.Backend = config.BackendNftables
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 
 	err := manager.syncRules(context.Background())
 	require.NoError(t, err)
@@ -844,36 +781,18 @@ func TestNftablesFlowtableOnlyMode(t *testing.T) {
 
 func TestNftablesFlowtableEmptyDevices(t *testing.T) {
 	// Empty devices should disable flowtable gracefully
-	origFilterIPv4 := config.FilterIPv4
-	origFilterIPv6 := config.FilterIPv6
-	origMasqIPv4 := config.MasqueradeIPv4
-	origMasqIPv6 := config.MasqueradeIPv6
-	origNetpol := config.EnableNetworkPolicy
-	origFlowtable := config.EnableFlowtable
-	origDevices := config.FlowtableDevices
-	origBackend := config.FirewallBackendMode
-	defer func() {
-		config.FilterIPv4 = origFilterIPv4
-		config.FilterIPv6 = origFilterIPv6
-		config.MasqueradeIPv4 = origMasqIPv4
-		config.MasqueradeIPv6 = origMasqIPv6
-		config.EnableNetworkPolicy = origNetpol
-		config.EnableFlowtable = origFlowtable
-		config.FlowtableDevices = origDevices
-		config.FirewallBackendMode = origBackend
-	}()
-
-	config.FilterIPv4 = false
-	config.FilterIPv6 = false
-	config.MasqueradeIPv4 = false
-	config.MasqueradeIPv6 = false
-	config.EnableNetworkPolicy = false
-	config.EnableFlowtable = true
-	config.FlowtableDevices = ""
-	config.FirewallBackendMode = config.BackendNftables
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+	cfg.Firewall.Flowtable = true
+	cfg.Firewall.FlowtableDevices = ""
+	cfg.Firewall.Backend = config.BackendNftables
 
 	fake := knftables.NewFake(knftables.InetFamily, nftTable)
-	manager := newTestNftablesManager(fake)
+	manager := newTestNftablesManager(fake, cfg)
 
 	err := manager.syncRules(context.Background())
 	require.NoError(t, err)
@@ -883,6 +802,19 @@ func TestNftablesFlowtableEmptyDevices(t *testing.T) {
 	assert.Nil(t, fake.Table.Chains[nftForwardChain])
 }
 
+// setElements returns the elements of a set, with concatenated keys joined by " . ".
+func setElements(fake *knftables.Fake, name string) []string {
+	set := fake.Table.Sets[name]
+	if set == nil {
+		return nil
+	}
+	var elements []string
+	for _, elem := range set.Elements {
+		elements = append(elements, strings.Join(elem.Key, " . "))
+	}
+	return elements
+}
+
 func containsAll(s string, substrs ...string) bool {
 	for _, sub := range substrs {
 		if !contains(s, sub) {
@@ -904,3 +836,340 @@ func searchString(s, substr string) bool {
 	}
 	return false
 }
+
+func TestNftablesAdminNetworkPolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
+	cfg.NetworkPolicy.AdminNetworkPolicy = true
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPolicies = []NetworkPolicyRule{
+		{
+			Direction:  "ingress",
+			Tier:       "admin",
+			Priority:   0,
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:     "deny",
+		},
+		{
+			Direction:  "ingress",
+			Tier:       "admin",
+			Priority:   1,
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.3")},
+			Action:     "pass",
+		},
+		{
+			Direction:  "ingress",
+			Tier:       "baseline",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.4")},
+			Action:     "deny",
+		},
+	}
+
+	err := manager.syncRules(context.Background())
+	require.NoError(t, err)
+
+	// The netpol chain enters the admin tier first
+	netpolChain := fake.Table.Chains[nftNetpolChain]
+	require.NotNil(t, netpolChain)
+	foundJump := false
+	for _, r := range netpolChain.Rules {
+		if containsAll(r.Rule, "jump "+nftAdminIngressChain) {
+			foundJump = true
+		}
+	}
+	assert.True(t, foundJump, "expected netpol chain to jump to the admin ingress chain")
+
+	anpChain := fake.Table.Chains[nftAdminIngressChain]
+	require.NotNil(t, anpChain)
+	require.NotEmpty(t, anpChain.Rules)
+	assert.True(t, containsAll(anpChain.Rules[0].Rule, "ip daddr 10.0.0.1", "ip saddr 10.0.0.2", "drop"))
+	assert.True(t, containsAll(anpChain.Rules[1].Rule, "ip daddr 10.0.0.1", "ip saddr 10.0.0.3", "goto "+nftNetpolIngressChain))
+	assert.Equal(t, "goto "+nftNetpolIngressChain, anpChain.Rules[len(anpChain.Rules)-1].Rule)
+
+	// NetworkPolicy falls through to the baseline tier
+	ingressChain := fake.Table.Chains[nftNetpolIngressChain]
+	require.NotNil(t, ingressChain)
+	require.NotEmpty(t, ingressChain.Rules)
+	assert.True(t, containsAll(ingressChain.Rules[len(ingressChain.Rules)-1].Rule, "jump "+nftBaselineIngressChain))
+
+	banpChain := fake.Table.Chains[nftBaselineIngressChain]
+	require.NotNil(t, banpChain)
+	require.Len(t, banpChain.Rules, 1)
+	assert.True(t, containsAll(banpChain.Rules[0].Rule, "ip daddr 10.0.0.1", "ip saddr 10.0.0.4", "drop"))
+}
+
+func TestNftablesAdminNetworkPolicyStablePorts(t *testing.T) {
+	cfg := config.Default()
+	cfg.NetworkPolicy.Enabled = true
+	cfg.NetworkPolicy.AdminNetworkPolicy = true
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPolicies = []NetworkPolicyRule{
+		{
+			Direction:  "ingress",
+			Tier:       "admin",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			PortRules: []PortRule{
+				{Protocol: "UDP", Port: 53},
+				{Protocol: "TCP", Port: 53},
+				{Protocol: "SCTP", Port: 9000},
+				{Protocol: "TCP", Port: 8080, EndPort: 8090},
+			},
+			Action: "deny",
+		},
+	}
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	anpChain := fake.Table.Chains[nftAdminIngressChain]
+	require.NotNil(t, anpChain)
+	require.Len(t, anpChain.Rules, 4)
+	assert.Contains(t, anpChain.Rules[0].Rule, "meta l4proto sctp th dport 9000")
+	assert.Contains(t, anpChain.Rules[1].Rule, "meta l4proto tcp th dport { 53, 8080-8090 }")
+	assert.Contains(t, anpChain.Rules[2].Rule, "meta l4proto udp th dport 53")
+
+	// The rules render the same every time, so the chain is left alone
+	last := fake.LastTransaction
+	for range 10 {
+		require.NoError(t, manager.syncRules(context.Background()))
+		assert.Same(t, last, fake.LastTransaction)
+	}
+}
+
+func TestNftablesRedefinedChainOrSet(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = true
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = false
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPodCIDRs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	require.NoError(t, manager.syncRules(context.Background()))
+	dump := fake.Dump()
+
+	for name, redefine := range map[string]func(r *nftRuleset){
+		"chain priority": func(r *nftRuleset) {
+			r.chain(nftForwardChain).Priority = knftables.PtrTo(knftables.ManglePriority)
+		},
+		"set flags": func(r *nftRuleset) {
+			r.set(nftPodCIDRsV4).Flags = nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// As if the table was written with other definitions
+			redefine(manager.applied)
+
+			require.NoError(t, manager.syncRules(context.Background()))
+			assert.Contains(t, fake.LastTransaction.String(), "delete table inet "+nftTable)
+			assert.Equal(t, dump, fake.Dump())
+			assert.True(t, manager.applied.sameDefinitions(manager.buildRuleset()))
+		})
+	}
+}
+
+func TestNftablesIncrementalPolicyUpdate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = true
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
+
+	policies := func(webPods ...string) []NetworkPolicyRule {
+		var podIPs []netip.Addr
+		for _, ip := range webPods {
+			podIPs = append(podIPs, netip.MustParseAddr(ip))
+		}
+		return []NetworkPolicyRule{
+			{
+				Direction:  "ingress",
+				Policy:     "default/web",
+				PodIPs:     podIPs,
+				AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.10")},
+				PortRules:  []PortRule{{Protocol: "TCP", Port: 80}},
+				Action:     "allow",
+			},
+			{
+				Direction:  "ingress",
+				Policy:     "default/db",
+				PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.20")},
+				AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+				Action:     "allow",
+			},
+			{
+				Direction: "ingress",
+				PodIPs:    append(podIPs, netip.MustParseAddr("10.0.0.20")),
+				Action:    "deny",
+			},
+		}
+	}
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPodCIDRs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	manager.currentPolicies = policies("10.0.0.1")
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	webChain := nftPolicyChainName("default/web", "ingress")
+	dbChain := nftPolicyChainName("default/db", "ingress")
+	webPods := nftPolicyChainName("default/web", "") + "r0-pods-v4"
+	require.NotNil(t, fake.Table.Chains[webChain])
+	require.NotNil(t, fake.Table.Chains[dbChain])
+	assert.Equal(t, "NetworkPolicy default/web", *fake.Table.Chains[webChain].Comment)
+
+	// A new pod selected by one policy only touches that policy's pod set and
+	// the isolation set
+	manager.currentPolicies = policies("10.0.0.1", "10.0.0.2")
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	tx := fake.LastTransaction.String()
+	assert.Contains(t, tx, "add element inet wigglenet "+webPods+" { 10.0.0.2 }")
+	assert.Contains(t, tx, "add element inet wigglenet "+nftNetpolIngressV4+" { 10.0.0.2 }")
+	assert.NotContains(t, tx, "chain")
+	assert.NotContains(t, tx, dbChain)
+	assert.NotContains(t, tx, nftPodCIDRsV4)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, setElements(fake, webPods))
+
+	// Nothing changed, nothing to do
+	last := fake.LastTransaction
+	require.NoError(t, manager.syncRules(context.Background()))
+	assert.Same(t, last, fake.LastTransaction)
+
+	// Removing a policy deletes its chain and sets, and rewrites only the
+	// chain that jumped to it
+	manager.currentPolicies = policies("10.0.0.1", "10.0.0.2")[1:]
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	tx = fake.LastTransaction.String()
+	assert.Contains(t, tx, "flush chain inet wigglenet "+nftNetpolIngressChain)
+	assert.Contains(t, tx, "delete chain inet wigglenet "+webChain)
+	assert.Contains(t, tx, "delete set inet wigglenet "+webPods)
+	assert.NotContains(t, tx, "flush chain inet wigglenet "+dbChain)
+	assert.NotContains(t, tx, "add rule inet wigglenet "+dbChain)
+	assert.NotContains(t, tx, nftPolicyChainName("default/db", "")+"r0")
+	assert.NotContains(t, tx, nftNetpolEgressChain)
+	assert.NotContains(t, tx, nftFirewallChain)
+	assert.Nil(t, fake.Table.Chains[webChain])
+	assert.Nil(t, fake.Table.Sets[webPods])
+	assert.NotNil(t, fake.Table.Chains[dbChain])
+}
+
+func TestNftablesFullResyncRemovesStaleObjects(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = false
+	cfg.Firewall.FilterIPv6 = false
+	cfg.Firewall.MasqueradeIPv4 = false
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.NetworkPolicy.Enabled = true
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPolicies = []NetworkPolicyRule{
+		{
+			Direction:  "ingress",
+			Policy:     "default/web",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:     "allow",
+		},
+	}
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	// Simulate a restart after the policy was deleted: the table still has
+	// the policy's objects, but the new process has no record of them.
+	manager = newTestNftablesManager(fake, cfg)
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	assert.Nil(t, fake.Table.Chains[nftPolicyChainName("default/web", "ingress")])
+	assert.Nil(t, fake.Table.Sets[nftPolicyChainName("default/web", "")+"r0-pods-v4"])
+	assert.NotNil(t, fake.Table.Chains[nftNetpolIngressChain])
+	assert.Len(t, fake.Table.Chains[nftNetpolIngressChain].Rules, 1)
+}
+
+func TestNftablesReconfigure(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	cfg.Firewall.MasqueradeIPv6 = false
+	cfg.Firewall.Flowtable = true
+	cfg.Firewall.FlowtableDevices = "eth0"
+	cfg.NetworkPolicy.Enabled = true
+
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPodCIDRs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	manager.currentPolicies = []NetworkPolicyRule{
+		{
+			Direction:  "ingress",
+			Policy:     "default/web",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+			Action:     "allow",
+		},
+	}
+	require.NoError(t, manager.syncRules(context.Background()))
+	require.NotNil(t, fake.Table.Chains[nftPolicyChainName("default/web", "ingress")])
+
+	// Changing the flowtable devices recreates the flowtable
+	next := *cfg
+	next.Firewall.FlowtableDevices = "eth1"
+	manager.setConfig(&next)
+	require.NoError(t, manager.syncRules(context.Background()))
+	assert.Equal(t, []string{"eth1"}, fake.Table.Flowtables[nftFlowtable].Devices)
+	assert.Equal(t, "ct state established ct packets > 128 flow offload @fastpath", fake.Table.Chains[nftForwardChain].Rules[0].Rule)
+
+	// Turning features off removes their chains and sets
+	next.Firewall.FilterIPv4 = false
+	next.Firewall.Flowtable = false
+	next.NetworkPolicy.Enabled = false
+	manager.setConfig(&next)
+	require.NoError(t, manager.syncRules(context.Background()))
+
+	assert.Empty(t, fake.Table.Flowtables)
+	assert.Empty(t, manager.currentPolicies)
+	for _, chain := range []string{nftForwardChain, nftFirewallChain, nftNetpolChain, nftPolicyChainName("default/web", "ingress")} {
+		assert.Nil(t, fake.Table.Chains[chain], chain)
+	}
+	assert.Nil(t, fake.Table.Sets[nftNetpolIngressV4])
+	assert.NotNil(t, fake.Table.Chains[nftMasqueradeChain])
+	assert.Equal(t, []string{"10.0.0.0/24"}, setElements(fake, nftPodCIDRsV4))
+
+	// A stale flowtable is removed by a full sync too
+	manager.setConfig(cfg)
+	require.NoError(t, manager.syncRules(context.Background()))
+	require.NotNil(t, fake.Table.Flowtables[nftFlowtable])
+	manager = newTestNftablesManager(fake, &next)
+	require.NoError(t, manager.syncRules(context.Background()))
+	assert.Empty(t, fake.Table.Flowtables)
+	assert.Nil(t, fake.Table.Chains[nftForwardChain])
+}
+
+func TestCleanupNftables(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+
+	// Nothing to remove
+	require.NoError(t, cleanupNftables(context.Background(), fake))
+	assert.Nil(t, fake.Table)
+
+	cfg := config.Default()
+	cfg.Firewall.FilterIPv4 = true
+	manager := newTestNftablesManager(fake, cfg)
+	manager.currentPodCIDRs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	require.NoError(t, manager.syncRules(context.Background()))
+	require.NotNil(t, fake.Table)
+
+	require.NoError(t, cleanupNftables(context.Background(), fake))
+	assert.Nil(t, fake.Table)
+}
@@ -0,0 +1,169 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// Readiness conditions
+const (
+	NodeInformerSynced = "node-informer"
+	WireguardApplied   = "wireguard"
+	CNIWritten         = "cni"
+	FirewallSynced     = "firewall"
+)
+
+// Checker tracks readiness conditions and the health of periodic syncs.
+//
+// The process is ready once every registered condition has been met. It is
+// live as long as no component has been failing to sync for longer than the
+// failure timeout.
+type Checker struct {
+	mu             sync.Mutex
+	conditions     map[string]bool // condition -> met
+	failingSince   map[string]time.Time
+	failureTimeout time.Duration
+	now            func() time.Time
+}
+
+// NewChecker creates a checker. A zero failureTimeout disables liveness
+// failures.
+func NewChecker(failureTimeout time.Duration) *Checker {
+	return &Checker{
+		conditions:     make(map[string]bool),
+		failingSince:   make(map[string]time.Time),
+		failureTimeout: failureTimeout,
+		now:            time.Now,
+	}
+}
+
+// Register adds readiness conditions that must be met before the process is
+// ready.
+func (c *Checker) Register(conditions ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, condition := range conditions {
+		if _, ok := c.conditions[condition]; !ok {
+			c.conditions[condition] = false
+		}
+	}
+}
+
+// MarkReady records that a readiness condition has been met.
+func (c *Checker) MarkReady(condition string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.conditions[condition]; ok {
+		c.conditions[condition] = true
+	}
+}
+
+// RecordSync records the outcome of a sync of a component. A successful sync
+// also meets the readiness condition of the same name.
+func (c *Checker) RecordSync(component string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if _, ok := c.failingSince[component]; !ok {
+			c.failingSince[component] = c.now()
+		}
+		return
+	}
+	delete(c.failingSince, component)
+	if _, ok := c.conditions[component]; ok {
+		c.conditions[component] = true
+	}
+}
+
+// unhealthy returns the components that have been failing for too long.
+func (c *Checker) unhealthy() []string {
+	var failing []string
+	if c.failureTimeout <= 0 {
+		return failing
+	}
+	for component, since := range c.failingSince {
+		if c.now().Sub(since) > c.failureTimeout {
+			failing = append(failing, fmt.Sprintf("%s: failing since %s", component, since.Format(time.RFC3339)))
+		}
+	}
+	slices.Sort(failing)
+	return failing
+}
+
+// Live reports whether the process is healthy, and the reasons if not.
+func (c *Checker) Live() (bool, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failing := c.unhealthy()
+	return len(failing) == 0, failing
+}
+
+// Ready reports whether the process is ready, and the reasons if not.
+func (c *Checker) Ready() (bool, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reasons := c.unhealthy()
+	for condition, met := range c.conditions {
+		if !met {
+			reasons = append(reasons, condition+": not ready")
+		}
+	}
+	slices.Sort(reasons)
+	return len(reasons) == 0, reasons
+}
+
+// Handler serves /healthz (liveness) and /readyz (readiness).
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, c.Live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, c.Ready)
+	})
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, check func() (bool, []string)) {
+	ok, reasons := check()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(reasons, "\n") + "\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// Run serves the health endpoints of the checker over plain HTTP, so that they
+// can be used by kubelet probes. It blocks until the context is cancelled or
+// the server encounters a fatal error.
+func Run(ctx context.Context, addr string, checker *Checker) {
+	logger := klog.FromContext(ctx)
+
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     checker.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("starting health server", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error(err, "health server failed")
+	}
+}
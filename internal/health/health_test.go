@@ -0,0 +1,89 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestChecker(failureTimeout time.Duration) (*Checker, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewChecker(failureTimeout)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func probe(c *Checker, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestReadiness(t *testing.T) {
+	c, _ := newTestChecker(time.Minute)
+	c.Register(NodeInformerSynced, WireguardApplied, FirewallSynced)
+
+	code, body := probe(c, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "firewall: not ready\nnode-informer: not ready\nwireguard: not ready\n", body)
+
+	// Liveness does not depend on readiness
+	code, _ = probe(c, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	c.MarkReady(NodeInformerSynced)
+	c.MarkReady(WireguardApplied)
+	c.RecordSync(FirewallSynced, errors.New("boom"))
+	code, body = probe(c, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "firewall: not ready\n", body)
+
+	c.RecordSync(FirewallSynced, nil)
+	code, body = probe(c, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+
+	// Unregistered conditions are ignored
+	c.MarkReady(CNIWritten)
+	ready, _ := c.Ready()
+	assert.True(t, ready)
+}
+
+func TestSyncFailureTimeout(t *testing.T) {
+	c, now := newTestChecker(5 * time.Minute)
+	c.Register(FirewallSynced)
+	c.RecordSync(FirewallSynced, nil)
+
+	c.RecordSync(FirewallSynced, errors.New("boom"))
+	*now = now.Add(4 * time.Minute)
+	c.RecordSync(FirewallSynced, errors.New("boom"))
+
+	live, _ := c.Live()
+	assert.True(t, live)
+
+	*now = now.Add(2 * time.Minute)
+	code, body := probe(c, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "firewall: failing since 2024-01-01T00:00:00Z\n", body)
+
+	code, _ = probe(c, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// A single successful sync resets the failure period
+	c.RecordSync(FirewallSynced, nil)
+	code, _ = probe(c, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestSyncFailureTimeoutDisabled(t *testing.T) {
+	c, now := newTestChecker(0)
+	c.RecordSync(FirewallSynced, errors.New("boom"))
+	*now = now.Add(24 * time.Hour)
+
+	live, _ := c.Live()
+	assert.True(t, live)
+}
@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/config"
 	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/health"
 )
 
 func TestSeparateChannelArchitecture(t *testing.T) {
@@ -70,7 +72,7 @@ func TestFirewallManagerChannels(t *testing.T) {
 	podCIDRUpdates := make(chan []netip.Prefix)
 	policyUpdates := make(chan []firewall.NetworkPolicyRule)
 
-	manager, err := firewall.New(podCIDRUpdates, policyUpdates)
+	manager, err := firewall.New(config.Default(), health.NewChecker(0), podCIDRUpdates, policyUpdates, nil)
 	if err != nil {
 		t.Skipf("firewall backend not available: %v", err)
 	}
@@ -0,0 +1,459 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	gcPeriod = time.Minute
+	// Allocations younger than this are never collected, so that pods that
+	// are being created are not mistaken for leaks.
+	gcGracePeriod = time.Minute
+)
+
+// Allocation is the set of addresses assigned to an interface of a container.
+type Allocation struct {
+	ContainerID string     `json:"containerID"`
+	IfName      string     `json:"ifName"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Pod         string     `json:"pod,omitempty"`
+	PodUID      string     `json:"podUID,omitempty"`
+	IPs         []IPConfig `json:"ips"`
+	Created     time.Time  `json:"created"`
+}
+
+type IPConfig struct {
+	// Address with the prefix length of the pod CIDR it was allocated from
+	Address netip.Prefix `json:"address"`
+	Gateway netip.Addr   `json:"gateway"`
+}
+
+type AllocateRequest struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	PodUID      string `json:"podUID,omitempty"`
+	// Pod CIDRs to allocate from, one address from each
+	Ranges []netip.Prefix `json:"ranges"`
+}
+
+type ReleaseRequest struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+}
+
+type Manager interface {
+	// Allocate assigns an address from each of the ranges to the container
+	// interface. It is idempotent, the existing allocation is returned if the
+	// interface already has one.
+	Allocate(ctx context.Context, req AllocateRequest) (Allocation, error)
+	// Release frees the addresses of the container interface, if any.
+	Release(ctx context.Context, containerID, ifName string) error
+	// Allocations returns all the current allocations.
+	Allocations() []Allocation
+	// Run serves the API on the unix socket and collects leaked allocations
+	// until the context is cancelled.
+	Run(ctx context.Context)
+}
+
+// state is what is persisted in IPAM_STATE_PATH
+type state struct {
+	Allocations []Allocation `json:"allocations"`
+	// Last allocated address per range, so that released addresses are not
+	// reused right away
+	LastReserved map[netip.Prefix]netip.Addr `json:"lastReserved"`
+}
+
+type manager struct {
+	mu         sync.Mutex
+	state      state
+	statePath  string
+	socketPath string
+	nodeName   string
+	// Informer of the pods on the local node, to find leaked allocations
+	factory   informers.SharedInformerFactory
+	podLister corelisters.PodLister
+	now       func() time.Time
+	// Receives the pod CIDRs of an address family that are (nearly) full, if
+	// pod CIDR expansion is enabled
+	podCIDRExhausted chan<- []netip.Prefix
+	// Utilization in percent at which the expansion is requested
+	expansionThreshold int
+}
+
+func NewManager(clientset kubernetes.Interface, cfg *config.Config, podCIDRExhausted chan<- []netip.Prefix) (Manager, error) {
+	if !cfg.PodCIDR.Expansion {
+		podCIDRExhausted = nil
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithTransform(util.StripManagedFields),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", cfg.NodeName).String()
+		}))
+
+	m := &manager{
+		statePath:          cfg.CNI.IPAMStatePath,
+		socketPath:         cfg.CNI.IPAMSocketPath,
+		nodeName:           cfg.NodeName,
+		factory:            factory,
+		podLister:          factory.Core().V1().Pods().Lister(),
+		now:                time.Now,
+		podCIDRExhausted:   podCIDRExhausted,
+		expansionThreshold: cfg.PodCIDR.ExpansionThreshold,
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *manager) load() error {
+	m.state = state{
+		Allocations:  make([]Allocation, 0),
+		LastReserved: make(map[netip.Prefix]netip.Addr),
+	}
+
+	data, err := os.ReadFile(m.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &m.state); err != nil {
+		return fmt.Errorf("invalid IPAM state in %s: %w", m.statePath, err)
+	}
+	if m.state.LastReserved == nil {
+		m.state.LastReserved = make(map[netip.Prefix]netip.Addr)
+	}
+	return nil
+}
+
+// save persists the state atomically, so that it is not lost if the daemon is
+// restarted halfway through.
+func (m *manager) save(s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.statePath), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.statePath+".temp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(m.statePath+".temp", m.statePath)
+}
+
+func (m *manager) Allocations() []Allocation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.state.Allocations)
+}
+
+func (m *manager) Allocate(ctx context.Context, req AllocateRequest) (Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	logger := klog.FromContext(ctx)
+
+	for _, allocation := range m.state.Allocations {
+		if allocation.ContainerID == req.ContainerID && allocation.IfName == req.IfName {
+			return allocation, nil
+		}
+	}
+
+	if len(req.Ranges) == 0 {
+		return Allocation{}, errors.New("no pod CIDRs to allocate from")
+	}
+
+	used := make(map[netip.Addr]bool)
+	for _, allocation := range m.state.Allocations {
+		for _, ip := range allocation.IPs {
+			used[ip.Address.Addr()] = true
+		}
+	}
+
+	allocation := Allocation{
+		ContainerID: req.ContainerID,
+		IfName:      req.IfName,
+		Namespace:   req.Namespace,
+		Pod:         req.Pod,
+		PodUID:      req.PodUID,
+		IPs:         make([]IPConfig, 0, len(req.Ranges)),
+		Created:     m.now(),
+	}
+
+	newState := state{
+		Allocations:  slices.Clone(m.state.Allocations),
+		LastReserved: make(map[netip.Prefix]netip.Addr),
+	}
+	for k, v := range m.state.LastReserved {
+		newState.LastReserved[k] = v
+	}
+
+	families := groupByFamily(req.Ranges)
+	for _, ranges := range families {
+		var ip IPConfig
+		for _, cidr := range ranges {
+			address, err := allocateAddress(cidr, used, m.state.LastReserved[cidr])
+			if err != nil {
+				continue
+			}
+			used[address] = true
+			newState.LastReserved[cidr] = address
+			ip = IPConfig{
+				Address: netip.PrefixFrom(address, cidr.Bits()),
+				Gateway: cidr.Addr().Next(),
+			}
+			break
+		}
+		if !ip.Address.IsValid() {
+			m.requestExpansion(ranges)
+			return Allocation{}, fmt.Errorf("no free addresses left in pod CIDRs %v", ranges)
+		}
+		allocation.IPs = append(allocation.IPs, ip)
+	}
+	newState.Allocations = append(newState.Allocations, allocation)
+
+	if err := m.save(newState); err != nil {
+		return Allocation{}, err
+	}
+	m.state = newState
+
+	for _, ranges := range families {
+		if utilization(ranges, used) >= m.expansionThreshold {
+			m.requestExpansion(ranges)
+		}
+	}
+
+	logger.Info("allocated addresses", "containerID", req.ContainerID, "pod", klog.KRef(req.Namespace, req.Pod), "ips", allocation.IPs)
+	return allocation, nil
+}
+
+func (m *manager) Release(ctx context.Context, containerID, ifName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.release(ctx, func(allocation Allocation) bool {
+		return allocation.ContainerID == containerID && allocation.IfName == ifName
+	})
+}
+
+// release removes the allocations matching the predicate, must be called with
+// the lock held.
+func (m *manager) release(ctx context.Context, matches func(Allocation) bool) error {
+	logger := klog.FromContext(ctx)
+
+	allocations := make([]Allocation, 0, len(m.state.Allocations))
+	for _, allocation := range m.state.Allocations {
+		if matches(allocation) {
+			logger.Info("released addresses", "containerID", allocation.ContainerID, "pod", klog.KRef(allocation.Namespace, allocation.Pod), "ips", allocation.IPs)
+		} else {
+			allocations = append(allocations, allocation)
+		}
+	}
+	if len(allocations) == len(m.state.Allocations) {
+		return nil
+	}
+
+	newState := state{Allocations: allocations, LastReserved: m.state.LastReserved}
+	if err := m.save(newState); err != nil {
+		return err
+	}
+	m.state = newState
+	return nil
+}
+
+// collectGarbage releases the allocations of pods that no longer exist on the
+// local node, e.g. because the CNI DEL was never delivered.
+func (m *manager) collectGarbage(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "failed to list pods for IPAM garbage collection")
+		return
+	}
+
+	uids := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != m.nodeName {
+			continue
+		}
+		uids[string(pod.UID)] = true
+		names[pod.Namespace+"/"+pod.Name] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := m.now().Add(-gcGracePeriod)
+	err = m.release(ctx, func(allocation Allocation) bool {
+		if allocation.Created.After(cutoff) {
+			return false
+		}
+		switch {
+		case allocation.PodUID != "":
+			return !uids[allocation.PodUID]
+		case allocation.Pod != "":
+			return !names[allocation.Namespace+"/"+allocation.Pod]
+		default:
+			// Not a Kubernetes pod, leave it alone
+			return false
+		}
+	})
+	if err != nil {
+		logger.Error(err, "failed to release leaked allocations")
+	}
+}
+
+func (m *manager) Run(ctx context.Context) {
+	wg := wait.Group{}
+	wg.StartWithContext(ctx, func(ctx context.Context) {
+		if err := serve(ctx, m.socketPath, m); err != nil {
+			klog.FromContext(ctx).Error(err, "IPAM server failed")
+		}
+	})
+	wg.StartWithContext(ctx, func(ctx context.Context) {
+		// Until the informer has synced, every allocation looks leaked
+		m.factory.StartWithContext(ctx)
+		if err := m.factory.WaitForCacheSyncWithContext(ctx).AsError(); err != nil {
+			klog.FromContext(ctx).Error(err, "timed out waiting for the pod cache to sync, not collecting leaked IPAM allocations")
+			return
+		}
+		wait.UntilWithContext(ctx, m.collectGarbage, gcPeriod)
+	})
+	wg.Wait()
+}
+
+// Cleanup removes the persisted allocations and the socket of the IPAM API.
+func Cleanup(ctx context.Context, cfg *config.Config) error {
+	state := cfg.CNI.IPAMStatePath
+	return util.RemoveFiles(klog.FromContext(ctx), state, state+".temp", cfg.CNI.IPAMSocketPath)
+}
+
+// requestExpansion asks for another pod CIDR of the family to be added to the
+// node. It does not block, a request that is already pending is enough.
+func (m *manager) requestExpansion(ranges []netip.Prefix) {
+	if m.podCIDRExhausted == nil {
+		return
+	}
+	select {
+	case m.podCIDRExhausted <- ranges:
+	default:
+	}
+}
+
+// groupByFamily groups the pod CIDRs by address family, keeping their order.
+func groupByFamily(cidrs []netip.Prefix) [][]netip.Prefix {
+	families := make([][]netip.Prefix, 0)
+	indexes := make(map[bool]int)
+	for _, cidr := range cidrs {
+		cidr = cidr.Masked()
+		if index, ok := indexes[cidr.Addr().Is6()]; ok {
+			families[index] = append(families[index], cidr)
+		} else {
+			indexes[cidr.Addr().Is6()] = len(families)
+			families = append(families, []netip.Prefix{cidr})
+		}
+	}
+	return families
+}
+
+// utilization returns the percentage of the allocatable addresses in the pod
+// CIDRs that are in use. Large ranges (e.g. IPv6 /64s) never fill up, so
+// their utilization is reported as 0.
+func utilization(ranges []netip.Prefix, used map[netip.Addr]bool) int {
+	var capacity, inUse uint64
+	for _, cidr := range ranges {
+		hostBits := cidr.Addr().BitLen() - cidr.Bits()
+		if hostBits >= 32 {
+			return 0
+		}
+		// Network address and gateway, and the broadcast address for IPv4
+		reserved := uint64(2)
+		if cidr.Addr().Is4() {
+			reserved = 3
+		}
+		if size := uint64(1) << hostBits; size > reserved {
+			capacity += size - reserved
+		}
+		for address := range used {
+			if cidr.Contains(address) {
+				inUse++
+			}
+		}
+	}
+	if capacity == 0 {
+		return 100
+	}
+	return int(inUse * 100 / capacity)
+}
+
+// allocateAddress returns the first free address in the pod CIDR after the
+// last reserved one. The first address is the gateway, and for IPv4 the
+// network and broadcast addresses are skipped.
+func allocateAddress(cidr netip.Prefix, used map[netip.Addr]bool, lastReserved netip.Addr) (netip.Addr, error) {
+	first := cidr.Addr().Next().Next()
+	last := lastAddress(cidr)
+	if cidr.Addr().Is4() {
+		last = last.Prev()
+	}
+	if !first.IsValid() || !last.IsValid() || first.Compare(last) > 0 {
+		return netip.Addr{}, fmt.Errorf("pod CIDR %s is too small", cidr)
+	}
+
+	start := first
+	if lastReserved.IsValid() && lastReserved.Compare(first) >= 0 && lastReserved.Compare(last) < 0 {
+		start = lastReserved.Next()
+	}
+
+	address := start
+	for {
+		if !used[address] {
+			return address, nil
+		}
+		if address == last {
+			address = first
+		} else {
+			address = address.Next()
+		}
+		if address == start {
+			return netip.Addr{}, fmt.Errorf("no free addresses left in pod CIDR %s", cidr)
+		}
+	}
+}
+
+func lastAddress(cidr netip.Prefix) netip.Addr {
+	bytes := cidr.Masked().Addr().AsSlice()
+	for i := cidr.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
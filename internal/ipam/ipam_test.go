@@ -0,0 +1,227 @@
+package ipam
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func newTestManager(t *testing.T, pods ...*v1.Pod) *manager {
+	t.Helper()
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pod := range pods {
+		require.NoError(t, indexer.Add(pod))
+	}
+
+	m := &manager{
+		statePath: filepath.Join(t.TempDir(), "ipam.json"),
+		nodeName:  "node",
+		podLister: corelisters.NewPodLister(indexer),
+		now:       time.Now,
+	}
+	require.NoError(t, m.load())
+	return m
+}
+
+func addresses(allocation Allocation) []netip.Prefix {
+	result := make([]netip.Prefix, 0)
+	for _, ip := range allocation.IPs {
+		result = append(result, ip.Address)
+	}
+	return result
+}
+
+func TestAllocate(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	m := newTestManager(t)
+
+	ranges := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("2001:db8:1::/64")}
+
+	a, err := m.Allocate(ctx, AllocateRequest{ContainerID: "a", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []IPConfig{
+		{Address: netip.MustParsePrefix("10.1.0.2/24"), Gateway: netip.MustParseAddr("10.1.0.1")},
+		{Address: netip.MustParsePrefix("2001:db8:1::2/64"), Gateway: netip.MustParseAddr("2001:db8:1::1")},
+	}, a.IPs)
+
+	// Idempotent
+	again, err := m.Allocate(ctx, AllocateRequest{ContainerID: "a", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, a, again)
+
+	b, err := m.Allocate(ctx, AllocateRequest{ContainerID: "b", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.3/24"), netip.MustParsePrefix("2001:db8:1::3/64")}, addresses(b))
+
+	// Released addresses are not reused right away
+	require.NoError(t, m.Release(ctx, "a", "eth0"))
+	c, err := m.Allocate(ctx, AllocateRequest{ContainerID: "c", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.4/24"), netip.MustParsePrefix("2001:db8:1::4/64")}, addresses(c))
+
+	// Releasing twice is fine
+	require.NoError(t, m.Release(ctx, "a", "eth0"))
+
+	// State survives a restart
+	reloaded := &manager{statePath: m.statePath}
+	require.NoError(t, reloaded.load())
+	assert.Equal(t, []string{"b", "c"}, []string{reloaded.state.Allocations[0].ContainerID, reloaded.state.Allocations[1].ContainerID})
+	assert.Equal(t, netip.MustParseAddr("10.1.0.4"), reloaded.state.LastReserved[netip.MustParsePrefix("10.1.0.0/24")])
+}
+
+func TestAllocateExhausted(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	m := newTestManager(t)
+
+	// .0 is the network address, .1 the gateway and .3 the broadcast address
+	ranges := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/30")}
+
+	a, err := m.Allocate(ctx, AllocateRequest{ContainerID: "a", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.2/30")}, addresses(a))
+
+	_, err = m.Allocate(ctx, AllocateRequest{ContainerID: "b", IfName: "eth0", Ranges: ranges})
+	assert.ErrorContains(t, err, "no free addresses")
+
+	// Wraps around once there is space again
+	require.NoError(t, m.Release(ctx, "a", "eth0"))
+	b, err := m.Allocate(ctx, AllocateRequest{ContainerID: "b", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.2/30")}, addresses(b))
+
+	_, err = m.Allocate(ctx, AllocateRequest{ContainerID: "c", IfName: "eth0"})
+	assert.Error(t, err)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	m := newTestManager(t,
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alive", UID: types.UID("uid-alive")},
+			Spec:       v1.PodSpec{NodeName: "node"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "elsewhere", UID: types.UID("uid-elsewhere")},
+			Spec:       v1.PodSpec{NodeName: "other"},
+		},
+	)
+
+	ranges := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}
+	requests := []AllocateRequest{
+		{ContainerID: "alive", Namespace: "default", Pod: "alive", PodUID: "uid-alive"},
+		{ContainerID: "recreated", Namespace: "default", Pod: "alive", PodUID: "uid-old"},
+		{ContainerID: "gone", Namespace: "default", Pod: "gone"},
+		{ContainerID: "elsewhere", Namespace: "default", Pod: "elsewhere", PodUID: "uid-elsewhere"},
+		{ContainerID: "unknown"},
+	}
+	for _, req := range requests {
+		req.IfName = "eth0"
+		req.Ranges = ranges
+		_, err := m.Allocate(ctx, req)
+		require.NoError(t, err)
+	}
+
+	// Recent allocations are kept
+	m.collectGarbage(ctx)
+	assert.Len(t, m.Allocations(), 5)
+
+	m.now = func() time.Time { return time.Now().Add(2 * gcGracePeriod) }
+	m.collectGarbage(ctx)
+
+	remaining := make([]string, 0)
+	for _, allocation := range m.Allocations() {
+		remaining = append(remaining, allocation.ContainerID)
+	}
+	assert.Equal(t, []string{"alive", "unknown"}, remaining)
+}
+
+func TestClient(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := newTestManager(t)
+	socketPath := filepath.Join(t.TempDir(), "ipam.sock")
+
+	done := make(chan error)
+	go func() {
+		done <- serve(ctx, socketPath, m)
+	}()
+
+	client := NewClient(socketPath)
+	require.Eventually(t, func() bool {
+		_, err := client.Allocations(ctx)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	allocation, err := client.Allocate(ctx, AllocateRequest{
+		ContainerID: "a",
+		IfName:      "eth0",
+		Ranges:      []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.2/24")}, addresses(allocation))
+
+	allocations, err := client.Allocations(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allocations, 1)
+
+	_, err = client.Allocate(ctx, AllocateRequest{ContainerID: "b", IfName: "eth0"})
+	assert.ErrorContains(t, err, "no pod CIDRs")
+
+	require.NoError(t, client.Release(ctx, "a", "eth0"))
+	allocations, err = client.Allocations(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, allocations)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestAllocateMultipleRanges(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	exhausted := make(chan []netip.Prefix, 1)
+	m := newTestManager(t)
+	m.podCIDRExhausted = exhausted
+	m.expansionThreshold = 50
+
+	small := netip.MustParsePrefix("10.1.0.0/29") // 5 allocatable addresses
+	ranges := []netip.Prefix{small, netip.MustParsePrefix("2001:db8:1::/64")}
+
+	// A single address per family
+	a, err := m.Allocate(ctx, AllocateRequest{ContainerID: "a", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.2/29"), netip.MustParsePrefix("2001:db8:1::2/64")}, addresses(a))
+	assert.Empty(t, exhausted)
+
+	for _, id := range []string{"b", "c"} {
+		_, err := m.Allocate(ctx, AllocateRequest{ContainerID: id, IfName: "eth0", Ranges: ranges})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []netip.Prefix{small}, <-exhausted)
+
+	// Once the first range is full, the next one of the family is used
+	for _, id := range []string{"d", "e"} {
+		_, err := m.Allocate(ctx, AllocateRequest{ContainerID: id, IfName: "eth0", Ranges: ranges})
+		require.NoError(t, err)
+	}
+	<-exhausted
+	ranges = []netip.Prefix{small, netip.MustParsePrefix("10.2.0.0/29"), netip.MustParsePrefix("2001:db8:1::/64")}
+	f, err := m.Allocate(ctx, AllocateRequest{ContainerID: "f", IfName: "eth0", Ranges: ranges})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.2.0.2/29"), netip.MustParsePrefix("2001:db8:1::7/64")}, addresses(f))
+}
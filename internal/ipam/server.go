@@ -0,0 +1,167 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const requestTimeout = 30 * time.Second
+
+// NewHandler returns the handler for the IPAM API:
+//
+//	POST /allocate     allocate addresses for a container interface
+//	POST /release      release the addresses of a container interface
+//	GET  /allocations  list all the allocations
+func NewHandler(m Manager) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /allocate", func(w http.ResponseWriter, r *http.Request) {
+		var req AllocateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		allocation, err := m.Allocate(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, allocation)
+	})
+
+	mux.HandleFunc("POST /release", func(w http.ResponseWriter, r *http.Request) {
+		var req ReleaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.Release(r.Context(), req.ContainerID, req.IfName); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /allocations", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Allocations())
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// serve serves the IPAM API on the unix socket until the context is cancelled.
+func serve(ctx context.Context, socketPath string, m Manager) error {
+	logger := klog.FromContext(ctx)
+
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
+		return err
+	}
+	// Left behind by the previous instance
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler: NewHandler(m),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logger.Info("serving IPAM API", "socket", socketPath)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Client talks to the IPAM API of the daemon over the unix socket.
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	return &Client{
+		httpClient: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Allocate(ctx context.Context, req AllocateRequest) (Allocation, error) {
+	var allocation Allocation
+	err := c.do(ctx, http.MethodPost, "/allocate", req, &allocation)
+	return allocation, err
+}
+
+func (c *Client) Release(ctx context.Context, containerID, ifName string) error {
+	return c.do(ctx, http.MethodPost, "/release", ReleaseRequest{ContainerID: containerID, IfName: ifName}, nil)
+}
+
+func (c *Client) Allocations(ctx context.Context) ([]Allocation, error) {
+	var allocations []Allocation
+	err := c.do(ctx, http.MethodGet, "/allocations", nil, &allocations)
+	return allocations, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored, the connection always goes to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://wigglenet"+path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("IPAM request failed: %s", bytes.TrimSpace(message))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tibordp/wigglenet/internal/health"
 	"k8s.io/apiserver/pkg/server/dynamiccertificates"
 	klog "k8s.io/klog/v2"
 )
@@ -59,6 +60,40 @@ var (
 		},
 	)
 
+	PeerEndpoint = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "wigglenet",
+			Name:      "peer_endpoint",
+			Help:      "Endpoint currently used for each WireGuard peer node (always 1).",
+		},
+		[]string{"node", "endpoint"},
+	)
+
+	OffLinkPeersTotal = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "wigglenet",
+			Name:      "off_link_peers_total",
+			Help:      "Current number of peer nodes that direct native routes cannot be installed for, as they are not on-link.",
+		},
+	)
+
+	BGPSessionEstablished = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "wigglenet",
+			Name:      "bgp_session_established",
+			Help:      "Whether the BGP session with the peer is established (1) or not (0).",
+		},
+		[]string{"peer"},
+	)
+
+	PodCIDRChangeBlocked = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "wigglenet",
+			Name:      "pod_cidr_change_blocked",
+			Help:      "Whether a change of the local pod CIDRs is held back (1), as pods still have addresses in the pod CIDRs that would be removed.",
+		},
+	)
+
 	NetworkPolicyRulesTotal = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "wigglenet",
@@ -67,6 +102,24 @@ var (
 		},
 		[]string{"direction"},
 	)
+
+	NetpolDropsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "wigglenet",
+			Name:      "netpol_drops_total",
+			Help:      "Total number of packets dropped by NetworkPolicy, by originating policy.",
+		},
+		[]string{"namespace", "policy", "direction"},
+	)
+
+	NetpolAuditDropsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "wigglenet",
+			Name:      "netpol_audit_drops_total",
+			Help:      "Total number of packets that NetworkPolicy in audit mode would have dropped, by originating policy.",
+		},
+		[]string{"namespace", "policy", "direction"},
+	)
 )
 
 func init() {
@@ -76,7 +129,13 @@ func init() {
 		FirewallSyncDuration,
 		PodCIDRsTotal,
 		PeersTotal,
+		PeerEndpoint,
+		OffLinkPeersTotal,
+		BGPSessionEstablished,
+		PodCIDRChangeBlocked,
 		NetworkPolicyRulesTotal,
+		NetpolDropsTotal,
+		NetpolAuditDropsTotal,
 	)
 }
 
@@ -102,17 +161,20 @@ type TLSConfig struct {
 	ClientCAFile string // If set, require and verify client certificates against this CA
 }
 
-// Run starts the Prometheus metrics HTTP(S) server. It blocks until the context
-// is cancelled or the server encounters a fatal error.
-func Run(ctx context.Context, addr string, tlsCfg *TLSConfig) {
+// Run starts the Prometheus metrics HTTP(S) server, which also serves the
+// health endpoints of checker. It blocks until the context is cancelled or the
+// server encounters a fatal error. If debugHandler is not nil, it is served
+// under /debug/.
+func Run(ctx context.Context, addr string, tlsCfg *TLSConfig, checker *health.Checker, debugHandler http.Handler) {
 	logger := klog.FromContext(ctx)
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+	mux.Handle("/healthz", checker.Handler())
+	mux.Handle("/readyz", checker.Handler())
+	if debugHandler != nil {
+		mux.Handle("/debug/", debugHandler)
+	}
 
 	server := &http.Server{
 		Addr:        addr,
@@ -0,0 +1,280 @@
+package networkpolicy
+
+import (
+	"cmp"
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tibordp/wigglenet/internal/firewall"
+
+	"k8s.io/klog/v2"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	anpv1alpha1 "sigs.k8s.io/network-policy-api/apis/v1alpha1"
+)
+
+// baselineAdminNetworkPolicyName is the name of the singleton
+// BaselineAdminNetworkPolicy. Objects with any other name are ignored.
+const baselineAdminNetworkPolicyName = "default"
+
+// generateAdminPolicyRules flattens AdminNetworkPolicies into "admin" tier rules
+// and the BaselineAdminNetworkPolicy into "baseline" tier rules. Rules are
+// numbered in evaluation order: ANPs by ascending priority (ties broken by
+// name, as the API leaves that order undefined), then by rule position.
+func (c *controller) generateAdminPolicyRules(ctx context.Context) ([]firewall.NetworkPolicyRule, error) {
+	anps, err := c.anpLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(anps, func(a, b *anpv1alpha1.AdminNetworkPolicy) int {
+		if n := cmp.Compare(a.Spec.Priority, b.Spec.Priority); n != 0 {
+			return n
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	var rules []firewall.NetworkPolicyRule
+
+	priority := 0
+	for _, anp := range anps {
+		subject := c.localOnly(c.selectSubject(ctx, anp.Spec.Subject))
+		for _, r := range anp.Spec.Ingress {
+			rules = append(rules, c.buildAdminRules(ctx, "admin", anp.Name, priority, "ingress", string(r.Action), subject, ingressPeers(r.From), r.Ports)...)
+			priority++
+		}
+		for _, r := range anp.Spec.Egress {
+			rules = append(rules, c.buildAdminRules(ctx, "admin", anp.Name, priority, "egress", string(r.Action), subject, r.To, r.Ports)...)
+			priority++
+		}
+	}
+
+	banps, err := c.banpLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	priority = 0
+	for _, banp := range banps {
+		if banp.Name != baselineAdminNetworkPolicyName {
+			continue
+		}
+		subject := c.localOnly(c.selectSubject(ctx, banp.Spec.Subject))
+		for _, r := range banp.Spec.Ingress {
+			rules = append(rules, c.buildAdminRules(ctx, "baseline", banp.Name, priority, "ingress", string(r.Action), subject, ingressPeers(r.From), r.Ports)...)
+			priority++
+		}
+		for _, r := range banp.Spec.Egress {
+			rules = append(rules, c.buildAdminRules(ctx, "baseline", banp.Name, priority, "egress", string(r.Action), subject, r.To, r.Ports)...)
+			priority++
+		}
+	}
+
+	return rules, nil
+}
+
+// buildAdminRules builds the firewall rules for a single ANP/BANP rule.
+// Ingress peers are passed as egress peers, which are a superset of them.
+func (c *controller) buildAdminRules(ctx context.Context, tier string, policy string, priority int, direction string, action string,
+	subject []PodInfo, peers []anpv1alpha1.AdminNetworkPolicyEgressPeer, ports *[]anpv1alpha1.AdminNetworkPolicyPort,
+) []firewall.NetworkPolicyRule {
+	if len(subject) == 0 {
+		return nil
+	}
+
+	rule := firewall.NetworkPolicyRule{
+		Direction: direction,
+		Action:    strings.ToLower(action),
+		Tier:      tier,
+		Priority:  priority,
+		Policy:    policy,
+		PodIPs:    make([]netip.Addr, 0, len(subject)),
+	}
+	for _, pod := range subject {
+		rule.PodIPs = append(rule.PodIPs, pod.IP)
+	}
+
+	var peerPods []PodInfo
+	for _, peer := range peers {
+		peerPods = append(peerPods, c.selectAdminPeer(ctx, peer)...)
+		rule.AllowedIPs = append(rule.AllowedIPs, c.selectNodeIPs(ctx, peer.Nodes)...)
+		rule.AllowedCIDRs = append(rule.AllowedCIDRs, parseNetworks(ctx, policy, peer.Networks)...)
+	}
+	for _, pod := range peerPods {
+		rule.AllowedIPs = append(rule.AllowedIPs, pod.IP)
+	}
+
+	// A rule without peers matches nothing.
+	if len(rule.AllowedIPs) == 0 && len(rule.AllowedCIDRs) == 0 {
+		return nil
+	}
+
+	// Named ports refer to the destination pods: the subject for ingress,
+	// the peers for egress.
+	namedPortPods := subject
+	if direction == "egress" {
+		namedPortPods = peerPods
+	}
+	portRules, ok := adminPortRules(ports, namedPortPods)
+	if !ok {
+		return nil
+	}
+	rule.PortRules = portRules
+
+	return []firewall.NetworkPolicyRule{rule}
+}
+
+// ingressPeers converts ingress peers to egress peers, which only add the
+// nodes and networks fields.
+func ingressPeers(peers []anpv1alpha1.AdminNetworkPolicyIngressPeer) []anpv1alpha1.AdminNetworkPolicyEgressPeer {
+	converted := make([]anpv1alpha1.AdminNetworkPolicyEgressPeer, 0, len(peers))
+	for _, peer := range peers {
+		converted = append(converted, anpv1alpha1.AdminNetworkPolicyEgressPeer{
+			Namespaces: peer.Namespaces,
+			Pods:       peer.Pods,
+		})
+	}
+	return converted
+}
+
+// adminPortRules converts ANP ports into PortRules, resolving named ports
+// against the given pods. It returns false if ports were specified but none of
+// them could be resolved, in which case the rule matches nothing.
+func adminPortRules(ports *[]anpv1alpha1.AdminNetworkPolicyPort, pods []PodInfo) ([]firewall.PortRule, bool) {
+	if ports == nil || len(*ports) == 0 {
+		return nil, true
+	}
+
+	var portRules []firewall.PortRule
+	for _, port := range *ports {
+		switch {
+		case port.PortNumber != nil:
+			portRules = append(portRules, firewall.PortRule{
+				Protocol: protocolOrTCP(string(port.PortNumber.Protocol)),
+				Port:     int(port.PortNumber.Port),
+			})
+		case port.PortRange != nil:
+			portRules = append(portRules, firewall.PortRule{
+				Protocol: protocolOrTCP(string(port.PortRange.Protocol)),
+				Port:     int(port.PortRange.Start),
+				EndPort:  int(port.PortRange.End),
+			})
+		case port.NamedPort != nil:
+			// A named port can map to different protocols on different pods.
+			for _, proto := range []string{"TCP", "UDP", "SCTP"} {
+				if p := resolveNamedPort(pods, *port.NamedPort, proto); p != 0 {
+					portRules = append(portRules, firewall.PortRule{Protocol: proto, Port: p})
+				}
+			}
+		}
+	}
+
+	return portRules, len(portRules) > 0
+}
+
+func protocolOrTCP(protocol string) string {
+	if protocol == "" {
+		return "TCP"
+	}
+	return protocol
+}
+
+// selectSubject returns the pods an ANP/BANP applies to.
+func (c *controller) selectSubject(ctx context.Context, subject anpv1alpha1.AdminNetworkPolicySubject) []PodInfo {
+	var selected []PodInfo
+	if subject.Namespaces != nil {
+		for _, ns := range c.namespacesMatching(ctx, subject.Namespaces) {
+			selected = append(selected, c.selectPods(ctx, ns, metav1.LabelSelector{})...)
+		}
+	} else if subject.Pods != nil {
+		for _, ns := range c.namespacesMatching(ctx, &subject.Pods.NamespaceSelector) {
+			selected = append(selected, c.selectPods(ctx, ns, subject.Pods.PodSelector)...)
+		}
+	}
+	return selected
+}
+
+// selectAdminPeer returns the pods matched by an ANP/BANP peer.
+func (c *controller) selectAdminPeer(ctx context.Context, peer anpv1alpha1.AdminNetworkPolicyEgressPeer) []PodInfo {
+	var selected []PodInfo
+	if peer.Namespaces != nil {
+		for _, ns := range c.namespacesMatching(ctx, peer.Namespaces) {
+			selected = append(selected, c.selectPods(ctx, ns, metav1.LabelSelector{})...)
+		}
+	} else if peer.Pods != nil {
+		for _, ns := range c.namespacesMatching(ctx, &peer.Pods.NamespaceSelector) {
+			selected = append(selected, c.selectPods(ctx, ns, peer.Pods.PodSelector)...)
+		}
+	}
+	return selected
+}
+
+// selectNodeIPs returns the internal and external addresses of the nodes
+// matched by a nodes peer.
+func (c *controller) selectNodeIPs(ctx context.Context, selector *metav1.LabelSelector) []netip.Addr {
+	if selector == nil {
+		return nil
+	}
+	logger := klog.FromContext(ctx)
+
+	nodeSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		logger.Info("invalid node selector", "error", err)
+		return nil
+	}
+	nodes, err := c.nodeLister.List(nodeSelector)
+	if err != nil {
+		logger.Error(err, "listing nodes")
+		return nil
+	}
+
+	var addrs []netip.Addr
+	for _, node := range nodes {
+		for _, address := range node.Status.Addresses {
+			if address.Type != v1.NodeInternalIP && address.Type != v1.NodeExternalIP {
+				continue
+			}
+			if addr, err := netip.ParseAddr(address.Address); err == nil && !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// parseNetworks parses the CIDRs of a networks peer. They are validated by the
+// API server, so an invalid one is only logged.
+func parseNetworks(ctx context.Context, policy string, networks []anpv1alpha1.CIDR) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(string(network))
+		if err != nil {
+			klog.FromContext(ctx).Info("invalid network in admin network policy", "policy", policy, "network", network, "error", err)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+func (c *controller) namespacesMatching(ctx context.Context, selector *metav1.LabelSelector) []string {
+	logger := klog.FromContext(ctx)
+
+	nsSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		logger.Info("invalid namespace selector", "error", err)
+		return nil
+	}
+
+	var matched []string
+	for nsName, nsLabels := range c.namespaces {
+		if nsSelector.Matches(labels.Set(nsLabels)) {
+			matched = append(matched, nsName)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,298 @@
+package networkpolicy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2/ktesting"
+	anpv1alpha1 "sigs.k8s.io/network-policy-api/apis/v1alpha1"
+	anplisters "sigs.k8s.io/network-policy-api/pkg/client/listers/apis/v1alpha1"
+)
+
+func newAnpListers(anps []*anpv1alpha1.AdminNetworkPolicy, banps []*anpv1alpha1.BaselineAdminNetworkPolicy) (anplisters.AdminNetworkPolicyLister, anplisters.BaselineAdminNetworkPolicyLister) {
+	anpIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, anp := range anps {
+		_ = anpIndexer.Add(anp)
+	}
+	banpIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, banp := range banps {
+		_ = banpIndexer.Add(banp)
+	}
+	return anplisters.NewAdminNetworkPolicyLister(anpIndexer), anplisters.NewBaselineAdminNetworkPolicyLister(banpIndexer)
+}
+
+func newAnpTestController() *controller {
+	return &controller{
+		pods: map[netip.Addr]PodInfo{
+			netip.MustParseAddr("10.0.0.1"): {
+				IP:        netip.MustParseAddr("10.0.0.1"),
+				Namespace: "tenant-a",
+				Labels:    map[string]string{"app": "web"},
+				ContainerPorts: []ContainerPort{
+					{Name: "http", ContainerPort: 8080, Protocol: "TCP"},
+				},
+			},
+			netip.MustParseAddr("10.0.0.2"): {
+				IP:        netip.MustParseAddr("10.0.0.2"),
+				Namespace: "tenant-b",
+				Labels:    map[string]string{"app": "web"},
+			},
+			netip.MustParseAddr("10.0.0.3"): {
+				IP:        netip.MustParseAddr("10.0.0.3"),
+				Namespace: "monitoring",
+				Labels:    map[string]string{"app": "prometheus"},
+			},
+			netip.MustParseAddr("10.0.0.4"): {
+				IP:        netip.MustParseAddr("10.0.0.4"),
+				Namespace: "tenant-a2",
+				Labels:    map[string]string{"app": "db"},
+			},
+		},
+		namespaces: map[string]map[string]string{
+			"tenant-a":   {"tenant": "a", "kind": "tenant"},
+			"tenant-a2":  {"tenant": "a", "kind": "tenant"},
+			"tenant-b":   {"tenant": "b", "kind": "tenant"},
+			"monitoring": {"kind": "infra"},
+		},
+	}
+}
+
+func tenantSubject() anpv1alpha1.AdminNetworkPolicySubject {
+	return anpv1alpha1.AdminNetworkPolicySubject{
+		Namespaces: &metav1.LabelSelector{MatchLabels: map[string]string{"kind": "tenant"}},
+	}
+}
+
+func TestGenerateAdminPolicyRulesPriorityOrder(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	c := newAnpTestController()
+
+	monitoringPeer := []anpv1alpha1.AdminNetworkPolicyIngressPeer{{
+		Namespaces: &metav1.LabelSelector{MatchLabels: map[string]string{"kind": "infra"}},
+	}}
+
+	c.anpLister, c.banpLister = newAnpListers([]*anpv1alpha1.AdminNetworkPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "deny-monitoring"},
+			Spec: anpv1alpha1.AdminNetworkPolicySpec{
+				Priority: 20,
+				Subject:  tenantSubject(),
+				Ingress: []anpv1alpha1.AdminNetworkPolicyIngressRule{
+					{Action: anpv1alpha1.AdminNetworkPolicyRuleActionDeny, From: monitoringPeer},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "allow-monitoring"},
+			Spec: anpv1alpha1.AdminNetworkPolicySpec{
+				Priority: 10,
+				Subject:  tenantSubject(),
+				Ingress: []anpv1alpha1.AdminNetworkPolicyIngressRule{
+					{Action: anpv1alpha1.AdminNetworkPolicyRuleActionAllow, From: monitoringPeer},
+					{Action: anpv1alpha1.AdminNetworkPolicyRuleActionPass, From: monitoringPeer},
+				},
+			},
+		},
+	}, nil)
+
+	rules, err := c.generateAdminPolicyRules(ctx)
+	require.NoError(t, err)
+	canonicalizeRules(rules)
+
+	require.Len(t, rules, 3)
+	assert.Equal(t, []string{"allow", "pass", "deny"}, []string{rules[0].Action, rules[1].Action, rules[2].Action})
+	assert.Equal(t, []int{0, 1, 2}, []int{rules[0].Priority, rules[1].Priority, rules[2].Priority})
+	for _, r := range rules {
+		assert.Equal(t, "admin", r.Tier)
+		assert.Equal(t, "ingress", r.Direction)
+		assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.3")}, r.AllowedIPs)
+		assert.Len(t, r.PodIPs, 3)
+	}
+}
+
+func TestGenerateAdminPolicyRulesNodesAndNetworks(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	c := newAnpTestController()
+
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range []*v1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "control-plane", Labels: map[string]string{"node-role.kubernetes.io/control-plane": ""}},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: "control-plane"},
+				{Type: v1.NodeInternalIP, Address: "192.168.0.1"},
+				{Type: v1.NodeInternalIP, Address: "fd00::1"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker"},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.168.0.2"},
+			}},
+		},
+	} {
+		require.NoError(t, nodeIndexer.Add(node))
+	}
+	c.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+
+	c.anpLister, c.banpLister = newAnpListers([]*anpv1alpha1.AdminNetworkPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "deny-external"},
+			Spec: anpv1alpha1.AdminNetworkPolicySpec{
+				Priority: 1,
+				Subject:  tenantSubject(),
+				Egress: []anpv1alpha1.AdminNetworkPolicyEgressRule{
+					{
+						Action: anpv1alpha1.AdminNetworkPolicyRuleActionDeny,
+						To: []anpv1alpha1.AdminNetworkPolicyEgressPeer{
+							{Nodes: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+								{Key: "node-role.kubernetes.io/control-plane", Operator: metav1.LabelSelectorOpExists},
+							}}},
+							{Networks: []anpv1alpha1.CIDR{"203.0.113.0/24", "2001:db8::1/64"}},
+						},
+					},
+					{
+						// Matches no nodes, but still has a network peer.
+						Action: anpv1alpha1.AdminNetworkPolicyRuleActionAllow,
+						To: []anpv1alpha1.AdminNetworkPolicyEgressPeer{
+							{Nodes: &metav1.LabelSelector{MatchLabels: map[string]string{"missing": "label"}}},
+							{Networks: []anpv1alpha1.CIDR{"0.0.0.0/0"}},
+						},
+					},
+				},
+			},
+		},
+	}, nil)
+
+	rules, err := c.generateAdminPolicyRules(ctx)
+	require.NoError(t, err)
+	canonicalizeRules(rules)
+
+	require.Len(t, rules, 2)
+	assert.Equal(t, "deny", rules[0].Action)
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("192.168.0.1"),
+		netip.MustParseAddr("fd00::1"),
+	}, rules[0].AllowedIPs)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("2001:db8::/64"),
+	}, rules[0].AllowedCIDRs)
+
+	assert.Equal(t, "allow", rules[1].Action)
+	assert.Empty(t, rules[1].AllowedIPs)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}, rules[1].AllowedCIDRs)
+}
+
+func TestGenerateAdminPolicyRulesNamedPort(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	c := newAnpTestController()
+
+	namedPort := "http"
+	c.anpLister, c.banpLister = newAnpListers([]*anpv1alpha1.AdminNetworkPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "allow-http"},
+			Spec: anpv1alpha1.AdminNetworkPolicySpec{
+				Priority: 1,
+				Subject: anpv1alpha1.AdminNetworkPolicySubject{
+					Pods: &anpv1alpha1.NamespacedPod{
+						PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					},
+				},
+				Ingress: []anpv1alpha1.AdminNetworkPolicyIngressRule{
+					{
+						Action: anpv1alpha1.AdminNetworkPolicyRuleActionAllow,
+						From: []anpv1alpha1.AdminNetworkPolicyIngressPeer{{
+							Pods: &anpv1alpha1.NamespacedPod{
+								NamespaceSelector: metav1.LabelSelector{},
+								PodSelector:       metav1.LabelSelector{MatchLabels: map[string]string{"app": "prometheus"}},
+							},
+						}},
+						Ports: &[]anpv1alpha1.AdminNetworkPolicyPort{
+							{NamedPort: &namedPort},
+							{PortRange: &anpv1alpha1.PortRange{Protocol: v1.ProtocolUDP, Start: 9000, End: 9100}},
+						},
+					},
+				},
+			},
+		},
+	}, nil)
+
+	rules, err := c.generateAdminPolicyRules(ctx)
+	require.NoError(t, err)
+	canonicalizeRules(rules)
+
+	require.Len(t, rules, 1)
+	assert.Equal(t, []firewall.PortRule{
+		{Protocol: "TCP", Port: 8080},
+		{Protocol: "UDP", Port: 9000, EndPort: 9100},
+	}, rules[0].PortRules)
+}
+
+func TestGenerateBaselineAdminPolicyRules(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	c := newAnpTestController()
+
+	allNamespaces := &metav1.LabelSelector{}
+
+	c.anpLister, c.banpLister = newAnpListers(nil, []*anpv1alpha1.BaselineAdminNetworkPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "default"},
+			Spec: anpv1alpha1.BaselineAdminNetworkPolicySpec{
+				Subject: tenantSubject(),
+				Egress: []anpv1alpha1.BaselineAdminNetworkPolicyEgressRule{
+					{
+						Action: anpv1alpha1.BaselineAdminNetworkPolicyRuleActionDeny,
+						To:     []anpv1alpha1.AdminNetworkPolicyEgressPeer{{Namespaces: allNamespaces}},
+					},
+				},
+			},
+		},
+		{
+			// Only the singleton named "default" is honored.
+			ObjectMeta: metav1.ObjectMeta{Name: "ignored"},
+			Spec: anpv1alpha1.BaselineAdminNetworkPolicySpec{
+				Subject: tenantSubject(),
+				Ingress: []anpv1alpha1.BaselineAdminNetworkPolicyIngressRule{
+					{
+						Action: anpv1alpha1.BaselineAdminNetworkPolicyRuleActionDeny,
+						From:   []anpv1alpha1.AdminNetworkPolicyIngressPeer{{Namespaces: allNamespaces}},
+					},
+				},
+			},
+		},
+	})
+
+	rules, err := c.generateAdminPolicyRules(ctx)
+	require.NoError(t, err)
+
+	require.Len(t, rules, 1)
+	assert.Equal(t, "baseline", rules[0].Tier)
+	assert.Equal(t, "egress", rules[0].Direction)
+	assert.Equal(t, "deny", rules[0].Action)
+	assert.Len(t, rules[0].AllowedIPs, 4)
+}
+
+func TestCanonicalizeRulesTierOrder(t *testing.T) {
+	rules := []firewall.NetworkPolicyRule{
+		{Tier: "baseline", Direction: "ingress", Action: "deny"},
+		{Direction: "ingress", Action: "allow"},
+		{Tier: "admin", Priority: 1, Direction: "ingress", Action: "allow"},
+		{Tier: "admin", Priority: 0, Direction: "ingress", Action: "deny"},
+	}
+	canonicalizeRules(rules)
+
+	assert.Equal(t, "admin", rules[0].Tier)
+	assert.Equal(t, 0, rules[0].Priority)
+	assert.Equal(t, "admin", rules[1].Tier)
+	assert.Equal(t, 1, rules[1].Priority)
+	assert.Equal(t, "", rules[2].Tier)
+	assert.Equal(t, "baseline", rules[3].Tier)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/config"
 	"github.com/tibordp/wigglenet/internal/firewall"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
@@ -46,7 +47,7 @@ func TestControllerEndToEndWithFakeClientset(t *testing.T) {
 	client := fake.NewSimpleClientset(pod, ns, np)
 	updates := make(chan []firewall.NetworkPolicyRule, 8)
 
-	ctrl, err := NewController(client, updates)
+	ctrl, err := NewController(config.Default(), client, nil, updates)
 	require.NoError(t, err)
 
 	go ctrl.Run(ctx)
@@ -3,11 +3,15 @@ package networkpolicy
 import (
 	"context"
 	"fmt"
+	"maps"
 	"net/netip"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/tibordp/wigglenet/internal/annotation"
 	"github.com/tibordp/wigglenet/internal/config"
 	"github.com/tibordp/wigglenet/internal/firewall"
 	"github.com/tibordp/wigglenet/internal/metrics"
@@ -18,6 +22,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/runtime"
@@ -28,12 +33,23 @@ import (
 	networkinglisters "k8s.io/client-go/listers/networking/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
+
+	anpclient "sigs.k8s.io/network-policy-api/pkg/client/clientset/versioned"
+	anpinformers "sigs.k8s.io/network-policy-api/pkg/client/informers/externalversions"
+	anplisters "sigs.k8s.io/network-policy-api/pkg/client/listers/apis/v1alpha1"
 )
 
 type Controller interface {
 	Run(ctx context.Context)
+	// Reconfigure switches to the live settings of a reloaded configuration,
+	// i.e. the default audit mode.
+	Reconfigure(cfg *config.Config)
+	firewall.PodResolver
 }
 
+// podIPIndex indexes pods by their IPs, for looking up pods in logged packets
+const podIPIndex = "podIP"
+
 // ContainerPort mirrors a relevant subset of v1.ContainerPort for named-port resolution.
 type ContainerPort struct {
 	Name          string
@@ -51,19 +67,39 @@ type PodInfo struct {
 type controller struct {
 	policyUpdates chan []firewall.NetworkPolicyRule
 
+	nodeName         string
+	defaultAuditMode atomic.Bool
+	enableMetrics    bool
+
 	factory      informers.SharedInformerFactory
 	netpolLister networkinglisters.NetworkPolicyLister
 	podLister    corelisters.PodLister
+	podIndexer   cache.Indexer
 	nsLister     corelisters.NamespaceLister
 
+	// Informer for the pods on this node, nil if the node name is not set
+	localFactory   informers.SharedInformerFactory
+	localPodLister corelisters.PodLister
+
+	// AdminNetworkPolicy informers, nil unless ANP support is enabled. Nodes
+	// are only watched for the nodes peers of AdminNetworkPolicies.
+	anpFactory anpinformers.SharedInformerFactory
+	anpLister  anplisters.AdminNetworkPolicyLister
+	banpLister anplisters.BaselineAdminNetworkPolicyLister
+	nodeLister corelisters.NodeLister
+
 	queue workqueue.TypedRateLimitingInterface[string]
 
 	// Current state
-	pods       map[netip.Addr]PodInfo       // podIP -> PodInfo
-	namespaces map[string]map[string]string // namespace -> labels
+	pods            map[netip.Addr]PodInfo       // podIP -> PodInfo
+	namespaces      map[string]map[string]string // namespace -> labels
+	auditNamespaces map[string]bool              // namespace -> audit mode, for annotated namespaces
+	localPods       map[netip.Addr]bool          // IPs of pods on this node, nil if not scoped
 }
 
-func NewController(clientset kubernetes.Interface, policyUpdates chan []firewall.NetworkPolicyRule) (Controller, error) {
+// NewController creates the NetworkPolicy controller. anpClientset is optional;
+// if it is nil, AdminNetworkPolicy and BaselineAdminNetworkPolicy are not watched.
+func NewController(cfg *config.Config, clientset kubernetes.Interface, anpClientset anpclient.Interface, policyUpdates chan []firewall.NetworkPolicyRule) (Controller, error) {
 	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithTransform(util.StripManagedFields))
 
 	netpols := factory.Networking().V1().NetworkPolicies()
@@ -82,29 +118,96 @@ func NewController(clientset kubernetes.Interface, policyUpdates chan []firewall
 		}
 	}
 
-	for _, reg := range []struct {
+	type registration struct {
 		informer cache.SharedIndexInformer
 		key      string
-	}{
+	}
+	if err := pods.Informer().AddIndexers(cache.Indexers{podIPIndex: podIPIndexFunc}); err != nil {
+		return nil, fmt.Errorf("adding pod IP index: %w", err)
+	}
+
+	registrations := []registration{
 		{netpols.Informer(), "networkpolicy"},
 		{pods.Informer(), "pod"},
 		{namespaces.Informer(), "namespace"},
-	} {
-		if _, err := reg.informer.AddEventHandler(enqueueOn(reg.key)); err != nil {
-			return nil, fmt.Errorf("registering %s event handler: %w", reg.key, err)
-		}
 	}
 
-	return &controller{
+	c := &controller{
 		policyUpdates: policyUpdates,
+		nodeName:      cfg.NodeName,
+		enableMetrics: cfg.Metrics.Enabled,
 		factory:       factory,
 		netpolLister:  netpols.Lister(),
 		podLister:     pods.Lister(),
+		podIndexer:    pods.Informer().GetIndexer(),
 		nsLister:      namespaces.Lister(),
 		queue:         queue,
 		pods:          make(map[netip.Addr]PodInfo),
 		namespaces:    make(map[string]map[string]string),
-	}, nil
+	}
+
+	c.defaultAuditMode.Store(cfg.NetworkPolicy.AuditMode)
+
+	if anpClientset != nil {
+		c.anpFactory = anpinformers.NewSharedInformerFactory(anpClientset, 0)
+		anps := c.anpFactory.Policy().V1alpha1().AdminNetworkPolicies()
+		banps := c.anpFactory.Policy().V1alpha1().BaselineAdminNetworkPolicies()
+		nodes := factory.Core().V1().Nodes()
+		c.anpLister = anps.Lister()
+		c.banpLister = banps.Lister()
+		c.nodeLister = nodes.Lister()
+
+		// The generated informer factory predates WithTransform, so set the
+		// transform on the informers directly.
+		for _, informer := range []cache.SharedIndexInformer{anps.Informer(), banps.Informer()} {
+			if err := informer.SetTransform(util.StripManagedFields); err != nil {
+				return nil, fmt.Errorf("setting informer transform: %w", err)
+			}
+		}
+
+		registrations = append(registrations,
+			registration{anps.Informer(), "adminnetworkpolicy"},
+			registration{banps.Informer(), "baselineadminnetworkpolicy"},
+		)
+
+		// Node status is updated all the time, only the labels and addresses
+		// matter for the nodes peers.
+		if _, err := nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { queue.Add("node") },
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNode, newNode := oldObj.(*v1.Node), newObj.(*v1.Node)
+				if !maps.Equal(oldNode.Labels, newNode.Labels) || !slices.Equal(oldNode.Status.Addresses, newNode.Status.Addresses) {
+					queue.Add("node")
+				}
+			},
+			DeleteFunc: func(interface{}) { queue.Add("node") },
+		}); err != nil {
+			return nil, fmt.Errorf("registering node event handler: %w", err)
+		}
+	}
+
+	// Policy is enforced in the FORWARD hook of the node hosting the pod, so
+	// rules are only generated for the pods on this node. The cluster-wide pod
+	// informer is still needed to resolve peers.
+	if c.nodeName != "" {
+		c.localFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+			informers.WithTransform(util.StripManagedFields),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", c.nodeName).String()
+			}))
+		localPods := c.localFactory.Core().V1().Pods()
+		c.localPodLister = localPods.Lister()
+
+		registrations = append(registrations, registration{localPods.Informer(), "pod"})
+	}
+
+	for _, reg := range registrations {
+		if _, err := reg.informer.AddEventHandler(enqueueOn(reg.key)); err != nil {
+			return nil, fmt.Errorf("registering %s event handler: %w", reg.key, err)
+		}
+	}
+
+	return c, nil
 }
 
 func (c *controller) Run(ctx context.Context) {
@@ -120,6 +223,24 @@ func (c *controller) Run(ctx context.Context) {
 		return
 	}
 
+	if c.localFactory != nil {
+		c.localFactory.StartWithContext(ctx)
+		if err := c.localFactory.WaitForCacheSyncWithContext(ctx).AsError(); err != nil {
+			runtime.HandleErrorWithContext(ctx, err, "timed out waiting for caches to sync")
+			return
+		}
+	}
+
+	if c.anpFactory != nil {
+		c.anpFactory.Start(ctx.Done())
+		for informerType, synced := range c.anpFactory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				runtime.HandleErrorWithContext(ctx, fmt.Errorf("cache for %v not synced", informerType), "timed out waiting for caches to sync")
+				return
+			}
+		}
+	}
+
 	// Initial sync
 	if err := c.syncState(ctx); err != nil {
 		runtime.HandleErrorWithContext(ctx, err, "initial NetworkPolicy sync failed")
@@ -131,6 +252,12 @@ func (c *controller) Run(ctx context.Context) {
 	logger.Info("finished NetworkPolicy controller")
 }
 
+func (c *controller) Reconfigure(cfg *config.Config) {
+	if c.defaultAuditMode.Swap(cfg.NetworkPolicy.AuditMode) != cfg.NetworkPolicy.AuditMode {
+		c.queue.Add("config")
+	}
+}
+
 func (c *controller) runWorker(ctx context.Context) {
 	for c.processNextItem(ctx) {
 	}
@@ -169,7 +296,7 @@ func (c *controller) syncState(ctx context.Context) error {
 		return err
 	}
 
-	if config.EnableMetrics {
+	if c.enableMetrics {
 		ingressCount := 0
 		egressCount := 0
 		for _, r := range policyRules {
@@ -217,39 +344,106 @@ func (c *controller) updatePodsMap() error {
 			}
 		}
 
-		// Handle dual-stack: read all pod IPs from status.podIPs
-		for _, podIPStatus := range pod.Status.PodIPs {
-			if podIPStatus.IP != "" {
-				if addr, err := netip.ParseAddr(podIPStatus.IP); err == nil {
-					newPods[addr] = PodInfo{
-						IP:             addr,
-						Namespace:      pod.Namespace,
-						Labels:         pod.Labels,
-						ContainerPorts: cPorts,
-					}
-				}
+		for _, addr := range podIPs(pod) {
+			newPods[addr] = PodInfo{
+				IP:             addr,
+				Namespace:      pod.Namespace,
+				Labels:         pod.Labels,
+				ContainerPorts: cPorts,
 			}
 		}
+	}
 
-		// Fallback to status.podIP for compatibility
-		if pod.Status.PodIP != "" {
-			if addr, err := netip.ParseAddr(pod.Status.PodIP); err == nil {
-				if _, exists := newPods[addr]; !exists {
-					newPods[addr] = PodInfo{
-						IP:             addr,
-						Namespace:      pod.Namespace,
-						Labels:         pod.Labels,
-						ContainerPorts: cPorts,
-					}
-				}
+	var newLocalPods map[netip.Addr]bool
+	if c.localPodLister != nil {
+		localPodList, err := c.localPodLister.List(labels.Everything())
+		if err != nil {
+			return err
+		}
+
+		newLocalPods = make(map[netip.Addr]bool)
+		for _, pod := range localPodList {
+			if pod.Status.Phase != v1.PodRunning || pod.Spec.NodeName != c.nodeName {
+				continue
+			}
+			for _, addr := range podIPs(pod) {
+				newLocalPods[addr] = true
 			}
 		}
 	}
 
 	c.pods = newPods
+	c.localPods = newLocalPods
 	return nil
 }
 
+// podIPs returns all IPs of a pod, handling dual-stack pods.
+func podIPs(pod *v1.Pod) []netip.Addr {
+	var addrs []netip.Addr
+
+	// Handle dual-stack: read all pod IPs from status.podIPs
+	for _, podIPStatus := range pod.Status.PodIPs {
+		if podIPStatus.IP != "" {
+			if addr, err := netip.ParseAddr(podIPStatus.IP); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	// Fallback to status.podIP for compatibility
+	if pod.Status.PodIP != "" {
+		if addr, err := netip.ParseAddr(pod.Status.PodIP); err == nil && !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// podIPIndexFunc indexes pods by IP. Host network pods share the node's IP, so
+// they are left out.
+func podIPIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Spec.HostNetwork {
+		return nil, nil
+	}
+	var keys []string
+	for _, addr := range podIPs(pod) {
+		keys = append(keys, addr.String())
+	}
+	return keys, nil
+}
+
+// PodName returns the "namespace/name" of the pod with the given IP. It is safe
+// to call concurrently with the controller.
+func (c *controller) PodName(addr netip.Addr) (string, bool) {
+	objs, err := c.podIndexer.ByIndex(podIPIndex, addr.String())
+	if err != nil || len(objs) == 0 {
+		return "", false
+	}
+
+	// IPs of terminated pods may already be reused, prefer the running pod
+	pod := objs[0].(*v1.Pod)
+	for _, obj := range objs {
+		if p := obj.(*v1.Pod); p.Status.Phase == v1.PodRunning {
+			pod = p
+			break
+		}
+	}
+	return pod.Namespace + "/" + pod.Name, true
+}
+
+// localOnly filters pods down to those running on this node. Without a node
+// name to scope to, all pods are considered local.
+func (c *controller) localOnly(pods []PodInfo) []PodInfo {
+	if c.localPods == nil {
+		return pods
+	}
+	return slices.DeleteFunc(pods, func(pod PodInfo) bool {
+		return !c.localPods[pod.IP]
+	})
+}
+
 func (c *controller) updateNamespacesMap() error {
 	nsList, err := c.nsLister.List(labels.Everything())
 	if err != nil {
@@ -257,14 +451,30 @@ func (c *controller) updateNamespacesMap() error {
 	}
 
 	newNamespaces := make(map[string]map[string]string)
+	newAuditNamespaces := make(map[string]bool)
 	for _, ns := range nsList {
 		newNamespaces[ns.Name] = ns.Labels
+		if val, ok := ns.Annotations[annotation.NetpolAuditAnnotation]; ok {
+			if audit, err := strconv.ParseBool(val); err == nil {
+				newAuditNamespaces[ns.Name] = audit
+			}
+		}
 	}
 
 	c.namespaces = newNamespaces
+	c.auditNamespaces = newAuditNamespaces
 	return nil
 }
 
+// auditMode reports whether the policies in a namespace only log the traffic
+// they would drop.
+func (c *controller) auditMode(namespace string) bool {
+	if audit, ok := c.auditNamespaces[namespace]; ok {
+		return audit
+	}
+	return c.defaultAuditMode.Load()
+}
+
 func (c *controller) generatePolicyRules(ctx context.Context) ([]firewall.NetworkPolicyRule, error) {
 	netpols, err := c.netpolLister.List(labels.Everything())
 	if err != nil {
@@ -273,13 +483,17 @@ func (c *controller) generatePolicyRules(ctx context.Context) ([]firewall.Networ
 
 	var rules []firewall.NetworkPolicyRule
 
-	// Track which pods are affected by policies (by direction)
-	affectedPodsIngress := make(map[netip.Addr]bool) // podIP -> true
-	affectedPodsEgress := make(map[netip.Addr]bool)  // podIP -> true
-
 	for _, netpol := range netpols {
-		// Find pods that this policy applies to
-		selectedPods := c.selectPods(ctx, netpol.Namespace, netpol.Spec.PodSelector)
+		policy := netpol.Namespace + "/" + netpol.Name
+
+		// Traffic to and from isolated pods is either dropped, or only logged
+		isolation := "deny"
+		if c.auditMode(netpol.Namespace) {
+			isolation = "audit"
+		}
+
+		// Find pods on this node that this policy applies to
+		selectedPods := c.localOnly(c.selectPods(ctx, netpol.Namespace, netpol.Spec.PodSelector))
 
 		// Check if this policy affects ingress traffic
 		hasIngressPolicy := false
@@ -301,15 +515,16 @@ func (c *controller) generatePolicyRules(ctx context.Context) ([]firewall.Networ
 
 		// Process ingress rules (if policy type is Ingress)
 		if hasIngressPolicy {
-			// Mark these pods as affected by ingress policies
-			for _, pod := range selectedPods {
-				affectedPodsIngress[pod.IP] = true
+			// The selected pods are isolated for ingress
+			if deny := isolationRule(selectedPods, "ingress", policy, isolation); deny != nil {
+				rules = append(rules, *deny)
 			}
 
 			// Generate allow rules for each ingress rule (if any)
 			for _, ingressRule := range netpol.Spec.Ingress {
 				rule := c.buildIngressRule(ctx, selectedPods, ingressRule, netpol.Namespace)
 				if rule != nil {
+					rule.Policy = policy
 					rules = append(rules, *rule)
 				}
 			}
@@ -317,42 +532,34 @@ func (c *controller) generatePolicyRules(ctx context.Context) ([]firewall.Networ
 
 		// Process egress rules (if policy type is Egress)
 		if hasEgressPolicy {
-			// Mark these pods as affected by egress policies
-			for _, pod := range selectedPods {
-				affectedPodsEgress[pod.IP] = true
+			// The selected pods are isolated for egress
+			if deny := isolationRule(selectedPods, "egress", policy, isolation); deny != nil {
+				rules = append(rules, *deny)
 			}
 
 			// Generate allow rules for each egress rule (if any)
 			for _, egressRule := range netpol.Spec.Egress {
 				rule := c.buildEgressRule(ctx, selectedPods, egressRule, netpol.Namespace)
 				if rule != nil {
+					rule.Policy = policy
 					rules = append(rules, *rule)
 				}
 			}
 		}
 	}
 
-	// Generate default deny rules for affected pods
-	for podIP := range affectedPodsIngress {
-		rules = append(rules, firewall.NetworkPolicyRule{
-			Direction: "ingress",
-			PodIPs:    []netip.Addr{podIP},
-			Action:    "deny",
-		})
-	}
-
-	for podIP := range affectedPodsEgress {
-		rules = append(rules, firewall.NetworkPolicyRule{
-			Direction: "egress",
-			PodIPs:    []netip.Addr{podIP},
-			Action:    "deny",
-		})
+	if c.anpLister != nil {
+		adminRules, err := c.generateAdminPolicyRules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, adminRules...)
 	}
 
-	// The rules above are assembled by iterating maps (pods, namespaces, the
-	// affected-pod sets), whose order is randomized in Go. Without canonicalizing,
-	// the generated slice would differ run-to-run for identical cluster state, so
-	// the firewall manager's reflect.DeepEqual change detection would fire on
+	// The rules above are assembled by iterating maps (pods, namespaces),
+	// whose order is randomized in Go. Without canonicalizing, the generated
+	// slice would differ run-to-run for identical cluster state, so the
+	// firewall manager's reflect.DeepEqual change detection would fire on
 	// every pod/namespace event and rewrite the entire ruleset. Sort into a
 	// stable order so equivalent state compares equal.
 	canonicalizeRules(rules)
@@ -360,6 +567,25 @@ func (c *controller) generatePolicyRules(ctx context.Context) ([]firewall.Networ
 	return rules, nil
 }
 
+// isolationRule builds the default deny (or audit) rule for the pods selected by
+// a policy in the given direction, or nil if no pods are selected.
+func isolationRule(selectedPods []PodInfo, direction string, policy string, action string) *firewall.NetworkPolicyRule {
+	if len(selectedPods) == 0 {
+		return nil
+	}
+
+	rule := &firewall.NetworkPolicyRule{
+		Direction: direction,
+		PodIPs:    make([]netip.Addr, 0, len(selectedPods)),
+		Action:    action,
+		Policy:    policy,
+	}
+	for _, pod := range selectedPods {
+		rule.PodIPs = append(rule.PodIPs, pod.IP)
+	}
+	return rule
+}
+
 // canonicalizeRules sorts a slice of NetworkPolicyRule (and the slices within
 // each rule) into a deterministic order, so that identical logical state always
 // produces a deep-equal result regardless of map iteration order.
@@ -382,19 +608,45 @@ func canonicalizeRules(rules []firewall.NetworkPolicyRule) {
 		})
 	}
 
+	// Admin and baseline tier rules are order-sensitive, so sort by tier and
+	// priority first; the content key only orders rules that are otherwise equal.
 	slices.SortFunc(rules, func(a, b firewall.NetworkPolicyRule) int {
+		if c := tierRank(a.Tier) - tierRank(b.Tier); c != 0 {
+			return c
+		}
+		if c := a.Priority - b.Priority; c != 0 {
+			return c
+		}
 		return strings.Compare(ruleSortKey(a), ruleSortKey(b))
 	})
 }
 
+// tierRank orders tiers by evaluation order.
+func tierRank(tier string) int {
+	switch tier {
+	case "admin":
+		return 0
+	case "baseline":
+		return 2
+	default:
+		return 1
+	}
+}
+
 // ruleSortKey builds a stable string key capturing every field of a rule. It
 // assumes the rule's inner slices have already been sorted.
 func ruleSortKey(r firewall.NetworkPolicyRule) string {
 	var sb strings.Builder
+	sb.WriteString(r.Tier)
+	sb.WriteByte('|')
+	sb.WriteString(strconv.Itoa(r.Priority))
+	sb.WriteByte('|')
 	sb.WriteString(r.Direction)
 	sb.WriteByte('|')
 	sb.WriteString(r.Action)
 	sb.WriteByte('|')
+	sb.WriteString(r.Policy)
+	sb.WriteByte('|')
 	for _, ip := range r.PodIPs {
 		sb.WriteString(ip.String())
 		sb.WriteByte(',')
@@ -5,11 +5,13 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/annotation"
 	"github.com/tibordp/wigglenet/internal/firewall"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	networkinglisters "k8s.io/client-go/listers/networking/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2/ktesting"
@@ -315,8 +317,8 @@ func TestGeneratePolicyRulesWithDefaultDeny(t *testing.T) {
 	// Should have 2 allow rules (ingress + egress)
 	assert.Len(t, allowRules, 2)
 
-	// Should have 4 deny rules (2 pods × 2 directions, covering both IPv4 and IPv6)
-	assert.Len(t, denyRules, 4)
+	// Should have 2 deny rules (one per direction, each covering both IPv4 and IPv6)
+	assert.Len(t, denyRules, 2)
 
 	// Check that we have deny rules for both pods and both directions
 	podIPsWithIngressDeny := make(map[netip.Addr]bool)
@@ -324,6 +326,7 @@ func TestGeneratePolicyRulesWithDefaultDeny(t *testing.T) {
 
 	for _, rule := range denyRules {
 		assert.Equal(t, "deny", rule.Action)
+		assert.Equal(t, "default/web-netpol", rule.Policy)
 		for _, podIP := range rule.PodIPs {
 			if rule.Direction == "ingress" {
 				podIPsWithIngressDeny[podIP] = true
@@ -456,6 +459,206 @@ func TestProcessNetworkPolicyPeerIPBlockExcept(t *testing.T) {
 	assert.False(t, found5, "10.0.5.1 should NOT be in the allowed CIDRs (excepted)")
 }
 
+func TestGeneratePolicyRulesLocalPodsOnly(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	c := &controller{
+		pods: map[netip.Addr]PodInfo{
+			netip.MustParseAddr("10.0.0.1"): {
+				IP:        netip.MustParseAddr("10.0.0.1"),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "web"},
+			},
+			netip.MustParseAddr("10.0.1.1"): {
+				IP:        netip.MustParseAddr("10.0.1.1"),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "web"},
+			},
+			netip.MustParseAddr("10.0.1.2"): {
+				IP:        netip.MustParseAddr("10.0.1.2"),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "backend"},
+			},
+		},
+		namespaces: map[string]map[string]string{
+			"default": {},
+		},
+		localPods: map[netip.Addr]bool{
+			netip.MustParseAddr("10.0.0.1"): true,
+		},
+		netpolLister: newNetpolLister(
+			&networkingv1.NetworkPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-netpol", Namespace: "default"},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							From: []networkingv1.NetworkPolicyPeer{
+								{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}}},
+							},
+						},
+					},
+				},
+			},
+			&networkingv1.NetworkPolicy{
+				// Only selects remote pods, so it contributes no rules
+				ObjectMeta: metav1.ObjectMeta{Name: "backend-netpol", Namespace: "default"},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}},
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				},
+			},
+		),
+	}
+
+	rules, err := c.generatePolicyRules(ctx)
+	assert.NoError(t, err)
+
+	// Only the local pod is selected, but peers are resolved cluster-wide
+	assert.Equal(t, []firewall.NetworkPolicyRule{
+		{
+			Direction:  "ingress",
+			Action:     "allow",
+			Policy:     "default/web-netpol",
+			PodIPs:     []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			AllowedIPs: []netip.Addr{netip.MustParseAddr("10.0.1.2")},
+		},
+		{
+			Direction: "ingress",
+			Action:    "deny",
+			Policy:    "default/web-netpol",
+			PodIPs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		},
+	}, rules)
+}
+
+func TestUpdatePodsMapLocalPods(t *testing.T) {
+	newPod := func(name, node, ip string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: node},
+			Status: v1.PodStatus{
+				Phase:  v1.PodRunning,
+				PodIPs: []v1.PodIP{{IP: ip}},
+			},
+		}
+	}
+	local := newPod("local", "node-a", "10.0.0.1")
+	remote := newPod("remote", "node-b", "10.0.1.1")
+
+	c := &controller{
+		nodeName:       "node-a",
+		podLister:      newPodLister(local, remote),
+		localPodLister: newPodLister(local),
+	}
+	assert.NoError(t, c.updatePodsMap())
+
+	assert.Len(t, c.pods, 2)
+	assert.Equal(t, map[netip.Addr]bool{netip.MustParseAddr("10.0.0.1"): true}, c.localPods)
+
+	// Without a local pod lister, every pod is considered local
+	c.localPodLister = nil
+	assert.NoError(t, c.updatePodsMap())
+	assert.Nil(t, c.localPods)
+	assert.Len(t, c.localOnly([]PodInfo{{IP: netip.MustParseAddr("10.0.1.1")}}), 1)
+}
+
+func TestGeneratePolicyRulesAuditMode(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	nsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range []*v1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "audited", Annotations: map[string]string{annotation.NetpolAuditAnnotation: "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "enforced", Annotations: map[string]string{annotation.NetpolAuditAnnotation: "false"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	} {
+		_ = nsIndexer.Add(ns)
+	}
+
+	c := &controller{
+		nsLister: corelisters.NewNamespaceLister(nsIndexer),
+		pods: map[netip.Addr]PodInfo{
+			netip.MustParseAddr("10.0.0.1"): {IP: netip.MustParseAddr("10.0.0.1"), Namespace: "audited"},
+			netip.MustParseAddr("10.0.0.2"): {IP: netip.MustParseAddr("10.0.0.2"), Namespace: "enforced"},
+			netip.MustParseAddr("10.0.0.3"): {IP: netip.MustParseAddr("10.0.0.3"), Namespace: "default"},
+		},
+	}
+	var netpols []*networkingv1.NetworkPolicy
+	for _, ns := range []string{"audited", "enforced", "default"} {
+		netpols = append(netpols, &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "deny-all", Namespace: ns},
+			Spec: networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			},
+		})
+	}
+	c.netpolLister = newNetpolLister(netpols...)
+	assert.NoError(t, c.updateNamespacesMap())
+
+	actions := func() map[string]string {
+		rules, err := c.generatePolicyRules(ctx)
+		assert.NoError(t, err)
+		result := make(map[string]string)
+		for _, rule := range rules {
+			result[rule.Policy] = rule.Action
+		}
+		return result
+	}
+
+	c.defaultAuditMode.Store(false)
+	assert.Equal(t, map[string]string{
+		"audited/deny-all":  "audit",
+		"enforced/deny-all": "deny",
+		"default/deny-all":  "deny",
+	}, actions())
+
+	// The annotation overrides the global setting in both directions
+	c.defaultAuditMode.Store(true)
+	assert.Equal(t, map[string]string{
+		"audited/deny-all":  "audit",
+		"enforced/deny-all": "deny",
+		"default/deny-all":  "audit",
+	}, actions())
+}
+
+func TestPodName(t *testing.T) {
+	newPod := func(name string, phase v1.PodPhase, hostNetwork bool) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       v1.PodSpec{HostNetwork: hostNetwork},
+			Status: v1.PodStatus{
+				Phase:  phase,
+				PodIPs: []v1.PodIP{{IP: "10.0.0.1"}},
+			},
+		}
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{podIPIndex: podIPIndexFunc})
+	for _, pod := range []*v1.Pod{
+		newPod("completed", v1.PodSucceeded, false),
+		newPod("running", v1.PodRunning, false),
+		newPod("host", v1.PodRunning, true),
+	} {
+		_ = indexer.Add(pod)
+	}
+	c := &controller{podIndexer: indexer}
+
+	name, ok := c.PodName(netip.MustParseAddr("10.0.0.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "default/running", name)
+
+	_, ok = c.PodName(netip.MustParseAddr("10.0.0.2"))
+	assert.False(t, ok)
+}
+
+func newPodLister(pods ...*v1.Pod) corelisters.PodLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pod := range pods {
+		_ = indexer.Add(pod)
+	}
+	return corelisters.NewPodLister(indexer)
+}
+
 // newNetpolLister builds a real NetworkPolicyLister backed by an in-memory
 // indexer, for tests that exercise generatePolicyRules.
 func newNetpolLister(netpols ...*networkingv1.NetworkPolicy) networkinglisters.NetworkPolicyLister {
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/networkpolicy"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	klog "k8s.io/klog/v2"
+	anpclient "sigs.k8s.io/network-policy-api/pkg/client/clientset/versioned"
+)
+
+// How often the configuration file is checked for changes. A ConfigMap update
+// takes a while to reach the mounted file anyway.
+const configPollInterval = 10 * time.Second
+
+// runReload reloads the configuration when the configuration file changes or
+// on SIGHUP, and hands the live settings over to the components. It also owns
+// the NetworkPolicy controller, which is started and stopped as NetworkPolicy
+// is turned on and off.
+func (c *wigglenet) runReload(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	c.netpol.start(ctx)
+	defer c.netpol.stop()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	current := c.config
+	contents := readConfigFile(c.configPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			logger.Info("reloading configuration on SIGHUP")
+		case <-ticker.C:
+			updated := readConfigFile(c.configPath)
+			if updated == nil || bytes.Equal(updated, contents) {
+				continue
+			}
+			logger.Info("configuration file changed, reloading", "path", c.configPath)
+		}
+
+		contents = readConfigFile(c.configPath)
+		current = c.reload(ctx, current)
+	}
+}
+
+// reload loads the configuration again and applies its live settings. It
+// returns the configuration in effect afterwards.
+func (c *wigglenet) reload(ctx context.Context, current *config.Config) *config.Config {
+	logger := klog.FromContext(ctx)
+
+	loaded, err := config.Load(c.configPath)
+	if err != nil {
+		logger.Error(err, "invalid configuration, keeping the current one")
+		return current
+	}
+
+	next, restart := config.Reload(current, loaded)
+	if len(restart) > 0 {
+		logger.Info("some settings cannot be changed without a restart, keeping their current values", "settings", restart)
+	}
+	if reflect.DeepEqual(next, current) {
+		logger.Info("no settings to change")
+		return current
+	}
+
+	logger.Info("applying new configuration")
+	c.firewallManager.Reconfigure(next)
+	c.controller.Reconfigure(next)
+	if err := c.netpol.reconfigure(ctx, next); err != nil {
+		logger.Error(err, "failed to restart NetworkPolicy controller")
+	}
+	return next
+}
+
+// readConfigFile returns the contents of the configuration file, or nil if
+// there is none or it cannot be read.
+func readConfigFile(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// netpolRunner runs the NetworkPolicy controller while NetworkPolicy is
+// enabled. It also resolves pods for the firewall's drop logs with the
+// controller that is currently running.
+type netpolRunner struct {
+	kubeconfig    *rest.Config
+	clientset     kubernetes.Interface
+	policyUpdates chan []firewall.NetworkPolicyRule
+
+	config *config.Config
+	// The controller to start, created ahead of time so that New can fail
+	next networkpolicy.Controller
+
+	mu      sync.RWMutex
+	current networkpolicy.Controller
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newNetpolRunner(kubeconfig *rest.Config, clientset kubernetes.Interface, policyUpdates chan []firewall.NetworkPolicyRule, cfg *config.Config) (*netpolRunner, error) {
+	r := &netpolRunner{
+		kubeconfig:    kubeconfig,
+		clientset:     clientset,
+		policyUpdates: policyUpdates,
+		config:        cfg,
+	}
+	if cfg.NetworkPolicy.Enabled {
+		var err error
+		if r.next, err = r.newController(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *netpolRunner) newController(cfg *config.Config) (networkpolicy.Controller, error) {
+	var anpClientset anpclient.Interface
+	if cfg.NetworkPolicy.AdminNetworkPolicy {
+		var err error
+		if anpClientset, err = anpclient.NewForConfig(r.kubeconfig); err != nil {
+			return nil, err
+		}
+	}
+	return networkpolicy.NewController(cfg, r.clientset, anpClientset, r.policyUpdates)
+}
+
+// start runs the controller that was created last, if any.
+func (r *netpolRunner) start(ctx context.Context) {
+	ctrl := r.next
+	if ctrl == nil {
+		return
+	}
+	r.next = nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctrl.Run(ctx)
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current, r.cancel, r.done = ctrl, cancel, done
+}
+
+// stop stops the running controller and waits for it to finish.
+func (r *netpolRunner) stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.current, r.cancel, r.done = nil, nil, nil
+	r.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// reconfigure starts, stops or restarts the controller if NetworkPolicy or
+// the AdminNetworkPolicy support was turned on or off, and passes the other
+// settings on to the running controller.
+func (r *netpolRunner) reconfigure(ctx context.Context, cfg *config.Config) error {
+	current, next := r.config.NetworkPolicy, cfg.NetworkPolicy
+	if next.Enabled == current.Enabled && (!next.Enabled || next.AdminNetworkPolicy == current.AdminNetworkPolicy) {
+		r.config = cfg
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if r.current != nil {
+			r.current.Reconfigure(cfg)
+		}
+		return nil
+	}
+
+	logger := klog.FromContext(ctx)
+	if current.Enabled {
+		logger.Info("stopping NetworkPolicy controller")
+		r.stop()
+	}
+	if !next.Enabled {
+		r.config = cfg
+		return nil
+	}
+
+	ctrl, err := r.newController(cfg)
+	if err != nil {
+		// Not running, so that the next reload tries again
+		stopped := *cfg
+		stopped.NetworkPolicy = config.NetworkPolicy{}
+		r.config = &stopped
+		return err
+	}
+	r.config, r.next = cfg, ctrl
+	r.start(ctx)
+	return nil
+}
+
+func (r *netpolRunner) PodName(addr netip.Addr) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.current == nil {
+		return "", false
+	}
+	return r.current.PodName(addr)
+}
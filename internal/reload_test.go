@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/firewall"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestNetpolRunnerReconfigure(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var policies atomic.Pointer[[]firewall.NetworkPolicyRule]
+	policyUpdates := make(chan []firewall.NetworkPolicyRule)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case rules := <-policyUpdates:
+				policies.Store(&rules)
+			}
+		}
+	}()
+	// The action of the rule that isolates the pod
+	action := func() string {
+		if rules := policies.Load(); rules != nil {
+			for _, rule := range *rules {
+				if rule.Policy == "default/deny-all" {
+					return rule.Action
+				}
+			}
+		}
+		return ""
+	}
+
+	withNetworkPolicy := func(netpol config.NetworkPolicy) *config.Config {
+		cfg := config.Default()
+		cfg.NetworkPolicy = netpol
+		return cfg
+	}
+
+	clientset := fake.NewClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+		},
+		&networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "deny-all", Namespace: "default"},
+			Spec:       networkingv1.NetworkPolicySpec{PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}},
+		},
+	)
+	r, err := newNetpolRunner(nil, clientset, policyUpdates, withNetworkPolicy(config.NetworkPolicy{}))
+	require.NoError(t, err)
+	r.start(ctx)
+	assert.Nil(t, r.current)
+
+	// Turning NetworkPolicy on starts the controller
+	require.NoError(t, r.reconfigure(ctx, withNetworkPolicy(config.NetworkPolicy{Enabled: true})))
+	assert.NotNil(t, r.current)
+	_, ok := r.PodName(netip.MustParseAddr("10.0.0.1"))
+	assert.False(t, ok)
+
+	// Other settings leave it running
+	current := r.current
+	require.NoError(t, r.reconfigure(ctx, withNetworkPolicy(config.NetworkPolicy{Enabled: true, Logging: true})))
+	assert.Same(t, current, r.current)
+
+	// The audit mode is switched without restarting the controller
+	assert.Eventually(t, func() bool { return action() == "deny" }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, r.reconfigure(ctx, withNetworkPolicy(config.NetworkPolicy{Enabled: true, Logging: true, AuditMode: true})))
+	assert.Same(t, current, r.current)
+	assert.Eventually(t, func() bool { return action() == "audit" }, 5*time.Second, 10*time.Millisecond)
+
+	// Turning it off stops the controller
+	require.NoError(t, r.reconfigure(ctx, withNetworkPolicy(config.NetworkPolicy{Logging: true})))
+	assert.Nil(t, r.current)
+	assert.Nil(t, r.done)
+}
@@ -0,0 +1,127 @@
+package routing
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync/atomic"
+
+	"github.com/tibordp/wigglenet/internal/util"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"k8s.io/klog/v2"
+)
+
+// RouteProtocol marks the routes installed by Wigglenet, so that stale routes
+// can be found and removed without touching routes owned by anyone else.
+const RouteProtocol netlink.RouteProtocol = 87
+
+// Route is a direct route to another node's pod CIDR over the underlay.
+type Route struct {
+	Dst     netip.Prefix
+	Gateway netip.Addr
+}
+
+type Manager interface {
+	// ApplyRoutes installs the given routes and removes all the other routes
+	// previously installed by Wigglenet.
+	ApplyRoutes(ctx context.Context, routes []Route, logger klog.Logger) error
+	// AppliedRoutes returns the last successfully applied routes, or nil.
+	AppliedRoutes() []Route
+}
+
+type routeManager struct {
+	lastAppliedRoutes atomic.Pointer[[]Route]
+}
+
+func NewManager() Manager {
+	return &routeManager{}
+}
+
+func (m *routeManager) AppliedRoutes() []Route {
+	if routes := m.lastAppliedRoutes.Load(); routes != nil {
+		return *routes
+	}
+	return nil
+}
+
+func (m *routeManager) ApplyRoutes(ctx context.Context, routes []Route, logger klog.Logger) error {
+	if last := m.lastAppliedRoutes.Load(); last != nil && reflect.DeepEqual(*last, routes) {
+		return nil
+	}
+
+	existingRoutes, err := netlink.RouteListFiltered(nl.FAMILY_ALL, &netlink.Route{Protocol: RouteProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+
+	redundant := make(map[Route]netlink.Route)
+	for _, route := range existingRoutes {
+		if route.Dst == nil {
+			continue
+		}
+		prefix, ok := util.PrefixFromIPNet(*route.Dst)
+		if !ok {
+			continue
+		}
+		gateway, _ := netip.AddrFromSlice(route.Gw)
+		redundant[Route{Dst: prefix, Gateway: gateway.Unmap()}] = route
+	}
+
+	missing := make([]netlink.Route, 0)
+	for _, route := range routes {
+		if _, ok := redundant[route]; ok {
+			delete(redundant, route)
+			continue
+		}
+
+		dst := util.PrefixToIPNet(route.Dst)
+		missing = append(missing, netlink.Route{
+			Dst:      &dst,
+			Gw:       net.IP(route.Gateway.AsSlice()),
+			Protocol: RouteProtocol,
+		})
+	}
+
+	// Remove first, so that a pod CIDR that moved to a different gateway can
+	// be added again
+	for _, v := range redundant {
+		logger.Info("removing route", "route", v)
+		if err := netlink.RouteDel(&v); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range missing {
+		logger.Info("adding route", "route", v)
+		// Replace, so that the route takes over from a tunnel route for a peer
+		// that is now routed natively
+		if err := netlink.RouteReplace(&v); err != nil {
+			return err
+		}
+	}
+
+	m.lastAppliedRoutes.Store(&routes)
+	return nil
+}
+
+// Cleanup removes all the routes installed by Wigglenet.
+func Cleanup(ctx context.Context) error {
+	return NewManager().ApplyRoutes(ctx, nil, klog.FromContext(ctx))
+}
+
+// OnLinkInterface returns the interface with an on-link prefix containing the
+// address, i.e. one the address can be reached at without a gateway.
+func OnLinkInterface(interfaces map[string][]netip.Prefix, addr netip.Addr) (string, bool) {
+	for _, name := range slices.Sorted(maps.Keys(interfaces)) {
+		for _, prefix := range interfaces[name] {
+			if prefix.Bits() < prefix.Addr().BitLen() && prefix.Contains(addr) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
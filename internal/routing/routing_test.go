@@ -0,0 +1,29 @@
+package routing
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnLinkInterface(t *testing.T) {
+	interfaces := map[string][]netip.Prefix{
+		"eth0": {netip.MustParsePrefix("192.168.0.10/24"), netip.MustParsePrefix("2001:db8::10/64")},
+		"eth1": {netip.MustParsePrefix("10.0.0.10/32")},
+	}
+
+	name, ok := OnLinkInterface(interfaces, netip.MustParseAddr("192.168.0.20"))
+	assert.True(t, ok)
+	assert.Equal(t, "eth0", name)
+
+	name, ok = OnLinkInterface(interfaces, netip.MustParseAddr("2001:db8::20"))
+	assert.True(t, ok)
+	assert.Equal(t, "eth0", name)
+
+	// Single-host prefixes do not count
+	_, ok = OnLinkInterface(interfaces, netip.MustParseAddr("10.0.0.10"))
+	assert.False(t, ok)
+	_, ok = OnLinkInterface(interfaces, netip.MustParseAddr("10.96.0.1"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,86 @@
+// Package netnstest runs tests in network namespaces of their own. The tests
+// are skipped if the namespaces cannot be created, e.g. when not running as
+// root.
+package netnstest
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netns"
+)
+
+// New creates a network namespace that is closed when the test ends. The
+// calling thread stays in its current namespace.
+func New(t *testing.T) netns.NsHandle {
+	t.Helper()
+
+	// netns.New switches the current thread to the new namespace
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatalf("getting the network namespace: %v", err)
+	}
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("cannot create a network namespace: %v", err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	if err := netns.Set(origin); err != nil {
+		// Locked once more, so that the thread, which is still in the
+		// namespace, exits with the test instead of being reused
+		runtime.LockOSThread()
+		t.Fatalf("switching back to the network namespace: %v", err)
+	}
+	return ns
+}
+
+// Enter moves the test into a new network namespace for as long as it runs.
+// Subtests and other goroutines stay in the original namespace, see Go.
+func Enter(t *testing.T) netns.NsHandle {
+	t.Helper()
+
+	// Namespaces are per thread
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("getting the network namespace: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("cannot create a network namespace: %v", err)
+	}
+
+	t.Cleanup(func() {
+		// A thread left in the namespace is not reused, it exits with the test
+		if err := netns.Set(origin); err == nil {
+			runtime.UnlockOSThread()
+		}
+		ns.Close()
+		origin.Close()
+	})
+	return ns
+}
+
+// Go runs f in a goroutine of its own in the network namespace. The returned
+// channel is closed when f returns, or right away if the goroutine cannot
+// switch to the namespace.
+func Go(ns netns.NsHandle, f func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Never unlocked, so that the thread exits with the goroutine
+		runtime.LockOSThread()
+		if err := netns.Set(ns); err != nil {
+			return
+		}
+		f()
+	}()
+	return done
+}
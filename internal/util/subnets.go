@@ -225,3 +225,13 @@ func SubtractPrefixes(base netip.Prefix, excepts []netip.Prefix) []netip.Prefix
 	}
 	return result
 }
+
+// PrefixCovered reports whether the prefix is contained in one of the prefixes.
+func PrefixCovered(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
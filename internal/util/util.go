@@ -2,13 +2,17 @@ package util
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/netip"
+	"os"
 	"slices"
 	"strings"
 
 	"github.com/tibordp/wigglenet/internal/annotation"
 	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 )
@@ -263,6 +267,65 @@ func GetInterfacePrefixes(ctx context.Context) (map[string][]netip.Prefix, error
 	return interfacePrefixesFrom(addrsByIface), nil
 }
 
+// routePrefixesFrom builds the routed prefix map from the routes and the names
+// of the links they go through. Like interfacePrefixesFrom, only global-unicast
+// destinations are kept, so the default route and link-local routes are left out.
+func routePrefixesFrom(routes []netlink.Route, linkNames map[int]string) map[string][]netip.Prefix {
+	result := make(map[string][]netip.Prefix)
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+		prefix, ok := PrefixFromIPNet(*route.Dst)
+		if !ok || !prefix.Addr().IsGlobalUnicast() {
+			continue
+		}
+		prefix = prefix.Masked()
+
+		// Routes without a link (e.g. unreachable routes) are under ""
+		links := []int{route.LinkIndex}
+		if len(route.MultiPath) > 0 {
+			links = links[:0]
+			for _, path := range route.MultiPath {
+				links = append(links, path.LinkIndex)
+			}
+		}
+		for _, link := range links {
+			name := linkNames[link]
+			if !slices.Contains(result[name], prefix) {
+				result[name] = append(result[name], prefix)
+			}
+		}
+	}
+
+	for name := range result {
+		slices.SortFunc(result[name], ComparePrefix)
+	}
+	return result
+}
+
+// GetRoutePrefixes returns the destinations of the routes in the main routing
+// table, keyed by the name of the interface they go through. Unlike
+// GetInterfacePrefixes, this includes prefixes that are routed to the host
+// rather than being on-link.
+func GetRoutePrefixes(ctx context.Context) (map[string][]netip.Prefix, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	linkNames := make(map[int]string, len(links))
+	for _, link := range links {
+		linkNames[link.Attrs().Index] = link.Attrs().Name
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	return routePrefixesFrom(routes, linkNames), nil
+}
+
 func GetNodeAddresses(node *v1.Node) []netip.Addr {
 	ipAddresses := make([]netip.Addr, 0)
 	for _, v := range node.Status.Addresses {
@@ -276,13 +339,40 @@ func GetNodeAddresses(node *v1.Node) []netip.Addr {
 }
 
 func SelectIP(ips []netip.Addr, family config.IPFamily) *netip.Addr {
+	if selected := SelectIPs(ips, family); len(selected) > 0 {
+		return &selected[0]
+	}
+
+	return nil
+}
+
+// SelectIPs returns all the addresses of the given family, in their original order.
+func SelectIPs(ips []netip.Addr, family config.IPFamily) []netip.Addr {
+	selected := make([]netip.Addr, 0)
 	for _, ip := range ips {
 		if ip.Is4() && (family == config.IPv4Family || family == config.DualStackFamily) {
-			return &ip
+			selected = append(selected, ip)
 		} else if ip.Is6() && (family == config.IPv6Family || family == config.DualStackFamily) {
-			return &ip
+			selected = append(selected, ip)
 		}
 	}
 
+	return selected
+}
+
+// RemoveFiles removes the files that exist, skipping the empty paths.
+func RemoveFiles(logger klog.Logger, paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		logger.Info("removed file", "path", path)
+	}
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
 )
 
 func TestAddrCompare(t *testing.T) {
@@ -73,3 +74,31 @@ func TestInterfacePrefixesFrom(t *testing.T) {
 	assert.Empty(t, got["lo"], "loopback should be dropped")
 	assert.Empty(t, got["eth1"], "non-IPNet addr should be dropped")
 }
+
+func TestRoutePrefixesFrom(t *testing.T) {
+	dst := func(cidr string) *net.IPNet {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		return ipNet
+	}
+
+	routes := []netlink.Route{
+		{LinkIndex: 2, Dst: dst("2001:db8:1::/56")},
+		{LinkIndex: 2, Dst: dst("10.0.0.0/24")},
+		{LinkIndex: 2, Dst: nil},              // default route: dropped
+		{LinkIndex: 2, Dst: dst("fe80::/64")}, // link-local: dropped
+		{LinkIndex: 2, Dst: dst("10.0.0.0/24")},
+		{Dst: dst("2001:db8:ffff::/48")}, // unreachable, no link
+		{Dst: dst("10.1.0.0/16"), MultiPath: []*netlink.NexthopInfo{{LinkIndex: 2}, {LinkIndex: 3}}},
+	}
+	linkNames := map[int]string{2: "eth0", 3: "eth1"}
+
+	got := routePrefixesFrom(routes, linkNames)
+
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("2001:db8:1::/56"),
+	}, got["eth0"])
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, got["eth1"])
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:ffff::/48")}, got[""])
+}
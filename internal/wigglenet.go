@@ -2,14 +2,21 @@ package internal
 
 import (
 	"context"
+	"net/http"
 	"net/netip"
+	"time"
 
+	"github.com/tibordp/wigglenet/internal/allocator"
+	"github.com/tibordp/wigglenet/internal/bgp"
 	"github.com/tibordp/wigglenet/internal/cni"
 	"github.com/tibordp/wigglenet/internal/config"
 	"github.com/tibordp/wigglenet/internal/controller"
+	"github.com/tibordp/wigglenet/internal/debug"
 	"github.com/tibordp/wigglenet/internal/firewall"
+	"github.com/tibordp/wigglenet/internal/health"
+	"github.com/tibordp/wigglenet/internal/ipam"
 	"github.com/tibordp/wigglenet/internal/metrics"
-	"github.com/tibordp/wigglenet/internal/networkpolicy"
+	"github.com/tibordp/wigglenet/internal/routing"
 	"github.com/tibordp/wigglenet/internal/wireguard"
 
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -25,7 +32,9 @@ type Wigglenet interface {
 	Run(ctx context.Context)
 }
 
-func New(ctx context.Context) (Wigglenet, error) {
+// New sets up Wigglenet with the configuration loaded from configPath. The
+// file is watched for changes of the settings that can be reloaded.
+func New(ctx context.Context, configPath string, cfg *config.Config) (Wigglenet, error) {
 	kubeconfig, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, err
@@ -38,73 +47,149 @@ func New(ctx context.Context) (Wigglenet, error) {
 
 	// Create separate channels for firewall manager
 	podCIDRUpdates := make(chan []netip.Prefix)
+	podCIDRExhausted := make(chan []netip.Prefix, 1)
 	policyUpdates := make(chan []firewall.NetworkPolicyRule)
-	firewallManager, err := firewall.New(podCIDRUpdates, policyUpdates)
+
+	// The NetworkPolicy controller runs while NetworkPolicy is enabled
+	netpol, err := newNetpolRunner(kubeconfig, clientset, policyUpdates, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := health.NewChecker(time.Duration(cfg.Health.SyncFailureTimeoutSeconds) * time.Second)
+	checker.Register(health.NodeInformerSynced, health.FirewallSynced)
+
+	firewallManager, err := firewall.New(cfg, checker, podCIDRUpdates, policyUpdates, netpol)
 	if err != nil {
 		return nil, err
 	}
 
+	speaker, err := newBGPSpeaker(cfg.BGP, cfg.Metrics.Enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	var podCIDRAllocator allocator.Allocator
+	if cfg.PodCIDR.Uses(config.SourceAllocator) {
+		podCIDRAllocator, err = allocator.NewAllocator(clientset, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ipamManager ipam.Manager
+	if !cfg.Routing.FirewallOnly && cfg.CNI.IPAMPlugin == config.IPAMWigglenet {
+		ipamManager, err = ipam.NewManager(clientset, cfg, podCIDRExhausted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var ctrl controller.Controller
 	var publicKey []byte
+	podCIDRStatus := &controller.PodCIDRStatus{}
+	debugSources := debug.Sources{Firewall: firewallManager, IPAM: ipamManager, PodCIDRs: podCIDRStatus}
 
-	if config.FirewallOnly {
-		ctrl, err = controller.NewController(clientset, nil, nil, podCIDRUpdates)
+	if cfg.Routing.FirewallOnly {
+		ctrl, err = controller.NewController(cfg, checker, clientset, nil, nil, speaker, nil, podCIDRUpdates, nil, podCIDRAllocator, podCIDRStatus, ipamManager)
 		if err != nil {
 			return nil, err
 		}
-	} else if config.NativeRouting {
-		cniwriter := cni.NewCNIConfigWriter()
-		ctrl, err = controller.NewController(clientset, nil, cniwriter, podCIDRUpdates)
+	} else if cfg.Routing.NativeRouting() {
+		cniwriter := cni.NewCNIConfigWriter(cfg)
+		debugSources.CNI = cniwriter
+		checker.Register(health.CNIWritten)
+		ctrl, err = controller.NewController(cfg, checker, clientset, nil, routing.NewManager(), speaker, cniwriter, podCIDRUpdates, podCIDRExhausted, podCIDRAllocator, podCIDRStatus, ipamManager)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		wg, err := wireguard.NewManager(ctx)
+		wg, err := wireguard.NewManager(ctx, cfg)
 		if err != nil {
 			return nil, err
 		}
 
-		cniwriter := cni.NewCNIConfigWriter()
-		ctrl, err = controller.NewController(clientset, wg, cniwriter, podCIDRUpdates)
+		cniwriter := cni.NewCNIConfigWriter(cfg)
+		debugSources.Wireguard = wg
+		debugSources.CNI = cniwriter
+		checker.Register(health.WireguardApplied, health.CNIWritten)
+		ctrl, err = controller.NewController(cfg, checker, clientset, wg, routing.NewManager(), speaker, cniwriter, podCIDRUpdates, podCIDRExhausted, podCIDRAllocator, podCIDRStatus, ipamManager)
 		if err != nil {
 			return nil, err
 		}
 		publicKey = wg.PublicKey()
 
-		if config.EnableMetrics {
+		if cfg.Metrics.Enabled {
 			metrics.RegisterWireGuardCollector(wg)
 		}
 	}
 
-	// Create NetworkPolicy controller if enabled
-	var netpolController networkpolicy.Controller
-	if config.EnableNetworkPolicy {
-		netpolController, err = networkpolicy.NewController(clientset, policyUpdates)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	if config.EnableMetrics {
-		metrics.SetBuildInfo(Version, string(config.FirewallBackendMode))
+	if cfg.Metrics.Enabled {
+		metrics.SetBuildInfo(Version, string(cfg.Firewall.Backend))
 	}
 
 	// Populate the node annotations
-	if err = controller.SetupNode(ctx, clientset.CoreV1().Nodes(), publicKey); err != nil {
+	resolution, err := controller.SetupNode(ctx, cfg, clientset.CoreV1().Nodes(), podCIDRAllocator, publicKey)
+	if err != nil {
 		return nil, err
 	}
+	podCIDRStatus.Set(resolution)
 
 	return &wigglenet{
-		controller:       ctrl,
-		firewallManager:  firewallManager,
-		netpolController: netpolController,
+		configPath:      configPath,
+		config:          cfg,
+		health:          checker,
+		controller:      ctrl,
+		firewallManager: firewallManager,
+		netpol:          netpol,
+		debugSources:    debugSources,
+		speaker:         speaker,
+		ipam:            ipamManager,
 	}, nil
 }
 
+// newBGPSpeaker creates the BGP speaker if any BGP peers are configured. The
+// ASN and the router ID were validated with the rest of the configuration.
+func newBGPSpeaker(cfg config.BGP, enableMetrics bool) (bgp.Speaker, error) {
+	if cfg.Peers == "" {
+		return nil, nil
+	}
+
+	peers, err := bgp.ParsePeers(cfg.Peers)
+	if err != nil {
+		return nil, err
+	}
+	communities, err := bgp.ParseCommunities(cfg.Communities)
+	if err != nil {
+		return nil, err
+	}
+
+	var routerID netip.Addr
+	if cfg.RouterID != "" {
+		routerID = netip.MustParseAddr(cfg.RouterID)
+	}
+
+	return bgp.NewSpeaker(bgp.Config{
+		LocalASN:    uint32(cfg.LocalASN),
+		RouterID:    routerID,
+		Peers:       peers,
+		Communities: communities,
+		HoldTime:    cfg.HoldTime.Duration,
+		Metrics:     enableMetrics,
+	}), nil
+}
+
 type wigglenet struct {
-	controller       controller.Controller
-	firewallManager  firewall.Manager
-	netpolController networkpolicy.Controller
+	configPath string
+	// The configuration at startup, runReload keeps track of the reloaded one
+	config          *config.Config
+	health          *health.Checker
+	controller      controller.Controller
+	firewallManager firewall.Manager
+	netpol          *netpolRunner
+	debugSources    debug.Sources
+	speaker         bgp.Speaker
+	ipam            ipam.Manager
 }
 
 func (c *wigglenet) Run(ctx context.Context) {
@@ -113,23 +198,40 @@ func (c *wigglenet) Run(ctx context.Context) {
 	wg.StartWithContext(ctx, c.firewallManager.Run)
 	wg.StartWithContext(ctx, c.controller.Run)
 
-	// Start NetworkPolicy controller if enabled
-	if c.netpolController != nil {
-		wg.StartWithContext(ctx, c.netpolController.Run)
+	if c.speaker != nil {
+		wg.StartWithContext(ctx, c.speaker.Run)
+	}
+
+	if c.ipam != nil {
+		wg.StartWithContext(ctx, c.ipam.Run)
+	}
+
+	// Reloads the configuration and runs the NetworkPolicy controller
+	wg.StartWithContext(ctx, c.runReload)
+
+	// Start health server for kubelet probes
+	if c.config.Health.BindAddr != "" {
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			health.Run(ctx, c.config.Health.BindAddr, c.health)
+		})
 	}
 
 	// Start metrics server if enabled
-	if config.EnableMetrics {
+	if m := c.config.Metrics; m.Enabled {
 		var tlsCfg *metrics.TLSConfig
-		if config.MetricsTLSCertFile != "" {
+		if m.TLSCertFile != "" {
 			tlsCfg = &metrics.TLSConfig{
-				CertFile:     config.MetricsTLSCertFile,
-				KeyFile:      config.MetricsTLSKeyFile,
-				ClientCAFile: config.MetricsTLSClientCA,
+				CertFile:     m.TLSCertFile,
+				KeyFile:      m.TLSKeyFile,
+				ClientCAFile: m.TLSClientCAFile,
 			}
 		}
+		var debugHandler http.Handler
+		if m.DebugAPI {
+			debugHandler = debug.NewHandler(c.debugSources)
+		}
 		wg.StartWithContext(ctx, func(ctx context.Context) {
-			metrics.Run(ctx, config.MetricsBindAddr, tlsCfg)
+			metrics.Run(ctx, m.BindAddr, tlsCfg, c.health, debugHandler)
 		})
 	}
 
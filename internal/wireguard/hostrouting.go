@@ -0,0 +1,182 @@
+package wireguard
+
+import (
+	"net/netip"
+
+	"github.com/tibordp/wigglenet/internal/config"
+	"github.com/tibordp/wigglenet/internal/util"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"k8s.io/klog/v2"
+)
+
+// Host encryption routes traffic to the peers' node addresses through the
+// tunnel. The routes live in a separate table that is consulted for all
+// packets except the ones marked by the WireGuard device itself, so that the
+// encrypted packets to the peer's endpoint still go over the underlay:
+//
+//	ip rule add not fwmark $WG_FWMARK table $WG_ROUTE_TABLE
+//	ip route add $PEER_NODE_IP dev wigglenet table $WG_ROUTE_TABLE
+
+const hostRoutingRulePriority = 24601
+
+func hostRoutingRule(cfg config.WireGuard, family int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = cfg.RouteTable
+	rule.Mark = uint32(cfg.Fwmark)
+	rule.Invert = true
+	rule.Priority = hostRoutingRulePriority
+	return rule
+}
+
+// firewallMark returns the mark the WireGuard device should put on its
+// packets, 0 if host encryption is disabled.
+func firewallMark(cfg config.WireGuard) int {
+	if cfg.HostEncryption {
+		return cfg.Fwmark
+	}
+	return 0
+}
+
+// reconcileHostRoutingRules adds the routing rule for host encryption if it is
+// enabled, and removes all the other rules pointing to the route table.
+func reconcileHostRoutingRules(logger klog.Logger, cfg config.WireGuard) error {
+	for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+		existingRules, err := netlink.RuleListFiltered(family, &netlink.Rule{Table: cfg.RouteTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+
+		desired := hostRoutingRule(cfg, family)
+		found := false
+		for _, rule := range existingRules {
+			if cfg.HostEncryption && !found && rule.Invert && rule.Mark == desired.Mark && rule.Priority == desired.Priority {
+				found = true
+				continue
+			}
+			logger.Info("removing routing rule", "rule", rule)
+			if err := netlink.RuleDel(&rule); err != nil {
+				return err
+			}
+		}
+
+		if cfg.HostEncryption && !found {
+			logger.Info("adding routing rule", "rule", desired)
+			if err := netlink.RuleAdd(desired); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// localSourceAddresses returns the node addresses that are assigned to a local
+// interface, so that they can be used as the source address of host traffic.
+func localSourceAddresses(nodeAddresses []netip.Addr) (v4, v6 *netip.Addr, err error) {
+	addrs, err := netlink.AddrList(nil, nl.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local := make(map[netip.Addr]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if a, ok := netip.AddrFromSlice(addr.IP); ok {
+			local[a.Unmap()] = struct{}{}
+		}
+	}
+
+	for _, address := range nodeAddresses {
+		if _, ok := local[address]; !ok {
+			continue
+		}
+		if address.Is4() && v4 == nil {
+			v4 = &address
+		} else if address.Is6() && v6 == nil {
+			v6 = &address
+		}
+	}
+	return v4, v6, nil
+}
+
+func (c *wireguardManager) getPeerNodeCIDRs(peers []Peer) []netip.Prefix {
+	cidrs := make([]netip.Prefix, 0)
+	if !c.config.WireGuard.HostEncryption {
+		return cidrs
+	}
+	for _, peer := range peers {
+		cidrs = append(cidrs, peer.NodeCIDRs...)
+	}
+	util.SortPrefixes(cidrs)
+	return cidrs
+}
+
+func (c *wireguardManager) reconcileHostRoutes(logger klog.Logger, nodeAddresses []netip.Addr, peerNodeCIDRs []netip.Prefix) error {
+	existingRoutes, err := netlink.RouteListFiltered(nl.FAMILY_ALL, &netlink.Route{
+		LinkIndex: c.link.Attrs().Index,
+		Table:     c.config.WireGuard.RouteTable,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+
+	var srcV4, srcV6 *netip.Addr
+	if len(peerNodeCIDRs) > 0 {
+		if srcV4, srcV6, err = localSourceAddresses(nodeAddresses); err != nil {
+			return err
+		}
+	}
+
+	redundant := make(map[netip.Prefix]netlink.Route)
+	for _, route := range existingRoutes {
+		if prefix, ok := util.PrefixFromIPNet(*route.Dst); ok {
+			redundant[prefix] = route
+		}
+	}
+
+	missing := make([]netlink.Route, 0)
+	for _, cidr := range peerNodeCIDRs {
+		src := srcV4
+		if cidr.Addr().Is6() {
+			src = srcV6
+		}
+
+		route := netlink.Route{
+			LinkIndex: c.link.Attrs().Index,
+			Table:     c.config.WireGuard.RouteTable,
+			Scope:     netlink.SCOPE_LINK,
+		}
+		netlinkCIDR := util.PrefixToIPNet(cidr)
+		route.Dst = &netlinkCIDR
+		if src != nil {
+			route.Src = src.AsSlice()
+		}
+
+		if existing, ok := redundant[cidr]; ok {
+			existingSrc, _ := netip.AddrFromSlice(existing.Src)
+			if (src == nil && existing.Src == nil) || (src != nil && existingSrc.Unmap() == *src) {
+				delete(redundant, cidr)
+				continue
+			}
+		}
+		missing = append(missing, route)
+	}
+
+	// Remove first, a route with a changed source address replaces the existing one
+	for _, v := range redundant {
+		logger.Info("removing host route", "route", v)
+		if err := netlink.RouteDel(&v); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range missing {
+		logger.Info("adding host route", "route", v)
+		if err := netlink.RouteAdd(&v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
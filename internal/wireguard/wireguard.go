@@ -1,8 +1,12 @@
 package wireguard
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -10,6 +14,8 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -49,25 +55,60 @@ type Manager interface {
 	PublicKey() []byte
 	// PeerStats reads current peer statistics from the WireGuard device.
 	PeerStats() ([]PeerStats, error)
+	// AppliedConfig returns the last successfully applied configuration, or nil.
+	AppliedConfig() *WireguardConfig
+	// KeyState describes the current private key and the staged next key.
+	KeyState() KeyState
+	// StageKey generates the next private key, unless one is already staged.
+	StageKey(ctx context.Context) error
+	// CommitKey switches the device over to the staged private key.
+	CommitKey(ctx context.Context) error
+	// SyncNextKeys moves the allowed IPs of peers that are rotating their key
+	// over to the next key, as soon as they have switched over to it.
+	SyncNextKeys(ctx context.Context) error
+}
+
+// KeyState describes the node's WireGuard keys during key rotation.
+type KeyState struct {
+	PublicKey     wgtypes.Key
+	Created       time.Time    // when the current key was generated
+	NextPublicKey *wgtypes.Key // nil unless a rotation is in progress
+	Staged        time.Time    // when the next key was generated
 }
 
 type wireguardManager struct {
+	config            *config.Config
 	link              netlink.Link
 	wgctrl            wgctrl.Client
-	privateKey        wgtypes.Key
-	publicKey         wgtypes.Key
-	lastAppliedConfig *WireguardConfig
+	lastAppliedConfig atomic.Pointer[WireguardConfig]
+
+	// mu guards the keys below and serializes device configuration, so that a
+	// key rotation cannot race with a reconcile using the previous key.
+	mu             sync.Mutex
+	privateKey     wgtypes.Key
+	publicKey      wgtypes.Key
+	keyCreated     time.Time
+	nextPrivateKey *wgtypes.Key
+	keyStaged      time.Time
+
+	// Cluster secret the per-pair preshared keys are derived from, nil if
+	// preshared keys are disabled.
+	presharedKeySecret []byte
 }
 
 type WireguardConfig struct {
 	Addresses []netip.Addr
 	Peers     []Peer
+	// The local node's addresses, used as the source address of host traffic
+	// to other nodes when host encryption is enabled
+	NodeAddresses []netip.Addr
 }
 
-func NewConfig(addresses []netip.Addr, peers []Peer) WireguardConfig {
+func NewConfig(addresses []netip.Addr, nodeAddresses []netip.Addr, peers []Peer) WireguardConfig {
 	config := WireguardConfig{
-		Addresses: addresses,
-		Peers:     peers,
+		Addresses:     addresses,
+		Peers:         peers,
+		NodeAddresses: nodeAddresses,
 	}
 	config.canonicalize()
 	return config
@@ -79,6 +120,9 @@ func (c *WireguardConfig) canonicalize() {
 	sort.Slice(c.Addresses, func(i, j int) bool {
 		return c.Addresses[i].Compare(c.Addresses[j]) < 0
 	})
+	sort.Slice(c.NodeAddresses, func(i, j int) bool {
+		return c.NodeAddresses[i].Compare(c.NodeAddresses[j]) < 0
+	})
 	sort.Slice(c.Peers, func(i, j int) bool {
 		return c.Peers[i].PublicKey.String() < c.Peers[j].PublicKey.String()
 	})
@@ -89,10 +133,166 @@ type Peer struct {
 	NodeCIDRs []netip.Prefix
 	PodCIDRs  []netip.Prefix
 	PublicKey wgtypes.Key
+	// The key the peer is about to rotate to, if any. It is configured without
+	// allowed IPs, so that the peer's first handshake with the new key succeeds.
+	NextPublicKey *wgtypes.Key
+	// Derived by the manager from the cluster secret, nil if preshared keys
+	// are disabled.
+	PresharedKey *wgtypes.Key
+	// All the addresses the peer can be reached at, in order of preference.
+	// Endpoint is one of them.
+	EndpointCandidates []netip.Addr
+	// Keepalive interval, 0 to disable
+	PersistentKeepalive time.Duration
+	// Port of the endpoint, 0 for the local listen port
+	Port int
+	// Whether the pod CIDRs are routed natively over the underlay rather than
+	// through the tunnel
+	Native bool
+	// Whether the peer is behind NAT and its public endpoint is not known. The
+	// endpoint WireGuard learned from the peer's packets is then kept, Endpoint
+	// is only used until there is one.
+	Roaming bool
+}
+
+func (p *Peer) endpointPort(defaultPort int) int {
+	if p.Port != 0 {
+		return p.Port
+	}
+	return defaultPort
 }
 
 func (c *wireguardManager) PublicKey() []byte {
-	return c.publicKey[:]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	publicKey := c.publicKey
+	return publicKey[:]
+}
+
+func (c *wireguardManager) KeyState() KeyState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := KeyState{
+		PublicKey: c.publicKey,
+		Created:   c.keyCreated,
+	}
+	if c.nextPrivateKey != nil {
+		nextPublicKey := c.nextPrivateKey.PublicKey()
+		state.NextPublicKey = &nextPublicKey
+		state.Staged = c.keyStaged
+	}
+	return state
+}
+
+func (c *wireguardManager) StageKey(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nextPrivateKey != nil {
+		return nil
+	}
+
+	nextPrivateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	if err := writePrivateKey(nextPrivateKeyFilename(c.config), nextPrivateKey); err != nil {
+		return err
+	}
+
+	c.nextPrivateKey = &nextPrivateKey
+	c.keyStaged = time.Now()
+	klog.FromContext(ctx).Info("staged next wireguard key", "nextPublicKey", nextPrivateKey.PublicKey().String())
+	return nil
+}
+
+func (c *wireguardManager) CommitKey(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nextPrivateKey == nil {
+		return fmt.Errorf("no wireguard key staged")
+	}
+
+	// Persist first, so that a restart picks up the new key even if we fail
+	// to configure the device below.
+	if err := os.Rename(nextPrivateKeyFilename(c.config), c.config.WireGuard.PrivateKeyPath); err != nil {
+		return err
+	}
+
+	previousPublicKey := c.publicKey
+	c.privateKey = *c.nextPrivateKey
+	c.publicKey = c.privateKey.PublicKey()
+	c.keyCreated = c.keyStaged
+	c.nextPrivateKey = nil
+	c.keyStaged = time.Time{}
+
+	device, err := c.wgctrl.Device(c.link.Attrs().Name)
+	if err != nil {
+		// Make sure the next reconcile configures the device with the new key
+		c.lastAppliedConfig.Store(nil)
+		return err
+	}
+
+	deviceConfig := wgtypes.Config{
+		PrivateKey: &c.privateKey,
+	}
+	// Preshared keys depend on our public key, so they change together with it
+	if c.presharedKeySecret != nil {
+		for _, peer := range device.Peers {
+			presharedKey := derivePresharedKey(c.presharedKeySecret, c.publicKey, peer.PublicKey)
+			deviceConfig.Peers = append(deviceConfig.Peers, wgtypes.PeerConfig{
+				PublicKey:    peer.PublicKey,
+				UpdateOnly:   true,
+				PresharedKey: &presharedKey,
+			})
+		}
+	}
+
+	if err := c.wgctrl.ConfigureDevice(device.Name, deviceConfig); err != nil {
+		c.lastAppliedConfig.Store(nil)
+		return err
+	}
+
+	logger := klog.FromContext(ctx)
+	logger.Info("rotated wireguard key", "previousPublicKey", previousPublicKey.String(), "publicKey", c.publicKey.String())
+
+	// Peers move their allowed IPs over to the new key once they see a
+	// handshake with it, so start one with every peer right away rather than
+	// when there is traffic for it.
+	if err := c.sendKeepalives(device.Name, device.Peers); err != nil {
+		logger.Error(err, "failed to send keepalives after key rotation")
+	}
+	return nil
+}
+
+// sendKeepalives makes the device send a keepalive to each of the peers, which
+// starts a handshake if there is no session with the peer. WireGuard sends one
+// when the persistent keepalive of a peer is turned on, so it is turned off,
+// on and then restored to its previous interval.
+func (c *wireguardManager) sendKeepalives(deviceName string, peers []wgtypes.Peer) error {
+	steps := []func(peer wgtypes.Peer) time.Duration{
+		func(wgtypes.Peer) time.Duration { return 0 },
+		func(wgtypes.Peer) time.Duration { return time.Second },
+		func(peer wgtypes.Peer) time.Duration { return peer.PersistentKeepaliveInterval },
+	}
+	for _, step := range steps {
+		peerConfigs := make([]wgtypes.PeerConfig, 0, len(peers))
+		for _, peer := range peers {
+			interval := step(peer)
+			peerConfigs = append(peerConfigs, wgtypes.PeerConfig{
+				PublicKey:                   peer.PublicKey,
+				UpdateOnly:                  true,
+				PersistentKeepaliveInterval: &interval,
+			})
+		}
+		if err := c.wgctrl.ConfigureDevice(deviceName, wgtypes.Config{Peers: peerConfigs}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *wireguardManager) AppliedConfig() *WireguardConfig {
+	return c.lastAppliedConfig.Load()
 }
 
 func (c *wireguardManager) PeerStats() ([]PeerStats, error) {
@@ -118,12 +318,15 @@ func (c *wireguardManager) PeerStats() ([]PeerStats, error) {
 	return stats, nil
 }
 
-func getPeerCIDRs(peers []Peer) []netip.Prefix {
+func (c *wireguardManager) getPeerCIDRs(peers []Peer) []netip.Prefix {
 	routes := make([]netip.Prefix, 0)
 	for _, peer := range peers {
+		if peer.Native {
+			continue
+		}
 		for _, cidr := range peer.PodCIDRs {
 			isIPv6 := cidr.Addr().Is6()
-			if (isIPv6 && !config.NativeRoutingIPv6) || (!isIPv6 && !config.NativeRoutingIPv4) {
+			if (isIPv6 && !c.config.Routing.NativeRoutingIPv6) || (!isIPv6 && !c.config.Routing.NativeRoutingIPv4) {
 				routes = append(routes, cidr)
 			}
 		}
@@ -179,7 +382,9 @@ func (c *wireguardManager) reconcileRoutes(logger klog.Logger, addresses []netip
 
 	for _, v := range missing {
 		logger.Info("adding route", "route", v)
-		if err := netlink.RouteAdd(&v); err != nil {
+		// Replace, as in mixed routing mode, the pod CIDR of a peer that was
+		// routed natively may still have a direct route.
+		if err := netlink.RouteReplace(&v); err != nil {
 			return err
 		}
 	}
@@ -237,7 +442,18 @@ func (c *wireguardManager) reconcileAddresses(logger klog.Logger, addresses []ne
 	return nil
 }
 
-func peerNeedsUpdate(existingPeer *wgtypes.PeerConfig, peer *Peer) bool {
+func presharedKeyEqual(a, b *wgtypes.Key) bool {
+	var zero wgtypes.Key
+	if a == nil {
+		a = &zero
+	}
+	if b == nil {
+		b = &zero
+	}
+	return *a == *b
+}
+
+func (c *wireguardManager) peerNeedsUpdate(existingPeer *wgtypes.PeerConfig, peer *Peer) bool {
 	// Compare AllowedIPs as a set, not positionally: the kernel may return them
 	// in a different order than we configured them, and the desired set is also
 	// assembled from independently-ordered sources. A positional comparison would
@@ -264,35 +480,147 @@ func peerNeedsUpdate(existingPeer *wgtypes.PeerConfig, peer *Peer) bool {
 		}
 	}
 
+	if !presharedKeyEqual(existingPeer.PresharedKey, peer.PresharedKey) {
+		return true
+	}
+
+	existingKeepalive := time.Duration(0)
+	if existingPeer.PersistentKeepaliveInterval != nil {
+		existingKeepalive = *existingPeer.PersistentKeepaliveInterval
+	}
+	if existingKeepalive != peer.PersistentKeepalive {
+		return true
+	}
+
 	if existingPeer.Endpoint == nil {
 		return true
 	}
 
+	if peer.Roaming {
+		return false
+	}
+
 	endpointAddr, _ := netip.AddrFromSlice(existingPeer.Endpoint.IP)
-	if endpointAddr.Unmap() != peer.Endpoint || existingPeer.Endpoint.Port != config.WGPort {
+	if endpointAddr.Unmap() != peer.Endpoint || existingPeer.Endpoint.Port != peer.endpointPort(c.config.WireGuard.Port) {
 		return true
 	}
 
 	return false
 }
 
-func createPeerChangeset(logger klog.Logger, existingPeers []wgtypes.Peer, desiredPeers []Peer) []wgtypes.PeerConfig {
+// withNextKeys adds a peer without allowed IPs for the next key of every peer
+// that is rotating its key. Once the peer switches over, the new key is already
+// known and its allowed IPs are moved over as an update rather than an addition.
+//
+// A handshake with the next key (handshakes holds the last handshake of every
+// configured key) means that the peer has already switched over. The allowed
+// IPs are then moved to the next key right away, rather than once the peer's
+// node annotations catch up, as traffic to and from the peer would otherwise
+// be dropped in the meantime.
+func withNextKeys(peers []Peer, handshakes map[wgtypes.Key]time.Time) []Peer {
+	result := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.NextPublicKey == nil || *peer.NextPublicKey == peer.PublicKey {
+			result = append(result, peer)
+			continue
+		}
+
+		if handshakes[*peer.NextPublicKey].After(handshakes[peer.PublicKey]) {
+			switched := peer
+			switched.PublicKey = *peer.NextPublicKey
+			switched.NextPublicKey = nil
+			result = append(result, switched)
+			continue
+		}
+
+		result = append(result, peer, Peer{
+			Endpoint:  peer.Endpoint,
+			PublicKey: *peer.NextPublicKey,
+			Port:      peer.Port,
+		})
+	}
+	return result
+}
+
+// rotatingPeers reports whether any of the peers is rotating its key.
+func rotatingPeers(peers []Peer) bool {
+	for _, peer := range peers {
+		if peer.NextPublicKey != nil && *peer.NextPublicKey != peer.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// derivePresharedKey derives the preshared key for a pair of nodes from the
+// cluster secret. Both nodes arrive at the same key, as the public keys are
+// ordered before hashing.
+func derivePresharedKey(secret []byte, a, b wgtypes.Key) wgtypes.Key {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("wigglenet preshared key"))
+	mac.Write(a[:])
+	mac.Write(b[:])
+
+	var presharedKey wgtypes.Key
+	copy(presharedKey[:], mac.Sum(nil))
+	return presharedKey
+}
+
+// withPresharedKeys returns a copy of the peers with their preshared keys set,
+// if preshared keys are enabled.
+func (c *wireguardManager) withPresharedKeys(peers []Peer) []Peer {
+	if c.presharedKeySecret == nil {
+		return peers
+	}
+
+	result := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		presharedKey := derivePresharedKey(c.presharedKeySecret, c.publicKey, peer.PublicKey)
+		peer.PresharedKey = &presharedKey
+		result = append(result, peer)
+	}
+	return result
+}
+
+func (c *wireguardManager) createPeerChangeset(logger klog.Logger, existingPeers []wgtypes.Peer, desiredPeers []Peer) []wgtypes.PeerConfig {
 	changeset := make(map[wgtypes.Key]wgtypes.PeerConfig)
 	for _, peer := range existingPeers {
-		changeset[peer.PublicKey] = wgtypes.PeerConfig{
+		peerConfig := wgtypes.PeerConfig{
 			PublicKey:         peer.PublicKey,
 			Remove:            true,
 			AllowedIPs:        peer.AllowedIPs,
 			Endpoint:          peer.Endpoint,
 			ReplaceAllowedIPs: true,
 		}
+		if peer.PresharedKey != (wgtypes.Key{}) {
+			presharedKey := peer.PresharedKey
+			peerConfig.PresharedKey = &presharedKey
+		}
+		if peer.PersistentKeepaliveInterval != 0 {
+			keepalive := peer.PersistentKeepaliveInterval
+			peerConfig.PersistentKeepaliveInterval = &keepalive
+		}
+		changeset[peer.PublicKey] = peerConfig
+	}
+
+	// Next keys follow the peer's current key in the desired peers, so the
+	// first key seen for an endpoint is the current one.
+	endpointKeys := make(map[netip.Addr]wgtypes.Key)
+	for _, peer := range desiredPeers {
+		if _, ok := endpointKeys[peer.Endpoint]; !ok {
+			endpointKeys[peer.Endpoint] = peer.PublicKey
+		}
 	}
 
 	for _, peer := range desiredPeers {
 		var peerConfig wgtypes.PeerConfig
 		var ok bool
 		if peerConfig, ok = changeset[peer.PublicKey]; ok {
-			if !peerNeedsUpdate(&peerConfig, &peer) {
+			if !c.peerNeedsUpdate(&peerConfig, &peer) {
 				delete(changeset, peer.PublicKey)
 				continue
 			}
@@ -303,23 +631,57 @@ func createPeerChangeset(logger klog.Logger, existingPeers []wgtypes.Peer, desir
 		}
 
 		peerConfig.PublicKey = peer.PublicKey
-		peerConfig.Endpoint = &net.UDPAddr{IP: peer.Endpoint.AsSlice(), Port: config.WGPort}
+		if !peer.Roaming || peerConfig.Endpoint == nil {
+			peerConfig.Endpoint = &net.UDPAddr{IP: peer.Endpoint.AsSlice(), Port: peer.endpointPort(c.config.WireGuard.Port)}
+		}
 		peerConfig.AllowedIPs = util.PrefixesToIPNets(peer.PodCIDRs)
 		peerConfig.AllowedIPs = append(peerConfig.AllowedIPs, util.PrefixesToIPNets(peer.NodeCIDRs)...)
 
+		if peer.PresharedKey != nil {
+			peerConfig.PresharedKey = peer.PresharedKey
+		} else if peerConfig.PresharedKey != nil {
+			// A zero key removes the preshared key from the peer
+			peerConfig.PresharedKey = &wgtypes.Key{}
+		}
+
+		if peer.PersistentKeepalive != 0 || peerConfig.PersistentKeepaliveInterval != nil {
+			keepalive := peer.PersistentKeepalive
+			peerConfig.PersistentKeepaliveInterval = &keepalive
+		}
+
 		changeset[peer.PublicKey] = peerConfig
 	}
 
+	// Additions and updates go first, so that the allowed IPs of a node that
+	// changed its key are moved over to the new key before the old one is
+	// removed. Within each group, order by key to keep the changeset stable.
 	peerConfigs := make([]wgtypes.PeerConfig, 0)
 	for _, v := range changeset {
+		peerConfigs = append(peerConfigs, v)
+	}
+	sort.Slice(peerConfigs, func(i, j int) bool {
+		if peerConfigs[i].Remove != peerConfigs[j].Remove {
+			return !peerConfigs[i].Remove
+		}
+		return peerConfigs[i].PublicKey.String() < peerConfigs[j].PublicKey.String()
+	})
+
+	for _, v := range peerConfigs {
 		if v.Remove {
-			logger.Info("removing peer", "publicKey", v.PublicKey.String())
+			var endpoint netip.Addr
+			if v.Endpoint != nil {
+				endpoint, _ = netip.AddrFromSlice(v.Endpoint.IP)
+			}
+			if newKey, ok := endpointKeys[endpoint.Unmap()]; ok {
+				logger.Info("replacing peer key", "previousPublicKey", v.PublicKey.String(), "publicKey", newKey.String())
+			} else {
+				logger.Info("removing peer", "publicKey", v.PublicKey.String())
+			}
 		} else if v.UpdateOnly {
 			logger.Info("updating peer", "publicKey", v.PublicKey.String())
 		} else {
 			logger.Info("adding peer", "publicKey", v.PublicKey.String())
 		}
-		peerConfigs = append(peerConfigs, v)
 	}
 
 	return peerConfigs
@@ -331,12 +693,18 @@ func (c *wireguardManager) reconcileWireguardPeers(logger klog.Logger, peers []P
 		return err
 	}
 
-	peerConfigs := createPeerChangeset(logger, device.Peers, peers)
+	handshakes := make(map[wgtypes.Key]time.Time, len(device.Peers))
+	for _, peer := range device.Peers {
+		handshakes[peer.PublicKey] = peer.LastHandshakeTime
+	}
+
+	desiredPeers := c.withPresharedKeys(withNextKeys(peers, handshakes))
+	peerConfigs := c.createPeerChangeset(logger, device.Peers, desiredPeers)
 
 	if len(peerConfigs) > 0 {
 		if err := c.wgctrl.ConfigureDevice(device.Name, wgtypes.Config{
 			PrivateKey: &c.privateKey,
-			ListenPort: &config.WGPort,
+			ListenPort: &c.config.WireGuard.Port,
 			Peers:      peerConfigs,
 		}); err != nil {
 			return err
@@ -346,43 +714,66 @@ func (c *wireguardManager) reconcileWireguardPeers(logger klog.Logger, peers []P
 	return nil
 }
 
-func (c *wireguardManager) ApplyConfiguration(ctx context.Context, config *WireguardConfig, logger klog.Logger) error {
-	if reflect.DeepEqual(config, c.lastAppliedConfig) {
+func (c *wireguardManager) ApplyConfiguration(ctx context.Context, wgConfig *WireguardConfig, logger klog.Logger) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reflect.DeepEqual(wgConfig, c.lastAppliedConfig.Load()) {
 		return nil
 	}
 
 	logger.Info("applying new Wireguard configuration")
-	if err := c.reconcileWireguardPeers(logger, config.Peers); err != nil {
+	if err := c.reconcileWireguardPeers(logger, wgConfig.Peers); err != nil {
 		return err
 	}
 
-	if err := c.reconcileAddresses(logger, config.Addresses); err != nil {
+	if err := c.reconcileAddresses(logger, wgConfig.Addresses); err != nil {
 		return err
 	}
 
-	peersCIDRs := getPeerCIDRs(config.Peers)
-	if err := c.reconcileRoutes(logger, config.Addresses, peersCIDRs); err != nil {
+	peersCIDRs := c.getPeerCIDRs(wgConfig.Peers)
+	if err := c.reconcileRoutes(logger, wgConfig.Addresses, peersCIDRs); err != nil {
 		return err
 	}
 
-	c.lastAppliedConfig = config
+	if err := c.reconcileHostRoutes(logger, wgConfig.NodeAddresses, c.getPeerNodeCIDRs(wgConfig.Peers)); err != nil {
+		return err
+	}
+
+	if err := reconcileHostRoutingRules(logger, c.config.WireGuard); err != nil {
+		return err
+	}
+
+	c.lastAppliedConfig.Store(wgConfig)
 	return nil
 }
 
-func ensureWgLink(ctx context.Context) (netlink.Link, error) {
+func (c *wireguardManager) SyncNextKeys(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	applied := c.lastAppliedConfig.Load()
+	if applied == nil || !rotatingPeers(applied.Peers) {
+		return nil
+	}
+	return c.reconcileWireguardPeers(klog.FromContext(ctx), applied.Peers)
+}
+
+func ensureWgLink(ctx context.Context, cfg *config.Config) (netlink.Link, error) {
 	logger := klog.FromContext(ctx)
-	link, err := netlink.LinkByName(config.WGLinkName)
+	name := cfg.WireGuard.InterfaceName
+	link, err := netlink.LinkByName(name)
 	if _, ok := err.(netlink.LinkNotFoundError); ok {
-		logger.Info("device does not exist, creating it", "device", config.WGLinkName)
-		newLink := wireguardLink{LinkAttrs: netlink.LinkAttrs{Name: config.WGLinkName}}
+		logger.Info("device does not exist, creating it", "device", name)
+		newLink := wireguardLink{LinkAttrs: netlink.LinkAttrs{Name: name}}
 		if err := netlink.LinkAdd(&newLink); err != nil {
 			return nil, err
 		}
-		link, _ = netlink.LinkByName(config.WGLinkName)
+		link, _ = netlink.LinkByName(name)
 	} else if err != nil {
 		return nil, err
 	} else if link.Type() != "wireguard" {
-		return nil, fmt.Errorf("interface %q is not of wireguard type", config.WGLinkName)
+		return nil, fmt.Errorf("interface %q is not of wireguard type", name)
 	}
 
 	if err := netlink.LinkSetUp(link); err != nil {
@@ -392,55 +783,156 @@ func ensureWgLink(ctx context.Context) (netlink.Link, error) {
 	return link, nil
 }
 
-func ensurePrivateKey(ctx context.Context) (*wgtypes.Key, error) {
+// Cleanup removes the WireGuard interface, which takes its addresses and routes
+// with it, the routing rules for host encryption and the private keys. It
+// carries on after a failure and returns all the errors.
+func Cleanup(ctx context.Context, cfg *config.Config) error {
 	logger := klog.FromContext(ctx)
+	errs := make([]error, 0)
+
+	// With host encryption disabled, all the rules are redundant
+	wgConfig := cfg.WireGuard
+	wgConfig.HostEncryption = false
+	if err := reconcileHostRoutingRules(logger, wgConfig); err != nil {
+		errs = append(errs, fmt.Errorf("removing routing rules: %w", err))
+	}
+
+	name := cfg.WireGuard.InterfaceName
+	if link, err := netlink.LinkByName(name); err == nil {
+		if link.Type() != "wireguard" {
+			errs = append(errs, fmt.Errorf("interface %q is not of wireguard type", name))
+		} else {
+			logger.Info("removing device", "device", name)
+			if err := netlink.LinkDel(link); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, util.RemoveFiles(logger, cfg.WireGuard.PrivateKeyPath, nextPrivateKeyFilename(cfg)))
+	return errors.Join(errs...)
+}
+
+func nextPrivateKeyFilename(cfg *config.Config) string {
+	return cfg.WireGuard.PrivateKeyPath + ".next"
+}
+
+func readPrivateKey(filename string) (wgtypes.Key, error) {
 	privateKey := wgtypes.Key{}
 
-	file, err := os.Open(config.PrivateKeyFilename)
+	file, err := os.Open(filename)
+	if err != nil {
+		return privateKey, err
+	}
+	defer file.Close()
+
+	decoder := base64.NewDecoder(base64.StdEncoding, file)
+
+	if len, err := io.ReadAtLeast(decoder, privateKey[:], wgtypes.KeyLen); err != nil {
+		return privateKey, err
+	} else if len != wgtypes.KeyLen {
+		return privateKey, fmt.Errorf("key of invalid length %d", len)
+	}
+
+	return privateKey, nil
+}
+
+func writePrivateKey(filename string, privateKey wgtypes.Key) error {
+	// Private key should only be readable by root
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := base64.NewEncoder(base64.StdEncoding, file)
+
+	if _, err := encoder.Write(privateKey[:]); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// keyModTime returns the modification time of a key file, which is when the
+// key was generated.
+func keyModTime(filename string) time.Time {
+	if info, err := os.Stat(filename); err == nil {
+		return info.ModTime()
+	}
+	return time.Now()
+}
+
+func ensurePrivateKey(ctx context.Context, cfg *config.Config) (*wgtypes.Key, error) {
+	logger := klog.FromContext(ctx)
+
+	privateKey, err := readPrivateKey(cfg.WireGuard.PrivateKeyPath)
 	if os.IsNotExist(err) {
 		logger.Info("wireguard private key not found, generating a new one")
 		privateKey, err = wgtypes.GeneratePrivateKey()
 		if err != nil {
 			return nil, err
 		}
-
-		// Private key should only be readable by root
-		file, err = os.OpenFile(config.PrivateKeyFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-		if err != nil {
+		if err := writePrivateKey(cfg.WireGuard.PrivateKeyPath, privateKey); err != nil {
 			return nil, err
 		}
-		defer file.Close()
+	} else if err != nil {
+		return nil, err
+	}
 
-		encoder := base64.NewEncoder(base64.StdEncoding, file)
+	return &privateKey, nil
+}
 
-		if _, err := encoder.Write(privateKey[:]); err != nil {
-			return nil, err
-		}
-		if err := encoder.Close(); err != nil {
-			return nil, err
-		}
-		if err := file.Sync(); err != nil {
-			return nil, err
-		}
+// loadPresharedKeySecret reads the cluster secret preshared keys are derived
+// from, if one is configured.
+func loadPresharedKeySecret(cfg *config.Config) ([]byte, error) {
+	path := cfg.WireGuard.PresharedKeySecretPath
+	if path == "" {
+		return nil, nil
+	}
+
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading preshared key secret: %w", err)
+	}
+
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("preshared key secret %s is empty", path)
+	}
+	return secret, nil
+}
+
+// loadNextPrivateKey loads the key staged by a rotation that was interrupted by
+// a restart, if any.
+func loadNextPrivateKey(ctx context.Context, cfg *config.Config) (*wgtypes.Key, error) {
+	nextPrivateKey, err := readPrivateKey(nextPrivateKeyFilename(cfg))
+	if os.IsNotExist(err) {
+		return nil, nil
 	} else if err != nil {
 		return nil, err
-	} else {
-		defer file.Close()
+	}
 
-		decoder := base64.NewDecoder(base64.StdEncoding, file)
+	klog.FromContext(ctx).Info("resuming wireguard key rotation", "nextPublicKey", nextPrivateKey.PublicKey().String())
+	return &nextPrivateKey, nil
+}
 
-		if len, err := io.ReadAtLeast(decoder, privateKey[:], wgtypes.KeyLen); err != nil {
-			return nil, err
-		} else if len != wgtypes.KeyLen {
-			return nil, fmt.Errorf("key of invalid length %d", len)
-		}
+func NewManager(ctx context.Context, cfg *config.Config) (Manager, error) {
+	privateKey, err := ensurePrivateKey(ctx, cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	return &privateKey, nil
-}
+	nextPrivateKey, err := loadNextPrivateKey(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-func NewManager(ctx context.Context) (Manager, error) {
-	privateKey, err := ensurePrivateKey(ctx)
+	presharedKeySecret, err := loadPresharedKeySecret(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -450,16 +942,31 @@ func NewManager(ctx context.Context) (Manager, error) {
 		return nil, err
 	}
 
-	link, err := ensureWgLink(ctx)
+	link, err := ensureWgLink(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	// With host encryption, the mark keeps the encrypted packets from being
+	// routed back into the tunnel. Clear it otherwise, in case it was enabled
+	// before.
+	fwmark := firewallMark(cfg.WireGuard)
+	if err := client.ConfigureDevice(link.Attrs().Name, wgtypes.Config{FirewallMark: &fwmark}); err != nil {
+		return nil, err
+	}
+
 	controller := wireguardManager{
-		wgctrl:     *client,
-		privateKey: *privateKey,
-		link:       link,
-		publicKey:  privateKey.PublicKey(),
+		config:             cfg,
+		wgctrl:             *client,
+		privateKey:         *privateKey,
+		link:               link,
+		publicKey:          privateKey.PublicKey(),
+		keyCreated:         keyModTime(cfg.WireGuard.PrivateKeyPath),
+		nextPrivateKey:     nextPrivateKey,
+		presharedKeySecret: presharedKeySecret,
+	}
+	if nextPrivateKey != nil {
+		controller.keyStaged = keyModTime(nextPrivateKeyFilename(cfg))
 	}
 
 	return &controller, nil
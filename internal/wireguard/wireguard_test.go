@@ -4,8 +4,10 @@ import (
 	"net"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tibordp/wigglenet/internal/config"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"k8s.io/klog/v2/ktesting"
 )
@@ -25,6 +27,10 @@ func parsePrefix(cidr string) netip.Prefix {
 	return p
 }
 
+func newTestManager(cfg *config.Config) *wireguardManager {
+	return &wireguardManager{config: cfg}
+}
+
 func TestCreateChangesetNoChange(t *testing.T) {
 	existingPeers := []wgtypes.Peer{
 		{
@@ -51,7 +57,7 @@ func TestCreateChangesetNoChange(t *testing.T) {
 
 	logger, ctx := ktesting.NewTestContext(t)
 	_ = ctx
-	actual := createPeerChangeset(logger, existingPeers, desiredPeers)
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
 
 	assert.Len(t, actual, 0)
 }
@@ -88,7 +94,7 @@ func TestCreateChangesetNoChangeReorderedAllowedIPs(t *testing.T) {
 	}
 
 	logger, _ := ktesting.NewTestContext(t)
-	actual := createPeerChangeset(logger, existingPeers, desiredPeers)
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
 	assert.Len(t, actual, 0, "reordered but identical AllowedIPs should not trigger an update")
 }
 
@@ -144,7 +150,7 @@ func TestCreateChangesetAdd(t *testing.T) {
 
 	logger, ctx := ktesting.NewTestContext(t)
 	_ = ctx
-	actual := createPeerChangeset(logger, existingPeers, desiredPeers)
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
 
 	assert.Equal(t, expected, actual)
 }
@@ -181,7 +187,7 @@ func TestCreateChangesetRemove(t *testing.T) {
 
 	logger, ctx := ktesting.NewTestContext(t)
 	_ = ctx
-	actual := createPeerChangeset(logger, existingPeers, desiredPeers)
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
 
 	assert.Equal(t, expected, actual)
 }
@@ -231,7 +237,320 @@ func TestCreateChangesetUpdate(t *testing.T) {
 
 	logger, ctx := ktesting.NewTestContext(t)
 	_ = ctx
-	actual := createPeerChangeset(logger, existingPeers, desiredPeers)
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
 
 	assert.Equal(t, expected, actual)
 }
+
+func TestCreateChangesetKeyRotation(t *testing.T) {
+	oldKey := parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg=")
+	newKey := parseKey("oFFVKLsHSZ5BFTLdKxubHnvprQ5jdssnaW6nzaQMrGY=")
+
+	existingPeers := []wgtypes.Peer{
+		{
+			PublicKey: oldKey,
+			Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+			AllowedIPs: []net.IPNet{
+				parseCIDR("192.168.0.0/24"),
+			},
+		},
+	}
+
+	desiredPeers := []Peer{
+		{
+			Endpoint:      netip.MustParseAddr("192.168.0.1"),
+			PodCIDRs:      []netip.Prefix{parsePrefix("192.168.0.0/24")},
+			NodeCIDRs:     []netip.Prefix{},
+			PublicKey:     oldKey,
+			NextPublicKey: &newKey,
+		},
+	}
+
+	logger, _ := ktesting.NewTestContext(t)
+
+	// The next key is added as a peer without allowed IPs
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, withNextKeys(desiredPeers, nil))
+	assert.Equal(t, []wgtypes.PeerConfig{
+		{
+			PublicKey:  newKey,
+			Endpoint:   &net.UDPAddr{IP: net.IP{192, 168, 0, 1}, Port: 24601},
+			AllowedIPs: []net.IPNet{},
+		},
+	}, actual)
+
+	existingPeers = append(existingPeers, wgtypes.Peer{
+		PublicKey: newKey,
+		Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+	})
+
+	// Once the node switches over, the allowed IPs move to the already
+	// configured new key before the old key is removed
+	desiredPeers[0].PublicKey = newKey
+	desiredPeers[0].NextPublicKey = nil
+	actual = newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Equal(t, []wgtypes.PeerConfig{
+		{
+			PublicKey:         newKey,
+			UpdateOnly:        true,
+			Endpoint:          &net.UDPAddr{IP: net.IP{192, 168, 0, 1}, Port: 24601},
+			ReplaceAllowedIPs: true,
+			AllowedIPs: []net.IPNet{
+				parseCIDR("192.168.0.0/24"),
+			},
+		},
+		{
+			PublicKey:         oldKey,
+			Remove:            true,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+			ReplaceAllowedIPs: true,
+			AllowedIPs: []net.IPNet{
+				parseCIDR("192.168.0.0/24"),
+			},
+		},
+	}, actual)
+}
+
+func TestCreateChangesetRoaming(t *testing.T) {
+	// The peer is behind NAT, WireGuard has learned its public endpoint
+	existingPeers := []wgtypes.Peer{
+		{
+			PublicKey: parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg="),
+			Endpoint:  &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1024},
+			AllowedIPs: []net.IPNet{
+				parseCIDR("192.168.0.0/24"),
+			},
+		},
+	}
+
+	desiredPeers := []Peer{
+		{
+			Endpoint:  netip.MustParseAddr("10.0.0.1"),
+			PodCIDRs:  []netip.Prefix{parsePrefix("192.168.0.0/24")},
+			NodeCIDRs: []netip.Prefix{},
+			PublicKey: parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg="),
+			Roaming:   true,
+		},
+	}
+
+	logger, _ := ktesting.NewTestContext(t)
+	manager := newTestManager(config.Default())
+	assert.Empty(t, manager.createPeerChangeset(logger, existingPeers, desiredPeers))
+
+	// Other changes keep the learned endpoint
+	desiredPeers[0].PodCIDRs = []netip.Prefix{parsePrefix("192.168.1.0/24")}
+	actual := manager.createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 1)
+	assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1024}, actual[0].Endpoint)
+
+	// Without a learned endpoint, the configured one is used
+	existingPeers[0].Endpoint = nil
+	actual = manager.createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 1)
+	assert.Equal(t, &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 24601}, actual[0].Endpoint)
+
+	// Not roaming, the configured endpoint replaces the learned one
+	existingPeers[0].Endpoint = &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1024}
+	desiredPeers[0].Roaming = false
+	actual = manager.createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 1)
+	assert.Equal(t, &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 24601}, actual[0].Endpoint)
+}
+
+func TestCreateChangesetKeyHandover(t *testing.T) {
+	oldKey := parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg=")
+	newKey := parseKey("oFFVKLsHSZ5BFTLdKxubHnvprQ5jdssnaW6nzaQMrGY=")
+	handshake := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	existingPeers := []wgtypes.Peer{
+		{
+			PublicKey:         oldKey,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+			AllowedIPs:        []net.IPNet{parseCIDR("192.168.0.0/24")},
+			LastHandshakeTime: handshake,
+		},
+		{
+			PublicKey: newKey,
+			Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+		},
+	}
+	// The node's annotations still have the old key as the current one
+	desiredPeers := []Peer{
+		{
+			Endpoint:      netip.MustParseAddr("192.168.0.1"),
+			PodCIDRs:      []netip.Prefix{parsePrefix("192.168.0.0/24")},
+			NodeCIDRs:     []netip.Prefix{},
+			PublicKey:     oldKey,
+			NextPublicKey: &newKey,
+		},
+	}
+	handshakes := func() map[wgtypes.Key]time.Time {
+		result := make(map[wgtypes.Key]time.Time)
+		for _, peer := range existingPeers {
+			result[peer.PublicKey] = peer.LastHandshakeTime
+		}
+		return result
+	}
+
+	logger, _ := ktesting.NewTestContext(t)
+	manager := newTestManager(config.Default())
+
+	// Before the node switches over, nothing changes
+	actual := manager.createPeerChangeset(logger, existingPeers, withNextKeys(desiredPeers, handshakes()))
+	assert.Empty(t, actual)
+
+	// A handshake with the next key means that the node has switched over, so
+	// the allowed IPs are moved to the next key without waiting for the node
+	// annotations to be updated
+	existingPeers[1].LastHandshakeTime = handshake.Add(time.Minute)
+	actual = manager.createPeerChangeset(logger, existingPeers, withNextKeys(desiredPeers, handshakes()))
+	assert.Equal(t, []wgtypes.PeerConfig{
+		{
+			PublicKey:         newKey,
+			UpdateOnly:        true,
+			Endpoint:          &net.UDPAddr{IP: net.IP{192, 168, 0, 1}, Port: 24601},
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{parseCIDR("192.168.0.0/24")},
+		},
+		{
+			PublicKey:         oldKey,
+			Remove:            true,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{parseCIDR("192.168.0.0/24")},
+		},
+	}, actual)
+
+	// Once that is applied, the stale annotations do not move them back
+	existingPeers = []wgtypes.Peer{{
+		PublicKey:         newKey,
+		Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+		AllowedIPs:        []net.IPNet{parseCIDR("192.168.0.0/24")},
+		LastHandshakeTime: handshake.Add(time.Minute),
+	}}
+	actual = manager.createPeerChangeset(logger, existingPeers, withNextKeys(desiredPeers, handshakes()))
+	assert.Empty(t, actual)
+	assert.True(t, rotatingPeers(desiredPeers))
+}
+
+func TestDerivePresharedKey(t *testing.T) {
+	a := parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg=")
+	b := parseKey("oFFVKLsHSZ5BFTLdKxubHnvprQ5jdssnaW6nzaQMrGY=")
+	secret := []byte("cluster secret")
+
+	// Both ends of the tunnel derive the same key
+	assert.Equal(t, derivePresharedKey(secret, a, b), derivePresharedKey(secret, b, a))
+	assert.NotEqual(t, wgtypes.Key{}, derivePresharedKey(secret, a, b))
+	assert.NotEqual(t, derivePresharedKey(secret, a, b), derivePresharedKey([]byte("other secret"), a, b))
+	assert.NotEqual(t, derivePresharedKey(secret, a, b), derivePresharedKey(secret, a, a))
+}
+
+func TestCreateChangesetPresharedKey(t *testing.T) {
+	presharedKey := parseKey("YGU/6sJ3Sh2vZBu+JoUG5nLZBaTWp8JSoOrI6O3uGjM=")
+
+	existingPeers := []wgtypes.Peer{
+		{
+			PublicKey: parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg="),
+			Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 24601},
+			AllowedIPs: []net.IPNet{
+				parseCIDR("192.168.0.0/24"),
+			},
+		},
+	}
+
+	desiredPeers := []Peer{
+		{
+			Endpoint:     netip.MustParseAddr("192.168.0.1"),
+			PodCIDRs:     []netip.Prefix{parsePrefix("192.168.0.0/24")},
+			NodeCIDRs:    []netip.Prefix{},
+			PublicKey:    parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg="),
+			PresharedKey: &presharedKey,
+		},
+	}
+
+	logger, ctx := ktesting.NewTestContext(t)
+	_ = ctx
+
+	// Enabling preshared keys updates the peer
+	actual := newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 1)
+	assert.True(t, actual[0].UpdateOnly)
+	assert.Equal(t, &presharedKey, actual[0].PresharedKey)
+
+	// Nothing to do once the key is configured
+	existingPeers[0].PresharedKey = presharedKey
+	actual = newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 0)
+
+	// Disabling preshared keys clears the key with a zero key
+	desiredPeers[0].PresharedKey = nil
+	actual = newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 1)
+	assert.Equal(t, &wgtypes.Key{}, actual[0].PresharedKey)
+}
+
+func TestGetPeerNodeCIDRs(t *testing.T) {
+	peers := []Peer{
+		{NodeCIDRs: []netip.Prefix{parsePrefix("192.168.1.1/32"), parsePrefix("2001:db8:1::1/128")}},
+		{NodeCIDRs: []netip.Prefix{parsePrefix("192.168.0.1/32")}},
+	}
+
+	assert.Empty(t, newTestManager(config.Default()).getPeerNodeCIDRs(peers))
+
+	cfg := config.Default()
+	cfg.WireGuard.HostEncryption = true
+	assert.Equal(t, []netip.Prefix{
+		parsePrefix("192.168.0.1/32"),
+		parsePrefix("192.168.1.1/32"),
+		parsePrefix("2001:db8:1::1/128"),
+	}, newTestManager(cfg).getPeerNodeCIDRs(peers))
+}
+
+func TestGetPeerCIDRs(t *testing.T) {
+	peers := []Peer{
+		{PodCIDRs: []netip.Prefix{parsePrefix("10.0.1.0/24"), parsePrefix("2001:db8:1::/64")}},
+		{PodCIDRs: []netip.Prefix{parsePrefix("10.0.2.0/24")}, Native: true},
+	}
+
+	assert.ElementsMatch(t, []netip.Prefix{
+		parsePrefix("10.0.1.0/24"),
+		parsePrefix("2001:db8:1::/64"),
+	}, newTestManager(config.Default()).getPeerCIDRs(peers))
+
+	// Natively routed families are not routed through the tunnel
+	cfg := config.Default()
+	cfg.Routing.NativeRoutingIPv6 = true
+	assert.Equal(t, []netip.Prefix{parsePrefix("10.0.1.0/24")}, newTestManager(cfg).getPeerCIDRs(peers))
+}
+
+func TestCreateChangesetEndpointPort(t *testing.T) {
+	existingPeers := []wgtypes.Peer{
+		{
+			PublicKey: parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg="),
+			Endpoint:  &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1024},
+			AllowedIPs: []net.IPNet{
+				parseCIDR("192.168.0.0/24"),
+			},
+		},
+	}
+
+	desiredPeers := []Peer{
+		{
+			Endpoint:  netip.MustParseAddr("203.0.113.1"),
+			Port:      1024,
+			PodCIDRs:  []netip.Prefix{parsePrefix("192.168.0.0/24")},
+			NodeCIDRs: []netip.Prefix{},
+			PublicKey: parseKey("2H+7wEq3SZOfPjNuoWatIUZnHIeR6SEiv5BiJmSJqEg="),
+		},
+	}
+
+	logger, _ := ktesting.NewTestContext(t)
+	assert.Len(t, newTestManager(config.Default()).createPeerChangeset(logger, existingPeers, desiredPeers), 0)
+
+	// Without an explicit port, the local listen port is used
+	cfg := config.Default()
+	cfg.WireGuard.Port = 51820
+	desiredPeers[0].Port = 0
+	actual := newTestManager(cfg).createPeerChangeset(logger, existingPeers, desiredPeers)
+	assert.Len(t, actual, 1)
+	assert.Equal(t, 51820, actual[0].Endpoint.Port)
+}
@@ -0,0 +1,53 @@
+// Package wireguardtest provides a fake wireguard.Manager for tests.
+package wireguardtest
+
+import (
+	"context"
+	"time"
+
+	"github.com/tibordp/wigglenet/internal/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/klog/v2"
+)
+
+// Manager is a wireguard.Manager that keeps its state in memory and never
+// touches a device.
+type Manager struct {
+	// Applied is the configuration returned by AppliedConfig. It is updated by
+	// ApplyConfiguration.
+	Applied *wireguard.WireguardConfig
+	Stats   []wireguard.PeerStats
+	Keys    wireguard.KeyState
+	// Next is the public key that StageKey stages.
+	Next wgtypes.Key
+}
+
+var _ wireguard.Manager = (*Manager)(nil)
+
+func (m *Manager) ApplyConfiguration(_ context.Context, config *wireguard.WireguardConfig, _ klog.Logger) error {
+	m.Applied = config
+	return nil
+}
+
+func (m *Manager) PublicKey() []byte                         { return m.Keys.PublicKey[:] }
+func (m *Manager) PeerStats() ([]wireguard.PeerStats, error) { return m.Stats, nil }
+func (m *Manager) AppliedConfig() *wireguard.WireguardConfig { return m.Applied }
+func (m *Manager) KeyState() wireguard.KeyState              { return m.Keys }
+
+func (m *Manager) StageKey(context.Context) error {
+	if m.Keys.NextPublicKey == nil {
+		next := m.Next
+		m.Keys.NextPublicKey = &next
+		m.Keys.Staged = time.Now()
+	}
+	return nil
+}
+
+func (m *Manager) CommitKey(context.Context) error {
+	if m.Keys.NextPublicKey != nil {
+		m.Keys = wireguard.KeyState{PublicKey: *m.Keys.NextPublicKey, Created: m.Keys.Staged}
+	}
+	return nil
+}
+
+func (m *Manager) SyncNextKeys(context.Context) error { return nil }